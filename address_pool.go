@@ -0,0 +1,171 @@
+package ike
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errPoolExhausted = errors.New("address pool exhausted")
+
+// AddressPool hands out internal addresses to remote access peers
+// Leases are keyed by peer identity, so a peer gets the same address
+// when it reconnects, unless the pool has been exhausted in the meantime
+type AddressPool struct {
+	first, last *big.Int
+	isV6        bool
+	prefix      int // used in INTERNAL_IP6_ADDRESS & narrowing
+
+	mtx     sync.Mutex
+	leases  map[string]*addressLease // identity -> lease
+	byAddr  map[string]*addressLease // address -> lease
+	nextIdx *big.Int                 // next address to try
+}
+
+type addressLease struct {
+	identity string
+	ip       net.IP
+	refs     int       // number of sessions using the lease
+	released time.Time // when refs dropped to 0
+}
+
+// NewAddressPool creates a pool from a network
+// the network address, and for v4 the broadcast address, are not handed out
+func NewAddressPool(network *net.IPNet) (*AddressPool, error) {
+	first, last, err := IPNetToFirstLastAddress(network)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := NewAddressPoolRange(first, last)
+	if err != nil {
+		return nil, err
+	}
+	pool.first.Add(pool.first, big.NewInt(1))
+	if !pool.isV6 {
+		pool.last.Sub(pool.last, big.NewInt(1))
+	}
+	if pool.first.Cmp(pool.last) > 0 {
+		return nil, errors.Errorf("address pool %s is too small", network)
+	}
+	pool.nextIdx.Set(pool.first)
+	pool.prefix, _ = network.Mask.Size()
+	return pool, nil
+}
+
+// NewAddressPoolRange creates a pool from an inclusive range of addresses
+func NewAddressPoolRange(first, last net.IP) (*AddressPool, error) {
+	first, last = check4(first), check4(last)
+	if len(first) != len(last) {
+		return nil, errors.Errorf("address pool %s-%s: mixed address families", first, last)
+	}
+	pool := &AddressPool{
+		first:  new(big.Int).SetBytes(first),
+		last:   new(big.Int).SetBytes(last),
+		isV6:   len(first) == net.IPv6len,
+		prefix: 8 * len(first),
+		leases: make(map[string]*addressLease),
+		byAddr: make(map[string]*addressLease),
+	}
+	if pool.first.Cmp(pool.last) > 0 {
+		return nil, errors.Errorf("address pool %s-%s: invalid range", first, last)
+	}
+	pool.nextIdx = new(big.Int).Set(pool.first)
+	return pool, nil
+}
+
+func (p *AddressPool) String() string {
+	return fmt.Sprintf("%s-%s", p.toIP(p.first), p.toIP(p.last))
+}
+
+// IsV6 returns true if the pool hands out v6 addresses
+func (p *AddressPool) IsV6() bool {
+	return p.isV6
+}
+
+// Prefix returns the prefix length that is sent along with the address
+func (p *AddressPool) Prefix() int {
+	return p.prefix
+}
+
+func (p *AddressPool) toIP(i *big.Int) net.IP {
+	l := net.IPv4len
+	if p.isV6 {
+		l = net.IPv6len
+	}
+	b := i.Bytes()
+	ip := make(net.IP, l)
+	copy(ip[l-len(b):], b)
+	return ip
+}
+
+// Lease returns the address for given identity, allocating one if necessary
+func (p *AddressPool) Lease(identity string) (net.IP, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if lease, ok := p.leases[identity]; ok {
+		lease.refs++
+		return lease.ip, nil
+	}
+	ip := p.findFree()
+	if ip == nil {
+		// reuse the lease that was released the longest ago
+		var oldest *addressLease
+		for _, lease := range p.leases {
+			if lease.refs > 0 {
+				continue
+			}
+			if oldest == nil || lease.released.Before(oldest.released) {
+				oldest = lease
+			}
+		}
+		if oldest == nil {
+			return nil, errors.WithStack(errPoolExhausted)
+		}
+		delete(p.leases, oldest.identity)
+		delete(p.byAddr, oldest.ip.String())
+		ip = oldest.ip
+	}
+	lease := &addressLease{identity: identity, ip: ip, refs: 1}
+	p.leases[identity] = lease
+	p.byAddr[ip.String()] = lease
+	return ip, nil
+}
+
+// findFree looks for an address that was never leased
+func (p *AddressPool) findFree() net.IP {
+	size := new(big.Int).Sub(p.last, p.first)
+	size.Add(size, big.NewInt(1))
+	// no point in looking if every address has a lease
+	if size.Cmp(big.NewInt(int64(len(p.byAddr)))) <= 0 {
+		return nil
+	}
+	for {
+		ip := p.toIP(p.nextIdx)
+		p.nextIdx.Add(p.nextIdx, big.NewInt(1))
+		if p.nextIdx.Cmp(p.last) > 0 {
+			p.nextIdx.Set(p.first)
+		}
+		if _, used := p.byAddr[ip.String()]; !used {
+			return ip
+		}
+	}
+}
+
+// Release marks the lease held by identity as unused
+// the address is kept for the identity until the pool runs out
+func (p *AddressPool) Release(identity string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	lease, ok := p.leases[identity]
+	if !ok || lease.refs == 0 {
+		return
+	}
+	lease.refs--
+	if lease.refs == 0 {
+		lease.released = time.Now()
+	}
+}
@@ -0,0 +1,139 @@
+package ike
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+func TestAddressPoolLease(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.10.0.0/30")
+	pool, err := NewAddressPool(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only .1 & .2 are usable
+	a, err := pool.Lease("alice")
+	if err != nil || a.String() != "10.10.0.1" {
+		t.Fatal(a, err)
+	}
+	b, err := pool.Lease("bob")
+	if err != nil || b.String() != "10.10.0.2" {
+		t.Fatal(b, err)
+	}
+	if _, err = pool.Lease("carol"); errors.Cause(err) != errPoolExhausted {
+		t.Fatal("expected exhausted pool", err)
+	}
+	// reconnect gets the same address
+	pool.Release("alice")
+	if a2, _ := pool.Lease("alice"); !a2.Equal(a) {
+		t.Error("alice got different address", a2)
+	}
+	// released address goes to a new identity when pool runs out
+	pool.Release("alice")
+	c, err := pool.Lease("carol")
+	if err != nil || !c.Equal(a) {
+		t.Fatal(c, err)
+	}
+	if _, err = pool.Lease("alice"); errors.Cause(err) != errPoolExhausted {
+		t.Error("expected exhausted pool", err)
+	}
+}
+
+func TestAddressPoolV6(t *testing.T) {
+	_, network, _ := net.ParseCIDR("2001:db8::/64")
+	pool, err := NewAddressPool(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pool.IsV6() || pool.Prefix() != 64 {
+		t.Error("bad pool", pool)
+	}
+	a, err := pool.Lease("alice")
+	if err != nil || a.String() != "2001:db8::1" {
+		t.Fatal(a, err)
+	}
+	if _, err = NewAddressPoolRange(net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("mixed range accepted")
+	}
+}
+
+func TestConfigurationReplyForSession(t *testing.T) {
+	cfg := testConfig()
+	_, local, _ := net.ParseCIDR("192.0.2.0/24")
+	_, network, _ := net.ParseCIDR("10.10.0.0/24")
+	pool, _ := NewAddressPool(network)
+	cfg.AddressPools = []*AddressPool{pool}
+	cfg.InternalDNS = []net.IP{net.ParseIP("192.0.2.53")}
+	cfg.AddNetworkSelectors(local, network, false)
+	sess := &Session{cfg: *cfg, Logger: log.NewNopLogger()}
+
+	// peer asks for everything
+	all, _ := selectorFromAddress(&net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)})
+	params := &authParams{
+		tsI: all,
+		tsR: all,
+		configuration: &protocol.ConfigurationPayload{
+			PayloadHeader:     &protocol.PayloadHeader{},
+			ConfigurationType: protocol.CFG_REQUEST,
+			ConfigurationAttributes: []*protocol.ConfigurationAttribute{
+				protocol.EmptyAttribute(protocol.INTERNAL_IP4_ADDRESS),
+				protocol.EmptyAttribute(protocol.INTERNAL_IP4_DNS),
+				protocol.EmptyAttribute(protocol.INTERNAL_IP4_SUBNET),
+			},
+		},
+	}
+	msg := &Message{Payloads: protocol.MakePayloads()}
+	msg.Payloads.Add(&protocol.IdPayload{
+		PayloadHeader: &protocol.PayloadHeader{},
+		IdPayloadType: protocol.PayloadTypeIDi,
+		IdType:        protocol.ID_RFC822_ADDR,
+		Data:          []byte("alice@example.com"),
+	})
+	if err := handleConfigurationForSession(sess, msg, params); err != nil {
+		t.Fatal(err)
+	}
+	reply := sess.configuration
+	if reply == nil || reply.ConfigurationType != protocol.CFG_REPLY {
+		t.Fatal("missing reply")
+	}
+	ips := reply.IPs(protocol.INTERNAL_IP4_ADDRESS)
+	if len(ips) != 1 || ips[0].String() != "10.10.0.1" {
+		t.Error("address", ips)
+	}
+	if dns := reply.IPs(protocol.INTERNAL_IP4_DNS); len(dns) != 1 || dns[0].String() != "192.0.2.53" {
+		t.Error("dns", dns)
+	}
+	if nets := reply.Networks(protocol.INTERNAL_IP4_SUBNET); len(nets) != 1 || nets[0].String() != "192.0.2.0/24" {
+		t.Error("subnet", nets)
+	}
+	// selectors narrowed to the leased address
+	if err := sess.cfg.CheckSelectors(params.tsI, params.tsR, false); err != nil {
+		t.Error(err)
+	}
+	if p := sess.cfg.Policy(); p.IniNet.String() != "10.10.0.1/32" {
+		t.Error("policy", p.IniNet)
+	}
+	sess.releaseAddresses()
+	if len(sess.leases) != 0 {
+		t.Error("lease not released")
+	}
+	// peer asks for a subnet we do not protect
+	sess = &Session{cfg: *cfg, Logger: log.NewNopLogger()}
+	_, other, _ := net.ParseCIDR("198.51.100.0/24")
+	params.tsI = all
+	params.tsR, _ = selectorFromAddress(other)
+	if err := handleConfigurationForSession(sess, msg, params); errors.Cause(err) != protocol.ERR_TS_UNACCEPTABLE {
+		t.Fatal("selectors were narrowed", err)
+	}
+	if len(sess.leases) != 0 || sess.configuration != nil {
+		t.Error("lease was kept")
+	}
+	if !reflect.DeepEqual(sess.cfg.TsI, cfg.TsI) {
+		t.Error("config was changed", sess.cfg.TsI)
+	}
+}
@@ -0,0 +1,83 @@
+package ike
+
+import (
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// rfc4739 multiple authentication rounds
+
+// runInitiatorAuthRounds authenticates with each of LocalAuthRounds
+// msg is responder's reply to the first round, reply to the last one is returned
+// HDR, SK { IDi, [CERT], [CERTREQ], AUTH, SA, TSi, TSr, N(MULTIPLE_AUTH_SUPPORTED), N(ANOTHER_AUTH_FOLLOWS) } -->
+// <-- HDR, SK { IDr, [CERT], AUTH }
+// HDR, SK { IDi, [CERT], AUTH } -->
+// <-- HDR, SK { SA, TSi, TSr }
+func runInitiatorAuthRounds(sess *Session, msg *Message) (*Message, error) {
+	// responder is authenticated in the first round
+	if err := handlePeerAuth(sess, msg); err != nil {
+		return nil, err
+	}
+	for sess.authRound < len(sess.localRounds) {
+		// MUTATION
+		sess.authRound++
+		sess.Logger.Log("IKE_AUTH", "round", "NUM", sess.authRound+1)
+		reply, err := sess.SendMsgGetReply(sess.AuthMsg)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkAuthResponseForSession(sess, reply); err != nil {
+			return nil, err
+		}
+		if reply, err = runEapClientRound(sess, reply); err != nil {
+			return nil, err
+		}
+		if err = handlePeerAuth(sess, reply); err != nil {
+			return nil, err
+		}
+		msg = reply
+	}
+	return msg, nil
+}
+
+// runResponderAuthRounds authenticates initiator with each of PeerAuthRounds
+// first is initiator's first IKE_AUTH request; replies to the last round are left to caller
+func runResponderAuthRounds(sess *Session, first *Message) (err error) {
+	if err = handlePeerAuth(sess, first); err != nil {
+		return
+	}
+	if first.Payloads.GetNotification(protocol.ANOTHER_AUTH_FOLLOWS) == nil {
+		return errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, "IKE_AUTH: another authentication is required")
+	}
+	for {
+		// authenticate ourselves, or acknowledge the round
+		if err = sess.sendMsg(sess.AuthMsg()); err != nil {
+			return
+		}
+		// MUTATION
+		sess.eapMsk = nil
+		msg, err := sess.waitForRequest()
+		if err != nil {
+			return err
+		}
+		// MUTATION
+		sess.authRound++
+		if err = checkAuthRequestForSession(sess, msg); err != nil {
+			return err
+		}
+		if err = handlePeerAuth(sess, msg); err != nil {
+			return err
+		}
+		another := msg.Payloads.GetNotification(protocol.ANOTHER_AUTH_FOLLOWS) != nil
+		if sess.authRound == len(sess.peerRounds) {
+			if another {
+				return errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, "IKE_AUTH: unexpected authentication round")
+			}
+			sess.Logger.Log("IKE_AUTH", "rounds done", "NUM", sess.authRound+1)
+			return nil
+		}
+		if !another {
+			return errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, "IKE_AUTH: another authentication is required")
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package ike
+
+import (
+	"testing"
+	"time"
+
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+var pskUserID = &PskIdentities{
+	Primary: "user@msgbox.io",
+	Ids:     map[string][]byte{"user@msgbox.io": []byte("bar")},
+}
+
+func TestAuthRounds(t *testing.T) {
+	cfg := sessionTestConfig()
+	cfg.LocalAuthRounds = []Identity{pskUserID}
+	cfg.PeerAuthRounds = []Identity{pskUserID}
+	cfg.RequestTicket = true
+	cfg.Tickets = NewTicketKeys(time.Hour, time.Hour)
+	ini, err := runSessionPair(t, cfg, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ini.authRound != 1 {
+		t.Errorf("%d more rounds", ini.authRound)
+	}
+	// ticket is for the first identity
+	if ini.Ticket() == nil || string(ini.Ticket().state.IdI) != pskTestID.Primary {
+		t.Error("no ticket for the first identity")
+	}
+}
+
+func TestAuthRoundsRequired(t *testing.T) {
+	cfg := sessionTestConfig()
+	cfg.PeerAuthRounds = []Identity{pskUserID}
+	_, err := runSessionPair(t, cfg, cfg, nil)
+	// either side may end first
+	if cause := errors.Cause(err); cause != protocol.ERR_AUTHENTICATION_FAILED && cause != errPeerRemovedIkeSa {
+		t.Fatalf("initiator authenticated once: %v", err)
+	}
+}
@@ -1,11 +1,16 @@
 package ike
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"net"
 	"testing"
 
 	"github.com/go-kit/kit/log"
 	"github.com/msgboxio/ike/platform"
+	"github.com/msgboxio/ike/protocol"
 )
 
 func TestPskAuth(t *testing.T) {
@@ -57,3 +62,56 @@ func testWithIdentity(t testing.TB, locid, remid Identity, log log.Logger) {
 // return test.RunContainer("--rm", "--privileged", "--name", "cli", "-v",
 // dir+"/server:/server", "min", "/server", "-local", "0.0.0.0:500", "-v", "2", "-tunnel")
 // })
+
+func TestCertChainAuth(t *testing.T) {
+	root, rootKey, err := NewECCA("TEST ROOT CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca, err := NewSignedCert(CertID{CommonName: "TEST ISSUING CA", IsCA: true}, caKey.Public(), root, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert, err := NewSignedCert(CertID{CommonName: "172.17.0.1"}, key.Public(), ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localID := &CertIdentity{
+		Certificate: cert,
+		Chain:       []*x509.Certificate{ca, root},
+		PrivateKey:  key,
+
+		AuthenticationMethod: protocol.AUTH_DIGITAL_SIGNATURE,
+	}
+	if inter := localID.Intermediates(); len(inter) != 1 || inter[0] != ca {
+		t.Fatal("root should not be sent", inter)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	remoteID := &CertIdentity{Roots: roots, Name: "172.17.0.1"}
+
+	ini, res := testSessionPair(t)
+	signer := &CertAuthenticator{tkm: ini.tkm, forInitiator: true, identity: localID, rfc7427Signatures: true}
+	verifier := &CertAuthenticator{tkm: res.tkm, forInitiator: false, identity: remoteID}
+	idP := &protocol.IdPayload{
+		PayloadHeader: &protocol.PayloadHeader{},
+		IdPayloadType: protocol.PayloadTypeIDi,
+		IdType:        localID.IdType(),
+		Data:          localID.Id(),
+	}
+	initB := []byte("IKE_SA_INIT")
+	sig, err := signer.Sign(initB, idP, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	method := localID.AuthMethod()
+	if err = verifier.Verify(initB, idP, method, sig, &peerCertificates{chain: []*x509.Certificate{cert, ca}}, logger); err != nil {
+		t.Error(err)
+	}
+	// without the intermediate
+	if err = verifier.Verify(initB, idP, method, sig, &peerCertificates{chain: []*x509.Certificate{cert}}, logger); err == nil {
+		t.Error("certificate verified without issuing CA")
+	}
+}
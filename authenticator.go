@@ -30,6 +30,22 @@ func NewAuthenticator(id Identity, tkm *Tkm, forInitiator, rfc7427Signatures boo
 				identity:          id,
 				rfc7427Signatures: rfc7427Signatures,
 			}}
+	case *EapIdentity:
+		return &proxyAuthenticator{
+			realAuth: &EapAuthenticator{
+				tkm:          tkm,
+				forInitiator: forInitiator,
+				identity:     id,
+				server:       newEapServer(id.(*EapIdentity)),
+			}}
+	case *EapClientIdentity:
+		return &proxyAuthenticator{
+			realAuth: &EapAuthenticator{
+				tkm:          tkm,
+				forInitiator: forInitiator,
+				identity:     id,
+				client:       newEapClient(id.(*EapClientIdentity)),
+			}}
 	default:
 		panic("no authenticator found for id: " + id.IdType().String())
 	}
@@ -49,6 +65,17 @@ func (p *proxyAuthenticator) Sign(initB []byte, idP *protocol.IdPayload, logger
 func (p *proxyAuthenticator) Verify(initB []byte, idP *protocol.IdPayload, authMethod protocol.AuthMethod, authData []byte, inbandData interface{}, logger log.Logger) error {
 	switch authMethod {
 	case protocol.AUTH_SHARED_KEY_MESSAGE_INTEGRITY_CODE:
+		// keyed with the MSK after EAP
+		if eapAuth, ok := p.realAuth.(*EapAuthenticator); ok {
+			return eapAuth.Verify(initB, idP, authMethod, authData, nil, logger)
+		}
+		// rfc5998 EAP-only; peer had no AUTH of its own, only a safe method authenticated it
+		if eapAuth, ok := inbandData.(*EapAuthenticator); ok {
+			if !eapAuth.safe() {
+				return errors.New("EAP-only authentication requires a safe method")
+			}
+			return eapAuth.Verify(initB, idP, authMethod, authData, nil, logger)
+		}
 		// find authenticator
 		pskAuth, ok := p.realAuth.(*PskAuthenticator)
 		if !ok {
@@ -3,6 +3,7 @@ package ike
 import (
 	"bytes"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
 	"fmt"
 
@@ -51,6 +52,12 @@ func (o *CertAuthenticator) Sign(initB []byte, idP *protocol.IdPayload, logger l
 	return CreateSignature(certID.Certificate.SignatureAlgorithm, authMethod, signed, certID.PrivateKey, logger)
 }
 
+// peerCertificates are the contents of CERT payloads from peer
+type peerCertificates struct {
+	chain []*x509.Certificate // end entity first
+	crls  []*pkix.CertificateList
+}
+
 // Verify using one of:
 // AUTH_RSA_DIGITAL_SIGNATURE with certificates
 // RFC 7427 - Signature Authentication in IKEv2
@@ -58,11 +65,12 @@ func (o *CertAuthenticator) Sign(initB []byte, idP *protocol.IdPayload, logger l
 // TODO: implement raw AUTH_RSA_DIGITAL_SIGNATURE & AUTH_DSS_DIGITAL_SIGNATURE
 // TODO: implement ECDSA from RFC4754
 func (o *CertAuthenticator) Verify(initB []byte, idP *protocol.IdPayload, authMethod protocol.AuthMethod, authData []byte, inbandData interface{}, logger log.Logger) error {
-	chain, ok := inbandData.([]*x509.Certificate)
+	certs, ok := inbandData.(*peerCertificates)
 	if !ok {
 		// should never happen
 		panic("logic error")
 	}
+	chain := certs.chain
 	if len(chain) == 0 {
 		return errors.New("missing certificates")
 	}
@@ -79,13 +87,23 @@ func (o *CertAuthenticator) Verify(initB []byte, idP *protocol.IdPayload, authMe
 		// should never happen
 		panic("logic error")
 	}
-	// Verify validity of certificate
+	// Verify validity of certificate, other certificates may be intermediates
 	opts := x509.VerifyOptions{
-		Roots: certID.Roots,
+		Roots:         certID.Roots,
+		Intermediates: x509.NewCertPool(),
 	}
-	if _, err := chain[0].Verify(opts); err != nil {
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := chain[0].Verify(opts)
+	if err != nil {
 		return errors.Wrap(err, "Unable to verify certificate")
 	}
+	if certID.Revocation != nil {
+		if err := certID.Revocation.CheckChain(chains[0], certs.crls, logger); err != nil {
+			return errors.Wrap(err, "Revocation check failed")
+		}
+	}
 	// ensure that certificate is for authorized ID: check in subject & altname
 	// TODO - is this reasonable?
 	if !MatchNameFromCert(&cert, certID.Name) {
@@ -0,0 +1,106 @@
+package ike
+
+import (
+	"crypto/hmac"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// EapAuthenticator is an Authenticator for initiators that authenticate with EAP, rfc7296 2.16
+// responders run the server, initiators the client
+// AUTH is keyed with the MSK, or with SK_p if the method derives none
+type EapAuthenticator struct {
+	tkm          *Tkm
+	forInitiator bool
+	identity     Identity
+	server       *eapServer
+	client       *eapClient
+}
+
+var _ Authenticator = (*EapAuthenticator)(nil)
+
+func (e *EapAuthenticator) Identity() Identity {
+	return e.identity
+}
+
+func (e *EapAuthenticator) result() *eapResult {
+	if e.client != nil {
+		return &e.client.eapResult
+	}
+	return &e.server.eapResult
+}
+
+// signB :=
+// responder: initRB | Ni | prf(SK_pr, IDr')
+// initiator: initIB | Nr | prf(SK_pi, IDi')
+// authB = prf( prf(MSK, "Key Pad for IKEv2"), SignB)
+func (e *EapAuthenticator) Sign(initB []byte, idP *protocol.IdPayload, logger log.Logger) ([]byte, error) {
+	if !e.result().success {
+		return nil, errors.New("EAP has not succeeded")
+	}
+	logger.Log("AUTH", fmt.Sprintf("OUR_EAP_KEY[%s]", string(idP.Data)))
+	return e.auth(initB, idP, e.forInitiator)
+}
+
+func (e *EapAuthenticator) Verify(initB []byte, idP *protocol.IdPayload, authMethod protocol.AuthMethod, authData []byte, inbandData interface{}, logger log.Logger) error {
+	logger.Log("AUTH", fmt.Sprintf("PEER_EAP_KEY[%s]", string(idP.Data)))
+	if authMethod != protocol.AUTH_SHARED_KEY_MESSAGE_INTEGRITY_CODE {
+		return errors.Errorf("Authentication method is not supported after EAP: %s", authMethod)
+	}
+	if !e.result().success {
+		return errors.Errorf("EAP has not succeeded for: %s", string(idP.Data))
+	}
+	auth, err := e.auth(initB, idP, !e.forInitiator)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(auth, authData) {
+		return errors.Errorf("Ike EAP Auth failed for: %s", string(idP.Data))
+	}
+	return nil
+}
+
+func (e *EapAuthenticator) auth(initB []byte, idP *protocol.IdPayload, forInitiator bool) ([]byte, error) {
+	key := e.result().msk
+	if key == nil {
+		// binds EAP conversation to IKE SA; only methods that derive none go without
+		if !eapKeyless[e.methodType()] {
+			return nil, errors.Errorf("EAP method %d derived no MSK", e.methodType())
+		}
+		key = e.tkm.skPr
+		if forInitiator {
+			key = e.tkm.skPi
+		}
+	}
+	signB := e.tkm.SignB(initB, idP.Encode(), forInitiator)
+	prf := e.tkm.suite.Prf
+	return prf.Apply(prf.Apply(key, _Keypad), signB)[:prf.Length], nil
+}
+
+// methodType is of the method that ran
+func (e *EapAuthenticator) methodType() protocol.EapType {
+	if e.client != nil {
+		if e.client.method == nil {
+			return 0
+		}
+		return e.client.method.Type()
+	}
+	return e.server.methodType()
+}
+
+// safe tells if the method that succeeded could authenticate gateway alone
+func (e *EapAuthenticator) safe() bool {
+	return e.result().success && eapOnlySafe[e.methodType()]
+}
+
+// eapAuthenticator returns the EAP authenticator behind auth, nil if there is none
+func eapAuthenticator(auth Authenticator) *EapAuthenticator {
+	if proxy, ok := auth.(*proxyAuthenticator); ok {
+		auth = proxy.realAuth
+	}
+	eap, _ := auth.(*EapAuthenticator)
+	return eap
+}
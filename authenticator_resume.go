@@ -0,0 +1,58 @@
+package ike
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// ResumeAuthenticator is an Authenticator for sessions resumed from a ticket, rfc5723 5.1
+// identities are the ones of the resumed session
+type ResumeAuthenticator struct {
+	tkm          *Tkm
+	forInitiator bool
+	identity     Identity
+}
+
+var _ Authenticator = (*ResumeAuthenticator)(nil)
+
+func (r *ResumeAuthenticator) Identity() Identity {
+	return r.identity
+}
+
+// signB :=
+// responder: resumeRB | Ni | prf(SK_pr, IDr')
+// initiator: resumeIB | Nr | prf(SK_pi, IDi')
+// authB = prf(SK_px, SignB)
+func (r *ResumeAuthenticator) Sign(initB []byte, idP *protocol.IdPayload, logger log.Logger) ([]byte, error) {
+	logger.Log("AUTH", fmt.Sprintf("OUR_RESUMED_ID[%s]", string(idP.Data)))
+	return r.auth(initB, idP, r.forInitiator), nil
+}
+
+func (r *ResumeAuthenticator) Verify(initB []byte, idP *protocol.IdPayload, authMethod protocol.AuthMethod, authData []byte, inbandData interface{}, logger log.Logger) error {
+	logger.Log("AUTH", fmt.Sprintf("PEER_RESUMED_ID[%s]", string(idP.Data)))
+	if authMethod != protocol.AUTH_SHARED_KEY_MESSAGE_INTEGRITY_CODE {
+		return errors.Errorf("Authentication method is not supported for resumed session: %s", authMethod)
+	}
+	if idP.IdType != r.identity.IdType() || !bytes.Equal(idP.Data, r.identity.Id()) {
+		return errors.Errorf("Resumed session was for another identity: %s", string(idP.Data))
+	}
+	if !hmac.Equal(r.auth(initB, idP, !r.forInitiator), authData) {
+		return errors.Errorf("Ike Resume Auth failed for: %s", string(idP.Data))
+	}
+	return nil
+}
+
+func (r *ResumeAuthenticator) auth(initB []byte, idP *protocol.IdPayload, forInitiator bool) []byte {
+	key := r.tkm.skPr
+	if forInitiator {
+		key = r.tkm.skPi
+	}
+	signB := r.tkm.SignB(initB, idP.Encode(), forInitiator)
+	prf := r.tkm.suite.Prf
+	return prf.Apply(key, signB)[:prf.Length]
+}
@@ -1,66 +1,260 @@
 package ike
 
 import (
-	"bytes"
+	"math/big"
+	"time"
 
+	"github.com/msgboxio/ike/platform"
 	"github.com/msgboxio/ike/protocol"
 	"github.com/pkg/errors"
 )
 
+// childSa is one of the Child SAs of an IKE SA
+// spis & selectors are from the IKE initiator's point of view
+type childSa struct {
+	espSpiI, espSpiR  protocol.Spi
+	tsI, tsR          protocol.Selectors
+	lifetime          time.Duration
+	rekeyAt, expireAt time.Time
+
+	sa *platform.SaParams // as installed, with its keys & addresses
+}
+
+// childSaFromConfig creates Child SA with configured selectors
+func childSaFromConfig(cfg *Config, child ChildSaConfig) *childSa {
+	lifetime := child.Lifetime
+	if lifetime == 0 {
+		lifetime = cfg.Lifetime
+	}
+	return &childSa{tsI: child.TsI, tsR: child.TsR, lifetime: lifetime}
+}
+
+// configuredChildSa finds configured Child SA with peer's selectors
+func configuredChildSa(cfg *Config, tsI, tsR protocol.Selectors, isTransportMode bool) *childSa {
+	configs := append([]ChildSaConfig{{TsI: cfg.TsI, TsR: cfg.TsR}}, cfg.Children...)
+	for _, child := range configs {
+		if cfg.checkSelectors(child.TsI, child.TsR, tsI, tsR, isTransportMode) == nil {
+			return childSaFromConfig(cfg, child)
+		}
+	}
+	return nil
+}
+
+// localSpi is our inbound spi of the SA
+func (child *childSa) localSpi(sess *Session) protocol.Spi {
+	if sess.isInitiator {
+		return child.espSpiI
+	}
+	return child.espSpiR
+}
+
+// peerSpi is peer's inbound spi of the SA
+func (child *childSa) peerSpi(sess *Session) protocol.Spi {
+	if sess.isInitiator {
+		return child.espSpiR
+	}
+	return child.espSpiI
+}
+
+// startTimers sets jittered rekey time & the deadline
+func (child *childSa) startTimers() {
+	now := time.Now()
+	// MUTATION
+	child.rekeyAt = now.Add(Jitter(child.lifetime, jitterFactor))
+	child.expireAt = now.Add(child.lifetime)
+}
+
+// nextTimeout is the time till SA needs to be rekeyed, or removed
+func (child *childSa) nextTimeout() time.Duration {
+	if next := time.Until(child.rekeyAt); next > 0 {
+		return next
+	}
+	return time.Until(child.expireAt)
+}
+
 // ChildSaFromSession creates CREATE_CHILD_SA messages
+// isInitiator is true for the side that started the exchange, either can rekey
+// child without spis is a new Child SA
+// response echoes selected, the number of the proposal chosen from the request
 // HDR, SK {N(REKEY_SA), SA, Ni, [KEi,] TSi, TSr}   -->
 // <--  HDR, SK {SA, Nr, [KEr,] TSi, TSr}
-func ChildSaFromSession(sess *Session, newTkm *Tkm, isInitiator bool, espSpi []byte) *Message {
+func ChildSaFromSession(sess *Session, child *childSa, newTkm *Tkm, isInitiator bool, espSpi []byte, selected uint8) *Message {
 	no := newTkm.Nr
-	targetEspSpi := sess.EspSpiR
 	if isInitiator {
 		no = newTkm.Ni
-		targetEspSpi = sess.EspSpiI
 	}
-	prop := protocol.ProposalFromTransform(protocol.ESP, sess.cfg.ProposalEsp, espSpi)
+	prop := proposals(protocol.ESP, sess.cfg.ProposalEsp, espSpi, selected)
+	// selectors are from the point of view of the exchange initiator
+	tsI, tsR := child.tsI, child.tsR
+	if isInitiator != sess.isInitiator {
+		tsI, tsR = tsR, tsI
+	}
 	return makeChildSa(
 		&childSaParams{
 			authParams: &authParams{
 				isResponse:      !isInitiator,
-				isInitiator:     isInitiator,
+				isInitiator:     sess.isInitiator,
 				isTransportMode: sess.cfg.IsTransportMode,
 				spiI:            sess.IkeSpiI,
 				spiR:            sess.IkeSpiR,
 				proposals:       prop,
-				tsI:             sess.cfg.TsI,
-				tsR:             sess.cfg.TsR,
-				lifetime:        sess.cfg.Lifetime,
+				tsI:             tsI,
+				tsR:             tsR,
+				lifetime:        child.lifetime,
 			},
-			targetEspSpi:  targetEspSpi,
+			targetEspSpi:  child.localSpi(sess),
 			nonce:         no,
 			dhTransformId: newTkm.suite.DhGroup.TransformId(),
 			dhPublic:      newTkm.DhPublic,
 		})
 }
 
-func checkIpsecRekeyRequest(sess *Session, params *childSaParams) (espSpiI protocol.Spi, err error) {
+// checkIpsecRekeyRequest finds the Child SA peer rekeys,
+// or the configured one peer wants to add
+// selected is the number of peer's proposal our suite matches
+func checkIpsecRekeyRequest(sess *Session, params *childSaParams) (child *childSa, espSpi protocol.Spi, selected uint8, err error) {
 	if params.tsI == nil || params.tsR == nil {
-		err = errors.Errorf("CREATE_CHILD_SA request: selectors are missing. Rekeying IKE SA unsupported")
+		err = errors.Errorf("CREATE_CHILD_SA request: selectors are missing")
 		return
 	}
-	if params.targetEspSpi == nil {
-		err = errors.Errorf("CREATE_CHILD_SA request: missing target ESP")
+	if selected, _, err = sess.cfg.SelectProposal(protocol.ESP, params.proposals); err != nil {
 		return
 	}
-	if !bytes.Equal(params.targetEspSpi, sess.EspSpiI) {
-		err = errors.Errorf("CREATE_CHILD_SA request: incorrect target ESP Spi: 0x%x, rx 0x%x",
-			params.targetEspSpi, sess.EspSpiI)
+	if sess.isInitiator {
+		// IKE responder started the exchange
+		params.tsI, params.tsR = params.tsR, params.tsI
+	}
+	if params.targetEspSpi != nil {
+		// peer identifies the SA by its inbound spi
+		if child = sess.childSaByPeerSpi(params.targetEspSpi); child == nil {
+			err = errors.Wrapf(protocol.ERR_CHILD_SA_NOT_FOUND, "CREATE_CHILD_SA request: target ESP Spi: 0x%x", params.targetEspSpi)
+			return
+		}
+	} else if child = configuredChildSa(&sess.cfg, params.tsI, params.tsR, params.isTransportMode); child == nil {
+		err = errors.Wrap(protocol.ERR_TS_UNACCEPTABLE, "CREATE_CHILD_SA request: no Child SA for selectors")
 		return
 	}
-	espSpiI, _, err = checkSelectorsForSession(sess, params.authParams)
+	espSpi, _, err = checkSelectorsForSession(sess, params.authParams, child.tsI, child.tsR)
 	return
 }
 
-func checkIpsecRekeyResponse(sess *Session, params *childSaParams) (espSpiR protocol.Spi, err error) {
+func checkIpsecRekeyResponse(sess *Session, child *childSa, params *childSaParams) (espSpi protocol.Spi, err error) {
 	if params.tsI == nil || params.tsR == nil {
 		err = errors.Errorf("CREATE_CHILD_SA response: selectors are missing")
 		return
 	}
-	espSpiR, _, err = checkSelectorsForSession(sess, params.authParams)
+	// peer echoes the number of the proposal it chose from our request
+	if len(params.proposals) != 1 {
+		err = errors.Wrapf(protocol.ERR_NO_PROPOSAL_CHOSEN, "CREATE_CHILD_SA response: %d proposals", len(params.proposals))
+		return
+	}
+	if num := int(params.proposals[0].Number); num < 1 || num > len(sess.cfg.ProposalEsp) ||
+		!sess.cfg.ProposalEsp[num-1].Within(params.proposals[0].Transforms) {
+		err = errors.Wrapf(protocol.ERR_NO_PROPOSAL_CHOSEN, "CREATE_CHILD_SA response: proposal %d was not offered", num)
+		return
+	}
+	if !sess.isInitiator {
+		// we started the exchange as IKE responder
+		params.tsI, params.tsR = params.tsR, params.tsI
+	}
+	espSpi, _, err = checkSelectorsForSession(sess, params.authParams, child.tsI, child.tsR)
+	return
+}
+
+// childSaRekey is a Child SA created by CREATE_CHILD_SA
+type childSaRekey struct {
+	*childSa
+	old         *childSa // replaced by this SA; nil for an additional Child SA
+	ni, nr      *big.Int // nonces of the exchange
+	isInitiator bool     // we started the exchange
+}
+
+// hasLowestNonce checks if one of a's nonces is lower than b's
+// rfc7296 2.8.1: of simultaneous rekeys, SA created with the lowest nonce is redundant
+func hasLowestNonce(a, b *childSaRekey) bool {
+	return lowestNonce(a.ni, a.nr).Cmp(lowestNonce(b.ni, b.nr)) < 0
+}
+
+func lowestNonce(x, y *big.Int) *big.Int {
+	if x.Cmp(y) < 0 {
+		return x
+	}
+	return y
+}
+
+// ikeSaRekey is the IKE SA created by CREATE_CHILD_SA
+// it replaces the current IKE SA once that is deleted
+type ikeSaRekey struct {
+	tkm         *Tkm
+	spiI, spiR  protocol.Spi
+	isInitiator bool  // we started the rekey
+	proposal    uint8 // selected by us as responder
+}
+
+// hasLowestNonce checks if one of r's nonces is lower than other's
+// same rule as for Child SAs; IKE SA created with the lowest nonce is redundant
+func (r *ikeSaRekey) hasLowestNonce(other *ikeSaRekey) bool {
+	return lowestNonce(r.tkm.Ni, r.tkm.Nr).Cmp(lowestNonce(other.tkm.Ni, other.tkm.Nr)) < 0
+}
+
+// ikeSaRekeyFromSession creates CREATE_CHILD_SA messages for rekeying IKE SA
+// HDR, SK {SA, Ni, KEi}   -->
+// <--  HDR, SK {SA, Nr, KEr}
+func ikeSaRekeyFromSession(sess *Session, rekey *ikeSaRekey) *Message {
+	no := rekey.tkm.Ni
+	spi := rekey.spiI
+	if !rekey.isInitiator {
+		no = rekey.tkm.Nr
+		spi = rekey.spiR
+	}
+	return makeChildSa(
+		&childSaParams{
+			authParams: &authParams{
+				isResponse:  !rekey.isInitiator,
+				isInitiator: sess.isInitiator,
+				spiI:        sess.IkeSpiI,
+				spiR:        sess.IkeSpiR,
+				proposals:   proposals(protocol.IKE, sess.cfg.ProposalIke, spi, rekey.proposal),
+			},
+			nonce:         no,
+			dhTransformId: rekey.tkm.suite.DhGroup.TransformId(),
+			dhPublic:      rekey.tkm.DhPublic,
+		})
+}
+
+// rekeysIkeSa checks if CREATE_CHILD_SA request proposes an IKE SA
+func rekeysIkeSa(msg *Message) bool {
+	sa, ok := msg.Payloads.Get(protocol.PayloadTypeSA).(*protocol.SaPayload)
+	return ok && len(sa.Proposals) > 0 && sa.Proposals[0].ProtocolID == protocol.IKE
+}
+
+func checkIkeSaRekeyRequest(sess *Session, params *childSaParams) (*ikeSaRekey, error) {
+	// only the negotiated suite is acceptable
+	num, _, err := sess.cfg.SelectIkeProposal(params.proposals, params.dhTransformId)
+	if err != nil {
+		return nil, err
+	}
+	spiI, err := spiFromProposal(params.proposals, protocol.IKE)
+	if err != nil {
+		return nil, errors.Wrap(protocol.ERR_INVALID_SYNTAX, err.Error())
+	}
+	return &ikeSaRekey{spiI: spiI, proposal: num}, nil
+}
+
+func checkIkeSaRekeyResponse(sess *Session, params *childSaParams) (spiR protocol.Spi, err error) {
+	if len(params.proposals) != 1 {
+		err = errors.Wrapf(protocol.ERR_NO_PROPOSAL_CHOSEN, "CREATE_CHILD_SA response: %d proposals", len(params.proposals))
+		return
+	}
+	_, suite, err := sess.cfg.SelectProposal(protocol.IKE, params.proposals)
+	if err != nil {
+		return
+	}
+	if err = checkDhTransform(suite, params.dhTransformId); err != nil {
+		return
+	}
+	if spiR, err = spiFromProposal(params.proposals, protocol.IKE); err != nil {
+		err = errors.Wrap(protocol.ERR_INVALID_SYNTAX, err.Error())
+	}
 	return
 }
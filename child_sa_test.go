@@ -0,0 +1,504 @@
+package ike
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msgboxio/ike/crypto"
+	"github.com/msgboxio/ike/platform"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// ikeSaState is recorded when IKE SA is rekeyed
+type ikeSaState struct {
+	sess             *Session
+	isInitiator      bool
+	oldSpiI          protocol.Spi
+	spiI, spiR       protocol.Spi
+	espSpiI, espSpiR protocol.Spi
+	skD              []byte
+}
+
+// establishedTestSessions connects a pair of sessions which have completed IKE_AUTH
+func establishedTestSessions(t *testing.T, rekeyed chan ikeSaState) (ini, res *Session) {
+	ini, res = testSessionPair(t)
+	iAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 500}
+	rAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 500}
+	espSpiI, espSpiR := MakeSpi()[:4], MakeSpi()[:4]
+	toI, toR := make(chan []byte, 10), make(chan []byte, 10)
+	for _, sess := range []*Session{ini, res} {
+		sess.incoming = make(chan *Message, 10)
+		sess.onIkeSaRekeyed = func(sess *Session, oldSpiI protocol.Spi) {
+			rekeyed <- ikeSaState{
+				sess:        sess,
+				isInitiator: sess.isInitiator,
+				oldSpiI:     oldSpiI,
+				spiI:        sess.IkeSpiI,
+				spiR:        sess.IkeSpiR,
+				espSpiI:     sess.children[0].espSpiI,
+				espSpiR:     sess.children[0].espSpiR,
+				skD:         sess.tkm.skD,
+			}
+		}
+	}
+	ini.Conn, ini.Local, ini.Remote = &testcb{writeTo: toR}, iAddr, rAddr
+	res.Conn, res.Local, res.Remote = &testcb{writeTo: toI}, rAddr, iAddr
+	ini.setAddresses(iAddr, rAddr)
+	res.setAddresses(rAddr, iAddr)
+	for _, sess := range []*Session{ini, res} {
+		sess.children = []*childSa{{
+			espSpiI:  espSpiI,
+			espSpiR:  espSpiR,
+			tsI:      sess.cfg.TsI,
+			tsR:      sess.cfg.TsR,
+			lifetime: sess.cfg.Lifetime,
+		}}
+	}
+	deliver := func(sess *Session, from chan []byte) {
+		for b := range from {
+			msg, err := DecodeMessage(b, logger)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			sess.PostMessage(msg)
+		}
+	}
+	go deliver(ini, toI)
+	go deliver(res, toR)
+	return
+}
+
+func TestIkeSaRekey(t *testing.T) {
+	rekeyed := make(chan ikeSaState, 4)
+	ini, res := establishedTestSessions(t, rekeyed)
+	oldSpiI, oldSkD := ini.IkeSpiI, ini.tkm.skD
+	ini.Cb.RemoveChildSa = func(*Session, *platform.SaParams) error {
+		t.Error("child sa was removed")
+		return nil
+	}
+	res.Cb = ini.Cb
+	// only original responder rekeys IKE SA; first as responder, then as initiator
+	res.cfg.IkeLifetime = 100 * time.Millisecond
+	cerr := make(chan error, 2)
+	go func() { cerr <- monitorSa(ini) }()
+	go func() { cerr <- monitorSa(res) }()
+	for round := 0; round < 2; round++ {
+		var states []ikeSaState
+		for len(states) < 2 {
+			select {
+			case state := <-rekeyed:
+				states = append(states, state)
+			case err := <-cerr:
+				t.Fatal(err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("IKE SA was not rekeyed")
+			}
+		}
+		a, b := states[0], states[1]
+		if !bytes.Equal(a.spiI, b.spiI) || !bytes.Equal(a.spiR, b.spiR) || !bytes.Equal(a.oldSpiI, oldSpiI) {
+			t.Errorf("round %d: spi mismatch", round)
+		}
+		if !bytes.Equal(a.skD, b.skD) || bytes.Equal(a.skD, oldSkD) {
+			t.Errorf("round %d: keys were not rekeyed", round)
+		}
+		for _, state := range states {
+			// side that rekeyed is the initiator of new IKE SA
+			if (state.sess == res) != state.isInitiator {
+				t.Errorf("round %d: wrong roles", round)
+			}
+		}
+		// child sa is kept, from the new initiator's point of view
+		if !bytes.Equal(a.espSpiI, b.espSpiI) || !bytes.Equal(a.espSpiR, b.espSpiR) {
+			t.Errorf("round %d: child sa differs", round)
+		}
+		oldSpiI, oldSkD = a.spiI, a.skD
+	}
+}
+
+// tapConn records the packets sent through Conn
+type tapConn struct {
+	Conn
+	mu   sync.Mutex
+	sent [][]byte
+}
+
+func (c *tapConn) WritePacket(b []byte, remote net.Addr) error {
+	c.mu.Lock()
+	c.sent = append(c.sent, append([]byte{}, b...))
+	c.mu.Unlock()
+	return c.Conn.WritePacket(b, remote)
+}
+
+func (c *tapConn) packets() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte{}, c.sent...)
+}
+
+func TestIkeSaRekeyCollision(t *testing.T) {
+	rekeyed := make(chan ikeSaState, 4)
+	ini, res := establishedTestSessions(t, rekeyed)
+	oldSpiI := ini.IkeSpiI
+	tapI, tapR := &tapConn{Conn: ini.Conn}, &tapConn{Conn: res.Conn}
+	ini.Conn, res.Conn = tapI, tapR
+	cerr := make(chan error, 2)
+	// both sides rekey at the same time
+	for _, sess := range []*Session{ini, res} {
+		go func(sess *Session) {
+			cerr <- runIkeSaRekey(sess)
+			serve(sess)
+		}(sess)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-cerr:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("rekey did not finish")
+		}
+	}
+	var states []ikeSaState
+	for len(states) < 2 {
+		select {
+		case state := <-rekeyed:
+			states = append(states, state)
+		case <-time.After(10 * time.Second):
+			t.Fatal("IKE SA was not rekeyed")
+		}
+	}
+	// both switched to the one that was not redundant
+	a, b := states[0], states[1]
+	if !bytes.Equal(a.spiI, b.spiI) || !bytes.Equal(a.spiR, b.spiR) || !bytes.Equal(a.skD, b.skD) {
+		t.Error("sessions kept different IKE SAs")
+	}
+	if !bytes.Equal(a.oldSpiI, oldSpiI) || !bytes.Equal(b.oldSpiI, oldSpiI) {
+		t.Error("IKE SA was rekeyed twice")
+	}
+	if ini.ikeSaRekey != nil || res.ikeSaRekey != nil {
+		t.Error("redundant IKE SA was kept")
+	}
+	// side that created the redundant IKE SA deletes it, in its first request
+	var deletes int
+	for _, b := range append(tapI.packets(), tapR.packets()...) {
+		msg, err := DecodeMessage(b, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spiI := msg.IkeHeader.SpiI; bytes.Equal(spiI, oldSpiI) || bytes.Equal(spiI, a.spiI) {
+			continue
+		}
+		if msg.IkeHeader.ExchangeType != protocol.INFORMATIONAL || msg.IkeHeader.Flags.IsResponse() || msg.IkeHeader.MsgID != 0 {
+			t.Errorf("%s on redundant IKE SA", msg.IkeHeader.ExchangeType)
+		}
+		deletes++
+	}
+	if deletes != 1 {
+		t.Errorf("%d requests on redundant IKE SA", deletes)
+	}
+}
+
+func TestIkeSaRekeyRefused(t *testing.T) {
+	rekeyed := make(chan ikeSaState, 4)
+	ini, res := establishedTestSessions(t, rekeyed)
+	oldSpiI := ini.IkeSpiI
+	cerr := make(chan error, 1)
+	go func() { cerr <- monitorSa(res) }()
+	// responder accepts only the negotiated suite
+	ini.cfg.ProposalIke = []protocol.TransformMap{crypto.Aes128Sha256Ecp256}
+	if err := runIkeSaRekey(ini); errors.Cause(err) != errIkeSaRekeyRefused {
+		t.Fatal("rekey was not refused", err)
+	}
+	// IKE SA is kept
+	if !bytes.Equal(ini.IkeSpiI, oldSpiI) {
+		t.Fatal("IKE SA was replaced")
+	}
+	if err := runDpd(ini); err != nil {
+		t.Fatal(err)
+	}
+	// retried with the group responder asked for
+	ini.cfg.ProposalIke = append(ini.cfg.ProposalIke, crypto.Aes128Sha256Modp3072)
+	if err := runIkeSaRekey(ini); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ini.IkeSpiI, oldSpiI) || ini.tkm.suite.DhGroup.TransformId() != protocol.MODP_3072 {
+		t.Fatal("IKE SA was not rekeyed")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-rekeyed:
+		case err := <-cerr:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("IKE SA was not rekeyed")
+		}
+	}
+	if err := runDpd(ini); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// saRecorder keeps Child SAs & policies of a session
+type saRecorder struct {
+	mu                 sync.Mutex
+	installed, removed []*platform.SaParams
+	policies           int
+}
+
+func (r *saRecorder) callback() SessionCallback {
+	return SessionCallback{
+		InstallPolicy: func(*Session, *protocol.PolicyParams) error {
+			r.mu.Lock()
+			r.policies++
+			r.mu.Unlock()
+			return nil
+		},
+		RemovePolicy: func(*Session, *protocol.PolicyParams) error {
+			r.mu.Lock()
+			r.policies--
+			r.mu.Unlock()
+			return nil
+		},
+		InstallChildSa: func(_ *Session, sa *platform.SaParams) error {
+			r.mu.Lock()
+			r.installed = append(r.installed, sa)
+			r.mu.Unlock()
+			return nil
+		},
+		RemoveChildSa: func(_ *Session, sa *platform.SaParams) error {
+			r.mu.Lock()
+			r.removed = append(r.removed, sa)
+			r.mu.Unlock()
+			return nil
+		},
+	}
+}
+
+func (r *saRecorder) get() (installed, removed []*platform.SaParams) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(installed, r.installed...), append(removed, r.removed...)
+}
+
+func (r *saRecorder) getPolicies() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.policies
+}
+
+// sameSa checks if both sides installed the same keys for the same spis
+func sameSa(a, b *platform.SaParams) bool {
+	return a.SpiI == b.SpiI && a.SpiR == b.SpiR &&
+		bytes.Equal(a.EspEi, b.EspEi) && bytes.Equal(a.EspAi, b.EspAi) &&
+		bytes.Equal(a.EspEr, b.EspEr) && bytes.Equal(a.EspAr, b.EspAr)
+}
+
+// serve handles peer's requests after rekey
+func serve(sess *Session) {
+	for msg := range sess.incoming {
+		sess.msgIDResp.replyTo(msg.IkeHeader.MsgID)
+		onInformational(sess, msg)
+	}
+}
+
+func TestIpsecRekeyByResponder(t *testing.T) {
+	ini, res := establishedTestSessions(t, nil)
+	recI, recR := &saRecorder{}, &saRecorder{}
+	ini.Cb, res.Cb = recI.callback(), recR.callback()
+	oldSpiI, oldSpiR := ini.children[0].espSpiI, ini.children[0].espSpiR
+	cerr := make(chan error, 1)
+	go func() { cerr <- monitorSa(ini) }()
+	if err := runIpsecRekey(res, res.children[0]); err != nil {
+		t.Fatal(err)
+	}
+	// wait for initiator to install the SA
+	for i := 0; i < 100; i++ {
+		if installed, _ := recI.get(); len(installed) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	installedI, removedI := recI.get()
+	installedR, removedR := recR.get()
+	if len(installedI) != 2 || len(installedR) != 1 {
+		t.Fatalf("installed %d & %d SAs", len(installedI), len(installedR))
+	}
+	if !sameSa(installedI[1], installedR[0]) {
+		t.Error("rekeyed SA differs")
+	}
+	if len(removedI) != 1 || len(removedR) != 1 ||
+		removedI[0].SpiI != int(SpiToInt32(oldSpiI)) || removedR[0].SpiR != int(SpiToInt32(oldSpiR)) {
+		t.Error("old SA was not removed")
+	}
+	if !bytes.Equal(res.children[0].espSpiI, ini.children[0].espSpiI) ||
+		!bytes.Equal(res.children[0].espSpiR, ini.children[0].espSpiR) {
+		t.Error("sessions use different SAs")
+	}
+	select {
+	case err := <-cerr:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestIpsecRekeyCollision(t *testing.T) {
+	ini, res := establishedTestSessions(t, nil)
+	recI, recR := &saRecorder{}, &saRecorder{}
+	ini.Cb, res.Cb = recI.callback(), recR.callback()
+	cerr := make(chan error, 2)
+	// both sides rekey at the same time
+	for _, sess := range []*Session{ini, res} {
+		go func(sess *Session) {
+			err := runIpsecRekey(sess, sess.children[0])
+			cerr <- err
+			serve(sess)
+		}(sess)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-cerr:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("rekey did not finish")
+		}
+	}
+	installedI, removedI := recI.get()
+	installedR, removedR := recR.get()
+	if len(installedI) != 2 || len(installedR) != 2 {
+		t.Fatalf("installed %d & %d SAs", len(installedI), len(installedR))
+	}
+	// old & redundant SA are removed
+	if len(removedI) != 2 || len(removedR) != 2 || removedI[0].SpiI != removedR[0].SpiI {
+		t.Fatalf("removed %d & %d SAs", len(removedI), len(removedR))
+	}
+	if len(ini.children) != 1 || len(res.children) != 1 ||
+		!bytes.Equal(res.children[0].espSpiI, ini.children[0].espSpiI) ||
+		!bytes.Equal(res.children[0].espSpiR, ini.children[0].espSpiR) {
+		t.Error("sessions kept different SAs")
+	}
+	// both installed the same pair of SAs
+	for _, sa := range installedI {
+		if !sameSa(sa, installedR[0]) && !sameSa(sa, installedR[1]) {
+			t.Error("SA differs", sa.SpiI, sa.SpiR)
+		}
+	}
+}
+
+func TestIpsecRekeyProposalNumber(t *testing.T) {
+	ini, res := establishedTestSessions(t, nil)
+	recI := &saRecorder{}
+	ini.Cb = recI.callback()
+	// proposal chosen in IKE_AUTH had another number
+	ini.cfg.ProposalEsp = append(ini.cfg.ProposalEsp, crypto.Aes256gcm16)
+	res.espProposal = 2
+	cerr := make(chan error, 1)
+	go func() { cerr <- monitorSa(res) }()
+	if err := runIpsecRekey(ini, ini.children[0]); err != nil {
+		t.Fatal(err)
+	}
+	if installed, _ := recI.get(); len(installed) != 1 {
+		t.Fatalf("installed %d SAs", len(installed))
+	}
+	select {
+	case err := <-cerr:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestAdditionalChildSa(t *testing.T) {
+	ini, res := establishedTestSessions(t, nil)
+	recI, recR := &saRecorder{}, &saRecorder{}
+	ini.Cb, res.Cb = recI.callback(), recR.callback()
+	iNet, rNet := &net.IPNet{IP: net.IPv4(10, 1, 0, 0), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.IPv4(10, 2, 0, 0), Mask: net.CIDRMask(24, 32)}
+	if err := ini.cfg.AddChildSa(iNet, rNet, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := res.cfg.AddChildSa(rNet, iNet, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	cerr := make(chan error, 1)
+	go func() { cerr <- monitorSa(res) }()
+	// responder has no Child SA for these selectors
+	other := &childSa{tsI: ini.cfg.TsI, tsR: ini.cfg.Children[0].TsI, lifetime: time.Hour}
+	if err := runIpsecRekey(ini, other); err != nil || len(ini.children) != 1 {
+		t.Fatal("rejected Child SA", err)
+	}
+	if err := runIpsecRekey(ini, childSaFromConfig(&ini.cfg, ini.cfg.Children[0])); err != nil {
+		t.Fatal(err)
+	}
+	if len(ini.children) != 2 || !reflect.DeepEqual(ini.children[1].tsR, ini.cfg.Children[0].TsR) {
+		t.Fatalf("%d Child SAs", len(ini.children))
+	}
+	for i := 0; i < 100; i++ {
+		if installed, _ := recR.get(); len(installed) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	installedI, _ := recI.get()
+	installedR, _ := recR.get()
+	if len(installedI) != 1 || len(installedR) != 2 || !sameSa(installedI[0], installedR[1]) {
+		t.Fatalf("installed %d & %d SAs", len(installedI), len(installedR))
+	}
+	if installedR[1].IniNet.String() != iNet.String() || installedR[1].ResNet.String() != rNet.String() {
+		t.Error("wrong selectors", installedR[1].IniNet, installedR[1].ResNet)
+	}
+	if recI.getPolicies() != 1 || recR.getPolicies() != 2 {
+		t.Errorf("%d & %d policies", recI.getPolicies(), recR.getPolicies())
+	}
+	// expired Child SA is deleted, others are kept
+	ini.children[0].startTimers()
+	ini.children[1].expireAt = time.Now()
+	if err := checkChildSas(ini); err != nil {
+		t.Fatal(err)
+	}
+	_, removedI := recI.get()
+	_, removedR := recR.get()
+	if len(ini.children) != 1 || len(removedI) != 1 || len(removedR) != 1 ||
+		removedR[0].SpiI != installedI[0].SpiI || recR.getPolicies() != 1 {
+		t.Fatal("Child SA was not deleted")
+	}
+	select {
+	case err := <-cerr:
+		t.Fatal(err)
+	default:
+	}
+	// removing the last one ends IKE SA
+	if err := deleteChildSa(ini, ini.children[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-cerr:
+		if errors.Cause(err) != errPeerRemovedEspSa {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("IKE SA was kept")
+	}
+}
+
+func TestCmdMoveSession(t *testing.T) {
+	cmd := NewCmd(nil, &SessionCallback{})
+	sess := &Session{IkeSpiI: MakeSpi()}
+	oldSpiI := sess.IkeSpiI
+	cmd.sessions.Add(SpiToInt64(oldSpiI), sess)
+	sess.IkeSpiI = MakeSpi()
+	cmd.moveSession(sess, oldSpiI)
+	if _, found := cmd.sessions.Get(SpiToInt64(oldSpiI)); found {
+		t.Error("session found by old spi")
+	}
+	if found, _ := cmd.sessions.Get(SpiToInt64(sess.IkeSpiI)); found != sess {
+		t.Error("session not found by new spi")
+	}
+}
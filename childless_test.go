@@ -0,0 +1,75 @@
+package ike
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/msgboxio/ike/protocol"
+)
+
+func TestChildless(t *testing.T) {
+	cfg := sessionTestConfig()
+	cfg.Childless = true
+	var mu sync.Mutex
+	var sent [][]byte
+	tap := func(b []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, append([]byte{}, b...))
+	}
+	ini, err := runTappedSessionPair(t, cfg, cfg, nil, tap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ini.childless {
+		t.Error("IKE SA is not childless")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var auth, child *Message
+	for _, b := range sent {
+		msg, err := DecodeMessage(b, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg.IkeHeader.ExchangeType {
+		case protocol.IKE_AUTH:
+			auth = msg
+		case protocol.CREATE_CHILD_SA:
+			child = msg
+		default:
+			continue
+		}
+		if err = DecryptMessage(msg, ini.tkm, false, logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if auth == nil || child == nil {
+		t.Fatal("IKE_AUTH & CREATE_CHILD_SA were not sent")
+	}
+	// Child SA for the selectors is created after IKE_AUTH
+	for _, pt := range []protocol.PayloadType{protocol.PayloadTypeSA, protocol.PayloadTypeTSi, protocol.PayloadTypeTSr} {
+		if auth.Payloads.Get(pt) != nil {
+			t.Errorf("IKE_AUTH has %s", pt)
+		}
+	}
+	params, err := parseChildSa(child, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ini.children) != 1 || ini.children[0].sa == nil {
+		t.Fatalf("%d Child SAs", len(ini.children))
+	}
+	// initiator's spi & selectors of the request
+	installed := ini.children[0].sa
+	if installed.SpiI != int(SpiToInt32(params.proposals[0].Spi)) {
+		t.Error("installed SA is not from CREATE_CHILD_SA")
+	}
+	if installed.IniNet.String() != "192.0.2.0/24" || installed.ResNet.String() != "192.0.2.0/24" {
+		t.Error("wrong selectors", installed.IniNet, installed.ResNet)
+	}
+	// IKE SA is kept without Child SAs
+	if err := checkChildSas(&Session{childless: true, Logger: logger}); err != nil {
+		t.Error(err)
+	}
+}
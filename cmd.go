@@ -8,12 +8,15 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
 )
 
 // Cmd provides utilities for building ike apps
 type Cmd struct {
 	sessions Sessions // map of initiator spi -> session
 	conn     Conn
+	natConn  Conn // optional, for NAT-T port
 	cb       *SessionCallback
 }
 
@@ -25,38 +28,119 @@ func NewCmd(conn Conn, cb *SessionCallback) *Cmd {
 	}
 }
 
+// SetNatTConn sets connection used once NAT is detected
+// it should be listening on NatTPort
+func (i *Cmd) SetNatTConn(conn Conn) {
+	i.natConn = conn
+}
+
 func (i *Cmd) runSession(spi uint64, sess *Session) (err error) {
+	sess.natConn = i.natConn
+	sess.onIkeSaRekeyed = i.moveSession
 	i.sessions.Add(spi, sess)
 	// wait for session to finish
 	err = RunSession(sess)
 	sess.Shutdown(err)
-	i.sessions.Remove(spi)
+	// spi changes when IKE SA is rekeyed
+	i.sessions.Remove(SpiToInt64(sess.IkeSpiI))
 	sess.Logger.Log("IKE_SA", "removed", "SESSION", fmt.Sprintf("%s<=>%s", sess.IkeSpiI, sess.IkeSpiR))
 	return
 }
 
+// moveSession finds session by the spi of its rekeyed IKE SA
+func (i *Cmd) moveSession(sess *Session, oldSpiI protocol.Spi) {
+	i.sessions.Remove(SpiToInt64(oldSpiI))
+	i.sessions.Add(SpiToInt64(sess.IkeSpiI), sess)
+}
+
 // RunInitiator starts & watches over on initiator session in a separate goroutine
 func (i *Cmd) RunInitiator(localAddr, remoteAddr net.Addr, config *Config, log log.Logger) {
 	go func() {
+		// session whose policies were kept when peer was found dead
+		var held *Session
+		defer func() {
+			if held != nil {
+				held.releasePolicies()
+			}
+		}()
+		// restarted session is resumed with the ticket from the previous one
+		var ticket *Ticket
+		// rfc5685; redirects are followed from the configured gateway
+		gateway := remoteAddr
+		var redirectedFrom string
+		var redirects redirectChain
 		for {
-			initiator, err := NewInitiator(config, localAddr, remoteAddr, i.conn, i.cb, log)
+			var initiator *Session
+			var err error
+			if ticket != nil && !ticket.Expired() {
+				initiator, err = NewResumingInitiator(config, ticket, localAddr, remoteAddr, i.conn, i.cb, log)
+			} else {
+				initiator, err = NewInitiator(config, localAddr, remoteAddr, i.conn, i.cb, log)
+			}
 			if err != nil {
 				log.Log("ERROR", err, "MSG", "could not start Initiator")
 				return
 			}
+			initiator.held = held
+			initiator.redirectedFrom = redirectedFrom
 			spi := SpiToInt64(initiator.IkeSpiI)
+			err = i.runSession(spi, initiator)
+			// still held, if session did not get to replace the policies
+			held = initiator.held
+			// tickets are used once
+			ticket = initiator.Ticket()
 			// if peer did not rekey in time
-			if err = i.runSession(spi, initiator); err == errorRekeyDeadlineExceeded {
+			if err == errorRekeyDeadlineExceeded {
 				initiator.Logger.Log("REKEY", "deadline exceeded")
 				continue
 			} else if err == context.Canceled {
 				break
+			} else if errors.Cause(err) == errTicketRejected {
+				// full IKE_SA_INIT right away
+				continue
+			} else if re, ok := errors.Cause(err).(redirectError); ok {
+				addr, rerr := redirects.follow(re.Gateway, remoteAddr)
+				if rerr == nil {
+					initiator.Logger.Log("REDIRECT", addr)
+					redirectedFrom = AddrToIp(remoteAddr).String()
+					remoteAddr = addr
+					continue
+				}
+				// start over with the original gateway
+				initiator.Logger.Log("ERROR", rerr)
+				redirectedFrom, remoteAddr = "", gateway
+				redirects = redirectChain{}
+			} else if errors.Cause(err) == errPeerDead {
+				switch config.DpdAction {
+				case DpdClear:
+					return
+				case DpdRestart:
+					continue
+				case DpdHold:
+					held = initiator
+				}
 			}
 			time.Sleep(time.Second * 5)
 		}
 	}()
 }
 
+// UpdateAddresses moves initiator sessions to the new local address, rfc4555
+// sessions without MOBIKE keep theirs
+func (i *Cmd) UpdateAddresses(local net.Addr) {
+	i.sessions.ForEach(func(sess *Session) {
+		sess.UpdateAddresses(local, nil)
+	})
+}
+
+// RedirectClients asks clients of gateway sessions to move to the gateways policy picks, rfc5685
+// clients that do not support it stay
+func (i *Cmd) RedirectClients(policy Redirector) {
+	i.sessions.ForEach(func(sess *Session) {
+		sess.Redirect(policy)
+	})
+}
+
 // ShutDown closes all active IKE sessions
 func (i *Cmd) ShutDown(err error) {
 	// shutdown sessions
@@ -68,22 +152,44 @@ func (i *Cmd) ShutDown(err error) {
 
 // Run loops until there is a socket error
 func (i *Cmd) Run(config *Config, log log.Logger) error {
+	if i.natConn == nil {
+		return i.serve(i.conn, config, log)
+	}
+	cerr := make(chan error, 2)
+	go func() { cerr <- i.serve(i.conn, config, log) }()
+	go func() { cerr <- i.serve(i.natConn, config, log) }()
+	return <-cerr
+}
+
+// serve reads messages from conn until there is a socket error
+func (i *Cmd) serve(conn Conn, config *Config, log log.Logger) error {
 	forUnknownSession := func(spi uint64, msg *Message) (sess *Session, err error) {
-		// handle IKE_SA_INIT requests
-		if err = checkInitRequest(msg, i.conn, config, log); err != nil {
-			return nil, err
+		// handle IKE_SA_INIT & IKE_SESSION_RESUME requests
+		if msg.IkeHeader.ExchangeType == protocol.IKE_SESSION_RESUME {
+			if err = checkResumeRequest(msg, conn, config, log); err != nil {
+				return nil, err
+			}
+			sess, err = NewResumingResponder(config, conn, i.cb, msg, log)
+		} else {
+			if err = checkInitRequest(msg, conn, config, log); err != nil {
+				return nil, err
+			}
+			sess, err = NewResponder(config, conn, i.cb, msg, log)
 		}
-		sess, err = NewResponder(config, i.conn, i.cb, msg, log)
 		if err != nil {
 			return nil, err
 		}
-		go i.runSession(spi, sess)
+		go func() {
+			// only initiators are restarted, no reason to hold policies
+			i.runSession(spi, sess)
+			sess.releasePolicies()
+		}()
 		return
 	}
 
 	for {
 		// this will return with error when there is a socket error
-		msg, err := ReadMessage(i.conn, log)
+		msg, err := ReadMessage(conn, log)
 		if err != nil {
 			return err
 		}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/go-kit/kit/log"
@@ -30,6 +34,51 @@ func waitForSignal(cancel context.CancelFunc, logger log.Logger) {
 
 var isDebug bool
 
+// watchLocalAddress moves sessions when the address used to reach remote changes
+func watchLocalAddress(cxt context.Context, cmd *ike.Cmd, local net.IP, remoteAddr *net.UDPAddr, logger log.Logger) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cxt.Done():
+			return
+		case <-ticker.C:
+		}
+		addr, err := platform.GetLocalAddress(remoteAddr.IP)
+		if err != nil || addr.Equal(local) {
+			continue
+		}
+		logger.Log("MOBIKE", "local address changed", "FROM", local, "TO", addr)
+		local = addr
+		cmd.UpdateAddresses(&net.UDPAddr{IP: local, Port: remoteAddr.Port})
+	}
+}
+
+// loadEapTls has our certificate for EAP-TLS, peer's is checked with caFile
+func loadEapTls(certFile, keyFile, caFile string) (*tls.Config, error) {
+	certs, err := ike.LoadCerts(certFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading %s", certFile)
+	}
+	key, err := ike.LoadKey(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading %s", keyFile)
+	}
+	roots, err := ike.LoadRoot(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading %s", caFile)
+	}
+	cert := tls.Certificate{PrivateKey: key}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ClientCAs:    roots,
+	}, nil
+}
+
 func loadConfig() (config *ike.Config, localString string, remoteString string, err error) {
 	flag.StringVar(&localString, "local", "0.0.0.0:4500", "address to bind to")
 	flag.StringVar(&remoteString, "remote", "", "address to connect to")
@@ -37,19 +86,65 @@ func loadConfig() (config *ike.Config, localString string, remoteString string,
 	var localTunnel, remoteTunnel string
 	flag.StringVar(&localTunnel, "localnet", "", "local network")
 	flag.StringVar(&remoteTunnel, "remotenet", "", "remote network")
+	var childNets string
+	flag.StringVar(&childNets, "childnets", "", "comma separated localnet=remotenet pairs for more Child SAs")
+
+	var pools, dnsServers string
+	flag.StringVar(&pools, "pool", "", "comma separated networks to assign peer addresses from")
+	flag.StringVar(&dnsServers, "dns", "", "comma separated dns servers for peers")
+	var requestAddress bool
+	flag.BoolVar(&requestAddress, "vip", requestAddress, "ask remote access gateway for an address")
 
 	var caFile, certFile, keyFile, peerID, peerPass, id, pass string
 	flag.StringVar(&caFile, "ca", "", "PEM encoded ca certificate")
-	flag.StringVar(&certFile, "cert", "", "PEM encoded peer certificate")
+	flag.StringVar(&certFile, "cert", "", "DER encoded certificate, followed by intermediate CA certificates")
 	flag.StringVar(&keyFile, "key", "", "PEM encoded peer key")
 	flag.StringVar(&peerID, "peerid", "", "Peer ID")
 	flag.StringVar(&peerPass, "peerpass", "", "Peer Password")
 	flag.StringVar(&id, "id", "", "our ID")
 	flag.StringVar(&pass, "pass", "", "our Password")
+	var eapUsers string
+	flag.StringVar(&eapUsers, "eapusers", "", "file of user:password lines; peers authenticate with EAP-MSCHAPv2, EAP-MD5 or EAP-GTC")
+	var eapUser, eapPass string
+	var eapTls bool
+	flag.StringVar(&eapUser, "eapuser", "", "authenticate to gateway with EAP as this user")
+	flag.StringVar(&eapPass, "eappass", "", "EAP-MSCHAPv2 password of eapuser")
+	flag.BoolVar(&eapTls, "eaptls", eapTls, "EAP-TLS with -cert & -key, peer's certificate is checked with -ca; gateway's name is -peerid")
+	var eapOnly bool
+	var radiusServers, radiusSecret string
+	var radiusPap bool
+	flag.StringVar(&radiusServers, "radius", "", "comma separated RADIUS servers, tried in turn; peers' EAP is relayed to them, sessions are accounted")
+	flag.StringVar(&radiusSecret, "radiussecret", "", "secret shared with RADIUS servers")
+	flag.BoolVar(&radiusPap, "radiuspap", radiusPap, "RADIUS checks passwords peers send with EAP-GTC, instead of relaying EAP")
+	flag.BoolVar(&eapOnly, "eaponly", eapOnly, "gateway is authenticated by EAP-TLS alone; its -id needs no -pass or certificate")
+
+	var crlFiles, ocspServer, revocationPolicy string
+	flag.StringVar(&crlFiles, "crl", "", "comma separated CRL files for checking peer certificates")
+	flag.StringVar(&ocspServer, "ocsp", "", "OCSP responder url for checking peer certificates")
+	flag.StringVar(&revocationPolicy, "revocation", "soft", "when revocation status is unknown: soft (accept) or hard (reject)")
 
 	var useESN bool
 	flag.BoolVar(&useESN, "esn", useESN, "use ESN")
 
+	var dpdDelay time.Duration
+	var dpdAction string
+	flag.DurationVar(&dpdDelay, "dpd", 0, "check if peer is alive after this long without messages, 0 disables")
+	flag.StringVar(&dpdAction, "dpdaction", "clear", "when peer is dead: clear, hold (keep policies till restarted) or restart")
+
+	var mobike bool
+	flag.BoolVar(&mobike, "mobike", mobike, "support MOBIKE; initiator follows changes of its local address")
+
+	var ticketLifetime time.Duration
+	flag.DurationVar(&ticketLifetime, "resume", 0, "issue, or ask for, session resumption tickets valid this long, 0 disables")
+
+	var childless bool
+	flag.BoolVar(&childless, "childless", childless, "create IKE SA without Child SA when peer supports it")
+
+	var redirects string
+	var followRedirect bool
+	flag.StringVar(&redirects, "redirect", "", "comma separated clientnet=gateway pairs; clients from clientnet are sent to gateway")
+	flag.BoolVar(&followRedirect, "followredirect", followRedirect, "follow gateway's redirects")
+
 	keysOf := func(m map[string]protocol.TransformMap) (ret []string) {
 		for k := range m {
 			ret = append(ret, k)
@@ -57,22 +152,47 @@ func loadConfig() (config *ike.Config, localString string, remoteString string,
 		return
 	}
 	var espSuite, ikeSuite string
-	flag.StringVar(&espSuite, "esp", "aes128-sha256", spew.Sprintf("esp crypto: %v", keysOf(crypto.EspSuites)))
-	flag.StringVar(&ikeSuite, "ike", "aes128-sha256-modp3072", spew.Sprintf("ike crypto: %v", keysOf(crypto.IkeSuites)))
+	flag.StringVar(&espSuite, "esp", "aes128-sha256", spew.Sprintf("comma separated esp crypto, most preferred first: %v", keysOf(crypto.EspSuites)))
+	flag.StringVar(&ikeSuite, "ike", "aes128-sha256-modp3072", spew.Sprintf("comma separated ike crypto, most preferred first: %v", keysOf(crypto.IkeSuites)))
 
 	flag.BoolVar(&isDebug, "debug", isDebug, "debug logs")
 	flag.Parse()
 
 	config = ike.DefaultConfig()
 
-	ok := false
-	if config.ProposalEsp, ok = crypto.EspSuites[espSuite]; !ok {
-		err = fmt.Errorf("esp suit %s is not available", espSuite)
-		return
+	for _, name := range strings.Split(espSuite, ",") {
+		suite, ok := crypto.EspSuites[name]
+		if !ok {
+			err = fmt.Errorf("esp suit %s is not available", name)
+			return
+		}
+		config.ProposalEsp = append(config.ProposalEsp, suite)
 	}
-	if config.ProposalIke, ok = crypto.IkeSuites[ikeSuite]; !ok {
-		err = fmt.Errorf("ike suit %s is not available", ikeSuite)
-		return
+	for _, name := range strings.Split(ikeSuite, ",") {
+		suite, ok := crypto.IkeSuites[name]
+		if !ok {
+			err = fmt.Errorf("ike suit %s is not available", name)
+			return
+		}
+		config.ProposalIke = append(config.ProposalIke, suite)
+	}
+	// RADIUS servers authenticate peers, & account for sessions
+	var radius *ike.RadiusClient
+	if radiusServers != "" {
+		nas, _ := os.Hostname()
+		var servers []ike.RadiusServer
+		for _, addr := range strings.Split(radiusServers, ",") {
+			servers = append(servers, ike.RadiusServer{Address: addr, Secret: []byte(radiusSecret)})
+		}
+		radius = ike.NewRadiusClient(servers, nas)
+		config.Accounting = radius
+	}
+	// EAP-TLS certificates
+	var eapTlsConfig *tls.Config
+	if eapTls {
+		if eapTlsConfig, err = loadEapTls(certFile, keyFile, caFile); err != nil {
+			return
+		}
 	}
 	// ca & id for verifying peer
 	if caFile != "" && peerID != "" {
@@ -81,15 +201,59 @@ func loadConfig() (config *ike.Config, localString string, remoteString string,
 		if err != nil {
 			return
 		}
-		config.PeerID = &ike.CertIdentity{
-			Roots: roots,
-			Name:  peerID,
+		// announced in CERTREQ
+		rootCerts, _err := ike.LoadPEMCerts(caFile)
+		err = errors.Wrapf(_err, "loading %s", caFile)
+		if err != nil {
+			return
+		}
+		peerCertID := &ike.CertIdentity{
+			Roots:     roots,
+			RootCerts: rootCerts,
+			Name:      peerID,
+		}
+		if crlFiles != "" || ocspServer != "" {
+			policy := ike.RevocationSoftFail
+			if revocationPolicy == "hard" {
+				policy = ike.RevocationHardFail
+			}
+			var files []string
+			if crlFiles != "" {
+				files = strings.Split(crlFiles, ",")
+			}
+			if peerCertID.Revocation, err = ike.NewRevocationChecker(files, ocspServer, policy); err != nil {
+				return
+			}
 		}
+		config.PeerID = peerCertID
 	} else if peerID != "" && peerPass != "" {
 		config.PeerID = &ike.PskIdentities{
 			Primary: peerID,
 			Ids:     map[string][]byte{peerID: []byte(peerPass)},
 		}
+	} else if eapUsers != "" || (eapTls && eapUser == "") {
+		eapID := &ike.EapIdentity{}
+		if eapTls {
+			serverTls := eapTlsConfig.Clone()
+			serverTls.ClientAuth = tls.RequireAndVerifyClientCert
+			eapID.Methods = append(eapID.Methods, ike.EapTls(serverTls))
+		}
+		if eapUsers != "" {
+			users, _err := ike.LoadLocalUsers(eapUsers)
+			err = errors.Wrapf(_err, "loading %s", eapUsers)
+			if err != nil {
+				return
+			}
+			eapID.Methods = append(eapID.Methods, ike.NewEapMschapv2, ike.NewEapMd5, ike.NewEapGtc)
+			eapID.Users = users
+		}
+		config.PeerID = eapID
+	} else if radius != nil {
+		if radiusPap {
+			config.PeerID = &ike.EapIdentity{Methods: []ike.NewEapMethod{ike.NewEapGtc}, Users: radius}
+		} else {
+			config.PeerID = &ike.EapIdentity{Radius: radius}
+		}
 	}
 	if config.PeerID == nil {
 		err = errors.New("peer credentials are missing")
@@ -108,10 +272,20 @@ func loadConfig() (config *ike.Config, localString string, remoteString string,
 		if err != nil {
 			return
 		}
-		config.LocalID = &ike.CertIdentity{
+		certID := &ike.CertIdentity{
 			Certificate: certs[0],
+			Chain:       certs[1:],
 			PrivateKey:  key,
 		}
+		// ca may have issued our certificate, peer can ask for it in CERTREQ
+		if caFile != "" {
+			certID.RootCerts, _err = ike.LoadPEMCerts(caFile)
+			err = errors.Wrapf(_err, "loading %s", caFile)
+			if err != nil {
+				return
+			}
+		}
+		config.LocalID = certID
 	}
 	if id != "" && pass != "" {
 		config.LocalID = &ike.PskIdentities{
@@ -119,11 +293,61 @@ func loadConfig() (config *ike.Config, localString string, remoteString string,
 			Ids:     map[string][]byte{id: []byte(pass)},
 		}
 	}
+	// gateway authenticated by EAP alone is only named
+	if eapOnly && config.LocalID == nil && id != "" {
+		config.LocalID = &ike.PskIdentities{Primary: id}
+	}
+	config.EapOnly = eapOnly
+	// gateway requires EAP
+	if eapUser != "" {
+		eapID := &ike.EapClientIdentity{User: eapUser, Password: eapPass}
+		if eapTls {
+			eapID.Tls = eapTlsConfig.Clone()
+			eapID.Tls.ServerName = peerID
+		}
+		config.LocalID = eapID
+	}
 	if config.LocalID == nil {
 		err = errors.New("our credentials are missing")
 		return
 	}
 
+	// remote access
+	for _, pool := range strings.Split(pools, ",") {
+		if pool == "" {
+			continue
+		}
+		_, network, _err := net.ParseCIDR(pool)
+		err = errors.Wrapf(_err, "pool %s", pool)
+		if err != nil {
+			return
+		}
+		addressPool, _err := ike.NewAddressPool(network)
+		if err = _err; err != nil {
+			return
+		}
+		config.AddressPools = append(config.AddressPools, addressPool)
+		// peers will be narrowed to their address
+		if remoteTunnel == "" {
+			remoteTunnel = pool
+		}
+	}
+	for _, dns := range strings.Split(dnsServers, ",") {
+		if ip := net.ParseIP(dns); ip != nil {
+			config.InternalDNS = append(config.InternalDNS, ip)
+		}
+	}
+	if requestAddress && remoteString != "" {
+		config.RequestAddress = true
+		// gateway narrows these
+		if localTunnel == "" {
+			localTunnel = "0.0.0.0/0"
+		}
+		if remoteTunnel == "" {
+			remoteTunnel = "0.0.0.0/0"
+		}
+	}
+
 	if localTunnel == "" && remoteTunnel == "" {
 		config.IsTransportMode = true
 	} else {
@@ -142,9 +366,77 @@ func loadConfig() (config *ike.Config, localString string, remoteString string,
 			isInitiator = false
 		}
 		err = config.AddNetworkSelectors(localnet, remotenet, isInitiator)
+		if err != nil {
+			return
+		}
+		for _, pair := range strings.Split(childNets, ",") {
+			if pair == "" {
+				continue
+			}
+			nets := strings.Split(pair, "=")
+			if len(nets) != 2 {
+				err = errors.Errorf("bad child networks %s", pair)
+				return
+			}
+			_, localnet, err = net.ParseCIDR(nets[0])
+			if err != nil {
+				return
+			}
+			_, remotenet, err = net.ParseCIDR(nets[1])
+			if err != nil {
+				return
+			}
+			if err = config.AddChildSa(localnet, remotenet, isInitiator, 0); err != nil {
+				return
+			}
+		}
+	}
+	config.DpdDelay = dpdDelay
+	switch dpdAction {
+	case "clear":
+		config.DpdAction = ike.DpdClear
+	case "hold":
+		config.DpdAction = ike.DpdHold
+	case "restart":
+		config.DpdAction = ike.DpdRestart
+	default:
+		err = errors.Errorf("unknown dpd action %s", dpdAction)
+		return
+	}
+	config.Mobike = mobike
+	config.Childless = childless
+	if ticketLifetime != 0 {
+		if remoteString != "" {
+			config.RequestTicket = true
+		} else {
+			config.Tickets = ike.NewTicketKeys(ticketLifetime, ticketLifetime)
+		}
 	}
+	var prefixes ike.PrefixRedirector
+	for _, pair := range strings.Split(redirects, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			err = errors.Errorf("bad redirect %s", pair)
+			return
+		}
+		_, clientnet, _err := net.ParseCIDR(parts[0])
+		err = errors.Wrapf(_err, "redirect %s", pair)
+		if err != nil {
+			return
+		}
+		prefixes = append(prefixes, ike.PrefixRedirect{Prefix: clientnet, Gateway: parts[1]})
+	}
+	if prefixes != nil {
+		config.Redirect = prefixes
+	}
+	config.AcceptRedirect = followRedirect
 	if useESN {
-		config.ProposalEsp.GetType(protocol.TRANSFORM_TYPE_ESN).TransformId = uint16(protocol.ESN)
+		for _, suite := range config.ProposalEsp {
+			suite.GetType(protocol.TRANSFORM_TYPE_ESN).TransformId = uint16(protocol.ESN)
+		}
 	}
 	return
 }
@@ -174,6 +466,10 @@ func main() {
 	}
 	platform.ListenForEvents(cxt, cb, logger)
 
+	if certID, ok := config.PeerID.(*ike.CertIdentity); ok && certID.Revocation != nil {
+		go certID.Revocation.Run(cxt, logger)
+	}
+
 	pconn, err := ike.Listen("udp", localString, logger)
 	if err != nil {
 		panic(fmt.Sprintf("Listen: %+v", err))
@@ -183,6 +479,21 @@ func main() {
 		panic(fmt.Sprintf("Bypass: %+v", err))
 	}
 
+	// NAT-T socket, unless already listening on its port
+	var natConn ike.Conn
+	if host, port, _ := net.SplitHostPort(localString); port != strconv.Itoa(ike.NatTPort) {
+		natConn, err = ike.ListenNatT("udp", net.JoinHostPort(host, strconv.Itoa(ike.NatTPort)), logger)
+		if err != nil {
+			panic(fmt.Sprintf("Listen: %+v", err))
+		}
+		if err := platform.SetSocketBypass(natConn.Inner()); err != nil {
+			panic(fmt.Sprintf("Bypass: %+v", err))
+		}
+		if err := platform.SetSocketEncap(natConn.Inner()); err != nil {
+			panic(fmt.Sprintf("Encap: %+v", err))
+		}
+	}
+
 	cmd := ike.NewCmd(pconn, &ike.SessionCallback{
 		InstallPolicy: func(session *ike.Session, pol *protocol.PolicyParams) error {
 			return platform.InstallPolicy(session.SessionID, pol, logger, session.IsInitiator())
@@ -196,8 +507,18 @@ func main() {
 		RemoveChildSa: func(session *ike.Session, sa *platform.SaParams) error {
 			return platform.RemoveChildSa(session.SessionID, sa, logger)
 		},
+		InstallClientConfig: func(session *ike.Session, cfg *platform.ClientConfig) error {
+			return platform.InstallClientConfig(session.SessionID, cfg, logger)
+		},
+		RemoveClientConfig: func(session *ike.Session, cfg *platform.ClientConfig) error {
+			return platform.RemoveClientConfig(session.SessionID, cfg, logger)
+		},
 	})
 
+	if natConn != nil {
+		cmd.SetNatTConn(natConn)
+	}
+
 	if remoteString != "" {
 		remoteAddr, err := net.ResolveUDPAddr("udp", remoteString)
 		if err != nil {
@@ -217,6 +538,9 @@ func main() {
 		}
 		localAddr := &net.UDPAddr{IP: local, Port: remoteAddr.Port}
 		cmd.RunInitiator(localAddr, remoteAddr, config, logger)
+		if config.Mobike {
+			go watchLocalAddress(cxt, cmd, local, remoteAddr, logger)
+		}
 	}
 
 	wg := &sync.WaitGroup{}
@@ -230,6 +554,9 @@ func main() {
 		cmd.ShutDown(cxt.Err())
 		// this will cause cmd.Run to return
 		pconn.Close()
+		if natConn != nil {
+			natConn.Close()
+		}
 		wg.Done()
 	}()
 
@@ -1,6 +1,7 @@
 package ike
 
 import (
+	"bytes"
 	"net"
 	"reflect"
 	"time"
@@ -10,14 +11,76 @@ import (
 )
 
 type Config struct {
-	ProposalIke, ProposalEsp protocol.TransformMap
+	// acceptable suites, in order of preference
+	// a session narrows these to the negotiated suite
+	ProposalIke, ProposalEsp []protocol.TransformMap
 
 	LocalID, PeerID Identity
+	// rfc4739; initiator authenticates with LocalID, then with each of LocalAuthRounds
+	// responder requires PeerID, then each of PeerAuthRounds
+	LocalAuthRounds, PeerAuthRounds []Identity
+	// rfc5998; initiator lets a gateway that requires EAP leave out its own AUTH
+	// responder does so when asked; either way the EAP method must be safe, and authenticate it
+	// gateway's LocalID then only names it
+	EapOnly bool
 
 	TsI, TsR             protocol.Selectors
 	IsTransportMode      bool
 	ThrottleInitRequests bool
 	Lifetime             time.Duration
+	// more Child SAs, created by initiator with CREATE_CHILD_SA after IKE_AUTH
+	Children []ChildSaConfig
+	// rfc6023; when both support it, IKE_AUTH creates no Child SA
+	// initiator creates the one for TsI & TsR, if any, after IKE_AUTH
+	Childless bool
+	// IKE SA is rekeyed before this expires; 0 disables rekeying
+	IkeLifetime time.Duration
+	// max size of rfc7383 fragments; 0 disables fragmentation
+	FragmentSize int
+
+	// requests are retransmitted after RetransmitTimeout, doubled for each of RetransmitRetries
+	// 0 uses REPLY_WAIT_TIMEOUT & DefaultRetransmitRetries
+	RetransmitTimeout time.Duration
+	RetransmitRetries int
+
+	// requests from peer we handle at once, sent as SET_WINDOW_SIZE; 0 is the default of 1
+	WindowSize uint32
+
+	// dead peer detection; peer is checked after this long without messages from it
+	// 0 disables checks
+	DpdDelay time.Duration
+	// check is retransmitted after DpdTimeout, doubled for each of DpdRetries
+	DpdTimeout time.Duration
+	DpdRetries int
+	// what Cmd does when peer is dead
+	DpdAction DpdAction
+
+	// side behind NAT sends keepalives this often; 0 disables them
+	NatKeepalive time.Duration
+	// rfc4555 MOBIKE; initiator can move the IKE SA & Child SAs to new addresses
+	Mobike bool
+
+	// rfc5723 session resumption
+	// responder issues tickets encrypted with these keys; nil disables it
+	// resuming initiators are always asked for a COOKIE before the ticket is opened
+	Tickets *TicketKeys
+	// initiator asks for a ticket; Cmd resumes the session with it when restarting
+	RequestTicket bool
+
+	// rfc5685 redirect
+	// gateway sends clients that support it to the gateway Redirect picks; nil disables it
+	Redirect Redirector
+	// client accepts REDIRECT; Cmd follows it to the new gateway
+	AcceptRedirect bool
+
+	// remote access: responder assigns internal addresses from these pools
+	AddressPools []*AddressPool
+	InternalDNS  []net.IP
+	// remote access: initiator asks for an internal address
+	RequestAddress bool
+
+	// rfc2866; sessions are reported once established, and when shut down
+	Accounting *RadiusClient
 }
 
 // StrongSwan recommendations for cipher suite
@@ -26,10 +89,24 @@ type Config struct {
 // aes128gcm16-prfsha256-ecp256 (AES-GCM-128 AEAD, SHA-256 as PRF and ECDH key exchange with 256 bit key length)
 // aes256gcm16-prfsha384-ecp384 (AES-GCM-256 AEAD, SHA-384 as PRF and ECDH key exchange with 384 bit key length)
 
+// ChildSaConfig has selectors of an additional Child SA
+// selectors are from the IKE initiator's point of view
+type ChildSaConfig struct {
+	TsI, TsR protocol.Selectors
+	Lifetime time.Duration // Config.Lifetime is used if 0
+}
+
 func DefaultConfig() *Config {
 	return &Config{
 		// ThrottleInitRequests: true,
-		Lifetime: time.Hour,
+		Lifetime:          time.Hour,
+		IkeLifetime:       3 * time.Hour,
+		FragmentSize:      DefaultFragmentSize,
+		RetransmitTimeout: REPLY_WAIT_TIMEOUT,
+		RetransmitRetries: DefaultRetransmitRetries,
+		DpdTimeout:        DefaultDpdTimeout,
+		DpdRetries:        DefaultDpdRetries,
+		NatKeepalive:      DefaultNatKeepalive,
 	}
 }
 
@@ -37,45 +114,99 @@ func DefaultConfig() *Config {
 // proposals
 //
 
-// CheckProposals checks if incoming proposals include our configuration
-func (cfg *Config) CheckProposals(prot protocol.ProtocolID, proposals protocol.Proposals) (err error) {
+// SelectProposal picks the first of peer's proposals that one of our suites matches completely
+// returns number of the chosen proposal & our matching suite
+func (cfg *Config) SelectProposal(prot protocol.ProtocolID, proposals protocol.Proposals) (uint8, protocol.TransformMap, error) {
+	suites := cfg.ProposalEsp
+	if prot == protocol.IKE {
+		suites = cfg.ProposalIke
+	}
+	// peer's order of preference
 	for _, prop := range proposals {
 		if prop.ProtocolID != prot {
 			continue
 		}
-		// select first acceptable one from the list
-		switch prot {
-		case protocol.IKE:
-			if cfg.ProposalIke.Within(prop.Transforms) {
-				return nil
+		for _, suite := range suites {
+			if suite.Within(prop.Transforms) {
+				return prop.Number, suite, nil
 			}
-		case protocol.ESP:
-			if cfg.ProposalEsp.Within(prop.Transforms) {
-				return nil
+		}
+	}
+	return 0, nil, errors.WithStack(protocol.ERR_NO_PROPOSAL_CHOSEN)
+}
+
+// SelectIkeProposal prefers proposals whose dh group was used in KE
+// if only other groups are acceptable, returns INVALID_KE_PAYLOAD
+func (cfg *Config) SelectIkeProposal(proposals protocol.Proposals, dhID protocol.DhTransformId) (uint8, protocol.TransformMap, error) {
+	var withKe protocol.Proposals
+	for _, prop := range proposals {
+		for _, tr := range prop.Transforms {
+			if tr.Transform.Type == protocol.TRANSFORM_TYPE_DH && protocol.DhTransformId(tr.Transform.TransformId) == dhID {
+				withKe = append(withKe, prop)
+				break
 			}
 		}
 	}
-	return errors.WithStack(protocol.ERR_NO_PROPOSAL_CHOSEN)
+	if num, suite, err := cfg.SelectProposal(protocol.IKE, withKe); err == nil {
+		return num, suite, nil
+	}
+	num, suite, err := cfg.SelectProposal(protocol.IKE, proposals)
+	if err != nil {
+		return 0, nil, err
+	}
+	return num, suite, checkDhTransform(suite, dhID)
 }
 
-func (cfg *Config) CheckDhTransform(dhID protocol.DhTransformId) error {
-	// make sure dh tranform id is the one that was configured
-	tr := cfg.ProposalIke[protocol.TRANSFORM_TYPE_DH].Transform.TransformId
-	if dh := protocol.DhTransformId(tr); dh != dhID {
+// checkDhTransform makes sure dh tranform id is the one from selected suite
+func checkDhTransform(suite protocol.TransformMap, dhID protocol.DhTransformId) error {
+	if dh := suiteDhGroup(suite); dh != dhID {
 		return errors.Wrapf(protocol.ERR_INVALID_KE_PAYLOAD,
-			"IKE_SA_INIT: Using different DH transform [%s] vs the one configured [%s]",
+			"IKE_SA_INIT: Using different DH transform [%s] vs the one selected [%s]",
 			dhID, dh) // C.1
 	}
 	return nil
 }
 
+// ikeSuiteWithDhGroup returns the first of our IKE suites using group dh
+func (cfg *Config) ikeSuiteWithDhGroup(dh protocol.DhTransformId) protocol.TransformMap {
+	for _, suite := range cfg.ProposalIke {
+		if suiteDhGroup(suite) == dh {
+			return suite
+		}
+	}
+	return nil
+}
+
+func suiteDhGroup(suite protocol.TransformMap) protocol.DhTransformId {
+	if tr := suite.GetType(protocol.TRANSFORM_TYPE_DH); tr != nil {
+		return protocol.DhTransformId(tr.TransformId)
+	}
+	return 0
+}
+
+// proposals returns all our suites for requests
+// responses echo the selected proposal number with the negotiated suite
+func proposals(prot protocol.ProtocolID, suites []protocol.TransformMap, spi []byte, selected uint8) protocol.Proposals {
+	if selected == 0 {
+		return protocol.ProposalsFromTransforms(prot, suites, spi)
+	}
+	props := protocol.ProposalFromTransform(prot, suites[0], spi)
+	props[0].Number = selected
+	return props
+}
+
 //
 // selectors
 //
 
 // CheckSelectors checks if incoming selectors match our configuration
 func (cfg *Config) CheckSelectors(tsi, tsr protocol.Selectors, isTransportMode bool) error {
-	p1 := cfg.Policy()
+	return cfg.checkSelectors(cfg.TsI, cfg.TsR, tsi, tsr, isTransportMode)
+}
+
+// checkSelectors checks if incoming selectors match the ones of a Child SA
+func (cfg *Config) checkSelectors(ourI, ourR, tsi, tsr protocol.Selectors, isTransportMode bool) error {
+	p1 := cfg.childPolicy(ourI, ourR)
 	p2 := selectorsToPolicy(tsi[0], tsr[0], isTransportMode)
 	if !reflect.DeepEqual(p1, p2) {
 		return errors.WithStack(protocol.ERR_INVALID_SELECTORS)
@@ -97,6 +228,35 @@ func (cfg *Config) CheckSelectors(tsi, tsr protocol.Selectors, isTransportMode b
 	return nil
 }
 
+// NarrowSelectors replaces peer's selectors with ours
+// if theirs include ours; used when assigning internal addresses
+func (cfg *Config) NarrowSelectors(tsi, tsr protocol.Selectors) (protocol.Selectors, protocol.Selectors, error) {
+	if !selectorsInclude(tsi, cfg.TsI) || !selectorsInclude(tsr, cfg.TsR) {
+		return nil, nil, errors.WithStack(protocol.ERR_TS_UNACCEPTABLE)
+	}
+	return cfg.TsI, cfg.TsR, nil
+}
+
+// selectorsInclude checks if the first selector of inner falls within one of outer
+func selectorsInclude(outer, inner protocol.Selectors) bool {
+	if len(inner) == 0 {
+		return false
+	}
+	in := inner[0]
+	for _, out := range outer {
+		if out.Type != in.Type ||
+			(out.IpProtocolId != 0 && out.IpProtocolId != in.IpProtocolId) ||
+			out.StartPort > in.StartPort || out.Endport < in.Endport {
+			continue
+		}
+		if bytes.Compare(check4(out.StartAddress), check4(in.StartAddress)) <= 0 &&
+			bytes.Compare(check4(out.EndAddress), check4(in.EndAddress)) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func selectorFromAddress(addr *net.IPNet) (protocol.Selectors, error) {
 	first, last, err := IPNetToFirstLastAddress(addr)
 	if err != nil {
@@ -116,8 +276,7 @@ func selectorFromAddress(addr *net.IPNet) (protocol.Selectors, error) {
 	}}, nil
 }
 
-// AddNetworkSelectors builds selector from address & mask
-func (cfg *Config) AddNetworkSelectors(localnet, remotenet *net.IPNet, forInitiator bool) (err error) {
+func networkSelectors(localnet, remotenet *net.IPNet, forInitiator bool) (tsI, tsR protocol.Selectors, err error) {
 	local, err := selectorFromAddress(localnet)
 	if err != nil {
 		return
@@ -126,16 +285,35 @@ func (cfg *Config) AddNetworkSelectors(localnet, remotenet *net.IPNet, forInitia
 	if err != nil {
 		return
 	}
-	// MUTATION
-	cfg.TsI = remote
-	cfg.TsR = local
 	if forInitiator {
-		cfg.TsI = local
-		cfg.TsR = remote
+		return local, remote, nil
+	}
+	return remote, local, nil
+}
+
+// AddNetworkSelectors builds selector from address & mask
+func (cfg *Config) AddNetworkSelectors(localnet, remotenet *net.IPNet, forInitiator bool) (err error) {
+	tsI, tsR, err := networkSelectors(localnet, remotenet, forInitiator)
+	if err != nil {
+		return
 	}
+	// MUTATION
+	cfg.TsI = tsI
+	cfg.TsR = tsR
 	return
 }
 
+// AddChildSa adds selectors for another Child SA
+func (cfg *Config) AddChildSa(localnet, remotenet *net.IPNet, forInitiator bool, lifetime time.Duration) error {
+	tsI, tsR, err := networkSelectors(localnet, remotenet, forInitiator)
+	if err != nil {
+		return err
+	}
+	// MUTATION
+	cfg.Children = append(cfg.Children, ChildSaConfig{TsI: tsI, TsR: tsR, Lifetime: lifetime})
+	return nil
+}
+
 // AddHostSelectors builds selectors from ip addresses
 func (cfg *Config) AddHostSelectors(local, remote net.IP, forInitiator bool) error {
 	slen := len(local) * 8
@@ -152,7 +330,12 @@ func (cfg *Config) AddHostSelectors(local, remote net.IP, forInitiator bool) err
 
 // Policy converts the selectors to policy
 func (cfg *Config) Policy() *protocol.PolicyParams {
-	return selectorsToPolicy(cfg.TsI[0], cfg.TsR[0], cfg.IsTransportMode)
+	return cfg.childPolicy(cfg.TsI, cfg.TsR)
+}
+
+// childPolicy converts the selectors of a Child SA to policy
+func (cfg *Config) childPolicy(tsI, tsR protocol.Selectors) *protocol.PolicyParams {
+	return selectorsToPolicy(tsI[0], tsR[0], cfg.IsTransportMode)
 }
 
 func selectorsToPolicy(tsI, tsR *protocol.Selector, isTransportMode bool) *protocol.PolicyParams {
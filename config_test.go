@@ -9,6 +9,7 @@ import (
 	"github.com/davecgh/go-spew/spew"
 	"github.com/msgboxio/ike/crypto"
 	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
 )
 
 func testConfig() *Config {
@@ -16,8 +17,8 @@ func testConfig() *Config {
 		// ThrottleInitRequests: true,
 		Lifetime: time.Hour,
 		// set
-		ProposalIke: crypto.Aes128Sha256Modp3072,
-		ProposalEsp: crypto.Aes128Sha256,
+		ProposalIke: []protocol.TransformMap{crypto.Aes128Sha256Modp3072},
+		ProposalEsp: []protocol.TransformMap{crypto.Aes128Sha256},
 	}
 }
 
@@ -33,19 +34,54 @@ func TestCopyConfig(t *testing.T) {
 
 func TestCheckProposals(t *testing.T) {
 	cfg := &Config{
-		ProposalIke: crypto.Aes128gcm16Prfsha256Ecp256,
-		ProposalEsp: crypto.Aes256gcm16,
+		ProposalIke: []protocol.TransformMap{crypto.Aes128gcm16Prfsha256Ecp256},
+		ProposalEsp: []protocol.TransformMap{crypto.Aes256gcm16},
 	}
 	ikeProps := protocol.ProposalFromTransform(protocol.IKE, crypto.Aes128gcm16Prfsha256Ecp256, MakeSpi())
-	if err := cfg.CheckProposals(protocol.IKE, ikeProps); err != nil {
+	if _, _, err := cfg.SelectProposal(protocol.IKE, ikeProps); err != nil {
 		t.Error("IKE", err)
 	}
 	ipsecProps := protocol.ProposalFromTransform(protocol.ESP, crypto.Aes256gcm16, MakeSpi())
-	if err := cfg.CheckProposals(protocol.ESP, ipsecProps); err != nil {
+	if _, _, err := cfg.SelectProposal(protocol.ESP, ipsecProps); err != nil {
 		t.Error("ESP", err)
 	}
-	if err := cfg.CheckProposals(protocol.IKE, ipsecProps); err == nil {
+	if _, _, err := cfg.SelectProposal(protocol.IKE, ipsecProps); err == nil {
 		spew.Dump(ipsecProps)
 		t.Error("NO ERROR")
 	}
 }
+
+func TestSelectProposal(t *testing.T) {
+	cfg := &Config{
+		ProposalIke: []protocol.TransformMap{crypto.Aes128gcm16Prfsha256Ecp256, crypto.Aes128Sha256Modp3072},
+	}
+	// sharing only the dh group is not enough
+	partial := protocol.ProposalFromTransform(protocol.IKE, crypto.Chacha20poly1305Prfsha256Ecp256, MakeSpi())
+	if _, _, err := cfg.SelectProposal(protocol.IKE, partial); err == nil {
+		t.Error("partially matching proposal accepted")
+	}
+	// peer's preference wins
+	peer := []protocol.TransformMap{crypto.Aes128Sha256Modp2048, crypto.Aes128Sha256Modp3072, crypto.Aes128gcm16Prfsha256Ecp256}
+	props := protocol.ProposalsFromTransforms(protocol.IKE, peer, MakeSpi())
+	num, suite, err := cfg.SelectProposal(protocol.IKE, props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 2 || !reflect.DeepEqual(suite, crypto.Aes128Sha256Modp3072) {
+		t.Errorf("selected %d: %v", num, suite)
+	}
+	// proposal matching KE is preferred
+	if num, _, err = cfg.SelectIkeProposal(props, protocol.ECP_256); err != nil || num != 3 {
+		t.Error("KE group", num, err)
+	}
+	// otherwise ask for another KE
+	props = protocol.ProposalsFromTransforms(protocol.IKE, peer[1:2], MakeSpi())
+	if _, _, err = cfg.SelectIkeProposal(props, protocol.MODP_2048); errors.Cause(err) != protocol.ERR_INVALID_KE_PAYLOAD {
+		t.Error("expected INVALID_KE_PAYLOAD", err)
+	}
+	// responder echoes exactly the selected suite
+	reply := proposals(protocol.IKE, []protocol.TransformMap{suite}, MakeSpi(), num)
+	if len(reply) != 1 || reply[0].Number != num || !suite.Within(reply[0].Transforms) || len(reply[0].Transforms) != len(suite) {
+		t.Error("bad reply", reply)
+	}
+}
@@ -0,0 +1,227 @@
+package ike
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/msgboxio/ike/platform"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// configurationRequest asks the gateway for addresses, dns servers & protected subnets
+func configurationRequest() *protocol.ConfigurationPayload {
+	return &protocol.ConfigurationPayload{
+		PayloadHeader:     &protocol.PayloadHeader{},
+		ConfigurationType: protocol.CFG_REQUEST,
+		ConfigurationAttributes: []*protocol.ConfigurationAttribute{
+			protocol.EmptyAttribute(protocol.INTERNAL_IP4_ADDRESS),
+			protocol.EmptyAttribute(protocol.INTERNAL_IP4_DNS),
+			protocol.EmptyAttribute(protocol.INTERNAL_IP4_SUBNET),
+			protocol.EmptyAttribute(protocol.INTERNAL_IP6_ADDRESS),
+			protocol.EmptyAttribute(protocol.INTERNAL_IP6_DNS),
+			protocol.EmptyAttribute(protocol.INTERNAL_IP6_SUBNET),
+		},
+	}
+}
+
+// handleConfigurationForSession assigns internal addresses to a remote access peer
+// and narrows its selectors to the assigned addresses
+// initiator applies the addresses it was assigned
+func handleConfigurationForSession(sess *Session, msg *Message, params *authParams) (err error) {
+	if sess.isInitiator {
+		return applyConfigurationReply(sess, params)
+	}
+	if len(sess.cfg.AddressPools) == 0 {
+		return
+	}
+	cp := params.configuration
+	if cp == nil || cp.ConfigurationType != protocol.CFG_REQUEST {
+		return
+	}
+	idP := msg.Payloads.Get(protocol.PayloadTypeIDi).(*protocol.IdPayload)
+	identity := fmt.Sprintf("%s:%x", idP.IdType, idP.Data)
+	reply, tsI, err := sess.leaseAddresses(identity, cp)
+	if err != nil {
+		return
+	}
+	// config is changed once peer's selectors are narrowed to the leases
+	narrowed := sess.cfg
+	narrowed.TsI = tsI
+	tsi, tsr, err := narrowed.NarrowSelectors(params.tsI, params.tsR)
+	if err != nil {
+		sess.releaseAddresses()
+		return
+	}
+	// MUTATION
+	sess.configuration = reply
+	sess.cfg.TsI = tsI
+	params.tsI, params.tsR = tsi, tsr
+	sess.Logger.Log("CFG_REPLY", fmt.Sprintf("%s", tsI), "ID", identity)
+	return
+}
+
+// applyConfigurationReply uses the addresses in CFG_REPLY as our selectors
+// and accepts the gateway narrowing our responder selectors
+func applyConfigurationReply(sess *Session, params *authParams) (err error) {
+	if sess.configuration == nil {
+		// did not ask
+		return
+	}
+	cp := params.configuration
+	if cp == nil || cp.ConfigurationType != protocol.CFG_REPLY {
+		return errors.Wrap(protocol.ERR_INTERNAL_ADDRESS_FAILURE, "gateway did not assign an address")
+	}
+	clientConfig := &platform.ClientConfig{
+		Gateway: AddrToIp(sess.Remote),
+		DNS:     append(cp.IPs(protocol.INTERNAL_IP4_DNS), cp.IPs(protocol.INTERNAL_IP6_DNS)...),
+		Subnets: append(cp.Networks(protocol.INTERNAL_IP4_SUBNET), cp.Networks(protocol.INTERNAL_IP6_SUBNET)...),
+	}
+	var tsI protocol.Selectors
+	for _, ip := range append(cp.IPs(protocol.INTERNAL_IP4_ADDRESS), cp.IPs(protocol.INTERNAL_IP6_ADDRESS)...) {
+		ip = check4(ip)
+		slen := len(ip) * 8
+		clientConfig.Addresses = append(clientConfig.Addresses, &net.IPNet{IP: ip, Mask: net.CIDRMask(slen, slen)})
+		tsI = append(tsI, hostSelector(ip)...)
+	}
+	if len(tsI) == 0 {
+		return errors.Wrap(protocol.ERR_INTERNAL_ADDRESS_FAILURE, "no address in CFG_REPLY")
+	}
+	// responder may narrow its selectors too
+	tsR := sess.cfg.TsR
+	if len(params.tsR) > 0 && selectorsInclude(sess.cfg.TsR, params.tsR) {
+		tsR = params.tsR
+	}
+	// route to what the gateway protects if it did not send subnets
+	if len(clientConfig.Subnets) == 0 {
+		for _, ts := range tsR {
+			clientConfig.Subnets = append(clientConfig.Subnets, FirstLastAddressToIPNet(ts.StartAddress, ts.EndAddress))
+		}
+	}
+	// MUTATION
+	sess.cfg.TsI = tsI
+	sess.cfg.TsR = tsR
+	sess.clientConfig = clientConfig
+	sess.Logger.Log("CFG_REPLY", fmt.Sprintf("%s", clientConfig.Addresses),
+		"DNS", fmt.Sprintf("%s", clientConfig.DNS),
+		"SUBNETS", fmt.Sprintf("%s", clientConfig.Subnets))
+	return
+}
+
+// onConfiguration answers CP in INFORMATIONAL request
+// gateway repeats what it assigned in IKE_AUTH, nothing is assigned anew
+// CFG_SET is acknowledged without attributes; none are changed
+func onConfiguration(sess *Session, cp *protocol.ConfigurationPayload) error {
+	reply := &protocol.ConfigurationPayload{PayloadHeader: &protocol.PayloadHeader{}}
+	switch cp.ConfigurationType {
+	case protocol.CFG_REQUEST:
+		reply.ConfigurationType = protocol.CFG_REPLY
+		if sess.configuration != nil && sess.configuration.ConfigurationType == protocol.CFG_REPLY {
+			reply.ConfigurationAttributes = sess.configuration.ConfigurationAttributes
+		}
+	case protocol.CFG_SET:
+		reply.ConfigurationType = protocol.CFG_ACK
+	default:
+		sess.Logger.Log("INFORMATIONAL", "unexpected", "CP", cp.ConfigurationType)
+		return sess.SendEmptyInformational(true)
+	}
+	sess.Logger.Log("INFORMATIONAL", "CP", "REPLY", reply.ConfigurationType)
+	return sess.sendConfigurationReply(reply)
+}
+
+// leaseAddresses builds a CFG_REPLY for the request
+// returns initiator selectors for the leased addresses
+func (sess *Session) leaseAddresses(identity string, req *protocol.ConfigurationPayload) (reply *protocol.ConfigurationPayload, tsI protocol.Selectors, err error) {
+	reply = &protocol.ConfigurationPayload{
+		PayloadHeader:     &protocol.PayloadHeader{},
+		ConfigurationType: protocol.CFG_REPLY,
+	}
+	var v4Pool, v6Pool *AddressPool
+	if len(req.Get(protocol.INTERNAL_IP4_ADDRESS)) > 0 {
+		ip, pool, lErr := sess.leaseAddress(identity, false)
+		if lErr != nil {
+			sess.Logger.Log("LEASE", "IP4", "ERROR", lErr)
+		} else {
+			v4Pool = pool
+			reply.Add(protocol.IPAttribute(protocol.INTERNAL_IP4_ADDRESS, ip))
+			if len(req.Get(protocol.INTERNAL_IP4_NETMASK)) > 0 {
+				reply.Add(protocol.IPAttribute(protocol.INTERNAL_IP4_NETMASK,
+					net.IP(net.CIDRMask(pool.Prefix(), 8*net.IPv4len))))
+			}
+			tsI = append(tsI, hostSelector(ip)...)
+		}
+	}
+	if len(req.Get(protocol.INTERNAL_IP6_ADDRESS)) > 0 {
+		ip, pool, lErr := sess.leaseAddress(identity, true)
+		if lErr != nil {
+			sess.Logger.Log("LEASE", "IP6", "ERROR", lErr)
+		} else {
+			v6Pool = pool
+			reply.Add(protocol.IPNetAttribute(protocol.INTERNAL_IP6_ADDRESS,
+				&net.IPNet{IP: ip, Mask: net.CIDRMask(pool.Prefix(), 8*net.IPv6len)}))
+			tsI = append(tsI, hostSelector(ip)...)
+		}
+	}
+	if v4Pool == nil && v6Pool == nil {
+		sess.releaseAddresses()
+		err = errors.Wrap(protocol.ERR_INTERNAL_ADDRESS_FAILURE, "could not assign address")
+		return
+	}
+	// dns servers & protected subnets of matching family
+	for _, dns := range sess.cfg.InternalDNS {
+		if dns.To4() != nil && v4Pool != nil && len(req.Get(protocol.INTERNAL_IP4_DNS)) > 0 {
+			reply.Add(protocol.IPAttribute(protocol.INTERNAL_IP4_DNS, dns))
+		} else if dns.To4() == nil && v6Pool != nil && len(req.Get(protocol.INTERNAL_IP6_DNS)) > 0 {
+			reply.Add(protocol.IPAttribute(protocol.INTERNAL_IP6_DNS, dns))
+		}
+	}
+	for _, ts := range sess.cfg.TsR {
+		subnet := FirstLastAddressToIPNet(ts.StartAddress, ts.EndAddress)
+		if ts.Type == protocol.TS_IPV4_ADDR_RANGE && v4Pool != nil && len(req.Get(protocol.INTERNAL_IP4_SUBNET)) > 0 {
+			reply.Add(protocol.IPNetAttribute(protocol.INTERNAL_IP4_SUBNET, subnet))
+		} else if ts.Type == protocol.TS_IPV6_ADDR_RANGE && v6Pool != nil && len(req.Get(protocol.INTERNAL_IP6_SUBNET)) > 0 {
+			reply.Add(protocol.IPNetAttribute(protocol.INTERNAL_IP6_SUBNET, subnet))
+		}
+	}
+	if len(req.Get(protocol.SUPPORTED_ATTRIBUTES)) > 0 {
+		reply.Add(protocol.SupportedAttributesAttribute(
+			protocol.INTERNAL_IP4_ADDRESS, protocol.INTERNAL_IP4_NETMASK,
+			protocol.INTERNAL_IP4_DNS, protocol.INTERNAL_IP4_SUBNET,
+			protocol.INTERNAL_IP6_ADDRESS, protocol.INTERNAL_IP6_DNS,
+			protocol.INTERNAL_IP6_SUBNET))
+	}
+	return
+}
+
+// leaseAddress gets an address from the first pool of given family that has one
+func (sess *Session) leaseAddress(identity string, isV6 bool) (ip net.IP, pool *AddressPool, err error) {
+	err = errors.New("no address pool configured")
+	for _, pool = range sess.cfg.AddressPools {
+		if pool.IsV6() != isV6 {
+			continue
+		}
+		if ip, err = pool.Lease(identity); err == nil {
+			// MUTATION
+			sess.peerIdentity = identity
+			sess.leases = append(sess.leases, pool)
+			return
+		}
+	}
+	return nil, nil, err
+}
+
+// releaseAddresses returns leased addresses to their pools
+func (sess *Session) releaseAddresses() {
+	for _, pool := range sess.leases {
+		pool.Release(sess.peerIdentity)
+	}
+	// MUTATION
+	sess.leases = nil
+}
+
+func hostSelector(ip net.IP) protocol.Selectors {
+	ip = check4(ip)
+	slen := len(ip) * 8
+	sel, _ := selectorFromAddress(&net.IPNet{IP: ip, Mask: net.CIDRMask(slen, slen)})
+	return sel
+}
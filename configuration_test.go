@@ -0,0 +1,138 @@
+package ike
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/msgboxio/ike/platform"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+func TestConfigurationApplyReply(t *testing.T) {
+	cfg := testConfig()
+	cfg.RequestAddress = true
+	sess := &Session{
+		cfg:           *cfg,
+		isInitiator:   true,
+		configuration: configurationRequest(),
+		Logger:        log.NewNopLogger(),
+	}
+	local := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 4500}
+	remote := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 4500}
+	if err := sess.setAddresses(local, remote); err != nil {
+		t.Fatal(err)
+	}
+	if p := sess.cfg.Policy(); p.IniNet.String() != "0.0.0.0/0" {
+		t.Fatal("initiator should ask for everything", p.IniNet)
+	}
+	// no reply
+	if err := handleConfigurationForSession(sess, nil, &authParams{}); err == nil {
+		t.Error("missing CFG_REPLY accepted")
+	}
+	_, subnet, _ := net.ParseCIDR("192.0.2.0/24")
+	tsI := hostSelector(net.ParseIP("10.10.0.1"))
+	tsR, _ := selectorFromAddress(subnet)
+	params := &authParams{
+		tsI: tsI,
+		tsR: tsR,
+		configuration: &protocol.ConfigurationPayload{
+			PayloadHeader:     &protocol.PayloadHeader{},
+			ConfigurationType: protocol.CFG_REPLY,
+			ConfigurationAttributes: []*protocol.ConfigurationAttribute{
+				protocol.IPAttribute(protocol.INTERNAL_IP4_ADDRESS, net.ParseIP("10.10.0.1")),
+				protocol.IPAttribute(protocol.INTERNAL_IP4_DNS, net.ParseIP("192.0.2.53")),
+			},
+		},
+	}
+	if err := handleConfigurationForSession(sess, nil, params); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.cfg.CheckSelectors(params.tsI, params.tsR, false); err != nil {
+		t.Error(err)
+	}
+	cc := sess.clientConfig
+	if cc == nil || len(cc.Addresses) != 1 || cc.Addresses[0].String() != "10.10.0.1/32" {
+		t.Fatal("address", cc)
+	}
+	if len(cc.DNS) != 1 || !cc.DNS[0].Equal(net.ParseIP("192.0.2.53")) {
+		t.Error("dns", cc.DNS)
+	}
+	// routes to narrowed selectors since there were no subnets
+	if len(cc.Subnets) != 1 || cc.Subnets[0].String() != "192.0.2.0/24" {
+		t.Error("subnets", cc.Subnets)
+	}
+	if !cc.Gateway.Equal(remote.IP) {
+		t.Error("gateway", cc.Gateway)
+	}
+	// only installed config is removed
+	var installErr error
+	removed := 0
+	sess.Cb = SessionCallback{
+		InstallClientConfig: func(*Session, *platform.ClientConfig) error { return installErr },
+		RemoveClientConfig: func(*Session, *platform.ClientConfig) error {
+			removed++
+			return nil
+		},
+	}
+	sess.removeClientConfig()
+	installErr = errors.New("no tun device")
+	if err := sess.installClientConfig(); err == nil {
+		t.Fatal("install error was lost")
+	}
+	sess.removeClientConfig()
+	if removed != 0 {
+		t.Fatal("removed config that was not installed")
+	}
+	installErr = nil
+	if err := sess.installClientConfig(); err != nil {
+		t.Fatal(err)
+	}
+	sess.removeClientConfig()
+	sess.removeClientConfig()
+	if removed != 1 {
+		t.Errorf("removed %d times", removed)
+	}
+}
+
+func TestConfigurationInformational(t *testing.T) {
+	ini, res := establishedTestSessions(t, nil)
+	res.configuration = &protocol.ConfigurationPayload{
+		PayloadHeader:     &protocol.PayloadHeader{},
+		ConfigurationType: protocol.CFG_REPLY,
+		ConfigurationAttributes: []*protocol.ConfigurationAttribute{
+			protocol.IPAttribute(protocol.INTERNAL_IP4_ADDRESS, net.ParseIP("10.10.0.1")),
+		},
+	}
+	go serve(res)
+	exchange := func(cp *protocol.ConfigurationPayload) *protocol.ConfigurationPayload {
+		msg, err := ini.SendMsgGetReply(func() (*OutgoingMessage, error) {
+			return ini.InformationalMsg(ConfigurationFromSession(ini, cp, false))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, ok := msg.Payloads.Get(protocol.PayloadTypeCP).(*protocol.ConfigurationPayload)
+		if !ok {
+			t.Fatal("no CP in reply")
+		}
+		return reply
+	}
+	// gateway repeats the assignment
+	reply := exchange(configurationRequest())
+	if ips := reply.IPs(protocol.INTERNAL_IP4_ADDRESS); reply.ConfigurationType != protocol.CFG_REPLY ||
+		len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.10.0.1")) {
+		t.Error("CFG_REPLY", reply.ConfigurationType, ips)
+	}
+	// and changes nothing
+	reply = exchange(&protocol.ConfigurationPayload{
+		ConfigurationType: protocol.CFG_SET,
+		ConfigurationAttributes: []*protocol.ConfigurationAttribute{
+			protocol.IPAttribute(protocol.INTERNAL_IP4_DNS, net.ParseIP("192.0.2.53")),
+		},
+	})
+	if reply.ConfigurationType != protocol.CFG_ACK || len(reply.ConfigurationAttributes) != 0 {
+		t.Error("CFG_ACK", reply.ConfigurationType, len(reply.ConfigurationAttributes))
+	}
+}
@@ -1,6 +1,7 @@
 package ike
 
 import (
+	"bytes"
 	"io"
 	"net"
 	"os"
@@ -26,6 +27,7 @@ type Conn interface {
 // check if types are implemented
 var _ Conn = (*pconnV4)(nil)
 var _ Conn = (*pconnV6)(nil)
+var _ Conn = (*natTConn)(nil)
 
 type pconnV4 ipv4.PacketConn
 
@@ -171,31 +173,68 @@ func (p *pconnV4) WritePacket(reply []byte, remoteAddr net.Addr) error {
 	return nil
 }
 
+// NatTPort is used once NAT is detected, rfc3948
+const NatTPort = 4500
+
+// natTConn adds the non-ESP marker to IKE messages on port 4500
+// and removes it from the received ones
+type natTConn struct {
+	Conn
+}
+
+var nonEspMarker = []byte{0, 0, 0, 0}
+
+// ListenNatT listens for IKE messages sent to NAT-T port
+func ListenNatT(network, address string, logger log.Logger) (Conn, error) {
+	conn, err := Listen(network, address, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &natTConn{conn}, nil
+}
+
+func (c *natTConn) ReadPacket() (b []byte, remoteAddr, localAddr net.Addr, err error) {
+	for {
+		b, remoteAddr, localAddr, err = c.Conn.ReadPacket()
+		if err != nil || len(b) == 1 {
+			// keepalives dont have the marker
+			return
+		}
+		if len(b) > len(nonEspMarker) && bytes.Equal(b[:len(nonEspMarker)], nonEspMarker) {
+			b = b[len(nonEspMarker):]
+			return
+		}
+		// ESP packets not decapsulated by the kernel are dropped
+	}
+}
+
+func (c *natTConn) WritePacket(reply []byte, remoteAddr net.Addr) error {
+	return c.Conn.WritePacket(append(append([]byte{}, nonEspMarker...), reply...), remoteAddr)
+}
+
+// writeKeepalive keeps the NAT mapping alive, rfc3948
+func (c *natTConn) writeKeepalive(remoteAddr net.Addr) error {
+	return c.Conn.WritePacket([]byte{0xff}, remoteAddr)
+}
+
 // ReadMessage reads an IKE message from connection
 // Connection errors are returned, protocol errors are simply logged
-// TODO - defrag logic seems wrong; revisit
+// Each datagram carries a whole IKE message or an rfc7383 fragment,
+// fragments are reassembled by the session once they are authenticated
 func ReadMessage(conn Conn, log log.Logger) (*Message, error) {
-	var buf []byte
 	for {
 		b, remoteAddr, localAddr, err := conn.ReadPacket()
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
 		log.Log("RX", len(b), "FROM", remoteAddr)
-		if buf != nil {
-			b = append(buf, b...)
-			buf = nil
-		}
 		if len(b) == 1 && (b[0] == 0xff) {
 			// log.Log("keepalive")
 			continue
 		}
 		msg, err := DecodeMessage(b, log)
-		if err == io.ErrShortBuffer {
-			buf = b
-			continue
-		}
 		if err != nil {
+			// truncated messages are dropped too
 			log.Log("ERROR", err)
 			continue
 		}
@@ -58,12 +58,13 @@ func testCfg() *Config {
 
 var zeroAddr = &net.UDPAddr{IP: net.IPv4zero, Port: 0}
 
+// datagrams are never joined; a truncated one is dropped
 func TestReadFragment(t *testing.T) {
 	conn := testConn()
 	sess, _ := NewInitiator(testCfg(), zeroAddr, zeroAddr, conn, &SessionCallback{}, logger)
 	msg, _ := InitFromSession(sess).Encode(nil, false, sess.Logger)
 	conn.WritePacket(msg[:40], nil)
-	conn.WritePacket(msg[40:], nil)
+	conn.WritePacket(msg, nil)
 	m2, _ := ReadMessage(conn, sess.Logger)
 	msg2, _ := m2.Encode(sess.tkm, false, sess.Logger)
 	if !bytes.Equal(msg, msg2) {
@@ -72,3 +73,23 @@ func TestReadFragment(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// IKE messages on NAT-T port carry the non-ESP marker, keepalives dont
+func TestNatTConn(t *testing.T) {
+	conn := testConn()
+	natConn := &natTConn{conn}
+	natConn.WritePacket([]byte{1, 2, 3, 4, 5}, nil)
+	if b := <-conn.ch; !bytes.Equal(b, []byte{0, 0, 0, 0, 1, 2, 3, 4, 5}) {
+		t.Fatalf("sent %x", b)
+	}
+	// ESP is dropped
+	conn.ch <- []byte{1, 2, 3, 4, 5}
+	natConn.writeKeepalive(nil)
+	if b, _, _, _ := natConn.ReadPacket(); !bytes.Equal(b, []byte{0xff}) {
+		t.Fatalf("read %x", b)
+	}
+	natConn.WritePacket([]byte{1, 2, 3, 4, 5}, nil)
+	if b, _, _, _ := natConn.ReadPacket(); !bytes.Equal(b, []byte{1, 2, 3, 4, 5}) {
+		t.Fatalf("read %x", b)
+	}
+}
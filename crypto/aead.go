@@ -74,8 +74,6 @@ func (cs *aeadCipher) Overhead(clear []byte) int {
 	return padlen + cs.ivLen + cs.icvLen
 }
 
-const aadLen = protocol.IKE_HEADER_LEN + protocol.PAYLOAD_HEADER_LENGTH
-
 func (cs *aeadCipher) VerifyDecrypt(ike, skA, skE []byte) (dec []byte, err error) {
 	// Encryption key has salt appended to it
 	key := skE[:cs.keyLen]
@@ -84,6 +82,7 @@ func (cs *aeadCipher) VerifyDecrypt(ike, skA, skE []byte) (dec []byte, err error
 	if err != nil {
 		return
 	}
+	aadLen := headerLen(ike)
 	aad := ike[:aadLen]
 	iv := ike[aadLen : aadLen+cs.ivLen]
 	ct := ike[aadLen+cs.ivLen:]
@@ -116,6 +115,7 @@ func (cs *aeadCipher) EncryptMac(ike, skA, skE []byte) (encr []byte, err error)
 	if err != nil {
 		return
 	}
+	aadLen := headerLen(ike)
 	aad := ike[:aadLen]                            // additional data
 	iv, err := rand.Prime(rand.Reader, cs.ivLen*8) // bits
 	if err != nil {
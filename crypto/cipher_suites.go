@@ -22,6 +22,15 @@ type Cipher interface {
 var _ Cipher = (*simpleCipher)(nil)
 var _ Cipher = (*aeadCipher)(nil)
 
+// headerLen returns length of ike & SK or SKF payload headers, which are sent in clear
+func headerLen(ike []byte) int {
+	hlen := protocol.IKE_HEADER_LEN + protocol.PAYLOAD_HEADER_LENGTH
+	if protocol.PayloadType(ike[16]) == protocol.PayloadTypeSKF {
+		hlen += protocol.FRAGMENT_HEADER_LENGTH
+	}
+	return hlen
+}
+
 type CipherSuite struct {
 	Cipher  // aead or nonAead
 	Prf     *Prf
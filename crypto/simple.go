@@ -41,13 +41,12 @@ func (cs *simpleCipher) VerifyDecrypt(ike, skA, skE []byte) (dec []byte, err err
 	if err = verifyMac(skA, ike, cs.macLen, cs.macFunc); err != nil {
 		return
 	}
-	b := ike[protocol.IKE_HEADER_LEN:]
-	dec, err = decrypt(b[protocol.PAYLOAD_HEADER_LENGTH:len(b)-cs.macLen], skE, cs.ivLen, cs.cipherFunc)
+	dec, err = decrypt(ike[headerLen(ike):len(ike)-cs.macLen], skE, cs.ivLen, cs.cipherFunc)
 	return
 }
 
 func (cs *simpleCipher) EncryptMac(ike, skA, skE []byte) (b []byte, err error) {
-	hlen := protocol.IKE_HEADER_LEN + protocol.PAYLOAD_HEADER_LENGTH
+	hlen := headerLen(ike)
 	headers := ike[:hlen]
 	payload := ike[hlen:]
 	// encrypt-then-MAC
@@ -0,0 +1,74 @@
+package ike
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DpdAction is taken by Cmd when peer is found dead
+type DpdAction int
+
+const (
+	// DpdClear removes the IKE SA, Child SAs & policies
+	DpdClear DpdAction = iota
+	// DpdHold keeps the policies so traffic is not sent in the clear,
+	// till the restarted initiator replaces them
+	DpdHold
+	// DpdRestart starts the initiator again right away
+	DpdRestart
+)
+
+func (a DpdAction) String() string {
+	switch a {
+	case DpdHold:
+		return "HOLD"
+	case DpdRestart:
+		return "RESTART"
+	}
+	return "CLEAR"
+}
+
+const (
+	DefaultDpdTimeout = 2 * time.Second
+	DefaultDpdRetries = 4
+)
+
+// runDpd checks if peer is alive with an empty INFORMATIONAL
+// retransmits with backoff; peer is dead when retries run out
+func runDpd(sess *Session) error {
+	sess.Logger.Log("DPD", "check")
+	emptyFn := func() (*OutgoingMessage, error) {
+		return sess.InformationalMsg(EmptyFromSession(sess, false))
+	}
+	timeout := sess.cfg.DpdTimeout
+	if timeout == 0 {
+		timeout = DefaultDpdTimeout
+	}
+	_, err := sess.sendMsgGetReply(emptyFn, func(msg *Message) error {
+		return onRequest(sess, msg)
+	}, &backoff{timeout: timeout, retries: sess.cfg.DpdRetries})
+	if IsTimeout(err) {
+		sess.Logger.Log("DPD", "dead", "ACTION", sess.cfg.DpdAction)
+		return errors.WithStack(errPeerDead)
+	}
+	return err
+}
+
+// holdPolicies checks if policies are kept after the session ends
+func (sess *Session) holdPolicies(err error) bool {
+	return errors.Cause(err) == errPeerDead && sess.cfg.DpdAction == DpdHold
+}
+
+// releasePolicies removes policies kept after peer was found dead
+func (sess *Session) releasePolicies() {
+	if !sess.policiesHeld {
+		return
+	}
+	sess.Logger.Log("DPD", "release")
+	// MUTATION
+	sess.policiesHeld = false
+	for len(sess.children) > 0 {
+		sess.dropChildSa(sess.children[0])
+	}
+}
@@ -0,0 +1,79 @@
+package ike
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func dpdTestSessions(t *testing.T) (ini, res *Session) {
+	ini, res = establishedTestSessions(t, nil)
+	for _, sess := range []*Session{ini, res} {
+		sess.cfg.DpdDelay = 50 * time.Millisecond
+		sess.cfg.DpdTimeout = 20 * time.Millisecond
+		sess.cfg.DpdRetries = 2
+		sess.children[0].startTimers()
+	}
+	return
+}
+
+func TestDpdAlivePeer(t *testing.T) {
+	ini, res := dpdTestSessions(t)
+	res.cfg.DpdDelay = 0
+	cerr := make(chan error, 2)
+	go func() { cerr <- monitorSa(ini) }()
+	go func() { cerr <- monitorSa(res) }()
+	select {
+	case err := <-cerr:
+		t.Fatal(err)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestDpdBusyDeadPeer(t *testing.T) {
+	ini, _ := dpdTestSessions(t)
+	// Child SA timer fires more often than DPD is due
+	ini.cfg.Lifetime = 10 * time.Millisecond
+	cerr := make(chan error, 1)
+	go func() { cerr <- monitorSa(ini) }()
+	select {
+	case err := <-cerr:
+		if errors.Cause(err) != errPeerDead {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer is alive")
+	}
+}
+
+func TestDpdDeadPeer(t *testing.T) {
+	ini, _ := dpdTestSessions(t)
+	rec := &saRecorder{}
+	ini.Cb = rec.callback()
+	ini.cfg.DpdAction = DpdHold
+	cerr := make(chan error, 1)
+	go func() { cerr <- monitorSa(ini) }()
+	var err error
+	select {
+	case err = <-cerr:
+		if errors.Cause(err) != errPeerDead {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer is alive")
+	}
+	// policies are kept till released
+	cxt, cancel := context.WithCancel(context.Background())
+	ini.cxt = cxt
+	cancel()
+	ini.Shutdown(err)
+	if _, removed := rec.get(); len(removed) != 1 || rec.getPolicies() != 1 {
+		t.Fatalf("removed %d SAs, %d policies left", len(removed), rec.getPolicies())
+	}
+	ini.releasePolicies()
+	if rec.getPolicies() != 0 || len(ini.children) != 0 {
+		t.Error("policies were not released")
+	}
+}
@@ -0,0 +1,343 @@
+package ike
+
+import (
+	"bufio"
+	stderror "errors"
+	"os"
+	"strings"
+
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// rfc7296 2.16 EAP
+
+var errEapFailed = stderror.New("EAP Failure")
+
+// EapUsers has the passwords of EAP users
+type EapUsers interface {
+	Password(user string) ([]byte, bool)
+}
+
+// LocalUsers is a local user database, of passwords by user name
+type LocalUsers map[string]string
+
+func (lu LocalUsers) Password(user string) ([]byte, bool) {
+	pass, ok := lu[user]
+	return []byte(pass), ok
+}
+
+// LoadLocalUsers reads user:password lines from file
+// empty lines & ones starting with # are skipped
+func LoadLocalUsers(file string) (LocalUsers, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	users := LocalUsers{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return nil, errors.Errorf("%s: invalid line %q", file, line)
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	return users, errors.WithStack(scanner.Err())
+}
+
+// eapOnlySafe are methods that can authenticate gateway without AUTH of its own, rfc5998 4
+// they authenticate both sides, derive the MSK, and resist dictionary attacks
+var eapOnlySafe = map[protocol.EapType]bool{
+	protocol.EAP_TYPE_TLS: true,
+}
+
+// eapKeyless are methods that derive no MSK; AUTH after them is keyed with SK_p
+var eapKeyless = map[protocol.EapType]bool{
+	protocol.EAP_TYPE_MD5_CHALLENGE: true,
+	protocol.EAP_TYPE_GTC:           true,
+}
+
+// EapMethod is the server side of an EAP method, for one conversation
+type EapMethod interface {
+	Type() protocol.EapType
+	// Start returns Type-Data of the first request to user, sent with identifier id
+	Start(user string, id uint8) ([]byte, error)
+	// Respond checks peer's response
+	// returns Type-Data of the next request, nil once peer is authenticated
+	Respond(resp *protocol.EapPayload) ([]byte, error)
+	// Msk is the key method derived, nil if none
+	Msk() []byte
+}
+
+// NewEapMethod creates a method for each conversation
+type NewEapMethod func(users EapUsers) EapMethod
+
+// eapResult is the outcome of a conversation
+type eapResult struct {
+	msk     []byte
+	success bool
+}
+
+// eapServer asks for peer's identity, then runs the methods peer accepts
+type eapServer struct {
+	eapResult
+	methods []EapMethod // in order of preference
+	method  EapMethod
+	started bool // peer answered method's request, it can not NAK it anymore
+	id      uint8
+	user    string
+	// EAP-only; methods must be safe
+	safeOnly bool
+	// relays to RADIUS, with State of its last reply
+	radius     *RadiusClient
+	state      []byte
+	class      []byte
+	relayedTyp protocol.EapType
+}
+
+func newEapServer(identity *EapIdentity) *eapServer {
+	s := &eapServer{radius: identity.Radius}
+	for _, newMethod := range identity.Methods {
+		s.methods = append(s.methods, newMethod(identity.Users))
+	}
+	return s
+}
+
+// start asks for peer's identity
+func (s *eapServer) start() *protocol.EapPayload {
+	return s.request(protocol.EAP_TYPE_IDENTITY, nil)
+}
+
+func (s *eapServer) request(t protocol.EapType, data []byte) *protocol.EapPayload {
+	s.id++
+	return &protocol.EapPayload{
+		PayloadHeader: &protocol.PayloadHeader{},
+		Code:          protocol.EAP_REQUEST,
+		Identifier:    s.id,
+		EapType:       t,
+		Data:          data,
+	}
+}
+
+// failure ends the conversation
+func (s *eapServer) failure() *protocol.EapPayload {
+	return &protocol.EapPayload{
+		PayloadHeader: &protocol.PayloadHeader{},
+		Code:          protocol.EAP_FAILURE,
+		Identifier:    s.id,
+	}
+}
+
+func (s *eapServer) allowed(m EapMethod) bool {
+	return !s.safeOnly || eapOnlySafe[m.Type()]
+}
+
+func (s *eapServer) startMethod(m EapMethod) (*protocol.EapPayload, error) {
+	s.method, s.started = m, false
+	data, err := m.Start(s.user, s.id+1)
+	if err != nil {
+		return nil, err
+	}
+	return s.request(m.Type(), data), nil
+}
+
+// handle returns the next packet for peer's response
+// conversation ends with Success, or Failure if err is returned
+func (s *eapServer) handle(resp *protocol.EapPayload) (*protocol.EapPayload, error) {
+	if resp.Code != protocol.EAP_RESPONSE || resp.Identifier != s.id {
+		return nil, errors.Errorf("EAP: unexpected %d packet %d", resp.Code, resp.Identifier)
+	}
+	if s.radius != nil {
+		return s.relay(resp)
+	}
+	switch {
+	case s.method == nil && resp.EapType == protocol.EAP_TYPE_IDENTITY:
+		s.user = string(resp.Data)
+		for _, m := range s.methods {
+			if s.allowed(m) {
+				return s.startMethod(m)
+			}
+		}
+		return nil, errors.New("EAP: no methods")
+	case s.method != nil && !s.started && resp.EapType == protocol.EAP_TYPE_NAK:
+		// peer asks for one of these
+		for _, t := range resp.Data {
+			for _, m := range s.methods {
+				if m != s.method && m.Type() == protocol.EapType(t) && s.allowed(m) {
+					return s.startMethod(m)
+				}
+			}
+		}
+		return nil, errors.Errorf("EAP: %s accepts none of our methods", s.user)
+	case s.method != nil && resp.EapType == s.method.Type():
+		s.started = true
+		data, err := s.method.Respond(resp)
+		if err != nil {
+			return nil, errors.Wrapf(err, "EAP: %s", s.user)
+		}
+		if data != nil {
+			return s.request(s.method.Type(), data), nil
+		}
+		s.msk, s.success = s.method.Msk(), true
+		return &protocol.EapPayload{
+			PayloadHeader: &protocol.PayloadHeader{},
+			Code:          protocol.EAP_SUCCESS,
+			Identifier:    s.id,
+		}, nil
+	}
+	return nil, errors.Errorf("EAP: unexpected response type %d", resp.EapType)
+}
+
+// methodType is of the method that runs, or ran
+func (s *eapServer) methodType() protocol.EapType {
+	if s.method != nil {
+		return s.method.Type()
+	}
+	return s.relayedTyp
+}
+
+// relay passes peer's response to RADIUS servers, and their reply to peer
+func (s *eapServer) relay(resp *protocol.EapPayload) (*protocol.EapPayload, error) {
+	if s.user == "" && resp.EapType == protocol.EAP_TYPE_IDENTITY {
+		s.user = string(resp.Data)
+	}
+	reply, err := s.radius.relayEap(s.user, resp.Encode(), s.state)
+	if err != nil {
+		return nil, err
+	}
+	switch reply.code {
+	case radiusAccessChallenge:
+		req := &protocol.EapPayload{PayloadHeader: &protocol.PayloadHeader{}}
+		if err = req.Decode(reply.eap); err != nil || req.Code != protocol.EAP_REQUEST {
+			return nil, errors.Errorf("EAP: RADIUS sent no request for %s", s.user)
+		}
+		if req.EapType != protocol.EAP_TYPE_IDENTITY && req.EapType != protocol.EAP_TYPE_NOTIFICATION {
+			if s.safeOnly && !eapOnlySafe[req.EapType] {
+				return nil, errors.Errorf("EAP: RADIUS method %d is not safe", req.EapType)
+			}
+			s.relayedTyp = req.EapType
+		}
+		s.id, s.state = req.Identifier, reply.state
+		return req, nil
+	case radiusAccessAccept:
+		s.msk, s.class, s.success = reply.msk, reply.class, true
+		return &protocol.EapPayload{
+			PayloadHeader: &protocol.PayloadHeader{},
+			Code:          protocol.EAP_SUCCESS,
+			Identifier:    s.id,
+		}, nil
+	}
+	return nil, errors.Errorf("EAP: RADIUS rejected %s", s.user)
+}
+
+// EapFromSession creates IKE_AUTH messages with EAP
+// responder's first one also authenticates it
+func EapFromSession(sess *Session, eap *protocol.EapPayload, withAuth bool) (*Message, error) {
+	authMsg := makeAuth(&authParams{
+		isInitiator: sess.isInitiator,
+		spiI:        sess.IkeSpiI,
+		spiR:        sess.IkeSpiR,
+		authOnly:    true,
+	})
+	if withAuth {
+		if err := addLocalAuth(sess, authMsg); err != nil {
+			return nil, err
+		}
+	}
+	authMsg.Payloads.Add(eap)
+	return authMsg, nil
+}
+
+// EapMsg generates IKE_AUTH with EAP
+func (sess *Session) EapMsg(eap *protocol.EapPayload, withAuth bool) (*OutgoingMessage, error) {
+	auth, err := EapFromSession(sess, eap, withAuth)
+	if err != nil {
+		return nil, err
+	}
+	auth.IkeHeader.MsgID = sess.nextID()
+	return sess.encode(auth)
+}
+
+// runEapServer authenticates initiator with EAP
+// msg is initiator's request without AUTH; responder authenticates itself in the first reply
+// HDR, SK { IDi, [CERTREQ], [IDr], SA, TSi, TSr } -->
+// <-- HDR, SK { IDr, [CERT], AUTH, EAP }
+// HDR, SK { EAP } -->
+// <-- HDR, SK { EAP (Success) }
+// HDR, SK { AUTH } -->
+func runEapServer(sess *Session, msg *Message, eap *EapAuthenticator) (err error) {
+	idP := peerIdPayload(sess, msg)
+	sess.Logger.Log("EAP", "start", "ID", string(idP.Data))
+	// MUTATION
+	eap.server.safeOnly = sess.eapOnly
+	out := eap.server.start()
+	withAuth := sess.authRound == 0
+	for {
+		if err = sess.sendMsg(sess.EapMsg(out, withAuth)); err != nil {
+			return
+		}
+		withAuth = false
+		if out.Code == protocol.EAP_FAILURE {
+			// peer was told already
+			return errors.Wrapf(errEapFailed, "EAP: %s", eap.server.user)
+		}
+		if msg, err = sess.waitForRequest(); err != nil {
+			return
+		}
+		if msg.IkeHeader.Flags.IsResponse() || msg.IkeHeader.ExchangeType != protocol.IKE_AUTH {
+			return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "EAP: unexpected message")
+		}
+		if out.Code == protocol.EAP_SUCCESS {
+			break
+		}
+		resp, ok := msg.Payloads.Get(protocol.PayloadTypeEAP).(*protocol.EapPayload)
+		if !ok {
+			return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "EAP: missing EAP payload")
+		}
+		if out, err = eap.server.handle(resp); err != nil {
+			sess.Logger.Log("EAP", err)
+			out = eap.server.failure()
+		}
+	}
+	sess.Logger.Log("EAP", "success", "USER", eap.server.user)
+	// AUTH is keyed with the MSK
+	authP, ok := msg.Payloads.Get(protocol.PayloadTypeAUTH).(*protocol.AuthPayload)
+	if !ok {
+		return errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, "EAP: missing AUTH")
+	}
+	if err = eap.Verify(sess.initIb, idP, authP.AuthMethod, authP.Data, nil, sess.Logger); err != nil {
+		return errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, err.Error())
+	}
+	// MUTATION
+	sess.eapMsk = eap
+	return
+}
+
+// addMskAuth adds our AUTH after EAP, signed by eap
+// it is for the ID sent before the conversation
+func addMskAuth(sess *Session, authMsg *Message, eap Authenticator) error {
+	initB, idPayloadType, id := sess.initRb, protocol.PayloadTypeIDr, sess.localIdentity()
+	if sess.isInitiator {
+		initB, idPayloadType, id = sess.initIb, protocol.PayloadTypeIDi, sess.localAuth().Identity()
+	}
+	signature, err := eap.Sign(initB, &protocol.IdPayload{
+		IdPayloadType: idPayloadType,
+		IdType:        id.IdType(),
+		Data:          id.Id(),
+	}, sess.Logger)
+	if err != nil {
+		return err
+	}
+	authMsg.Payloads.Add(&protocol.AuthPayload{
+		PayloadHeader: &protocol.PayloadHeader{},
+		AuthMethod:    protocol.AUTH_SHARED_KEY_MESSAGE_INTEGRITY_CODE,
+		Data:          signature,
+	})
+	return nil
+}
@@ -0,0 +1,169 @@
+package ike
+
+import (
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// eapClientMethod is the peer side of an EAP method, for one conversation
+type eapClientMethod interface {
+	Type() protocol.EapType
+	// Respond returns Type-Data of the response to server's request
+	Respond(req *protocol.EapPayload) ([]byte, error)
+	// Done once the method ran; those that can have authenticated server, and derived the MSK
+	Done() bool
+	Msk() []byte
+}
+
+// eapClient answers gateway's requests with the methods credentials allow
+type eapClient struct {
+	eapResult
+	user    string
+	methods []eapClientMethod
+	method  eapClientMethod
+	// EAP-only; gateway is not authenticated yet, only safe methods may run
+	safeOnly bool
+}
+
+func newEapClient(identity *EapClientIdentity) *eapClient {
+	c := &eapClient{user: identity.User}
+	if identity.Tls != nil {
+		c.methods = append(c.methods, newEapTlsClient(identity.Tls))
+	}
+	if identity.Password != "" {
+		c.methods = append(c.methods,
+			&eapMschapv2Client{user: identity.User, password: []byte(identity.Password)},
+			&eapGtcClient{password: []byte(identity.Password)})
+	}
+	return c
+}
+
+func (c *eapClient) response(req *protocol.EapPayload, t protocol.EapType, data []byte) *protocol.EapPayload {
+	return &protocol.EapPayload{
+		PayloadHeader: &protocol.PayloadHeader{},
+		Code:          protocol.EAP_RESPONSE,
+		Identifier:    req.Identifier,
+		EapType:       t,
+		Data:          data,
+	}
+}
+
+// handle returns our response to server's packet, nil after Success
+// Failure, and Success before the method is done, end with err
+func (c *eapClient) handle(req *protocol.EapPayload) (*protocol.EapPayload, error) {
+	switch req.Code {
+	case protocol.EAP_SUCCESS:
+		if c.method == nil || !c.method.Done() {
+			return nil, errors.New("EAP: Success before the method was done")
+		}
+		c.msk, c.success = c.method.Msk(), true
+		return nil, nil
+	case protocol.EAP_FAILURE:
+		return nil, errors.Wrapf(errEapFailed, "EAP: %s", c.user)
+	case protocol.EAP_REQUEST:
+	default:
+		return nil, errors.Errorf("EAP: unexpected %d packet %d", req.Code, req.Identifier)
+	}
+	switch req.EapType {
+	case protocol.EAP_TYPE_IDENTITY:
+		return c.response(req, protocol.EAP_TYPE_IDENTITY, []byte(c.user)), nil
+	case protocol.EAP_TYPE_NOTIFICATION:
+		return c.response(req, protocol.EAP_TYPE_NOTIFICATION, nil), nil
+	}
+	for _, m := range c.methods {
+		if m.Type() != req.EapType || (c.safeOnly && !eapOnlySafe[m.Type()]) {
+			continue
+		}
+		if c.method != nil && c.method != m {
+			return nil, errors.Errorf("EAP: server switched to method %d", req.EapType)
+		}
+		c.method = m
+		data, err := m.Respond(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "EAP: %s", c.user)
+		}
+		return c.response(req, m.Type(), data), nil
+	}
+	if c.method != nil {
+		return nil, errors.Errorf("EAP: server switched to method %d", req.EapType)
+	}
+	// ask for the methods we have credentials for
+	var nak []byte
+	for _, m := range c.methods {
+		if !c.safeOnly || eapOnlySafe[m.Type()] {
+			nak = append(nak, byte(m.Type()))
+		}
+	}
+	return c.response(req, protocol.EAP_TYPE_NAK, nak), nil
+}
+
+// runEapClient authenticates initiator with EAP, once gateway authenticated itself
+// msg is gateway's reply with the first request; the reply to our AUTH is returned
+// <-- HDR, SK { IDr, [CERT], AUTH, EAP }
+// HDR, SK { EAP } -->
+// <-- HDR, SK { EAP (Success) }
+// HDR, SK { AUTH } -->
+// <-- HDR, SK { AUTH, SA, TSi, TSr }
+func runEapClient(sess *Session, msg *Message, eap *EapAuthenticator) (*Message, error) {
+	sess.Logger.Log("EAP", "start", "ID", eap.client.user)
+	// MUTATION
+	eap.client.safeOnly = sess.eapOnly
+	for {
+		req, ok := msg.Payloads.Get(protocol.PayloadTypeEAP).(*protocol.EapPayload)
+		if !ok {
+			return nil, errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, "EAP: missing EAP payload")
+		}
+		resp, err := eap.client.handle(req)
+		if err != nil {
+			return nil, errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, err.Error())
+		}
+		if resp == nil {
+			break
+		}
+		if msg, err = sess.SendMsgGetReply(func() (*OutgoingMessage, error) {
+			return sess.EapMsg(resp, false)
+		}); err != nil {
+			return nil, err
+		}
+		if err = checkAuthResponseForSession(sess, msg); err != nil {
+			return nil, err
+		}
+	}
+	sess.Logger.Log("EAP", "success", "USER", eap.client.user)
+	msg, err := sess.SendMsgGetReply(sess.EapAuthMsg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, checkAuthResponseForSession(sess, msg)
+}
+
+// EapAuthMsg generates initiator's IKE_AUTH after EAP
+// its AUTH is keyed with the MSK
+func (sess *Session) EapAuthMsg() (*OutgoingMessage, error) {
+	auth := makeAuth(&authParams{
+		isInitiator: sess.isInitiator,
+		spiI:        sess.IkeSpiI,
+		spiR:        sess.IkeSpiR,
+		authOnly:    true,
+	})
+	if err := addMskAuth(sess, auth, sess.localAuth()); err != nil {
+		return nil, err
+	}
+	auth.IkeHeader.MsgID = sess.nextID()
+	return sess.encode(auth)
+}
+
+// runEapClientRound runs EAP when our credential for the current round needs it
+// gateway authenticates itself before the first round's conversation
+func runEapClientRound(sess *Session, msg *Message) (*Message, error) {
+	eap := eapAuthenticator(sess.localAuth())
+	if eap == nil || eap.client == nil {
+		return msg, nil
+	}
+	if sess.authRound == 0 {
+		if err := handlePeerAuth(sess, msg); err != nil {
+			return nil, err
+		}
+	}
+	return runEapClient(sess, msg, eap)
+}
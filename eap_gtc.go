@@ -0,0 +1,69 @@
+package ike
+
+import (
+	"crypto/hmac"
+
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// EAP-GTC, rfc3748 5.6; peer sends its password, protected by the IKE SA
+// it checks user & password credentials, like XAuth did for IKEv1
+// it derives no MSK, nor authenticates the server
+
+// EapPasswordChecker checks passwords it does not reveal, like RADIUS servers
+type EapPasswordChecker interface {
+	CheckPassword(user string, password []byte) error
+}
+
+type eapGtc struct {
+	users EapUsers
+	user  string
+}
+
+// NewEapGtc creates EAP-GTC method
+// users that are an EapPasswordChecker check the passwords themselves
+func NewEapGtc(users EapUsers) EapMethod {
+	return &eapGtc{users: users}
+}
+
+func (m *eapGtc) Type() protocol.EapType { return protocol.EAP_TYPE_GTC }
+func (m *eapGtc) Msk() []byte            { return nil }
+
+// Start prompts for the password
+func (m *eapGtc) Start(user string, id uint8) ([]byte, error) {
+	m.user = user
+	return []byte("Password: "), nil
+}
+
+func (m *eapGtc) Respond(resp *protocol.EapPayload) ([]byte, error) {
+	if checker, ok := m.users.(EapPasswordChecker); ok {
+		if err := checker.CheckPassword(m.user, resp.Data); err != nil {
+			return nil, errors.Wrapf(err, "GTC: %s", m.user)
+		}
+		return nil, nil
+	}
+	password, ok := m.users.Password(m.user)
+	if !ok {
+		return nil, errors.Errorf("GTC: unknown user %s", m.user)
+	}
+	if !hmac.Equal(password, resp.Data) {
+		return nil, errors.Errorf("GTC: wrong password for %s", m.user)
+	}
+	return nil, nil
+}
+
+// eapGtcClient answers the prompt with our password
+type eapGtcClient struct {
+	password []byte
+	done     bool
+}
+
+func (m *eapGtcClient) Type() protocol.EapType { return protocol.EAP_TYPE_GTC }
+func (m *eapGtcClient) Done() bool             { return m.done }
+func (m *eapGtcClient) Msk() []byte            { return nil }
+
+func (m *eapGtcClient) Respond(req *protocol.EapPayload) ([]byte, error) {
+	m.done = true
+	return m.password, nil
+}
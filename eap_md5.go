@@ -0,0 +1,63 @@
+package ike
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// EAP MD5-Challenge, rfc3748 5.4
+// it derives no MSK, nor authenticates the server
+
+type eapMd5 struct {
+	users     EapUsers
+	user      string
+	id        uint8
+	challenge []byte
+}
+
+// NewEapMd5 creates EAP MD5-Challenge method
+func NewEapMd5(users EapUsers) EapMethod {
+	return &eapMd5{users: users}
+}
+
+func (m *eapMd5) Type() protocol.EapType { return protocol.EAP_TYPE_MD5_CHALLENGE }
+func (m *eapMd5) Msk() []byte            { return nil }
+
+// Start sends the challenge
+// Value-Size | Value | Name
+func (m *eapMd5) Start(user string, id uint8) ([]byte, error) {
+	m.user, m.id = user, id
+	m.challenge = make([]byte, 16)
+	if _, err := rand.Read(m.challenge); err != nil {
+		return nil, err
+	}
+	return append([]byte{16}, m.challenge...), nil
+}
+
+// Respond checks Value is md5(Identifier | password | challenge)
+func (m *eapMd5) Respond(resp *protocol.EapPayload) ([]byte, error) {
+	data := resp.Data
+	if len(data) < 1+md5.Size || data[0] != md5.Size {
+		return nil, errors.New("MD5: invalid Response")
+	}
+	password, ok := m.users.Password(m.user)
+	if !ok {
+		return nil, errors.Errorf("MD5: unknown user %s", m.user)
+	}
+	if !hmac.Equal(md5Response(m.id, password, m.challenge), data[1:1+md5.Size]) {
+		return nil, errors.Errorf("MD5: wrong password for %s", m.user)
+	}
+	return nil, nil
+}
+
+func md5Response(id uint8, password, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{id})
+	h.Write(password)
+	h.Write(challenge)
+	return h.Sum(nil)
+}
@@ -0,0 +1,246 @@
+package ike
+
+import (
+	"bytes"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/md4"
+)
+
+// EAP-MSCHAPv2, draft-kamath-pppext-eap-mschapv2, rfc2759 & rfc3079
+
+const (
+	mschapChallenge = 1
+	mschapResponse  = 2
+	mschapSuccess   = 3
+	mschapFailure   = 4
+)
+
+var (
+	mschapMagic1 = []byte("Magic server to client signing constant")
+	mschapMagic2 = []byte("Pad to make it do more than one iteration")
+	// rfc3079 key derivation
+	mppeMasterMagic = []byte("This is the MPPE Master Key")
+	mppeSendMagic   = []byte("On the client side, this is the send key; on the server side, it is the receive key.")
+	mppeRecvMagic   = []byte("On the client side, this is the receive key; on the server side, it is the send key.")
+	mppeShsPad1     = make([]byte, 40)
+	mppeShsPad2     = bytes.Repeat([]byte{0xf2}, 40)
+)
+
+// mschapPacket is OpCode | MS-CHAPv2-ID | MS-Length | data
+func mschapPacket(opCode, id uint8, data []byte) []byte {
+	b := []byte{opCode, id, 0, 0}
+	b = append(b, data...)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
+}
+
+func ntPasswordHash(password []byte) []byte {
+	h := md4.New()
+	for _, c := range utf16.Encode([]rune(string(password))) {
+		h.Write([]byte{byte(c), byte(c >> 8)})
+	}
+	return h.Sum(nil)
+}
+
+// mschapUser is user name without domain
+func mschapUser(name string) string {
+	if i := strings.LastIndex(name, `\`); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+func challengeHash(peerChallenge, authChallenge []byte, user string) []byte {
+	user = mschapUser(user)
+	h := sha1.New()
+	h.Write(peerChallenge)
+	h.Write(authChallenge)
+	h.Write([]byte(user))
+	return h.Sum(nil)[:8]
+}
+
+// desKey spreads 7 bytes over 8, leaving room for parity bits
+func desKey(k []byte) []byte {
+	return []byte{
+		k[0],
+		k[0]<<7 | k[1]>>1,
+		k[1]<<6 | k[2]>>2,
+		k[2]<<5 | k[3]>>3,
+		k[3]<<4 | k[4]>>4,
+		k[4]<<3 | k[5]>>5,
+		k[5]<<2 | k[6]>>6,
+		k[6] << 1,
+	}
+}
+
+// challengeResponse encrypts challenge with each 7 bytes of the zero padded hash
+func challengeResponse(challenge, passwordHash []byte) []byte {
+	z := append(append([]byte{}, passwordHash...), make([]byte, 5)...)
+	resp := make([]byte, 24)
+	for i := 0; i < 3; i++ {
+		block, _ := des.NewCipher(desKey(z[7*i : 7*i+7]))
+		block.Encrypt(resp[8*i:], challenge)
+	}
+	return resp
+}
+
+func generateNtResponse(authChallenge, peerChallenge []byte, user string, password []byte) []byte {
+	return challengeResponse(challengeHash(peerChallenge, authChallenge, user), ntPasswordHash(password))
+}
+
+// authenticatorResponse proves to peer that we know its password
+func authenticatorResponse(password, ntResponse, peerChallenge, authChallenge []byte, user string) string {
+	hashHash := md4.New()
+	hashHash.Write(ntPasswordHash(password))
+	h := sha1.New()
+	h.Write(hashHash.Sum(nil))
+	h.Write(ntResponse)
+	h.Write(mschapMagic1)
+	digest := h.Sum(nil)
+	h = sha1.New()
+	h.Write(digest)
+	h.Write(challengeHash(peerChallenge, authChallenge, user))
+	h.Write(mschapMagic2)
+	return fmt.Sprintf("S=%X", h.Sum(nil))
+}
+
+// mschapv2Msk is MasterReceiveKey | MasterSendKey of the server
+func mschapv2Msk(password, ntResponse []byte) []byte {
+	hashHash := md4.New()
+	hashHash.Write(ntPasswordHash(password))
+	h := sha1.New()
+	h.Write(hashHash.Sum(nil))
+	h.Write(ntResponse)
+	h.Write(mppeMasterMagic)
+	masterKey := h.Sum(nil)[:16]
+	startKey := func(magic []byte) []byte {
+		h := sha1.New()
+		h.Write(masterKey)
+		h.Write(mppeShsPad1)
+		h.Write(magic)
+		h.Write(mppeShsPad2)
+		return h.Sum(nil)[:16]
+	}
+	return append(startKey(mppeSendMagic), startKey(mppeRecvMagic)...)
+}
+
+// eapMschapv2 authenticates users from EapUsers with EAP-MSCHAPv2
+// peer that fails gets EAP Failure, without MSCHAPv2 Failure
+type eapMschapv2 struct {
+	users     EapUsers
+	user      string
+	id        uint8
+	challenge []byte
+	success   bool // Success Request was sent
+	msk       []byte
+}
+
+// NewEapMschapv2 creates EAP-MSCHAPv2 method; it derives the MSK
+func NewEapMschapv2(users EapUsers) EapMethod {
+	return &eapMschapv2{users: users}
+}
+
+func (m *eapMschapv2) Type() protocol.EapType { return protocol.EAP_TYPE_MSCHAPV2 }
+func (m *eapMschapv2) Msk() []byte            { return m.msk }
+
+// Start sends the Challenge
+// Value-Size | Challenge | Name
+func (m *eapMschapv2) Start(user string, id uint8) ([]byte, error) {
+	m.user, m.id = mschapUser(user), id
+	m.challenge = make([]byte, 16)
+	if _, err := rand.Read(m.challenge); err != nil {
+		return nil, err
+	}
+	data := append([]byte{16}, m.challenge...)
+	return mschapPacket(mschapChallenge, m.id, append(data, "ike"...)), nil
+}
+
+// Respond checks peer's Response, then waits for it to acknowledge our Success
+// Value-Size | Peer-Challenge | Reserved | NT-Response | Flags | Name
+func (m *eapMschapv2) Respond(resp *protocol.EapPayload) ([]byte, error) {
+	data := resp.Data
+	if len(data) < 1 {
+		return nil, errors.New("MSCHAPv2: empty packet")
+	}
+	if m.success {
+		if data[0] != mschapSuccess {
+			return nil, errors.Errorf("MSCHAPv2: unexpected op code %d", data[0])
+		}
+		return nil, nil
+	}
+	if data[0] != mschapResponse || len(data) < 4+1+49 || data[4] != 49 {
+		return nil, errors.New("MSCHAPv2: invalid Response")
+	}
+	peerChallenge, ntResponse := data[5:21], data[29:53]
+	// Name must be the EAP identity, whose password is checked
+	user := m.user
+	if name := mschapUser(string(data[54:])); name != user {
+		return nil, errors.Errorf("MSCHAPv2: Name %s is not identity %s", name, user)
+	}
+	password, ok := m.users.Password(user)
+	if !ok {
+		return nil, errors.Errorf("MSCHAPv2: unknown user %s", user)
+	}
+	if !hmac.Equal(generateNtResponse(m.challenge, peerChallenge, user, password), ntResponse) {
+		return nil, errors.Errorf("MSCHAPv2: wrong password for %s", user)
+	}
+	m.success = true
+	m.msk = mschapv2Msk(password, ntResponse)
+	msg := authenticatorResponse(password, ntResponse, peerChallenge, m.challenge, user) + " M=OK"
+	return mschapPacket(mschapSuccess, m.id, []byte(msg)), nil
+}
+
+// eapMschapv2Client answers gateway's Challenge, and checks it knows the password too
+type eapMschapv2Client struct {
+	user         string
+	password     []byte
+	ntResponse   []byte
+	authResponse string
+	done         bool
+}
+
+func (m *eapMschapv2Client) Type() protocol.EapType { return protocol.EAP_TYPE_MSCHAPV2 }
+func (m *eapMschapv2Client) Done() bool             { return m.done }
+func (m *eapMschapv2Client) Msk() []byte            { return mschapv2Msk(m.password, m.ntResponse) }
+
+func (m *eapMschapv2Client) Respond(req *protocol.EapPayload) ([]byte, error) {
+	data := req.Data
+	if len(data) < 4 {
+		return nil, errors.New("MSCHAPv2: short packet")
+	}
+	switch data[0] {
+	case mschapChallenge:
+		if len(data) < 4+1+16 || data[4] != 16 {
+			return nil, errors.New("MSCHAPv2: invalid Challenge")
+		}
+		authChallenge := data[5:21]
+		peerChallenge := make([]byte, 16)
+		if _, err := rand.Read(peerChallenge); err != nil {
+			return nil, err
+		}
+		m.ntResponse = generateNtResponse(authChallenge, peerChallenge, m.user, m.password)
+		m.authResponse = authenticatorResponse(m.password, m.ntResponse, peerChallenge, authChallenge, m.user)
+		value := append(append(append([]byte{49}, peerChallenge...), make([]byte, 8)...), m.ntResponse...)
+		value = append(append(value, 0), m.user...)
+		return mschapPacket(mschapResponse, data[1], value), nil
+	case mschapSuccess:
+		if m.ntResponse == nil || !strings.HasPrefix(string(data[4:]), m.authResponse) {
+			return nil, errors.New("MSCHAPv2: server does not know the password")
+		}
+		m.done = true
+		return []byte{mschapSuccess}, nil
+	case mschapFailure:
+		return nil, errors.Errorf("MSCHAPv2: Failure %q", data[4:])
+	}
+	return nil, errors.Errorf("MSCHAPv2: unexpected op code %d", data[0])
+}
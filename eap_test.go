@@ -0,0 +1,325 @@
+package ike
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/msgboxio/ike/protocol"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// rfc2759 9.2 & rfc3079 3.5.3
+func TestMschapv2Vectors(t *testing.T) {
+	password := []byte("clientPass")
+	authChallenge := unhex(t, "5B5D7C7D7B3F2F3E3C2C602132262628")
+	peerChallenge := unhex(t, "21402324255E262A28295F2B3A337C7E")
+	if h := ntPasswordHash(password); !bytes.Equal(h, unhex(t, "44EBBA8D5312B8D611474411F56989AE")) {
+		t.Errorf("PasswordHash %X", h)
+	}
+	nt := generateNtResponse(authChallenge, peerChallenge, "User", password)
+	if !bytes.Equal(nt, unhex(t, "82309ECD8D708B5EA08FAA3981CD83544233114A3D85D6DF")) {
+		t.Errorf("NT-Response %X", nt)
+	}
+	if resp := authenticatorResponse(password, nt, peerChallenge, authChallenge, "User"); resp != "S=407A5589115FD0D6209F510FE9C04566932CDA56" {
+		t.Errorf("AuthenticatorResponse %s", resp)
+	}
+	// server's send key
+	if msk := mschapv2Msk(password, nt); !bytes.Equal(msk[16:], unhex(t, "8B7CDC149B993A1BA118CB153F56DCCB")) {
+		t.Errorf("MSK %X", msk)
+	}
+}
+
+func TestEapPayload(t *testing.T) {
+	for _, eap := range []*protocol.EapPayload{
+		{Code: protocol.EAP_REQUEST, Identifier: 1, EapType: protocol.EAP_TYPE_IDENTITY, Data: []byte{}},
+		{Code: protocol.EAP_RESPONSE, Identifier: 2, EapType: protocol.EAP_TYPE_MSCHAPV2, Data: []byte{2, 2, 0, 4}},
+		{Code: protocol.EAP_SUCCESS, Identifier: 3},
+	} {
+		dec := &protocol.EapPayload{}
+		if err := dec.Decode(eap.Encode()); err != nil {
+			t.Fatal(err)
+		}
+		if dec.Code != eap.Code || dec.Identifier != eap.Identifier || dec.EapType != eap.EapType || !bytes.Equal(dec.Data, eap.Data) {
+			t.Errorf("%+v != %+v", dec, eap)
+		}
+	}
+	if err := (&protocol.EapPayload{}).Decode([]byte{1, 1, 0, 9, 1}); err == nil {
+		t.Error("wrong length was accepted")
+	}
+}
+
+// mschapv2Peer answers server's requests
+func mschapv2Peer(t *testing.T, s *eapServer, user, password string) (*protocol.EapPayload, error) {
+	return mschapv2PeerAs(t, s, user, user, password)
+}
+
+// mschapv2PeerAs sends identity, then authenticates as user
+func mschapv2PeerAs(t *testing.T, s *eapServer, identity, user, password string) (*protocol.EapPayload, error) {
+	out, err := s.handle(&protocol.EapPayload{Code: protocol.EAP_RESPONSE, Identifier: s.id, EapType: protocol.EAP_TYPE_IDENTITY, Data: []byte(identity)})
+	if err != nil {
+		return nil, err
+	}
+	if out.EapType != protocol.EAP_TYPE_MSCHAPV2 || out.Data[0] != mschapChallenge {
+		t.Fatalf("not a challenge: %+v", out)
+	}
+	authChallenge := out.Data[5:21]
+	peerChallenge := bytes.Repeat([]byte{7}, 16)
+	value := append(append(peerChallenge, make([]byte, 8)...), generateNtResponse(authChallenge, peerChallenge, user, []byte(password))...)
+	data := append(append([]byte{49}, value...), 0)
+	out, err = s.handle(&protocol.EapPayload{Code: protocol.EAP_RESPONSE, Identifier: out.Identifier, EapType: protocol.EAP_TYPE_MSCHAPV2,
+		Data: mschapPacket(mschapResponse, out.Data[1], append(data, user...))})
+	if err != nil {
+		return nil, err
+	}
+	if out.Data[0] != mschapSuccess {
+		t.Fatalf("not a success: %+v", out)
+	}
+	return s.handle(&protocol.EapPayload{Code: protocol.EAP_RESPONSE, Identifier: out.Identifier, EapType: protocol.EAP_TYPE_MSCHAPV2, Data: []byte{mschapSuccess}})
+}
+
+func TestEapServer(t *testing.T) {
+	identity := &EapIdentity{
+		Methods: []NewEapMethod{NewEapMschapv2, NewEapMd5},
+		Users:   LocalUsers{"alice": "secret", "bob": "hunter2"},
+	}
+	s := newEapServer(identity)
+	s.start()
+	out, err := mschapv2Peer(t, s, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Code != protocol.EAP_SUCCESS || !s.success || len(s.msk) != 32 {
+		t.Errorf("MSCHAPv2 failed: %+v", out)
+	}
+	// wrong password
+	s = newEapServer(identity)
+	s.start()
+	if _, err = mschapv2Peer(t, s, "alice", "guess"); err == nil || s.success {
+		t.Error("wrong password was accepted")
+	}
+	// credentials of another user
+	s = newEapServer(identity)
+	s.start()
+	if _, err = mschapv2PeerAs(t, s, "bob", "alice", "secret"); err == nil || s.success {
+		t.Error("Name other than identity was accepted")
+	}
+	// domain is not part of the name
+	s = newEapServer(identity)
+	s.start()
+	if out, err = mschapv2PeerAs(t, s, "alice", `CORP\alice`, "secret"); err != nil || out.Code != protocol.EAP_SUCCESS {
+		t.Errorf("domain Name was rejected: %v", err)
+	}
+	// peer asks for MD5 instead
+	s = newEapServer(identity)
+	s.start()
+	out, _ = s.handle(&protocol.EapPayload{Code: protocol.EAP_RESPONSE, Identifier: s.id, EapType: protocol.EAP_TYPE_IDENTITY, Data: []byte("alice")})
+	out, err = s.handle(&protocol.EapPayload{Code: protocol.EAP_RESPONSE, Identifier: out.Identifier, EapType: protocol.EAP_TYPE_NAK, Data: []byte{byte(protocol.EAP_TYPE_MD5_CHALLENGE)}})
+	if err != nil || out.EapType != protocol.EAP_TYPE_MD5_CHALLENGE {
+		t.Fatalf("NAK was not followed: %v", err)
+	}
+	value := md5Response(out.Identifier, []byte("secret"), out.Data[1:17])
+	out, err = s.handle(&protocol.EapPayload{Code: protocol.EAP_RESPONSE, Identifier: out.Identifier, EapType: protocol.EAP_TYPE_MD5_CHALLENGE, Data: append([]byte{16}, value...)})
+	if err != nil || out.Code != protocol.EAP_SUCCESS || s.msk != nil {
+		t.Errorf("MD5 failed: %v", err)
+	}
+}
+
+// eapTlsConfigs has gateway's & user's certificates, from the same CA
+func eapTlsConfigs(t *testing.T) (server, client *tls.Config) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "msgbox.io CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	issue := func(name string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	server = &tls.Config{
+		Certificates: []tls.Certificate{issue("gw.msgbox.io", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{issue("user.msgbox.io", x509.ExtKeyUsageClientAuth)},
+		RootCAs:      roots,
+		ServerName:   "gw.msgbox.io",
+	}
+	return
+}
+
+// runEapConversation passes packets between server & client till either ends it
+func runEapConversation(s *eapServer, c *eapClient) error {
+	out := s.start()
+	for {
+		resp, err := c.handle(out)
+		if err != nil || resp == nil {
+			return err
+		}
+		if out, err = s.handle(resp); err != nil {
+			c.handle(s.failure())
+			return err
+		}
+	}
+}
+
+func TestEapClient(t *testing.T) {
+	serverTls, clientTls := eapTlsConfigs(t)
+	identity := &EapIdentity{
+		Methods: []NewEapMethod{NewEapMd5, NewEapMschapv2, EapTls(serverTls)},
+		Users:   LocalUsers{"alice": "secret"},
+	}
+	for _, test := range []struct {
+		name   string
+		client *EapClientIdentity
+		mskLen int
+	}{
+		{"MSCHAPv2", &EapClientIdentity{User: "alice", Password: "secret"}, 32},
+		{"TLS", &EapClientIdentity{User: "alice", Tls: clientTls}, 64},
+	} {
+		s, c := newEapServer(identity), newEapClient(test.client)
+		if err := runEapConversation(s, c); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !s.success || !c.success || len(c.msk) != test.mskLen || !bytes.Equal(s.msk, c.msk) {
+			t.Errorf("%s: no common MSK", test.name)
+		}
+	}
+	// gateway's certificate is not for the name we expect
+	wrongName := clientTls.Clone()
+	wrongName.ServerName = "other.msgbox.io"
+	s, c := newEapServer(identity), newEapClient(&EapClientIdentity{User: "alice", Tls: wrongName})
+	if err := runEapConversation(s, c); err == nil || c.success {
+		t.Error("gateway was not checked")
+	}
+	// wrong password
+	s, c = newEapServer(identity), newEapClient(&EapClientIdentity{User: "alice", Password: "guess"})
+	if err := runEapConversation(s, c); err == nil || c.success {
+		t.Error("wrong password was accepted")
+	}
+}
+
+func TestEapSessions(t *testing.T) {
+	serverTls, clientTls := eapTlsConfigs(t)
+	for _, client := range []*EapClientIdentity{
+		{User: "alice", Password: "secret"},
+		{User: "alice", Tls: clientTls},
+	} {
+		cfgR := sessionTestConfig()
+		cfgR.PeerID = &EapIdentity{
+			Methods: []NewEapMethod{NewEapMschapv2, EapTls(serverTls)},
+			Users:   LocalUsers{"alice": "secret"},
+		}
+		cfg := sessionTestConfig()
+		cfg.LocalID = client
+		ini, err := runSessionPair(t, cfg, cfgR, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eap := eapAuthenticator(ini.localAuth()); !eap.client.success {
+			t.Error("EAP did not succeed")
+		}
+	}
+}
+
+func TestEapOnly(t *testing.T) {
+	serverTls, clientTls := eapTlsConfigs(t)
+	configs := func(client *EapClientIdentity) (cfg, cfgR *Config) {
+		cfgR = sessionTestConfig()
+		cfgR.EapOnly = true
+		// gateway holds no IKE credentials
+		cfgR.LocalID = &PskIdentities{Primary: "gw.msgbox.io"}
+		cfgR.PeerID = &EapIdentity{
+			Methods: []NewEapMethod{NewEapMschapv2, EapTls(serverTls)},
+			Users:   LocalUsers{"alice": "secret"},
+		}
+		cfg = sessionTestConfig()
+		cfg.EapOnly = true
+		cfg.LocalID = client
+		return
+	}
+	cfg, cfgR := configs(&EapClientIdentity{User: "alice", Password: "secret", Tls: clientTls})
+	ini, err := runSessionPair(t, cfg, cfgR, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ini.eapOnly {
+		t.Error("gateway sent AUTH")
+	}
+	// MSCHAPv2 is not safe without gateway's AUTH
+	cfg, cfgR = configs(&EapClientIdentity{User: "alice", Password: "secret"})
+	if _, err = runSessionPair(t, cfg, cfgR, nil); err == nil {
+		t.Error("MSCHAPv2 was used for EAP-only")
+	}
+	// nor would initiator accept it
+	client := newEapClient(&EapClientIdentity{User: "alice", Password: "secret"})
+	client.method, client.success = client.methods[0], true
+	eap := &EapAuthenticator{client: client}
+	idP := &protocol.IdPayload{IdType: protocol.ID_FQDN, Data: []byte("gw.msgbox.io")}
+	if err = NewAuthenticator(pskTestID, nil, true, false).Verify(nil, idP, protocol.AUTH_SHARED_KEY_MESSAGE_INTEGRITY_CODE, nil, eap, logger); err == nil {
+		t.Error("EAP-only was allowed with MSCHAPv2")
+	}
+}
+
+func TestEapMskRequired(t *testing.T) {
+	ini, _ := testSessionPair(t)
+	_, clientTls := eapTlsConfigs(t)
+	client := newEapClient(&EapClientIdentity{User: "alice", Password: "secret", Tls: clientTls})
+	eap := &EapAuthenticator{tkm: ini.tkm, forInitiator: true, client: client}
+	idP := &protocol.IdPayload{IdType: protocol.ID_RFC822_ADDR, Data: []byte("alice")}
+	// EAP-TLS without its MSK would not bind the conversation to IKE SA
+	client.method, client.success = client.methods[0], true
+	if _, err := eap.Sign(ini.initIb, idP, logger); err == nil {
+		t.Error("AUTH was keyed without the MSK")
+	}
+	// GTC derives none
+	client.method = client.methods[2]
+	if _, err := eap.Sign(ini.initIb, idP, logger); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,284 @@
+package ike
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// EAP-TLS, rfc5216; TLS 1.2 as the MSK is exported as rfc5216 defines it
+
+const (
+	eapTlsLength = 0x80
+	eapTlsMore   = 0x40
+	eapTlsStart  = 0x20
+
+	// TLS data in each packet, keeps IKE messages below the usual MTU
+	eapTlsFragment = 1000
+	// how long TLS waits for peer's next message
+	eapTlsTimeout = time.Minute
+)
+
+// eapTlsPipe is the connection TLS runs over
+// Read pauses the handshake until peer's next message is in
+type eapTlsPipe struct {
+	input   chan []byte
+	wait    chan struct{}
+	pending []byte
+	output  []byte // written since handshake last paused
+}
+
+func (p *eapTlsPipe) Read(b []byte) (int, error) {
+	if len(p.pending) == 0 {
+		p.wait <- struct{}{}
+		select {
+		case data, ok := <-p.input:
+			if !ok {
+				return 0, io.EOF
+			}
+			p.pending = data
+		case <-time.After(eapTlsTimeout):
+			return 0, errors.New("EAP-TLS: timed out")
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *eapTlsPipe) Write(b []byte) (int, error) {
+	p.output = append(p.output, b...)
+	return len(b), nil
+}
+
+func (p *eapTlsPipe) Close() error                       { return nil }
+func (p *eapTlsPipe) LocalAddr() net.Addr                { return nil }
+func (p *eapTlsPipe) RemoteAddr() net.Addr               { return nil }
+func (p *eapTlsPipe) SetDeadline(t time.Time) error      { return nil }
+func (p *eapTlsPipe) SetReadDeadline(t time.Time) error  { return nil }
+func (p *eapTlsPipe) SetWriteDeadline(t time.Time) error { return nil }
+
+// eapTls runs the handshake in its own goroutine, one flight for each of peer's
+type eapTls struct {
+	pipe     *eapTlsPipe
+	conn     *tls.Conn
+	done     chan error
+	finished bool
+	err      error
+	recv     []byte // fragments of peer's message
+	send     []byte // what is left of ours
+	sendLen  int
+	key      []byte // MSK
+}
+
+// newEapTls starts the handshake, returns its first flight
+func newEapTls(config *tls.Config, isClient bool) (*eapTls, []byte, error) {
+	config = config.Clone()
+	config.MaxVersion = tls.VersionTLS12
+	t := &eapTls{
+		pipe: &eapTlsPipe{input: make(chan []byte), wait: make(chan struct{}, 1)},
+		done: make(chan error, 1),
+	}
+	if isClient {
+		t.conn = tls.Client(t.pipe, config)
+	} else {
+		t.conn = tls.Server(t.pipe, config)
+	}
+	go func() { t.done <- t.conn.Handshake() }()
+	out, err := t.pause()
+	return t, out, err
+}
+
+// pause waits for handshake to need peer's next message, or to end
+func (t *eapTls) pause() ([]byte, error) {
+	select {
+	case <-t.pipe.wait:
+	case t.err = <-t.done:
+		t.finished = true
+		if t.err == nil {
+			// handshake without a key fails
+			t.key, t.err = t.exportMsk()
+		}
+		if t.err != nil {
+			return nil, errors.Wrap(t.err, "EAP-TLS")
+		}
+	}
+	out := t.pipe.output
+	t.pipe.output = nil
+	return out, nil
+}
+
+// resume passes peer's message to the handshake, returns our reply
+func (t *eapTls) resume(msg []byte) ([]byte, error) {
+	if t.finished {
+		return nil, errors.New("EAP-TLS: message after handshake")
+	}
+	select {
+	case t.pipe.input <- msg:
+	case t.err = <-t.done:
+		t.finished = true
+		return nil, errors.Wrap(t.err, "EAP-TLS")
+	}
+	return t.pause()
+}
+
+// stop ends an unfinished handshake
+func (t *eapTls) stop() {
+	if !t.finished {
+		t.finished, t.err = true, errors.New("EAP-TLS: stopped")
+		close(t.pipe.input)
+	}
+}
+
+func (t *eapTls) setSend(msg []byte) {
+	t.send, t.sendLen = msg, len(msg)
+}
+
+// packet returns Flags | [TLS Message Length] | [TLS Data] with the next fragment to send
+// empty one acknowledges peer's fragment
+func (t *eapTls) packet() []byte {
+	n, flags := len(t.send), uint8(0)
+	if n > eapTlsFragment {
+		n, flags = eapTlsFragment, eapTlsMore
+	}
+	b := []byte{flags}
+	if len(t.send) == t.sendLen && flags&eapTlsMore != 0 {
+		b[0] |= eapTlsLength
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[1:], uint32(t.sendLen))
+	}
+	b = append(b, t.send[:n]...)
+	t.send = t.send[n:]
+	return b
+}
+
+// next returns Type-Data of our packet for peer's
+// our fragments go out as peer acknowledges them; peer's are acknowledged till all are in
+func (t *eapTls) next(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errors.New("EAP-TLS: empty packet")
+	}
+	if len(t.send) > 0 {
+		return t.packet(), nil
+	}
+	flags := data[0]
+	data = data[1:]
+	if flags&eapTlsLength != 0 {
+		if len(data) < 4 {
+			return nil, errors.New("EAP-TLS: short packet")
+		}
+		data = data[4:]
+	}
+	t.recv = append(t.recv, data...)
+	if flags&eapTlsMore != 0 {
+		return []byte{0}, nil
+	}
+	msg := t.recv
+	t.recv = nil
+	out, err := t.resume(msg)
+	if err != nil {
+		return nil, err
+	}
+	t.setSend(out)
+	return t.packet(), nil
+}
+
+// exportMsk exports the MSK with the rfc5216 label
+func (t *eapTls) exportMsk() ([]byte, error) {
+	state := t.conn.ConnectionState()
+	return state.ExportKeyingMaterial("client EAP encryption", nil, 64)
+}
+
+// eapTlsServer authenticates peers by their certificates
+type eapTlsServer struct {
+	config *tls.Config
+	tls    *eapTls
+}
+
+// EapTls creates EAP-TLS method, its config should require & verify client certificates
+func EapTls(config *tls.Config) NewEapMethod {
+	return func(EapUsers) EapMethod {
+		return &eapTlsServer{config: config}
+	}
+}
+
+func (m *eapTlsServer) Type() protocol.EapType { return protocol.EAP_TYPE_TLS }
+
+func (m *eapTlsServer) Msk() []byte {
+	if m.tls == nil {
+		return nil
+	}
+	return m.tls.key
+}
+
+// Start asks peer to start the handshake
+func (m *eapTlsServer) Start(user string, id uint8) ([]byte, error) {
+	return []byte{eapTlsStart}, nil
+}
+
+// Respond runs the handshake, peer is done once it acknowledges our Finished
+func (m *eapTlsServer) Respond(resp *protocol.EapPayload) ([]byte, error) {
+	if m.tls == nil {
+		t, _, err := newEapTls(m.config, false)
+		if err != nil {
+			return nil, err
+		}
+		m.tls = t
+	}
+	if m.tls.finished && m.tls.err == nil && len(m.tls.send) == 0 {
+		return nil, nil
+	}
+	data, err := m.tls.next(resp.Data)
+	if err != nil {
+		m.tls.stop()
+	}
+	return data, err
+}
+
+// eapTlsClient authenticates us with a certificate, and checks gateway's
+type eapTlsClient struct {
+	config *tls.Config
+	tls    *eapTls
+}
+
+func newEapTlsClient(config *tls.Config) *eapTlsClient {
+	return &eapTlsClient{config: config}
+}
+
+func (m *eapTlsClient) Type() protocol.EapType { return protocol.EAP_TYPE_TLS }
+
+func (m *eapTlsClient) Done() bool {
+	return m.tls != nil && m.tls.finished && m.tls.err == nil && len(m.tls.send) == 0
+}
+
+func (m *eapTlsClient) Msk() []byte {
+	return m.tls.key
+}
+
+func (m *eapTlsClient) Respond(req *protocol.EapPayload) ([]byte, error) {
+	if len(req.Data) > 0 && req.Data[0]&eapTlsStart != 0 {
+		if m.tls != nil {
+			m.tls.stop()
+		}
+		t, hello, err := newEapTls(m.config, true)
+		if err != nil {
+			return nil, err
+		}
+		m.tls = t
+		t.setSend(hello)
+		return t.packet(), nil
+	}
+	if m.tls == nil {
+		return nil, errors.New("EAP-TLS: handshake was not started")
+	}
+	data, err := m.tls.next(req.Data)
+	if err != nil {
+		m.tls.stop()
+	}
+	return data, err
+}
@@ -0,0 +1,191 @@
+package ike
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// rfc7383 fragmentation
+
+const (
+	// ipv6 minimum mtu, less ip & udp headers
+	DefaultFragmentSize = 1280 - 40 - 8
+
+	maxFragments       = 64
+	maxReassembledSize = 64 * 1024
+	maxPendingMessages = 4
+	fragmentTimeout    = 30 * time.Second
+)
+
+var errIncompleteMessage = errors.New("waiting for more fragments")
+
+// EncodeFragments encodes the message, and if it does not fit in fragmentSize,
+// splits the encrypted payloads into SKF fragments
+func (msg *Message) EncodeFragments(tkm *Tkm, forInitiator bool, fragmentSize int, log log.Logger) (frags [][]byte, err error) {
+	b, err := msg.Encode(tkm, forInitiator, log)
+	if err != nil {
+		return
+	}
+	if len(b) <= fragmentSize || msg.IkeHeader.NextPayload != protocol.PayloadTypeSK || len(msg.Payloads.Array) == 0 {
+		return [][]byte{b}, nil
+	}
+	payload := protocol.EncodePayloads(msg.Payloads)
+	hdrLen := protocol.IKE_HEADER_LEN + protocol.PAYLOAD_HEADER_LENGTH + protocol.FRAGMENT_HEADER_LENGTH
+	// worst case padding
+	chunkLen := fragmentSize - hdrLen - tkm.CryptoOverhead(nil)
+	if chunkLen <= 0 {
+		return nil, errors.Errorf("fragment size %d is too small", fragmentSize)
+	}
+	total := (len(payload) + chunkLen - 1) / chunkLen
+	if total > maxFragments {
+		return nil, errors.Errorf("message needs %d fragments, limit is %d", total, maxFragments)
+	}
+	hdr := *msg.IkeHeader
+	hdr.NextPayload = protocol.PayloadTypeSKF
+	for num := 1; num <= total; num++ {
+		chunk := payload[(num-1)*chunkLen:]
+		if len(chunk) > chunkLen {
+			chunk = chunk[:chunkLen]
+		}
+		plen := len(chunk) + tkm.CryptoOverhead(chunk)
+		// only first fragment carries the type of first inner payload
+		next := protocol.PayloadTypeNone
+		if num == 1 {
+			next = msg.Payloads.Array[0].Type()
+		}
+		skf := &protocol.EncryptedFragmentPayload{
+			PayloadHeader: &protocol.PayloadHeader{
+				NextPayload:   next,
+				PayloadLength: uint16(protocol.FRAGMENT_HEADER_LENGTH + plen),
+			},
+			FragmentNumber: uint16(num),
+			TotalFragments: uint16(total),
+		}
+		hdr.MsgLength = uint32(hdrLen + plen)
+		clear := append(append(append(hdr.Encode(), skf.PayloadHeader.Encode()...), skf.Encode()...), chunk...)
+		var frag []byte
+		if frag, err = tkm.EncryptMac(clear, forInitiator); err != nil {
+			return nil, err
+		}
+		frags = append(frags, frag)
+	}
+	log.Log("TX", fmt.Sprintf("[%d] %s%s", msg.IkeHeader.MsgID, msg.IkeHeader.ExchangeType, msg.IkeHeader.Flags),
+		"fragments", total)
+	return
+}
+
+type fragmentKey struct {
+	msgID      uint32
+	isResponse bool
+}
+
+// fragmentBuffer collects decrypted contents of fragments of a message
+type fragmentBuffer struct {
+	first    *Message
+	contents [][]byte // indexed by fragment number - 1
+	received int
+	size     int
+	started  time.Time
+}
+
+// defragment verifies & decrypts a fragment, returning the reassembled message
+// once all fragments have been received
+func (sess *Session) defragment(msg *Message) (*Message, error) {
+	if !sess.fragmentation {
+		return nil, errors.New("fragmentation was not negotiated")
+	}
+	skf, ok := msg.Payloads.Get(protocol.PayloadTypeSKF).(*protocol.EncryptedFragmentPayload)
+	if !ok {
+		return nil, errors.Wrap(protocol.ERR_INVALID_SYNTAX, "missing SKF payload")
+	}
+	if skf.TotalFragments > maxFragments {
+		return nil, errors.Errorf("too many fragments: %d", skf.TotalFragments)
+	}
+	key := fragmentKey{msg.IkeHeader.MsgID, msg.IkeHeader.Flags.IsResponse()}
+	// check message id before keeping anything around
+	expected := sess.msgIDResp.canAccept(key.msgID)
+	if key.isResponse {
+		expected = sess.msgIDReq.isPending(key.msgID)
+	}
+	if !expected {
+		return nil, errors.Wrap(protocol.ERR_INVALID_MESSAGE_ID,
+			fmt.Sprintf("fragment of unexpected message %d", key.msgID))
+	}
+	// each fragment is individually protected
+	clear, err := sess.tkm.VerifyDecrypt(msg.Data, sess.isInitiator)
+	if err != nil {
+		return nil, err
+	}
+	sess.expireFragments()
+	buf, found := sess.fragments[key]
+	if found && len(buf.contents) != int(skf.TotalFragments) {
+		// rfc7383 2.6.1: peer may resend with smaller fragments
+		if int(skf.TotalFragments) < len(buf.contents) {
+			return nil, errors.Errorf("fragment %d of %d, expected %d fragments",
+				skf.FragmentNumber, skf.TotalFragments, len(buf.contents))
+		}
+		found = false
+	}
+	if !found {
+		if len(sess.fragments) >= maxPendingMessages {
+			return nil, errors.New("too many messages being reassembled")
+		}
+		buf = &fragmentBuffer{
+			contents: make([][]byte, skf.TotalFragments),
+			started:  time.Now(),
+		}
+		// MUTATION
+		if sess.fragments == nil {
+			sess.fragments = make(map[fragmentKey]*fragmentBuffer)
+		}
+		sess.fragments[key] = buf
+	}
+	idx := skf.FragmentNumber - 1
+	if buf.contents[idx] != nil {
+		// duplicate
+		return nil, errIncompleteMessage
+	}
+	if buf.size+len(clear) > maxReassembledSize {
+		delete(sess.fragments, key)
+		return nil, errors.Errorf("reassembled message exceeds %d bytes", maxReassembledSize)
+	}
+	buf.contents[idx] = clear
+	buf.received++
+	buf.size += len(clear)
+	if idx == 0 {
+		buf.first = msg
+	}
+	if buf.received < len(buf.contents) {
+		return nil, errIncompleteMessage
+	}
+	delete(sess.fragments, key)
+	var b []byte
+	for _, c := range buf.contents {
+		b = append(b, c...)
+	}
+	whole := &Message{
+		IkeHeader:  buf.first.IkeHeader,
+		LocalAddr:  msg.LocalAddr,
+		RemoteAddr: msg.RemoteAddr,
+	}
+	first := buf.first.Payloads.Get(protocol.PayloadTypeSKF)
+	if err = whole.DecodePayloads(b, first.NextPayloadType(), sess.Logger); err != nil {
+		return nil, err
+	}
+	return whole, nil
+}
+
+// expireFragments drops messages that were not completed in time
+func (sess *Session) expireFragments() {
+	for key, buf := range sess.fragments {
+		if time.Since(buf.started) > fragmentTimeout {
+			sess.Logger.Log("FRAGMENTS", "timeout", "MSGID", key.msgID, "RECEIVED", buf.received)
+			// MUTATION
+			delete(sess.fragments, key)
+		}
+	}
+}
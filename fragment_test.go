@@ -0,0 +1,118 @@
+package ike
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/msgboxio/ike/protocol"
+)
+
+func largeMessage(sess *Session, size int) *Message {
+	data := make([]byte, size)
+	rand.Read(data)
+	msg := &Message{
+		IkeHeader: &protocol.IkeHeader{
+			SpiI:         sess.IkeSpiI,
+			SpiR:         sess.IkeSpiR,
+			NextPayload:  protocol.PayloadTypeSK,
+			MajorVersion: protocol.IKEV2_MAJOR_VERSION,
+			MinorVersion: protocol.IKEV2_MINOR_VERSION,
+			ExchangeType: protocol.IKE_AUTH,
+			Flags:        protocol.INITIATOR,
+			MsgID:        1,
+		},
+		Payloads: protocol.MakePayloads(),
+	}
+	msg.Payloads.Add(&protocol.CertPayload{
+		PayloadHeader:    &protocol.PayloadHeader{},
+		CertEncodingType: protocol.X_509_CERTIFICATE_SIGNATURE,
+		Data:             data,
+	})
+	return msg
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	ini, res := testSessionPair(t)
+	res.msgIDResp.accept(0)
+	msg := largeMessage(ini, 5000)
+	out, err := ini.encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Fragments) < 2 {
+		t.Fatalf("expected fragments, got %d", len(out.Fragments))
+	}
+	var whole *Message
+	// deliver out of order, with a duplicate
+	frags := append(append([][]byte{}, out.Fragments[1:]...), out.Fragments[0], out.Fragments[1])
+	for i, b := range frags {
+		if len(b) > DefaultFragmentSize {
+			t.Errorf("fragment %d is too large: %d", i, len(b))
+		}
+		fmsg, err := DecodeMessage(b, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole, err = res.defragment(fmsg)
+		if i < len(out.Fragments)-1 {
+			if err != errIncompleteMessage {
+				t.Fatalf("fragment %d: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	if whole == nil {
+		t.Fatal("message was not reassembled")
+	}
+	sent := msg.Payloads.Get(protocol.PayloadTypeCERT).(*protocol.CertPayload)
+	got, ok := whole.Payloads.Get(protocol.PayloadTypeCERT).(*protocol.CertPayload)
+	if !ok || !bytes.Equal(sent.Data, got.Data) {
+		t.Error("reassembled message differs")
+	}
+	if len(res.fragments) != 0 {
+		t.Error("buffer was not released")
+	}
+}
+
+func TestFragmentRejected(t *testing.T) {
+	ini, res := testSessionPair(t)
+	out, err := ini.encode(largeMessage(ini, 3000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmsg, _ := DecodeMessage(out.Fragments[0], logger)
+	// wrong message id
+	if _, err = res.defragment(fmsg); err == nil || err == errIncompleteMessage {
+		t.Error("unexpected message id accepted", err)
+	}
+	res.msgIDResp.accept(0)
+	// tampered
+	bad := append([]byte{}, out.Fragments[0]...)
+	bad[len(bad)-1] ^= 0xff
+	fmsg, _ = DecodeMessage(bad, logger)
+	if _, err = res.defragment(fmsg); err == nil || err == errIncompleteMessage {
+		t.Error("tampered fragment accepted", err)
+	}
+	// not negotiated
+	res.fragmentation = false
+	fmsg, _ = DecodeMessage(out.Fragments[0], logger)
+	if _, err = res.defragment(fmsg); err == nil {
+		t.Error("fragment accepted without negotiation")
+	}
+}
+
+func TestFragmentSmallMessage(t *testing.T) {
+	ini, _ := testSessionPair(t)
+	out, err := ini.encode(largeMessage(ini, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Fragments != nil || out.Data == nil {
+		t.Error("small message should not be fragmented")
+	}
+}
@@ -1,7 +1,10 @@
 package ike
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/sha1"
+	"crypto/tls"
 	"crypto/x509"
 
 	"github.com/msgboxio/ike/protocol"
@@ -38,12 +41,68 @@ func (psk *PskIdentities) AuthData(id []byte) []byte {
 	return nil
 }
 
+// EapIdentity authenticates initiators with EAP
+// Methods are offered in order, initiator can NAK to another of them
+// with Radius, the conversation is relayed to its servers instead
+type EapIdentity struct {
+	Methods []NewEapMethod
+	Users   EapUsers
+	Radius  *RadiusClient
+}
+
+// peer's identity is known from EAP, IDi is not checked
+func (e *EapIdentity) IdType() protocol.IdType {
+	return protocol.ID_KEY_ID
+}
+
+func (e *EapIdentity) Id() []byte {
+	return nil
+}
+
+func (e *EapIdentity) AuthMethod() protocol.AuthMethod {
+	return protocol.AUTH_SHARED_KEY_MESSAGE_INTEGRITY_CODE
+}
+
+func (e *EapIdentity) AuthData(id []byte) []byte {
+	return nil
+}
+
+// EapClientIdentity authenticates initiator to gateways that require EAP
+// EAP-MSCHAPv2 is used if Password is set, EAP-TLS if Tls is
+type EapClientIdentity struct {
+	User     string
+	Password string
+	Tls      *tls.Config
+}
+
+func (e *EapClientIdentity) IdType() protocol.IdType {
+	return protocol.ID_RFC822_ADDR
+}
+
+func (e *EapClientIdentity) Id() []byte {
+	return []byte(e.User)
+}
+
+func (e *EapClientIdentity) AuthMethod() protocol.AuthMethod {
+	return protocol.AUTH_SHARED_KEY_MESSAGE_INTEGRITY_CODE
+}
+
+func (e *EapClientIdentity) AuthData(id []byte) []byte {
+	return nil
+}
+
 type CertIdentity struct {
 	Certificate          *x509.Certificate
+	Chain                []*x509.Certificate // issuers of Certificate, may end with the root CA
 	PrivateKey           crypto.Signer
 	Roots                *x509.CertPool
+	RootCerts            []*x509.Certificate // certificates in Roots, announced in CERTREQ; may include our issuer
+	Revocation           *RevocationChecker  // checks peer certificates, if set
 	Name                 string
 	AuthenticationMethod protocol.AuthMethod
+
+	// other certificates we hold, used when peer asks for their CA
+	Alternates []*CertIdentity
 }
 
 func (c *CertIdentity) IdType() protocol.IdType {
@@ -65,3 +124,83 @@ func (c *CertIdentity) AuthMethod() protocol.AuthMethod {
 	}
 	return c.AuthenticationMethod
 }
+
+// Intermediates returns the issuers that are sent along with our certificate
+// self signed roots are left out, peer must already have them
+func (c *CertIdentity) Intermediates() (certs []*x509.Certificate) {
+	for _, cert := range c.Chain {
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return
+}
+
+// caHash is the SHA-1 hash of CA public key, as used in CERTREQ
+func caHash(ca *x509.Certificate) []byte {
+	h := sha1.Sum(ca.RawSubjectPublicKeyInfo)
+	return h[:]
+}
+
+// CertAuthorities returns hashes of the trusted CAs
+func (c *CertIdentity) CertAuthorities() (hashes [][]byte) {
+	for _, ca := range c.RootCerts {
+		hashes = append(hashes, caHash(ca))
+	}
+	return
+}
+
+// issuedBy checks if ca signed cert, found by AuthorityKeyId or by name
+func issuedBy(cert, ca *x509.Certificate) bool {
+	if len(cert.AuthorityKeyId) > 0 && len(ca.SubjectKeyId) > 0 {
+		if !bytes.Equal(cert.AuthorityKeyId, ca.SubjectKeyId) {
+			return false
+		}
+	} else if !bytes.Equal(cert.RawIssuer, ca.RawSubject) {
+		return false
+	}
+	return cert.CheckSignatureFrom(ca) == nil
+}
+
+// issuers returns CAs of Certificate & its chain, from the chain & RootCerts
+// CA that is only known as a root is found too
+func (c *CertIdentity) issuers() (cas []*x509.Certificate) {
+	known := append(append([]*x509.Certificate{}, c.Chain...), c.RootCerts...)
+	for _, cert := range append([]*x509.Certificate{c.Certificate}, c.Chain...) {
+		for _, ca := range known {
+			if issuedBy(cert, ca) {
+				cas = append(cas, ca)
+			}
+		}
+	}
+	return
+}
+
+// isIssuedBy checks if one of our certificates was issued by a requested CA
+// CERTREQ has hashes of CA public keys
+func (c *CertIdentity) isIssuedBy(hashes [][]byte) bool {
+	for _, issuer := range c.issuers() {
+		h := caHash(issuer)
+		for _, want := range hashes {
+			if bytes.Equal(h, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ForAuthorities picks the certificate issued by one of the CAs in CERTREQ
+// defaults to the primary certificate
+func (c *CertIdentity) ForAuthorities(hashes [][]byte) *CertIdentity {
+	if len(hashes) == 0 || c.isIssuedBy(hashes) {
+		return c
+	}
+	for _, alt := range c.Alternates {
+		if alt.isIssuedBy(hashes) {
+			return alt
+		}
+	}
+	return c
+}
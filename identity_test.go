@@ -0,0 +1,92 @@
+package ike
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/msgboxio/ike/protocol"
+)
+
+func TestCertIdentityForAuthorities(t *testing.T) {
+	local1, remote1 := eccertTestIds(t)
+	local2, remote2 := eccertTestIds(t)
+	primary := local1.(*CertIdentity)
+	alternate := local2.(*CertIdentity)
+	primary.Alternates = []*CertIdentity{alternate}
+
+	if sel := primary.ForAuthorities(nil); sel != primary {
+		t.Error("without CERTREQ primary should be used")
+	}
+	// peer trusts CA of alternate
+	if sel := primary.ForAuthorities(trustedAuthorities(remote2)); sel != alternate {
+		t.Error("alternate not selected")
+	}
+	if sel := primary.ForAuthorities(trustedAuthorities(remote1)); sel != primary {
+		t.Error("primary not selected")
+	}
+	// unknown CA
+	if sel := primary.ForAuthorities([][]byte{make([]byte, protocol.CA_HASH_LENGTH)}); sel != primary {
+		t.Error("primary should be the default")
+	}
+}
+
+func TestCertIdentityForAuthoritiesIssuer(t *testing.T) {
+	local1, remote1 := eccertTestIds(t)
+	local2, remote2 := eccertTestIds(t)
+	primary := local1.(*CertIdentity)
+	alternate := local2.(*CertIdentity)
+	primary.Alternates = []*CertIdentity{alternate}
+	// CAs are not in the chains, only known as roots
+	primary.Chain, primary.RootCerts = nil, remote1.(*CertIdentity).RootCerts
+	alternate.Chain, alternate.RootCerts = nil, remote2.(*CertIdentity).RootCerts
+	if sel := primary.ForAuthorities(trustedAuthorities(remote2)); sel != alternate {
+		t.Error("alternate not selected")
+	}
+	if sel := primary.ForAuthorities(trustedAuthorities(remote1)); sel != primary {
+		t.Error("primary not selected")
+	}
+	// a root that did not issue our certificate
+	alternate.RootCerts = remote1.(*CertIdentity).RootCerts
+	if alternate.isIssuedBy(trustedAuthorities(remote1)) {
+		t.Error("matched CA that is not our issuer")
+	}
+}
+
+func TestCertRequestInInit(t *testing.T) {
+	_, remoteID := eccertTestIds(t)
+	hashes := trustedAuthorities(remoteID)
+	if len(hashes) != 1 || len(hashes[0]) != protocol.CA_HASH_LENGTH {
+		t.Fatal("bad hashes", hashes)
+	}
+	cfg := testConfig()
+	cfg.LocalID = pskTestID
+	cfg.PeerID = remoteID
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 500}
+	tkmI, err := NewTkm(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkm, err := NewTkm(cfg, tkmI.Ni)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := &Session{cfg: *cfg, tkm: tkm, IkeSpiI: MakeSpi(), IkeSpiR: MakeSpi(), Local: addr, Remote: addr}
+	// responder's reply
+	b, err := InitFromSession(sess).Encode(nil, false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := DecodeMessage(b, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.LocalAddr, msg.RemoteAddr = addr, addr
+	init, err := parseInit(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(init.certAuthorities) != 1 || !bytes.Equal(init.certAuthorities[0], hashes[0]) {
+		t.Error("CERTREQ was not received", init.certAuthorities)
+	}
+}
@@ -1,6 +1,7 @@
 package ike
 
 import (
+	"crypto/x509"
 	"fmt"
 	"time"
 
@@ -13,21 +14,27 @@ import (
 func authFromSession(sess *Session) (*Message, error) {
 	// proposal
 	var prop protocol.Proposals
-	// part of signed octet
-	var initB []byte
-	var idPayloadType protocol.PayloadType
+	// rfc4739; initiator authenticates in each round, responder in the first one
+	// Child SA is created once the last round is done
+	var withAuth, authOnly, anotherAuth bool
 	if sess.isInitiator {
-		prop = protocol.ProposalFromTransform(protocol.ESP, sess.cfg.ProposalEsp, sess.EspSpiI)
-		// initiators's signed octet
-		// initI | Nr | prf(sk_pi | IDi )
-		initB = sess.initIb
-		idPayloadType = protocol.PayloadTypeIDi
+		withAuth = true
+		authOnly = sess.authRound > 0
+		anotherAuth = sess.authRound < len(sess.localRounds)
 	} else {
-		prop = protocol.ProposalFromTransform(protocol.ESP, sess.cfg.ProposalEsp, sess.EspSpiR)
-		// responder's signed octet
-		// initR | Ni | prf(sk_pr | IDr )
-		initB = sess.initRb
-		idPayloadType = protocol.PayloadTypeIDr
+		// with EAP, identity was sent before the conversation
+		withAuth = sess.authRound == 0 && sess.eapMsk == nil
+		authOnly = sess.authRound < len(sess.peerRounds)
+	}
+	// first Child SA is created with IKE SA, unless it is childless
+	if sess.isInitiator {
+		if !sess.childless && !authOnly {
+			prop = proposals(protocol.ESP, sess.cfg.ProposalEsp, sess.children[0].espSpiI, 0)
+		}
+	} else {
+		if !sess.childless && !authOnly {
+			prop = proposals(protocol.ESP, sess.cfg.ProposalEsp, sess.children[0].espSpiR, sess.espProposal)
+		}
 	}
 	authMsg := makeAuth(
 		&authParams{
@@ -39,44 +46,162 @@ func authFromSession(sess *Session) (*Message, error) {
 			tsI:             sess.cfg.TsI,
 			tsR:             sess.cfg.TsR,
 			lifetime:        sess.cfg.Lifetime,
+			configuration:   sess.configuration,
+			windowSize:      sess.cfg.WindowSize,
+			mobike:          sess.cfg.Mobike,
+			childless:       sess.childless,
+			multipleAuth:    sess.isInitiator && !authOnly && len(sess.localRounds) > 0,
+			anotherAuth:     anotherAuth,
+			authOnly:        authOnly,
 		})
-	id := sess.authLocal.Identity()
+	// initiator asks for peer certificate, unless resuming
+	if sess.isInitiator && sess.resume == nil && !authOnly {
+		if certAuthorities := trustedAuthorities(sess.cfg.PeerID); len(certAuthorities) > 0 {
+			authMsg.Payloads.Add(certRequest(certAuthorities))
+		}
+	}
+	// rfc5998; initiator accepts gateways authenticated by EAP alone
+	if eap := eapAuthenticator(sess.localAuth()); sess.isInitiator && sess.cfg.EapOnly && !authOnly && eap != nil && eap.client != nil {
+		authMsg.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.EAP_ONLY_AUTHENTICATION,
+		})
+	}
+	// rfc5723 resumption ticket
+	if sess.isInitiator && sess.cfg.RequestTicket && !authOnly {
+		authMsg.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.TICKET_REQUEST,
+		})
+	} else if !sess.isInitiator && sess.ticket != nil && !authOnly {
+		authMsg.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.TICKET_LT_OPAQUE,
+			NotificationMessage: &protocol.TicketLifetime{
+				Lifetime: time.Until(sess.ticket.Expires),
+				Ticket:   sess.ticket.Opaque,
+			},
+		})
+	}
+	// responder's AUTH after EAP is keyed with the MSK
+	if !sess.isInitiator && sess.eapMsk != nil {
+		if err := addMskAuth(sess, authMsg, sess.eapMsk); err != nil {
+			return nil, err
+		}
+	}
+	if !withAuth {
+		return authMsg, nil
+	}
+	if err := addLocalAuth(sess, authMsg); err != nil {
+		return nil, err
+	}
+	return authMsg, nil
+}
+
+// addLocalAuth adds our CERT, ID & AUTH for the current round
+func addLocalAuth(sess *Session, authMsg *Message) error {
+	// responder's signed octet
+	// initR | Ni | prf(sk_pr | IDr )
+	initB, idPayloadType := sess.initRb, protocol.PayloadTypeIDr
+	if sess.isInitiator {
+		// initiators's signed octet
+		// initI | Nr | prf(sk_pi | IDi )
+		initB, idPayloadType = sess.initIb, protocol.PayloadTypeIDi
+	}
+	authLocal := sess.localAuth()
+	id := sess.requestedIdentity(authLocal.Identity())
+	iDp := &protocol.IdPayload{
+		PayloadHeader: &protocol.PayloadHeader{},
+		IdPayloadType: idPayloadType,
+		IdType:        id.IdType(),
+		Data:          id.Id(),
+	}
+	// rfc5998; EAP authenticates gateway, it has no CERT or AUTH of its own
+	if !sess.isInitiator && sess.eapOnly {
+		authMsg.Payloads.Add(iDp)
+		return nil
+	}
 	// add CERT
 	switch id.AuthMethod() {
 	case protocol.AUTH_RSA_DIGITAL_SIGNATURE, protocol.AUTH_DIGITAL_SIGNATURE:
 		certID, ok := id.(*CertIdentity)
 		if !ok {
 			// should never happen
-			return nil, errors.New("missing Certificate Identity")
+			return errors.New("missing Certificate Identity")
+		}
+		// send the certificate peer asked for
+		if id != authLocal.Identity() {
+			authLocal = NewAuthenticator(certID, sess.tkm, sess.isInitiator, sess.rfc7427Signatures)
 		}
 		if certID.Certificate == nil {
-			return nil, errors.New("missing Certificate")
+			return errors.New("missing Certificate")
+		}
+		// end entity certificate goes first
+		for _, cert := range append([]*x509.Certificate{certID.Certificate}, certID.Intermediates()...) {
+			authMsg.Payloads.Add(&protocol.CertPayload{
+				PayloadHeader:    &protocol.PayloadHeader{},
+				CertEncodingType: protocol.X_509_CERTIFICATE_SIGNATURE,
+				Data:             cert.Raw,
+			})
 		}
-		authMsg.Payloads.Add(&protocol.CertPayload{
-			PayloadHeader:    &protocol.PayloadHeader{},
-			CertEncodingType: protocol.X_509_CERTIFICATE_SIGNATURE,
-			Data:             certID.Certificate.Raw,
-		})
 	}
 	// add ID
-	iDp := &protocol.IdPayload{
-		PayloadHeader: &protocol.PayloadHeader{},
-		IdPayloadType: idPayloadType,
-		IdType:        id.IdType(),
-		Data:          id.Id(),
-	}
 	authMsg.Payloads.Add(iDp)
+	// AUTH follows the EAP conversation
+	if eap := eapAuthenticator(authLocal); eap != nil && eap.client != nil && !eap.client.success {
+		return nil
+	}
 	// signature
-	signature, err := sess.authLocal.Sign(initB, iDp, sess.Logger)
+	signature, err := authLocal.Sign(initB, iDp, sess.Logger)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	authMsg.Payloads.Add(&protocol.AuthPayload{
 		PayloadHeader: &protocol.PayloadHeader{},
 		AuthMethod:    id.AuthMethod(),
 		Data:          signature,
 	})
-	return authMsg, nil
+	return nil
+}
+
+// localIdentity is the identity sent to peer in the first round
+func (sess *Session) localIdentity() Identity {
+	return sess.requestedIdentity(sess.authLocal.Identity())
+}
+
+// requestedIdentity picks the certificate peer asked for
+func (sess *Session) requestedIdentity(id Identity) Identity {
+	if certID, ok := id.(*CertIdentity); ok {
+		return certID.ForAuthorities(sess.peerAuthorities)
+	}
+	return id
+}
+
+// localAuth authenticates us in the current round
+func (sess *Session) localAuth() Authenticator {
+	if sess.isInitiator && sess.authRound > 0 {
+		return sess.localRounds[sess.authRound-1]
+	}
+	return sess.authLocal
+}
+
+// peerAuth authenticates peer in the current round
+func (sess *Session) peerAuth() Authenticator {
+	if !sess.isInitiator && sess.authRound > 0 {
+		return sess.peerRounds[sess.authRound-1]
+	}
+	return sess.authPeer
+}
+
+// peerIdPayload is IDi from initiator, or IDr from responder
+// peerIdPayload returns nil if msg has none
+func peerIdPayload(sess *Session, msg *Message) *protocol.IdPayload {
+	idType := protocol.PayloadTypeIDi
+	if sess.isInitiator {
+		idType = protocol.PayloadTypeIDr
+	}
+	idP, _ := msg.Payloads.Get(idType).(*protocol.IdPayload)
+	return idP
 }
 
 // auth respones can be a valid auth message, auth resp with AUTHENTICATION_FAILED
@@ -99,8 +224,14 @@ func checkAuthResponseForSession(sess *Session, msg *Message) (err error) {
 	if msg.IkeHeader.ExchangeType != protocol.IKE_AUTH {
 		return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_AUTH: incorrect type")
 	}
+	// responder only authenticates in the first round
+	// with EAP, its replies carry EAP instead; AUTH is checked once gateway's is expected
+	required := authRPayloads
+	if eap := eapAuthenticator(sess.localAuth()); sess.authRound > 0 || (eap != nil && eap.client != nil) {
+		required = nil
+	}
 	// ensure other payloads are present
-	if err = msg.EnsurePayloads(authRPayloads); err != nil {
+	if err = msg.EnsurePayloads(required); err != nil {
 		// not a proper AUTH response
 		// check for NOTIFICATION : AUTHENTICATION_FAILED
 		for _, n := range msg.Payloads.GetNotifications() {
@@ -125,68 +256,152 @@ func checkAuthRequestForSession(sess *Session, msg *Message) (err error) {
 	if msg.IkeHeader.ExchangeType != protocol.IKE_AUTH {
 		return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_AUTH: incorrect type")
 	}
+	// EAP peers leave out AUTH
+	required := authIPayloads
+	if eapAuthenticator(sess.peerAuth()) != nil {
+		required = eapIPayloads
+	}
 	// ensure other payloads are present
-	if err := msg.EnsurePayloads(authIPayloads); err != nil {
+	if err := msg.EnsurePayloads(required); err != nil {
 		return err
 	}
 	return nil
 }
 
 func handleAuthForSession(sess *Session, msg *Message) (spi protocol.Spi, lt time.Duration, err error) {
-	// can we authenticate ?
-	if err = authenticateSession(sess, msg); err != nil {
-		err = errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, err.Error())
+	if err = handlePeerAuth(sess, msg); err != nil {
 		return
 	}
+	return handleSaForSession(sess, msg)
+}
+
+// handlePeerAuth authenticates peer in the current round
+// responder authenticated itself in the first one, later ones are only checked for errors
+func handlePeerAuth(sess *Session, msg *Message) (err error) {
+	// responder uses CERTREQ from initiator to pick its certificate
+	if !sess.isInitiator && sess.authRound == 0 {
+		// MUTATION
+		sess.peerAuthorities = msg.Payloads.GetCertAuthorities()
+	}
+	// can we authenticate ?
+	hasAuth := msg.Payloads.Get(protocol.PayloadTypeAUTH) != nil
+	if eap := eapAuthenticator(sess.peerAuth()); !sess.isInitiator && eap != nil && !hasAuth {
+		// rfc5998; initiator may let EAP authenticate us : MUTATION
+		sess.eapOnly = sess.cfg.EapOnly && sess.authRound == 0 &&
+			msg.Payloads.GetNotification(protocol.EAP_ONLY_AUTHENTICATION) != nil
+		// takes more exchanges
+		if err = runEapServer(sess, msg, eap); err != nil {
+			return
+		}
+	} else if eap := eapAuthenticator(sess.localAuth()); sess.isInitiator && eap != nil && eap.client != nil && eap.client.success {
+		// gateway's AUTH after EAP is keyed with the MSK too
+		authP, ok := msg.Payloads.Get(protocol.PayloadTypeAUTH).(*protocol.AuthPayload)
+		if !ok {
+			return errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, "EAP: missing AUTH")
+		}
+		// with EAP only, gateway is left to the method
+		var verifier Authenticator = eap
+		var inband interface{}
+		if sess.eapOnly {
+			verifier, inband = sess.peerAuth(), eap
+		}
+		if err = verifier.Verify(sess.initRb, sess.peerIDp, authP.AuthMethod, authP.Data, inband, sess.Logger); err != nil {
+			return errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, err.Error())
+		}
+	} else if eap := eapAuthenticator(sess.localAuth()); sess.isInitiator && sess.authRound == 0 && sess.cfg.EapOnly && eap != nil && eap.client != nil && !hasAuth {
+		// rfc5998; gateway's AUTH follows the conversation
+		idP := peerIdPayload(sess, msg)
+		if idP == nil {
+			return errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, "EAP-only: missing IDr")
+		}
+		// MUTATION
+		sess.eapOnly, sess.peerIDp = true, idP
+	} else if !sess.isInitiator || sess.authRound == 0 {
+		if err = authenticateSession(sess, msg); err != nil {
+			return errors.Wrap(protocol.ERR_AUTHENTICATION_FAILED, err.Error())
+		}
+	}
 	for _, n := range msg.Payloads.GetNotifications() {
 		if nErr, ok := protocol.GetIkeErrorCode(n.NotificationType); ok {
 			// for example, due to FAILED_CP_REQUIRED, NO_PROPOSAL_CHOSEN, TS_UNACCEPTABLE etc
 			// TODO - for now, we should simply end the IKE_SA
-			err = errors.Wrap(nErr, "peer notified")
-			return
+			return errors.Wrap(nErr, "peer notified")
 		}
 	}
+	return
+}
+
+// handleSaForSession checks the SA parameters of IKE_AUTH
+// returns Peer Spi
+func handleSaForSession(sess *Session, msg *Message) (spi protocol.Spi, lt time.Duration, err error) {
+	// initiator may still create a Child SA : MUTATION
+	if !sess.isInitiator && sess.childless && msg.Payloads.Get(protocol.PayloadTypeSA) != nil {
+		sess.childless = false
+	}
 	// are SA parameters ok?
-	params, err := parseSaAndSelectors(msg)
-	if err != nil {
+	var params *authParams
+	if sess.childless {
+		params = parseChildless(msg)
+	} else if params, err = parseSaAndSelectors(msg); err != nil {
+		return
+	}
+	// peer may accept several requests at once
+	sess.msgIDReq.setWindow(params.windowSize)
+	// both support MOBIKE : MUTATION
+	sess.mobike = sess.cfg.Mobike && params.mobike
+	// remote access peer asking for an address?
+	if err = handleConfigurationForSession(sess, msg, params); err != nil {
+		return
+	}
+	if sess.childless {
+		sess.Logger.Log("IKE_SA", "childless")
 		return
 	}
-	spi, lt, err = checkSelectorsForSession(sess, params)
+	spi, lt, err = checkSelectorsForSession(sess, params, sess.cfg.TsI, sess.cfg.TsR)
 	return
 }
 
 func authenticateSession(sess *Session, msg *Message) (err error) {
 	// authenticate peer
-	var idP *protocol.IdPayload
 	var initB []byte
 	if sess.isInitiator {
 		initB = sess.initRb
-		idP = msg.Payloads.Get(protocol.PayloadTypeIDr).(*protocol.IdPayload)
 	} else {
 		initB = sess.initIb
-		idP = msg.Payloads.Get(protocol.PayloadTypeIDi).(*protocol.IdPayload)
 	}
-	authP := msg.Payloads.Get(protocol.PayloadTypeAUTH).(*protocol.AuthPayload)
+	idP := peerIdPayload(sess, msg)
+	authP, ok := msg.Payloads.Get(protocol.PayloadTypeAUTH).(*protocol.AuthPayload)
+	if idP == nil || !ok {
+		return errors.New("missing ID or AUTH")
+	}
+	// MUTATION
+	sess.peerIDp = idP
 	chain, err := msg.Payloads.GetCertchain()
 	if err != nil {
 		return err
 	}
-	return sess.authPeer.Verify(initB, idP, authP.AuthMethod, authP.Data, chain, sess.Logger)
+	crls, err := msg.Payloads.GetCertRevocationLists()
+	if err != nil {
+		return err
+	}
+	return sess.peerAuth().Verify(initB, idP, authP.AuthMethod, authP.Data,
+		&peerCertificates{chain: chain, crls: crls}, sess.Logger)
 }
 
-// checkSelectorsForSession returns Peer Spi
-func checkSelectorsForSession(sess *Session, params *authParams) (spi protocol.Spi, lt time.Duration, err error) {
-	if err = sess.cfg.CheckProposals(protocol.ESP, params.proposals); err != nil {
+// checkSelectorsForSession compares peer's selectors with ours, tsI & tsR
+// returns Peer Spi
+func checkSelectorsForSession(sess *Session, params *authParams, tsI, tsR protocol.Selectors) (spi protocol.Spi, lt time.Duration, err error) {
+	if err = selectEspProposal(sess, params); err != nil {
 		sess.Logger.Log("BAD_PROPOSAL", err,
 			"PEER", spew.Sprintf("%#v", params.proposals),
 			"OUR", spew.Sprintf("%#v", sess.cfg.ProposalEsp))
 		return
 	}
 	// selectors
-	if err = sess.cfg.CheckSelectors(params.tsI, params.tsR, params.isTransportMode); err != nil {
+	if err = sess.cfg.checkSelectors(tsI, tsR, params.tsI, params.tsR, params.isTransportMode); err != nil {
 		sess.Logger.Log("BAD_SELECTORS", err,
 			"PEER", fmt.Sprintf("[INI]%s<=>%s[RES]", params.tsI, params.tsR),
-			"OUR_SELECTORS", fmt.Sprintf("[INI]%s<=>%s[RES]", sess.cfg.TsI, sess.cfg.TsR))
+			"OUR_SELECTORS", fmt.Sprintf("[INI]%s<=>%s[RES]", tsI, tsR))
 		return
 	}
 	// message looks OK
@@ -196,7 +411,7 @@ func checkSelectorsForSession(sess *Session, params *authParams) (spi protocol.S
 		spi = append([]byte{}, params.spiI...)
 	}
 	lt = params.lifetime
-	log := []interface{}{"SELECTORS", fmt.Sprintf("[INI]%s<=>%s[RES]", sess.cfg.TsI, sess.cfg.TsR)}
+	log := []interface{}{"SELECTORS", fmt.Sprintf("[INI]%s<=>%s[RES]", tsI, tsR)}
 	if params.lifetime != 0 {
 		log = append(log, "LIFETIME", params.lifetime)
 	}
@@ -208,3 +423,32 @@ func checkSelectorsForSession(sess *Session, params *authParams) (spi protocol.S
 	sess.Logger.Log(log...)
 	return
 }
+
+// selectEspProposal negotiates the esp suite
+// responses must contain exactly one of our proposals
+func selectEspProposal(sess *Session, params *authParams) error {
+	if params.isResponse && len(params.proposals) != 1 {
+		return errors.Wrapf(protocol.ERR_NO_PROPOSAL_CHOSEN, "%d proposals in response", len(params.proposals))
+	}
+	num, suite, err := sess.cfg.SelectProposal(protocol.ESP, params.proposals)
+	if err != nil {
+		return err
+	}
+	if err = sess.tkm.setEspSuite(suite); err != nil {
+		return err
+	}
+	// MUTATION
+	sess.cfg.ProposalEsp = []protocol.TransformMap{suite}
+	if !params.isResponse {
+		sess.espProposal = num
+	}
+	return nil
+}
+
+// trustedAuthorities returns hashes of CAs we accept peer certificates from
+func trustedAuthorities(peerID Identity) [][]byte {
+	if certID, ok := peerID.(*CertIdentity); ok {
+		return certID.CertAuthorities()
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package ike
 
 import (
+	"bytes"
 	"math/big"
 	"net"
 	"time"
@@ -20,6 +21,9 @@ var (
 		protocol.PayloadTypeIDi,
 		protocol.PayloadTypeAUTH,
 	}
+	eapIPayloads = []protocol.PayloadType{
+		protocol.PayloadTypeIDi,
+	}
 	authRPayloads = []protocol.PayloadType{
 		protocol.PayloadTypeIDr,
 		protocol.PayloadTypeAUTH,
@@ -33,6 +37,10 @@ var (
 		protocol.PayloadTypeTSr,
 	}
 
+	resumePayloads = []protocol.PayloadType{
+		protocol.PayloadTypeNonce,
+	}
+
 	rekeyIkeSaPayloads = []protocol.PayloadType{
 		protocol.PayloadTypeSA,
 		protocol.PayloadTypeKE,
@@ -54,9 +62,17 @@ var (
 // b->a
 //	HDR((SPIi=xxx, SPIr=yyy, IKE_SA_INIT, Flags: Response, Message ID=0),
 // 	SAr1, KEr, Nr, [CERTREQ]
+// IKE_SESSION_RESUME, rfc5723
+// a->b
+//	HDR(SPIi=xxx, SPIr=0, IKE_SESSION_RESUME, Flags: Initiator, Message ID=0),
+//	[N(COOKIE),] Ni, N(TICKET_OPAQUE)
+// b->a
+//	HDR(SPIi=xxx, SPIr=yyy, IKE_SESSION_RESUME, Flags: Response, Message ID=0),
+//	Nr
 type initParams struct {
 	isInitiator bool
 	isResponse  bool
+	isResume    bool // IKE_SESSION_RESUME
 	spiI, spiR  protocol.Spi
 
 	nonce         *big.Int
@@ -68,6 +84,16 @@ type initParams struct {
 	cookie            []byte
 	rfc7427Signatures bool
 	hasNat            bool
+	natLocal          bool // receiver is behind NAT
+	natRemote         bool // sender is behind NAT
+	fragmentation     bool
+	certAuthorities   [][]byte // CERTREQ
+	ticket            []byte   // TICKET_OPAQUE
+	resume            *Ticket  // ticket opened by responder
+	redirectSupported bool     // REDIRECT_SUPPORTED, or REDIRECTED_FROM
+	redirectedFrom    string   // REDIRECTED_FROM
+	childless         bool     // CHILDLESS_IKEV2_SUPPORTED
+	multipleAuth      bool     // MULTIPLE_AUTH_SUPPORTED
 }
 
 func makeInit(params *initParams, local, remote net.Addr) *Message {
@@ -76,13 +102,17 @@ func makeInit(params *initParams, local, remote net.Addr) *Message {
 	if params.isInitiator {
 		flags = protocol.INITIATOR
 	}
+	exchange := protocol.IKE_SA_INIT
+	if params.isResume {
+		exchange = protocol.IKE_SESSION_RESUME
+	}
 	init := &Message{
 		IkeHeader: &protocol.IkeHeader{
 			SpiI:         params.spiI,
 			SpiR:         params.spiR,
 			MajorVersion: protocol.IKEV2_MAJOR_VERSION,
 			MinorVersion: protocol.IKEV2_MINOR_VERSION,
-			ExchangeType: protocol.IKE_SA_INIT,
+			ExchangeType: exchange,
 			Flags:        flags,
 			// MsgID:        0, // ALWAYS
 		},
@@ -95,19 +125,32 @@ func makeInit(params *initParams, local, remote net.Addr) *Message {
 			NotificationMessage: params.cookie,
 		})
 	}
-	init.Payloads.Add(&protocol.SaPayload{
-		PayloadHeader: &protocol.PayloadHeader{},
-		Proposals:     params.proposals,
-	})
-	init.Payloads.Add(&protocol.KePayload{
-		PayloadHeader: &protocol.PayloadHeader{},
-		DhTransformId: params.dhTransformID,
-		KeyData:       params.dhPublic,
-	})
+	// resumed IKE SA keeps its suite, keys come from the ticket
+	if !params.isResume {
+		init.Payloads.Add(&protocol.SaPayload{
+			PayloadHeader: &protocol.PayloadHeader{},
+			Proposals:     params.proposals,
+		})
+		init.Payloads.Add(&protocol.KePayload{
+			PayloadHeader: &protocol.PayloadHeader{},
+			DhTransformId: params.dhTransformID,
+			KeyData:       params.dhPublic,
+		})
+	}
 	init.Payloads.Add(&protocol.NoncePayload{
 		PayloadHeader: &protocol.PayloadHeader{},
 		Nonce:         params.nonce,
 	})
+	if params.ticket != nil {
+		init.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:       &protocol.PayloadHeader{},
+			NotificationType:    protocol.TICKET_OPAQUE,
+			NotificationMessage: params.ticket,
+		})
+	}
+	if len(params.certAuthorities) > 0 {
+		init.Payloads.Add(certRequest(params.certAuthorities))
+	}
 	// HashAlgorithmId has been set
 	if params.rfc7427Signatures {
 		init.Payloads.Add(&protocol.NotifyPayload{
@@ -121,29 +164,64 @@ func makeInit(params *initParams, local, remote net.Addr) *Message {
 			},
 		})
 	}
+	if params.fragmentation {
+		init.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.IKEV2_FRAGMENTATION_SUPPORTED,
+		})
+	}
+	if params.childless {
+		init.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.CHILDLESS_IKEV2_SUPPORTED,
+		})
+	}
+	if params.multipleAuth {
+		init.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.MULTIPLE_AUTH_SUPPORTED,
+		})
+	}
 	if params.hasNat {
+		addNatDetection(init, params.spiI, params.spiR, local, remote)
+	}
+	// redirected initiator tells the new gateway which one sent it there
+	if params.redirectedFrom != "" {
 		init.Payloads.Add(&protocol.NotifyPayload{
 			PayloadHeader:       &protocol.PayloadHeader{},
-			NotificationType:    protocol.NAT_DETECTION_DESTINATION_IP,
-			NotificationMessage: getNatHash(params.spiI, params.spiR, remote),
+			NotificationType:    protocol.REDIRECTED_FROM,
+			NotificationMessage: &protocol.Redirect{Gateway: params.redirectedFrom},
 		})
+	} else if params.redirectSupported {
 		init.Payloads.Add(&protocol.NotifyPayload{
-			PayloadHeader:       &protocol.PayloadHeader{},
-			NotificationType:    protocol.NAT_DETECTION_SOURCE_IP,
-			NotificationMessage: getNatHash(params.spiI, params.spiR, local),
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.REDIRECT_SUPPORTED,
 		})
 	}
 	return init
 }
 
+// certRequest asks for certificates issued by the CAs with given key hashes
+func certRequest(hashes [][]byte) *protocol.CertRequestPayload {
+	return &protocol.CertRequestPayload{
+		PayloadHeader:          &protocol.PayloadHeader{},
+		CertEncodingType:       protocol.X_509_CERTIFICATE_SIGNATURE,
+		CertificationAuthority: bytes.Join(hashes, nil),
+	}
+}
+
 func parseInit(msg *Message) (*initParams, error) {
 	params := &initParams{}
-	if msg.IkeHeader.ExchangeType != protocol.IKE_SA_INIT {
+	switch msg.IkeHeader.ExchangeType {
+	case protocol.IKE_SA_INIT:
+	case protocol.IKE_SESSION_RESUME:
+		params.isResume = true
+	default:
 		return nil, errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_SA_INIT: incorrect type")
 	}
 	// Message ID must always be 0
 	if msg.IkeHeader.MsgID != 0 {
-		return nil, errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_SA_INIT: invalid Message Id")
+		return nil, errors.Wrapf(protocol.ERR_INVALID_SYNTAX, "%s: invalid Message Id", msg.IkeHeader.ExchangeType)
 	}
 	if msg.IkeHeader.Flags&protocol.RESPONSE != 0 {
 		params.isResponse = true
@@ -153,26 +231,51 @@ func parseInit(msg *Message) (*initParams, error) {
 	}
 	params.spiI = msg.IkeHeader.SpiI
 	params.spiR = msg.IkeHeader.SpiR
+	params.certAuthorities = msg.Payloads.GetCertAuthorities()
 	params.ns = msg.Payloads.GetNotifications()
 	// process notifications
 	for _, ns := range params.ns {
 		switch ns.NotificationType {
 		case protocol.SIGNATURE_HASH_ALGORITHMS:
 			params.rfc7427Signatures = true
+		case protocol.IKEV2_FRAGMENTATION_SUPPORTED:
+			params.fragmentation = true
 		case protocol.NAT_DETECTION_DESTINATION_IP:
 			// check NAT-T payload to determine if there is a NAT between the two peers
 			if !checkNatHash(ns.NotificationMessage.([]byte), params.spiI, params.spiR, msg.LocalAddr) {
 				params.hasNat = true
+				params.natLocal = true
 			}
 		case protocol.NAT_DETECTION_SOURCE_IP:
 			if !checkNatHash(ns.NotificationMessage.([]byte), params.spiI, params.spiR, msg.RemoteAddr) {
 				params.hasNat = true
+				params.natRemote = true
 			}
 		case protocol.COOKIE:
 			// did we get a COOKIE ?
 			params.cookie = ns.NotificationMessage.([]byte)
+		case protocol.TICKET_OPAQUE:
+			params.ticket = ns.NotificationMessage.([]byte)
+		case protocol.CHILDLESS_IKEV2_SUPPORTED:
+			params.childless = true
+		case protocol.MULTIPLE_AUTH_SUPPORTED:
+			params.multipleAuth = true
+		case protocol.REDIRECT_SUPPORTED:
+			params.redirectSupported = true
+		case protocol.REDIRECTED_FROM:
+			params.redirectSupported = true
+			if rd, ok := ns.NotificationMessage.(*protocol.Redirect); ok {
+				params.redirectedFrom = rd.Gateway
+			}
 		}
 	}
+	if params.isResume {
+		if err := msg.EnsurePayloads(resumePayloads); err != nil {
+			return params, err
+		}
+		params.nonce = msg.Payloads.Get(protocol.PayloadTypeNonce).(*protocol.NoncePayload).Nonce
+		return params, nil
+	}
 	// if we got a COOKIE request, then there are no more payloads
 	if err := msg.EnsurePayloads(initPayloads); err != nil {
 		return params, err
@@ -207,6 +310,13 @@ type authParams struct {
 	proposals       protocol.Proposals
 	tsI, tsR        protocol.Selectors
 	lifetime        time.Duration
+	configuration   *protocol.ConfigurationPayload // CFG_REQUEST or CFG_REPLY
+	windowSize      uint32
+	mobike          bool // MOBIKE_SUPPORTED
+	childless       bool // rfc6023; no SA, TSi & TSr
+	multipleAuth    bool // MULTIPLE_AUTH_SUPPORTED
+	anotherAuth     bool // ANOTHER_AUTH_FOLLOWS
+	authOnly        bool // rfc4739; more rounds follow, only identity & AUTH are added
 }
 
 // id, cert & auth payloads are added later
@@ -227,22 +337,33 @@ func makeAuth(params *authParams) *Message {
 		},
 		Payloads: protocol.MakePayloads(),
 	}
-	auth.Payloads.Add(&protocol.SaPayload{
-		PayloadHeader: &protocol.PayloadHeader{},
-		Proposals:     params.proposals,
-	})
-	auth.Payloads.Add(&protocol.TrafficSelectorPayload{
-		PayloadHeader:              &protocol.PayloadHeader{},
-		TrafficSelectorPayloadType: protocol.PayloadTypeTSi,
-		Selectors:                  params.tsI,
-	})
-	auth.Payloads.Add(&protocol.TrafficSelectorPayload{
-		PayloadHeader:              &protocol.PayloadHeader{},
-		TrafficSelectorPayloadType: protocol.PayloadTypeTSr,
-		Selectors:                  params.tsR,
-	})
+	if params.anotherAuth {
+		auth.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.ANOTHER_AUTH_FOLLOWS,
+		})
+	}
+	if params.authOnly {
+		return auth
+	}
+	if !params.childless {
+		auth.Payloads.Add(&protocol.SaPayload{
+			PayloadHeader: &protocol.PayloadHeader{},
+			Proposals:     params.proposals,
+		})
+		auth.Payloads.Add(&protocol.TrafficSelectorPayload{
+			PayloadHeader:              &protocol.PayloadHeader{},
+			TrafficSelectorPayloadType: protocol.PayloadTypeTSi,
+			Selectors:                  params.tsI,
+		})
+		auth.Payloads.Add(&protocol.TrafficSelectorPayload{
+			PayloadHeader:              &protocol.PayloadHeader{},
+			TrafficSelectorPayloadType: protocol.PayloadTypeTSr,
+			Selectors:                  params.tsR,
+		})
+	}
 	// check for transport mode config
-	if params.isTransportMode {
+	if params.isTransportMode && !params.childless {
 		auth.Payloads.Add(&protocol.NotifyPayload{
 			PayloadHeader: &protocol.PayloadHeader{},
 			// ProtocolId:       IKE,
@@ -256,7 +377,7 @@ func makeAuth(params *authParams) *Message {
 			NotificationType: protocol.INITIAL_CONTACT,
 		})
 	}
-	if !params.isInitiator && params.lifetime != 0 {
+	if !params.isInitiator && params.lifetime != 0 && !params.childless {
 		auth.Payloads.Add(&protocol.NotifyPayload{
 			PayloadHeader: &protocol.PayloadHeader{},
 			// ProtocolId:       IKE,
@@ -264,10 +385,36 @@ func makeAuth(params *authParams) *Message {
 			NotificationMessage: params.lifetime,
 		})
 	}
+	if params.windowSize > 1 {
+		auth.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:       &protocol.PayloadHeader{},
+			NotificationType:    protocol.SET_WINDOW_SIZE,
+			NotificationMessage: params.windowSize,
+		})
+	}
+	if params.mobike {
+		auth.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.MOBIKE_SUPPORTED,
+		})
+	}
+	if params.multipleAuth {
+		auth.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.MULTIPLE_AUTH_SUPPORTED,
+		})
+	}
+	if params.configuration != nil {
+		auth.Payloads.Add(&protocol.ConfigurationPayload{
+			PayloadHeader:           &protocol.PayloadHeader{},
+			ConfigurationType:       params.configuration.ConfigurationType,
+			ConfigurationAttributes: params.configuration.ConfigurationAttributes,
+		})
+	}
 	return auth
 }
 
-func parseSa(msg *Message) (*authParams, error) {
+func parseSa(msg *Message, prot protocol.ProtocolID) (*authParams, error) {
 	params := &authParams{}
 	if msg.IkeHeader.Flags&protocol.RESPONSE != 0 {
 		params.isResponse = true
@@ -279,12 +426,12 @@ func parseSa(msg *Message) (*authParams, error) {
 	if err := msg.EnsurePayloads(saPayload); err != nil {
 		return nil, err
 	}
-	espSa := msg.Payloads.Get(protocol.PayloadTypeSA).(*protocol.SaPayload)
-	if espSa.Proposals == nil {
+	sa := msg.Payloads.Get(protocol.PayloadTypeSA).(*protocol.SaPayload)
+	if sa.Proposals == nil {
 		return nil, errors.New("proposals are missing")
 	}
-	params.proposals = espSa.Proposals
-	spi, err := spiFromProposal(params.proposals, protocol.ESP)
+	params.proposals = sa.Proposals
+	spi, err := spiFromProposal(params.proposals, prot)
 	if err != nil {
 		return nil, err
 	}
@@ -300,7 +447,7 @@ func parseSaAndSelectors(msg *Message) (*authParams, error) {
 	if err := msg.EnsurePayloads(saPayloads); err != nil {
 		return nil, err
 	}
-	params, err := parseSa(msg)
+	params, err := parseSa(msg, protocol.ESP)
 	if err != nil {
 		return nil, err
 	}
@@ -312,16 +459,42 @@ func parseSaAndSelectors(msg *Message) (*authParams, error) {
 	}
 	params.tsI = tsI
 	params.tsR = tsR
-	// notifications
+	return parseAuthOptions(msg, params), nil
+}
+
+// parseChildless reads IKE_AUTH without SA & selectors, rfc6023
+func parseChildless(msg *Message) *authParams {
+	params := &authParams{
+		isResponse:  msg.IkeHeader.Flags&protocol.RESPONSE != 0,
+		isInitiator: msg.IkeHeader.Flags&protocol.INITIATOR != 0,
+		childless:   true,
+	}
+	return parseAuthOptions(msg, params)
+}
+
+// parseAuthOptions reads notifications & configuration
+func parseAuthOptions(msg *Message, params *authParams) *authParams {
 	for _, ns := range msg.Payloads.GetNotifications() {
 		switch ns.NotificationType {
 		case protocol.AUTH_LIFETIME:
 			params.lifetime = ns.NotificationMessage.(time.Duration)
 		case protocol.USE_TRANSPORT_MODE:
 			params.isTransportMode = true
+		case protocol.SET_WINDOW_SIZE:
+			params.windowSize = ns.NotificationMessage.(uint32)
+		case protocol.MOBIKE_SUPPORTED:
+			params.mobike = true
+		case protocol.MULTIPLE_AUTH_SUPPORTED:
+			params.multipleAuth = true
+		case protocol.ANOTHER_AUTH_FOLLOWS:
+			params.anotherAuth = true
 		}
 	}
-	return params, nil
+	// configuration, only in IKE_AUTH
+	if cp := msg.Payloads.Get(protocol.PayloadTypeCP); cp != nil {
+		params.configuration = cp.(*protocol.ConfigurationPayload)
+	}
+	return params
 }
 
 // CREATE_CHILD_SA
@@ -329,7 +502,7 @@ func parseSaAndSelectors(msg *Message) (*authParams, error) {
 //  HDR(SPIi=xxx, SPIy=yyy, CREATE_CHILD_SA, Flags: none, Message ID=m),
 //  SK {SA, Ni, KEi} - ike sa
 //  SK {N(REKEY_SA), SA, Ni, [KEi,] TSi, TSr} - for rekey child sa
-//  SK {SA, Ni, [KEi,] TSi, TSr} - for new child sa, what is the use case ??
+//  SK {SA, Ni, [KEi,] TSi, TSr} - for new child sa, with other selectors
 // a<-b
 //  HDR(SPIi=xxx, SPIr=yyy, CREATE_CHILD_SA, Flags: Initiator | Response, Message ID=m),
 //  SK {N(NO_ADDITIONAL_SAS} - reject
@@ -363,8 +536,8 @@ func makeChildSa(params *childSaParams) *Message {
 		},
 		Payloads: protocol.MakePayloads(),
 	}
-	// presence of traffic selectors means that CHILD SA is being rekeyed
-	if params.tsI != nil && params.tsR != nil && params.isInitiator {
+	// target spi means that CHILD SA is being rekeyed, otherwise a new one is created
+	if params.targetEspSpi != nil && !params.isResponse {
 		child.Payloads.Add(&protocol.NotifyPayload{
 			ProtocolId:       protocol.ESP,
 			PayloadHeader:    &protocol.PayloadHeader{},
@@ -405,7 +578,7 @@ func makeChildSa(params *childSaParams) *Message {
 			NotificationType: protocol.USE_TRANSPORT_MODE,
 		})
 	}
-	if !params.isInitiator && params.lifetime != 0 {
+	if params.isResponse && params.lifetime != 0 {
 		child.Payloads.Add(&protocol.NotifyPayload{
 			PayloadHeader: &protocol.PayloadHeader{},
 			// ProtocolId:       IKE,
@@ -451,7 +624,7 @@ func parseChildSa(msg *Message, forInitiator bool) (*childSaParams, error) {
 		}
 	} else if err := msg.EnsurePayloads(rekeyIkeSaPayloads); err == nil {
 		// rekeying IKE SA - no selectors
-		params.authParams, err = parseSa(msg)
+		params.authParams, err = parseSa(msg, protocol.IKE)
 		if err != nil {
 			return nil, err
 		}
@@ -14,14 +14,25 @@ import (
 //
 
 // InitFromSession creates IKE_SA_INIT messages
+// or IKE_SESSION_RESUME for resumed sessions
 func InitFromSession(sess *Session) *Message {
+	if sess.resume != nil {
+		return ResumeFromSession(sess)
+	}
 	var prop protocol.Proposals
+	var certAuthorities [][]byte
+	var redirectSupported, multipleAuth bool
 	nonce := sess.tkm.Nr
 	if sess.isInitiator {
-		prop = protocol.ProposalFromTransform(protocol.IKE, sess.cfg.ProposalIke, sess.IkeSpiI)
+		prop = proposals(protocol.IKE, sess.cfg.ProposalIke, sess.IkeSpiI, 0)
 		nonce = sess.tkm.Ni
+		redirectSupported = sess.redirectSupported
 	} else {
-		prop = protocol.ProposalFromTransform(protocol.IKE, sess.cfg.ProposalIke, sess.IkeSpiR)
+		prop = proposals(protocol.IKE, sess.cfg.ProposalIke, sess.IkeSpiR, sess.ikeProposal)
+		// responder asks for certificates in its reply
+		certAuthorities = trustedAuthorities(sess.cfg.PeerID)
+		// initiator has to authenticate more than once
+		multipleAuth = len(sess.cfg.PeerAuthRounds) > 0
 	}
 	return makeInit(&initParams{
 		isInitiator:       sess.isInitiator,
@@ -34,6 +45,12 @@ func InitFromSession(sess *Session) *Message {
 		nonce:             nonce,
 		rfc7427Signatures: sess.rfc7427Signatures,
 		hasNat:            true,
+		fragmentation:     sess.fragmentation,
+		certAuthorities:   certAuthorities,
+		redirectSupported: redirectSupported,
+		redirectedFrom:    sess.redirectedFrom,
+		childless:         sess.cfg.Childless,
+		multipleAuth:      multipleAuth,
 	}, sess.Local, sess.Remote)
 }
 
@@ -70,6 +87,24 @@ func _checkInitRequest(cfg *Config, init *initParams, remote net.Addr) error {
 	if SpiToInt64(init.spiI) == 0 {
 		return errors.Wrap(protocol.ERR_INVALID_IKE_SPI, "IKE_SA_INIT: missing SPI")
 	}
+	if err := checkCookie(cfg, init, remote); err != nil {
+		return err
+	}
+	// check ike proposal & if KE uses its dh group
+	if _, _, err := cfg.SelectIkeProposal(init.proposals, init.dhTransformID); err != nil {
+		return err
+	}
+	// client may be sent to another gateway
+	if cfg.Redirect != nil && init.redirectSupported {
+		if gw := cfg.Redirect.Redirect(remote); gw != "" {
+			return redirectError{gw}
+		}
+	}
+	return nil
+}
+
+// checkCookie makes sure initiator returned the COOKIE we asked for
+func checkCookie(cfg *Config, init *initParams, remote net.Addr) error {
 	// did we get a COOKIE ?
 	if cookie := init.cookie; cookie != nil {
 		// is COOKIE correct ?
@@ -79,22 +114,20 @@ func _checkInitRequest(cfg *Config, init *initParams, remote net.Addr) error {
 	} else if cfg.ThrottleInitRequests {
 		return errMissingCookie
 	}
-	// check if transforms are usable
-	if err := cfg.CheckDhTransform(init.dhTransformID); err != nil {
-		return err
-	}
-	// check ike proposal
-	if err := cfg.CheckProposals(protocol.IKE, init.proposals); err != nil {
-		return err
-	}
 	return nil
 }
 
 func initErrorNeedsReply(init *initParams, config *Config, remote net.Addr, err error) *Message {
+	// send REDIRECT with initiator's nonce
+	if re, ok := errors.Cause(err).(redirectError); ok {
+		return notificationResponse(init.spiI, protocol.REDIRECT, &protocol.Redirect{Gateway: re.Gateway, Nonce: init.nonce.Bytes()}, remote)
+	}
 	// send INVALID_KE_PAYLOAD, NO_PROPOSAL_CHOSEN, or COOKIE
 	switch cause := errors.Cause(err); cause {
 	case protocol.ERR_INVALID_KE_PAYLOAD:
-		tid := config.ProposalIke[protocol.TRANSFORM_TYPE_DH].Transform.TransformId
+		// ask for the group of the proposal we would select
+		_, suite, _ := config.SelectProposal(protocol.IKE, init.proposals)
+		tid := uint16(suiteDhGroup(suite))
 		return notificationResponse(init.spiI, protocol.INVALID_KE_PAYLOAD, tid, remote)
 	case protocol.ERR_NO_PROPOSAL_CHOSEN:
 		return notificationResponse(init.spiI, protocol.NO_PROPOSAL_CHOSEN, nil, remote)
@@ -131,10 +164,20 @@ func notificationResponse(spi protocol.Spi, nt protocol.NotificationType, data i
 // incoming response
 //
 
+// peerRequestsDhGroupError is returned when responder wants KE from another group
+type peerRequestsDhGroupError struct {
+	DhGroup protocol.DhTransformId
+}
+
+func (e peerRequestsDhGroupError) Error() string {
+	return "Rx INVALID_KE_PAYLOAD: " + e.DhGroup.String()
+}
+
 func checkInitResponseForSession(sess *Session, msg *Message) error {
-	init, err := parseInit(msg)
-	if err != nil {
-		return err
+	// error responses only have a notification
+	init, parseErr := parseInit(msg)
+	if init == nil {
+		return parseErr
 	}
 	if init.isInitiator { // id must be zero
 		return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_SA_INIT: response from initiator")
@@ -143,29 +186,41 @@ func checkInitResponseForSession(sess *Session, msg *Message) error {
 	if bytes.Equal(init.spiR, init.spiI) {
 		return errors.Wrap(protocol.ERR_INVALID_IKE_SPI, "IKE_SA_INIT: invalid SPI")
 	}
-	// handle INVALID_KE_PAYLOAD, NO_PROPOSAL_CHOSEN, or COOKIE
+	// handle INVALID_KE_PAYLOAD, NO_PROPOSAL_CHOSEN, COOKIE, or REDIRECT
 	for _, notif := range init.ns {
 		switch notif.NotificationType {
+		case protocol.REDIRECT:
+			return checkRedirect(sess, notif)
 		case protocol.COOKIE:
 			return peerRequestsCookieError{notif}
 		case protocol.INVALID_KE_PAYLOAD:
-			// TODO - handle properly
-			return errors.Wrap(protocol.ERR_INVALID_KE_PAYLOAD, "IKE_SA_INIT: peer returned")
+			dh, ok := notif.NotificationMessage.(uint16)
+			if !ok {
+				return errors.Wrap(protocol.ERR_INVALID_KE_PAYLOAD, "IKE_SA_INIT: peer returned")
+			}
+			return peerRequestsDhGroupError{protocol.DhTransformId(dh)}
 		case protocol.NO_PROPOSAL_CHOSEN:
 			return errors.Wrap(protocol.ERR_NO_PROPOSAL_CHOSEN, "IKE_SA_INIT: peer returned")
 		}
 	}
+	if parseErr != nil {
+		return parseErr
+	}
 	// make sure responder spi is set
 	// in case messages are being reflected - TODO
 	if SpiToInt64(init.spiR) == 0 {
 		return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_SA_INIT: invalid responder SPI")
 	}
-	// check if transforms are usable
-	if err := sess.cfg.CheckDhTransform(init.dhTransformID); err != nil {
+	// responder must choose exactly one of our proposals
+	if len(init.proposals) != 1 {
+		return errors.Wrapf(protocol.ERR_NO_PROPOSAL_CHOSEN, "IKE_SA_INIT: %d proposals in response", len(init.proposals))
+	}
+	_, suite, err := sess.cfg.SelectProposal(protocol.IKE, init.proposals)
+	if err != nil {
 		return err
 	}
-	// check ike proposal
-	if err := sess.cfg.CheckProposals(protocol.IKE, init.proposals); err != nil {
+	// check if transforms are usable
+	if err := checkDhTransform(suite, init.dhTransformID); err != nil {
 		return err
 	}
 	msg.Params = init
@@ -0,0 +1,180 @@
+package ike
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// rfc5723 session resumption
+
+//
+// outgoing request
+//
+
+// ResumeFromSession creates IKE_SESSION_RESUME messages
+// initiator returns the ticket; there are no SA & KE payloads
+func ResumeFromSession(sess *Session) *Message {
+	nonce := sess.tkm.Nr
+	var ticket []byte
+	if sess.isInitiator {
+		nonce = sess.tkm.Ni
+		ticket = sess.resume.Opaque
+	}
+	return makeInit(&initParams{
+		isInitiator:   sess.isInitiator,
+		isResume:      true,
+		spiI:          sess.IkeSpiI,
+		spiR:          sess.IkeSpiR,
+		cookie:        sess.responderCookie,
+		nonce:         nonce,
+		hasNat:        true,
+		fragmentation: sess.fragmentation,
+		ticket:        ticket,
+	}, sess.Local, sess.Remote)
+}
+
+//
+// incoming request
+//
+
+// checkResumeRequest opens the ticket
+// COOKIE requests & rejected tickets are answered here
+func checkResumeRequest(msg *Message, conn Conn, config *Config, log log.Logger) error {
+	if err := msg.CheckFlags(); err != nil {
+		return err
+	}
+	init, err := parseInit(msg)
+	if err != nil {
+		return err
+	}
+	if err := _checkResumeRequest(config, init, msg.RemoteAddr); err != nil {
+		if reply := resumeErrorNeedsReply(init, msg.RemoteAddr, err); reply != nil {
+			log.Log("RESUME_REPLY", err.Error())
+			WriteMessage(conn, reply, nil, false, log)
+		}
+		return err
+	}
+	msg.Params = init
+	return nil
+}
+
+func _checkResumeRequest(cfg *Config, init *initParams, remote net.Addr) error {
+	if !init.isInitiator {
+		return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_SESSION_RESUME: request from responder")
+	}
+	if SpiToInt64(init.spiI) == 0 {
+		return errors.Wrap(protocol.ERR_INVALID_IKE_SPI, "IKE_SESSION_RESUME: missing SPI")
+	}
+	// ticket is used once, so only after peer returned our COOKIE
+	// otherwise a spoofed request could use it up
+	if init.cookie == nil {
+		return errMissingCookie
+	}
+	if err := checkCookie(cfg, init, remote); err != nil {
+		return err
+	}
+	if init.ticket == nil {
+		return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_SESSION_RESUME: missing ticket")
+	}
+	if cfg.Tickets == nil {
+		return errors.Wrap(errTicketRejected, "tickets are not issued")
+	}
+	st, err := cfg.Tickets.open(init.ticket)
+	if err != nil {
+		return err
+	}
+	init.resume = &Ticket{Opaque: init.ticket, Expires: st.Expires, state: st}
+	return nil
+}
+
+func resumeErrorNeedsReply(init *initParams, remote net.Addr, err error) (reply *Message) {
+	// send COOKIE, or TICKET_NACK
+	switch errors.Cause(err) {
+	case errMissingCookie:
+		reply = notificationResponse(init.spiI, protocol.COOKIE, getCookie(init.nonce, init.spiI, remote), remote)
+	case errTicketRejected, errTicketInvalid, errTicketExpired, errTicketReplayed:
+		reply = notificationResponse(init.spiI, protocol.TICKET_NACK, nil, remote)
+	default:
+		return nil
+	}
+	reply.IkeHeader.ExchangeType = protocol.IKE_SESSION_RESUME
+	return
+}
+
+//
+// incoming response
+//
+
+func checkResumeResponseForSession(sess *Session, msg *Message) error {
+	// error responses only have a notification
+	init, parseErr := parseInit(msg)
+	if init == nil {
+		return parseErr
+	}
+	if !init.isResume {
+		return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_SESSION_RESUME: incorrect type")
+	}
+	if init.isInitiator {
+		return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_SESSION_RESUME: response from initiator")
+	}
+	for _, notif := range init.ns {
+		switch notif.NotificationType {
+		case protocol.COOKIE:
+			return peerRequestsCookieError{notif}
+		case protocol.TICKET_NACK:
+			// full IKE_SA_INIT is needed
+			return errors.Wrap(errTicketRejected, "IKE_SESSION_RESUME: peer returned TICKET_NACK")
+		}
+	}
+	if parseErr != nil {
+		return parseErr
+	}
+	if SpiToInt64(init.spiR) == 0 || bytes.Equal(init.spiR, init.spiI) {
+		return errors.Wrap(protocol.ERR_INVALID_IKE_SPI, "IKE_SESSION_RESUME: invalid responder SPI")
+	}
+	msg.Params = init
+	return nil
+}
+
+//
+// tickets issued in IKE_AUTH
+//
+
+// issueTicket seals the IKE SA into a ticket, if peer asked for one
+func (sess *Session) issueTicket(msg *Message) error {
+	if sess.cfg.Tickets == nil || msg.Payloads.GetNotification(protocol.TICKET_REQUEST) == nil {
+		return nil
+	}
+	st := newTicketState(sess, peerIdPayload(sess, msg), sess.cfg.Tickets.Lifetime)
+	opaque, err := sess.cfg.Tickets.seal(st)
+	if err != nil {
+		return err
+	}
+	// MUTATION
+	sess.ticket = &Ticket{Opaque: opaque, Expires: st.Expires, state: st}
+	return nil
+}
+
+// keepTicket keeps the ticket responder issued
+// peerID is from responder's first IKE_AUTH reply
+func (sess *Session) keepTicket(msg *Message, peerID *protocol.IdPayload) {
+	n := msg.Payloads.GetNotification(protocol.TICKET_LT_OPAQUE)
+	if n == nil {
+		if sess.cfg.RequestTicket {
+			sess.Logger.Log("TICKET", "not issued")
+		}
+		return
+	}
+	tlt, ok := n.NotificationMessage.(*protocol.TicketLifetime)
+	if !ok {
+		return
+	}
+	st := newTicketState(sess, peerID, tlt.Lifetime)
+	// MUTATION
+	sess.ticket = &Ticket{Opaque: tlt.Ticket, Expires: st.Expires, state: st}
+	sess.Logger.Log("TICKET", "issued", "LIFETIME", tlt.Lifetime)
+}
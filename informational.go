@@ -84,16 +84,52 @@ func NotifyFromSession(sess *Session, ie protocol.IkeErrorCode, isResponse bool)
 
 // DeleteFromSession builds an IKE delete Request
 func DeleteFromSession(sess *Session) *Message {
+	return deleteIkeSa(sess.isInitiator, sess.IkeSpiI, sess.IkeSpiR)
+}
+
+// deleteIkeSa builds a delete Request for the IKE SA with spiI & spiR
+func deleteIkeSa(isInitiator bool, spiI, spiR protocol.Spi) *Message {
 	// ike protocol ID, but no spi
 	// always a request
+	return makeInformational(infoParams{
+		isInitiator: isInitiator,
+		spiI:        spiI,
+		spiR:        spiR,
+		payload: &protocol.DeletePayload{
+			PayloadHeader: &protocol.PayloadHeader{},
+			ProtocolId:    protocol.IKE,
+			Spis:          []protocol.Spi{},
+		},
+	})
+}
+
+// DeleteEspFromSession builds an ESP delete Request or a Response
+// spis are the ones we expect in inbound packets
+func DeleteEspFromSession(sess *Session, isResponse bool, spis ...protocol.Spi) *Message {
 	return makeInformational(infoParams{
 		isInitiator: sess.isInitiator,
+		isResponse:  isResponse,
 		spiI:        sess.IkeSpiI,
 		spiR:        sess.IkeSpiR,
 		payload: &protocol.DeletePayload{
 			PayloadHeader: &protocol.PayloadHeader{},
-			ProtocolId:    protocol.IKE,
-			Spis:          []protocol.Spi{},
+			ProtocolId:    protocol.ESP,
+			Spis:          spis,
+		},
+	})
+}
+
+// ConfigurationFromSession builds a Configuration Request or a Response
+func ConfigurationFromSession(sess *Session, cp *protocol.ConfigurationPayload, isResponse bool) *Message {
+	return makeInformational(infoParams{
+		isInitiator: sess.isInitiator,
+		isResponse:  isResponse,
+		spiI:        sess.IkeSpiI,
+		spiR:        sess.IkeSpiR,
+		payload: &protocol.ConfigurationPayload{
+			PayloadHeader:           &protocol.PayloadHeader{},
+			ConfigurationType:       cp.ConfigurationType,
+			ConfigurationAttributes: cp.ConfigurationAttributes,
 		},
 	})
 }
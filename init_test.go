@@ -51,10 +51,11 @@ func TestInit1(t *testing.T) {
 	}
 }
 
-// Initiator cannot handle INVALID_KE_PAYLOAD, responder can generate one
+// responder generates INVALID_KE_PAYLOAD, initiator retries with requested group
 func TestInit2(t *testing.T) {
 	var cfg1 = testConfig()
-	cfg1.ProposalIke = crypto.Aes128Sha256Ecp256
+	// KE is for the first proposal
+	cfg1.ProposalIke = []protocol.TransformMap{crypto.Aes128Sha256Ecp256, crypto.Aes128Sha256Modp3072}
 	cfg1.LocalID = pskTestID
 	cfg1.PeerID = pskTestID
 	_, net, _ := net.ParseCIDR("192.0.2.0/24")
@@ -67,9 +68,40 @@ func TestInit2(t *testing.T) {
 	go runTestInitiator(cfg1, &testcb{chr, sa, cerr}, chi, logger)
 
 	var cfg2 = *cfg1
-	cfg2.ProposalIke = crypto.Aes128Sha256Modp3072
+	cfg2.ProposalIke = []protocol.TransformMap{crypto.Aes128Sha256Modp3072}
 	go runTestResponder(&cfg2, &testcb{chi, sa, cerr}, chr, logger)
-	if err := waitFor2Sa(t, sa, cerr); errors.Cause(err) != protocol.ERR_INVALID_KE_PAYLOAD {
-		t.Error("wrong Error", err)
+	if err := waitFor2Sa(t, sa, cerr); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInitSetDhGroup(t *testing.T) {
+	cfg := testConfig()
+	cfg.ProposalIke = []protocol.TransformMap{crypto.Aes128Sha256Ecp256, crypto.Aes128Sha256Modp3072}
+	cfg.LocalID = pskTestID
+	cfg.PeerID = pskTestID
+	sess, err := NewInitiator(cfg, zeroAddr, zeroAddr, &testcb{}, &SessionCallback{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni, public := sess.tkm.Ni, sess.tkm.DhPublic
+	if err = sess.SetDhGroup(protocol.MODP_3072); err != nil {
+		t.Fatal(err)
+	}
+	if sess.tkm.suite.DhGroup.TransformId() != protocol.MODP_3072 || sess.tkm.DhPublic.Cmp(public) == 0 {
+		t.Error("KE was not regenerated")
+	}
+	if sess.tkm.Ni.Cmp(ni) != 0 {
+		t.Error("nonce changed")
+	}
+	init := InitFromSession(sess).Payloads.Get(protocol.PayloadTypeKE).(*protocol.KePayload)
+	if init.DhTransformId != protocol.MODP_3072 {
+		t.Error("wrong group in KE", init.DhTransformId)
+	}
+	// not allowed, or already used
+	for _, dh := range []protocol.DhTransformId{protocol.MODP_2048, protocol.MODP_3072} {
+		if err = sess.SetDhGroup(dh); errors.Cause(err) != protocol.ERR_INVALID_KE_PAYLOAD {
+			t.Error(dh, err)
+		}
 	}
 }
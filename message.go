@@ -57,7 +57,7 @@ func DecodeMessage(b []byte, log log.Logger) (msg *Message, err error) {
 		return
 	}
 	// save for later
-	msg.Data = b
+	msg.Data = b[:msg.IkeHeader.MsgLength]
 	return
 }
 
@@ -0,0 +1,272 @@
+package ike
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"reflect"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// rfc4555 MOBIKE
+
+// addressUpdate moves the IKE SA to new addresses
+type addressUpdate struct {
+	local, remote net.Addr
+}
+
+// UpdateAddresses asks the session to move to new addresses, nil keeps the current one
+// only the original initiator moves, once both peers support MOBIKE; responders ignore it
+// a pending update is replaced by the newer one
+func (sess *Session) UpdateAddresses(local, remote net.Addr) {
+	if sess.addressUpdates == nil {
+		return
+	}
+	for {
+		select {
+		case sess.addressUpdates <- addressUpdate{local, remote}:
+			return
+		default:
+		}
+		select {
+		case <-sess.addressUpdates:
+		default:
+		}
+	}
+}
+
+// UpdateSaAddressesFromSession builds UPDATE_SA_ADDRESSES Request or a Response
+// both carry NAT detection for the addresses they are sent from & to
+// HDR, SK { N(UPDATE_SA_ADDRESSES), N(NAT_DETECTION_SOURCE_IP), N(NAT_DETECTION_DESTINATION_IP), [N(COOKIE2)] } -->
+// <-- HDR, SK { N(NAT_DETECTION_SOURCE_IP), N(NAT_DETECTION_DESTINATION_IP), [N(COOKIE2)] }
+func UpdateSaAddressesFromSession(sess *Session, isResponse bool, cookie2 []byte) *Message {
+	info := makeInformational(infoParams{
+		isInitiator: sess.isInitiator,
+		isResponse:  isResponse,
+		spiI:        sess.IkeSpiI,
+		spiR:        sess.IkeSpiR,
+	})
+	if !isResponse {
+		info.Payloads.Add(&protocol.NotifyPayload{
+			PayloadHeader:    &protocol.PayloadHeader{},
+			NotificationType: protocol.UPDATE_SA_ADDRESSES,
+		})
+	}
+	addNatDetection(info, sess.IkeSpiI, sess.IkeSpiR, sess.Local, sess.Remote)
+	addCookie2(info, cookie2)
+	return info
+}
+
+// Cookie2FromSession builds a return routability check, or its Response
+// HDR, SK { N(COOKIE2) } -->
+// <-- HDR, SK { N(COOKIE2) }
+func Cookie2FromSession(sess *Session, isResponse bool, cookie2 []byte) *Message {
+	info := makeInformational(infoParams{
+		isInitiator: sess.isInitiator,
+		isResponse:  isResponse,
+		spiI:        sess.IkeSpiI,
+		spiR:        sess.IkeSpiR,
+	})
+	addCookie2(info, cookie2)
+	return info
+}
+
+func addCookie2(msg *Message, cookie2 []byte) {
+	if cookie2 == nil {
+		return
+	}
+	msg.Payloads.Add(&protocol.NotifyPayload{
+		PayloadHeader:       &protocol.PayloadHeader{},
+		NotificationType:    protocol.COOKIE2,
+		NotificationMessage: cookie2,
+	})
+}
+
+func newCookie2() []byte {
+	cookie2 := make([]byte, 16)
+	rand.Read(cookie2)
+	return cookie2
+}
+
+// getCookie2 returns COOKIE2 from msg, nil if there is none
+func getCookie2(msg *Message) []byte {
+	if n := msg.Payloads.GetNotification(protocol.COOKIE2); n != nil {
+		return n.NotificationMessage.([]byte)
+	}
+	return nil
+}
+
+// isReturnRoutabilityCheck checks if peer's request only has COOKIE2
+func isReturnRoutabilityCheck(msg *Message) bool {
+	return len(msg.Payloads.Array) == 1 && getCookie2(msg) != nil
+}
+
+// detectNat compares the NAT detection hashes of msg with the addresses
+func detectNat(msg *Message, spiI, spiR protocol.Spi, local, remote net.Addr) (natLocal, natRemote bool) {
+	for _, ns := range msg.Payloads.GetNotifications() {
+		switch ns.NotificationType {
+		case protocol.NAT_DETECTION_DESTINATION_IP:
+			natLocal = !checkNatHash(ns.NotificationMessage.([]byte), spiI, spiR, local)
+		case protocol.NAT_DETECTION_SOURCE_IP:
+			natRemote = !checkNatHash(ns.NotificationMessage.([]byte), spiI, spiR, remote)
+		}
+	}
+	return
+}
+
+// runUpdateSaAddresses moves IKE SA to new addresses, then the Child SAs once peer replied
+// NAT may be on the new path, so NAT-T port is used if we can
+func runUpdateSaAddresses(sess *Session, upd addressUpdate) (err error) {
+	if !sess.mobike {
+		sess.Logger.Log("MOBIKE", "not supported by peer")
+		return
+	}
+	local, remote := upd.local, upd.remote
+	if local == nil {
+		local = sess.Local
+	}
+	if remote == nil {
+		remote = sess.Remote
+	}
+	if sess.natConn != nil {
+		local = &net.UDPAddr{IP: AddrToIp(local), Port: NatTPort}
+		remote = &net.UDPAddr{IP: AddrToIp(remote), Port: NatTPort}
+	}
+	sess.moveTo(local, remote)
+	cookie2 := newCookie2()
+	updateFn := func() (*OutgoingMessage, error) {
+		return sess.InformationalMsg(UpdateSaAddressesFromSession(sess, false, cookie2))
+	}
+	msg, err := sess.sendMsgGetReply(updateFn, func(msg *Message) error {
+		return onRequest(sess, msg)
+	}, nil)
+	if err != nil {
+		return
+	}
+	for _, n := range msg.Payloads.GetNotifications() {
+		if nErr, ok := protocol.GetIkeErrorCode(n.NotificationType); ok {
+			return errors.Wrap(nErr, "UPDATE_SA_ADDRESSES: peer notified")
+		}
+	}
+	if !bytes.Equal(getCookie2(msg), cookie2) {
+		return errors.New("UPDATE_SA_ADDRESSES: COOKIE2 was not returned")
+	}
+	sess.setNatState(detectNat(msg, sess.IkeSpiI, sess.IkeSpiR, sess.Local, sess.Remote))
+	return sess.moveSas()
+}
+
+// onUpdateSaAddresses moves IKE SA to the addresses peer sent the request from
+// Child SAs follow once return routability of the new address is checked
+func onUpdateSaAddresses(sess *Session, msg *Message) error {
+	if !sess.mobike || sess.addressUpdates != nil {
+		level.Warn(sess.Logger).Log("MOBIKE", "unexpected UPDATE_SA_ADDRESSES")
+		return sess.SendEmptyInformational(true)
+	}
+	if msg.LocalAddr != nil && msg.RemoteAddr != nil {
+		sess.moveTo(msg.LocalAddr, msg.RemoteAddr)
+		sess.setNatState(detectNat(msg, sess.IkeSpiI, sess.IkeSpiR, msg.LocalAddr, msg.RemoteAddr))
+		// MUTATION
+		sess.addressesMoved = true
+	}
+	reply := UpdateSaAddressesFromSession(sess, true, getCookie2(msg))
+	reply.IkeHeader.MsgID = sess.msgIDResp.reply()
+	return sess.sendMsg(sess.encode(reply))
+}
+
+// onReturnRoutabilityCheck returns peer's COOKIE2
+func onReturnRoutabilityCheck(sess *Session, msg *Message) error {
+	reply := Cookie2FromSession(sess, true, getCookie2(msg))
+	reply.IkeHeader.MsgID = sess.msgIDResp.reply()
+	return sess.sendMsg(sess.encode(reply))
+}
+
+// runReturnRoutabilityCheck checks that peer can be reached at its new address
+// then moves the Child SAs there
+func runReturnRoutabilityCheck(sess *Session) (err error) {
+	// MUTATION
+	sess.addressesMoved = false
+	cookie2 := newCookie2()
+	checkFn := func() (*OutgoingMessage, error) {
+		return sess.InformationalMsg(Cookie2FromSession(sess, false, cookie2))
+	}
+	msg, err := sess.sendMsgGetReply(checkFn, func(msg *Message) error {
+		return onRequest(sess, msg)
+	}, nil)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(getCookie2(msg), cookie2) {
+		return errors.New("return routability: COOKIE2 was not returned")
+	}
+	return sess.moveSas()
+}
+
+// moveTo switches IKE SA to new addresses
+// messages to NAT-T port are sent with its socket; peer does not move back from it
+func (sess *Session) moveTo(local, remote net.Addr) {
+	sess.Logger.Log("MOBIKE", fmt.Sprintf("%s<=>%s", local, remote))
+	// MUTATION
+	sess.Local, sess.Remote = local, remote
+	if _, port := AddrToIpPort(local); port == NatTPort && sess.natConn != nil {
+		sess.Conn = sess.natConn
+	}
+}
+
+// setNatState records NAT on the new path
+// ESP is sent in UDP only through NAT
+func (sess *Session) setNatState(natLocal, natRemote bool) {
+	sess.Logger.Log("NAT", "update", "LOCAL", natLocal, "REMOTE", natRemote)
+	// MUTATION
+	sess.natLocal, sess.natRemote = natLocal, natRemote
+	sess.udpEncap = sess.natConn != nil && sess.Conn == sess.natConn && (natLocal || natRemote)
+}
+
+// moveSas re-installs Child SAs & their policies at the session's addresses
+// spis & keys are kept
+func (sess *Session) moveSas() (err error) {
+	var moved []*childSa
+	for _, child := range sess.children {
+		old := child.sa
+		if old == nil {
+			continue
+		}
+		if sess.Cb.RemoveChildSa != nil {
+			if err = sess.Cb.RemoveChildSa(sess, old); err != nil {
+				return
+			}
+		}
+		// policy is shared by Child SAs with the same selectors
+		shared := false
+		for _, c := range moved {
+			if reflect.DeepEqual(c.tsI, child.tsI) && reflect.DeepEqual(c.tsR, child.tsR) {
+				shared = true
+			}
+		}
+		if !shared {
+			pol := *old.PolicyParams
+			pol.IniPort, pol.ResPort = 0, 0
+			if sess.Cb.RemovePolicy != nil {
+				if err = sess.Cb.RemovePolicy(sess, &pol); err != nil {
+					return
+				}
+			}
+			if err = sess.installPolicy(child); err != nil {
+				return
+			}
+		}
+		sa := *old
+		pol := *old.PolicyParams
+		sa.PolicyParams = &pol
+		if err = sess.AddSa(&sa); err != nil {
+			return
+		}
+		// MUTATION
+		child.sa = &sa
+		moved = append(moved, child)
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package ike
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/msgboxio/ike/platform"
+)
+
+func TestMobikeUpdateAddresses(t *testing.T) {
+	ini, res := establishedTestSessions(t, nil)
+	recI, recR := &saRecorder{}, &saRecorder{}
+	ini.Cb, res.Cb = recI.callback(), recR.callback()
+	ini.mobike, res.mobike = true, true
+	ini.addressUpdates = make(chan addressUpdate, 1)
+	// address responder sees initiator's messages from
+	var from atomic.Value
+	from.Store(ini.Local)
+	toI, toR := make(chan []byte, 10), make(chan []byte, 10)
+	ini.Conn, res.Conn = &testcb{writeTo: toR}, &testcb{writeTo: toI}
+	go func() {
+		for b := range toR {
+			if msg, err := DecodeMessage(b, logger); err == nil {
+				msg.LocalAddr, msg.RemoteAddr = res.Local, from.Load().(net.Addr)
+				res.PostMessage(msg)
+			}
+		}
+	}()
+	go func() {
+		for b := range toI {
+			if msg, err := DecodeMessage(b, logger); err == nil {
+				ini.PostMessage(msg)
+			}
+		}
+	}()
+	cerr := make(chan error, 2)
+	go func() { cerr <- monitorSa(ini) }()
+	go func() { cerr <- monitorSa(res) }()
+	waitFor := func(rec *saRecorder, installed int) []*platform.SaParams {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			select {
+			case err := <-cerr:
+				t.Fatal(err)
+			case <-time.After(10 * time.Millisecond):
+			}
+			if sas, _ := rec.get(); len(sas) == installed {
+				return sas
+			}
+		}
+		t.Fatal("SA was not installed")
+		return nil
+	}
+	waitFor(recI, 1)
+	waitFor(recR, 1)
+	// initiator moved to another network
+	moved := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 500}
+	from.Store(net.Addr(moved))
+	ini.UpdateAddresses(moved, nil)
+	for _, rec := range []*saRecorder{recI, recR} {
+		sas := waitFor(rec, 2)
+		_, removed := rec.get()
+		if len(removed) != 1 || !removed[0].Ini.Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Fatal("old SA was not removed")
+		}
+		// same spis & keys at the new address
+		if !sameSa(sas[0], sas[1]) || !sas[1].Ini.Equal(moved.IP) {
+			t.Errorf("SA was not moved: %s<=>%s", sas[1].Ini, sas[1].Res)
+		}
+		if rec.getPolicies() != 1 {
+			t.Errorf("%d policies", rec.getPolicies())
+		}
+	}
+}
+
+func TestMobikeNatDetection(t *testing.T) {
+	ini, res := establishedTestSessions(t, nil)
+	local := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 500}
+	mapped := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1500}
+	ini.Local = local
+	update := UpdateSaAddressesFromSession(ini, false, newCookie2())
+	if natLocal, natRemote := detectNat(update, ini.IkeSpiI, ini.IkeSpiR, res.Local, mapped); natLocal || !natRemote {
+		t.Error("responder did not detect NAT")
+	}
+	res.Remote = mapped
+	reply := UpdateSaAddressesFromSession(res, true, nil)
+	if natLocal, natRemote := detectNat(reply, ini.IkeSpiI, ini.IkeSpiR, local, ini.Remote); !natLocal || natRemote {
+		t.Error("initiator did not detect NAT")
+	}
+}
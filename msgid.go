@@ -1,39 +1,164 @@
 package ike
 
 import (
-	"log"
+	"fmt"
+	"math"
+	"sync"
 
+	"github.com/msgboxio/ike/protocol"
 	"github.com/pkg/errors"
 )
 
+// msgIDRekeyAt leaves enough ids to rekey the IKE SA before they wrap around
+const msgIDRekeyAt uint32 = math.MaxUint32 - 1<<16
+
+// msgID tracks message ids of requests in one direction, rfc7296 2.3
+// up to window requests can be outstanding
+// checked when messages are read & used when they are handled, so it is locked
 type msgID struct {
-	id        int
-	confirmed bool
+	mu      sync.Mutex
+	low     uint32          // lowest outstanding id
+	high    uint32          // id of the next new request
+	window  uint32          // SET_WINDOW_SIZE of the side receiving the requests
+	done    map[uint32]bool // outstanding ids already done
+	replyID uint32          // id of the request being answered
+
+	responses map[uint32]*OutgoingMessage // resent for retransmitted requests
 }
 
-func (m *msgID) confirm() (err error) {
-	if m.confirmed {
-		err = errors.New("confirming a confirmed id")
-		log.Printf("%+v", err)
-		return
+func newMsgID(window uint32) *msgID {
+	if window == 0 {
+		window = 1
 	}
-	m.id++
-	m.confirmed = true
-	return
+	return &msgID{window: window, done: map[uint32]bool{}}
 }
 
-// TODO - handle overflow
+// next allocates id for our request
 func (m *msgID) next() uint32 {
-	if m.confirmed {
-		m.confirmed = false
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.high
+	m.high++
+	return id
+}
+
+// hasRoom checks if peer accepts another request
+func (m *msgID) hasRoom() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.high-m.low < m.window
+}
+
+// confirm marks our request as answered
+func (m *msgID) confirm(id uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isOutstanding(id) {
+		return errors.Wrap(protocol.ERR_INVALID_MESSAGE_ID,
+			fmt.Sprintf("unexpected response id %d, outstanding %d-%d", id, m.low, m.high))
+	}
+	m.setDone(id)
+	return nil
+}
+
+// isPending checks if response to our request can still arrive
+func (m *msgID) isPending(id uint32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.isOutstanding(id)
+}
+
+func (m *msgID) isOutstanding(id uint32) bool {
+	return id-m.low < m.high-m.low && !m.done[id]
+}
+
+// accept checks if peer's request is new & within our window
+func (m *msgID) accept(id uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isNew(id) {
+		return errors.Wrap(protocol.ERR_INVALID_MESSAGE_ID,
+			fmt.Sprintf("unexpected request id %d, window %d-%d", id, m.low, m.low+m.window-1))
+	}
+	if id-m.low >= m.high-m.low {
+		m.high = id + 1
+	}
+	m.setDone(id)
+	return nil
+}
+
+// canAccept checks if peer's request would be accepted
+func (m *msgID) canAccept(id uint32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.isNew(id)
+}
+
+func (m *msgID) isNew(id uint32) bool {
+	return id-m.low < m.window && !m.done[id]
+}
+
+// replyTo is called when peer's request is handled
+func (m *msgID) replyTo(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replyID = id
+}
+
+// reply returns id for the response to the request being handled
+func (m *msgID) reply() uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.replyID
+}
+
+// addResponse keeps responses to requests peer may still retransmit
+func (m *msgID) addResponse(msg *OutgoingMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.responses == nil {
+		m.responses = map[uint32]*OutgoingMessage{}
+	}
+	m.responses[msg.header.MsgID] = msg
+	for id := range m.responses {
+		// left the window
+		if m.low-id > m.window && id-m.low >= m.window {
+			delete(m.responses, id)
+		}
 	}
-	return uint32(m.id)
 }
 
-func (m *msgID) get() int {
-	return m.id
+func (m *msgID) response(id uint32) *OutgoingMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.responses[id]
+}
+
+func (m *msgID) setDone(id uint32) {
+	m.done[id] = true
+	for m.done[m.low] {
+		delete(m.done, m.low)
+		m.low++
+	}
+}
+
+func (m *msgID) reset(to uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.low, m.high = to, to
+	m.done = map[uint32]bool{}
+}
+
+func (m *msgID) setWindow(window uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if window > 0 {
+		m.window = window
+	}
 }
 
-func (m *msgID) reset(to int) {
-	m.id = to
+func (m *msgID) exhausted() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.high >= msgIDRekeyAt
 }
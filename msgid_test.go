@@ -0,0 +1,75 @@
+package ike
+
+import (
+	"testing"
+	"time"
+
+	"github.com/msgboxio/ike/protocol"
+)
+
+func TestMsgIDWindow(t *testing.T) {
+	// our requests, peer accepts 2 at once
+	req := newMsgID(1)
+	req.setWindow(2)
+	if req.next() != 0 || req.next() != 1 || req.hasRoom() {
+		t.Fatal("window of 2")
+	}
+	// responses may come in any order
+	if err := req.confirm(1); err != nil || req.hasRoom() {
+		t.Fatal("window moved", err)
+	}
+	if err := req.confirm(1); err == nil {
+		t.Error("confirmed twice")
+	}
+	if err := req.confirm(0); err != nil || !req.hasRoom() || req.isPending(2) {
+		t.Fatal("window did not move", err)
+	}
+	// peer's requests, we accept 2 at once
+	resp := newMsgID(2)
+	if resp.accept(2) == nil {
+		t.Error("accepted beyond window")
+	}
+	if err := resp.accept(1); err != nil || !resp.canAccept(0) || resp.canAccept(1) {
+		t.Fatal("out of order", err)
+	}
+	if err := resp.accept(0); err != nil || resp.accept(0) == nil || !resp.canAccept(3) {
+		t.Fatal("window did not move", err)
+	}
+	// responses are kept while peer may retransmit
+	resp.replyTo(3)
+	if resp.reply() != 3 {
+		t.Error("reply id")
+	}
+	for id := uint32(0); id < 6; id++ {
+		if id >= 2 {
+			resp.accept(id)
+		}
+		resp.addResponse(&OutgoingMessage{header: &protocol.IkeHeader{MsgID: id}})
+	}
+	if resp.response(5) == nil || resp.response(4) == nil || resp.response(1) != nil {
+		t.Error("wrong responses kept")
+	}
+}
+
+// IKE SA is rekeyed before message ids run out
+func TestMsgIDExhausted(t *testing.T) {
+	rekeyed := make(chan ikeSaState, 2)
+	ini, res := establishedTestSessions(t, rekeyed)
+	ini.msgIDReq.reset(msgIDRekeyAt)
+	res.msgIDResp.reset(msgIDRekeyAt)
+	cerr := make(chan error, 2)
+	go func() { cerr <- monitorSa(ini) }()
+	go func() { cerr <- monitorSa(res) }()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-rekeyed:
+		case err := <-cerr:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("IKE SA was not rekeyed")
+		}
+	}
+	if ini.msgIDReq.exhausted() {
+		t.Error("message ids were not reset")
+	}
+}
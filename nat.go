@@ -3,12 +3,17 @@ package ike
 import (
 	"bytes"
 	"crypto/sha1"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/msgboxio/ike/protocol"
 	"github.com/msgboxio/packets"
 )
 
+// DefaultNatKeepalive is frequent enough for most NAT mappings, rfc3948
+const DefaultNatKeepalive = 20 * time.Second
+
 func checkNatHash(digest []byte, spiI, spiR protocol.Spi, addr net.Addr) bool {
 	target := getNatHash(spiI, spiR, addr)
 	return bytes.Equal(digest, target)
@@ -25,3 +30,80 @@ func getNatHash(spiI, spiR protocol.Spi, addr net.Addr) []byte {
 	digest.Write(portb)
 	return digest.Sum(nil)
 }
+
+// addNatDetection adds hashes of the addresses msg is sent from & to
+func addNatDetection(msg *Message, spiI, spiR protocol.Spi, local, remote net.Addr) {
+	msg.Payloads.Add(&protocol.NotifyPayload{
+		PayloadHeader:       &protocol.PayloadHeader{},
+		NotificationType:    protocol.NAT_DETECTION_DESTINATION_IP,
+		NotificationMessage: getNatHash(spiI, spiR, remote),
+	})
+	msg.Payloads.Add(&protocol.NotifyPayload{
+		PayloadHeader:       &protocol.PayloadHeader{},
+		NotificationType:    protocol.NAT_DETECTION_SOURCE_IP,
+		NotificationMessage: getNatHash(spiI, spiR, local),
+	})
+}
+
+// setNat records which side is behind NAT
+// initiator moves to NAT-T port, responder follows when it sees messages on that port
+func (sess *Session) setNat(init *initParams) {
+	sess.Logger.Log("NAT", "detected", "LOCAL", init.natLocal, "REMOTE", init.natRemote)
+	// MUTATION
+	sess.natLocal, sess.natRemote = init.natLocal, init.natRemote
+	if !sess.isInitiator {
+		return
+	}
+	if sess.natConn == nil {
+		sess.Logger.Log("NAT", "no socket for NAT-T port")
+		return
+	}
+	sess.useNatT(
+		&net.UDPAddr{IP: AddrToIp(sess.Local), Port: NatTPort},
+		&net.UDPAddr{IP: AddrToIp(sess.Remote), Port: NatTPort})
+}
+
+// followNatT moves responder to NAT-T port, if peer sent msg to it
+// replies are sent to the port NAT mapped for peer
+func (sess *Session) followNatT(msg *Message) {
+	if sess.udpEncap || sess.natConn == nil || msg.LocalAddr == nil {
+		return
+	}
+	if _, port := AddrToIpPort(msg.LocalAddr); port != NatTPort {
+		return
+	}
+	sess.useNatT(msg.LocalAddr, msg.RemoteAddr)
+}
+
+func (sess *Session) useNatT(local, remote net.Addr) {
+	sess.Logger.Log("NAT-T", fmt.Sprintf("%s<=>%s", local, remote))
+	// MUTATION
+	sess.Conn = sess.natConn
+	sess.Local, sess.Remote = local, remote
+	sess.udpEncap = true
+}
+
+// saPorts returns ports for UDP encapsulated ESP
+// zero when ESP is sent as is
+func (sess *Session) saPorts() (int, int) {
+	if !sess.udpEncap {
+		return 0, 0
+	}
+	_, localPort := AddrToIpPort(sess.Local)
+	_, remotePort := AddrToIpPort(sess.Remote)
+	if sess.isInitiator {
+		return localPort, remotePort
+	}
+	return remotePort, localPort
+}
+
+// sendNatKeepalive is sent by the side behind NAT
+func (sess *Session) sendNatKeepalive() {
+	conn, ok := sess.Conn.(*natTConn)
+	if !ok || !sess.natLocal || !sess.udpEncap {
+		return
+	}
+	if err := conn.writeKeepalive(sess.Remote); err != nil {
+		sess.Logger.Log("NAT", "keepalive", "ERROR", err)
+	}
+}
@@ -0,0 +1,64 @@
+package ike
+
+import (
+	"net"
+	"testing"
+
+	"github.com/msgboxio/ike/platform"
+)
+
+func TestNatT(t *testing.T) {
+	iAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 500}
+	natAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1500}
+	rAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 500}
+	var installed *platform.SaParams
+	cb := &SessionCallback{
+		InstallChildSa: func(_ *Session, sa *platform.SaParams) error {
+			installed = sa
+			return nil
+		},
+	}
+	ini, err := NewInitiator(testCfg(), iAddr, rAddr, testConn(), cb, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ini.natConn = &natTConn{testConn()}
+	// responder sees the address mapped by NAT
+	b, _ := InitFromSession(ini).Encode(nil, true, logger)
+	msg, _ := DecodeMessage(b, logger)
+	msg.LocalAddr, msg.RemoteAddr = rAddr, natAddr
+	init, err := parseInit(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !init.hasNat || init.natLocal || !init.natRemote {
+		t.Fatal("NAT was not detected")
+	}
+	// initiator moves to NAT-T port
+	ini.setNat(&initParams{hasNat: true, natLocal: true})
+	if ini.Conn != ini.natConn || ini.Remote.String() != "192.0.2.2:4500" {
+		t.Fatal("initiator did not move", ini.Remote)
+	}
+	ini.AddSa(&platform.SaParams{PolicyParams: ini.cfg.Policy()})
+	if installed.IniPort != NatTPort || installed.ResPort != NatTPort {
+		t.Error("ESP is not in UDP", installed.IniPort, installed.ResPort)
+	}
+	// responder follows to the mapped port
+	res := &Session{
+		natConn: &natTConn{testConn()},
+		Local:   rAddr,
+		Remote:  natAddr,
+		Logger:  logger,
+	}
+	res.setNat(init)
+	if res.udpEncap {
+		t.Fatal("responder moved")
+	}
+	res.followNatT(&Message{
+		LocalAddr:  &net.UDPAddr{IP: rAddr.IP, Port: NatTPort},
+		RemoteAddr: &net.UDPAddr{IP: natAddr.IP, Port: 1501},
+	})
+	if iniPort, resPort := res.saPorts(); iniPort != 1501 || resPort != NatTPort || res.Conn != res.natConn {
+		t.Error("responder did not follow", iniPort, resPort)
+	}
+}
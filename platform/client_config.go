@@ -0,0 +1,13 @@
+package platform
+
+import "net"
+
+// ClientConfig is the configuration a remote access gateway assigned to us
+type ClientConfig struct {
+	Gateway   net.IP       // remote tunnel endpoint
+	Addresses []*net.IPNet // internal addresses
+	DNS       []net.IP
+	Subnets   []*net.IPNet // networks reachable through the tunnel
+
+	linkIndex int // interface the address was added to
+}
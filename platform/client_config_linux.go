@@ -0,0 +1,87 @@
+// +build linux
+
+package platform
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// clientRoutes returns routes for the subnets, using the first assigned address
+// of matching family as source
+func clientRoutes(cfg *ClientConfig, gw *netlink.Route) (routes []*netlink.Route) {
+	for _, subnet := range cfg.Subnets {
+		for _, addr := range cfg.Addresses {
+			if (addr.IP.To4() == nil) != (subnet.IP.To4() == nil) {
+				continue
+			}
+			routes = append(routes, &netlink.Route{
+				LinkIndex: cfg.linkIndex,
+				Dst:       subnet,
+				Src:       addr.IP,
+				Gw:        gw.Gw,
+			})
+			break
+		}
+	}
+	return
+}
+
+// InstallClientConfig adds the internal addresses to the interface facing the gateway
+// and routes the subnets through it
+func InstallClientConfig(sid int32, cfg *ClientConfig, log log.Logger) error {
+	gws, err := netlink.RouteGet(cfg.Gateway)
+	if err != nil {
+		return errors.Wrapf(err, "no route to %s", cfg.Gateway)
+	}
+	gw := &gws[0]
+	link, err := netlink.LinkByIndex(gw.LinkIndex)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	cfg.linkIndex = gw.LinkIndex
+	for _, addr := range cfg.Addresses {
+		log.Log("ADD_ADDRESS", fmt.Sprintf("%s dev %s", addr, link.Attrs().Name))
+		if err = netlink.AddrAdd(link, &netlink.Addr{IPNet: addr}); err != nil {
+			return errors.Wrapf(err, "adding %s", addr)
+		}
+	}
+	for _, route := range clientRoutes(cfg, gw) {
+		log.Log("ADD_ROUTE", fmt.Sprintf("%s src %s via %s", route.Dst, route.Src, route.Gw))
+		if err = netlink.RouteReplace(route); err != nil {
+			return errors.Wrapf(err, "adding route %s", route.Dst)
+		}
+	}
+	if len(cfg.DNS) > 0 {
+		log.Log("DNS", fmt.Sprintf("%s", cfg.DNS))
+	}
+	return nil
+}
+
+// RemoveClientConfig removes what InstallClientConfig added
+func RemoveClientConfig(sid int32, cfg *ClientConfig, log log.Logger) (err error) {
+	link, err := netlink.LinkByIndex(cfg.linkIndex)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	gw := &netlink.Route{}
+	if gws, _err := netlink.RouteGet(cfg.Gateway); _err == nil {
+		gw = &gws[0]
+	}
+	for _, route := range clientRoutes(cfg, gw) {
+		log.Log("REMOVE_ROUTE", fmt.Sprintf("%s src %s", route.Dst, route.Src))
+		if _err := netlink.RouteDel(route); _err != nil {
+			err = errors.Wrapf(_err, "removing route %s", route.Dst)
+		}
+	}
+	for _, addr := range cfg.Addresses {
+		log.Log("REMOVE_ADDRESS", fmt.Sprintf("%s dev %s", addr, link.Attrs().Name))
+		if _err := netlink.AddrDel(link, &netlink.Addr{IPNet: addr}); _err != nil {
+			err = errors.Wrapf(_err, "removing %s", addr)
+		}
+	}
+	return
+}
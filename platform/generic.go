@@ -26,10 +26,21 @@ func RemoveChildSa(sid int32, *SaParams, log.Logger) error {
 	return  errors.Errorf("RemoveChildSa is not supported on %s", runtime.GOOS)
 }
 
+func InstallClientConfig(sid int32, *ClientConfig, log.Logger) error {
+	return  errors.Errorf("InstallClientConfig is not supported on %s", runtime.GOOS)
+}
+func RemoveClientConfig(sid int32, *ClientConfig, log.Logger) error {
+	return  errors.Errorf("RemoveClientConfig is not supported on %s", runtime.GOOS)
+}
+
 func SetSocketBypass(conn net.Conn) (err error) {
 	return  errors.Errorf("SetSocketBypass is not supported on %s", runtime.GOOS)
 }
 
+func SetSocketEncap(conn net.Conn) (err error) {
+	return errors.Errorf("SetSocketEncap is not supported on %s", runtime.GOOS)
+}
+
 func ListenForEvents(context.Context, func(interface{}), log.Logger) {
 	return
 }
@@ -422,5 +422,9 @@ func SetSocketBypass(conn net.Conn) error {
 	return os.NewSyscallError("setsockopt", setsockopt(fd, sol, ipsecPolicy, unsafe.Pointer(&policy), SADB_POLICY_SIZE))
 }
 
+func SetSocketEncap(conn net.Conn) error {
+	return errors.Errorf("SetSocketEncap is not supported on %s", runtime.GOOS)
+}
+
 func ListenForEvents(context.Context, func(interface{}), log.Logger) {
 }
@@ -4,6 +4,7 @@ import (
 	"net"
 	"runtime"
 
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
@@ -25,3 +26,11 @@ func GetLocalAddress(remote net.IP) (local net.IP, err error) {
 	*/
 	return nil, errors.Errorf("GetLocalAddress is not supported on %s", runtime.GOOS)
 }
+
+func InstallClientConfig(sid int32, cfg *ClientConfig, log log.Logger) error {
+	return errors.Errorf("InstallClientConfig is not supported on %s", runtime.GOOS)
+}
+
+func RemoveClientConfig(sid int32, cfg *ClientConfig, log log.Logger) error {
+	return errors.Errorf("RemoveClientConfig is not supported on %s", runtime.GOOS)
+}
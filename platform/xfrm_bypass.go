@@ -37,3 +37,19 @@ func SetSocketBypass(conn net.Conn) error {
 	policy.Dir = uint8(netlink.XFRM_DIR_OUT)
 	return os.NewSyscallError("setsockopt", setsockopt(fd, sol, ipsecPolicy, unsafe.Pointer(&policy), policy.Len()))
 }
+
+const (
+	UDP_ENCAP          = 100
+	UDP_ENCAP_ESPINUDP = 2
+)
+
+// SetSocketEncap makes kernel decapsulate ESP received on NAT-T port 4500
+// IKE messages with the non-ESP marker are still passed to the socket
+func SetSocketEncap(conn net.Conn) error {
+	fd, _, err := sysfd(conn)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	encap := int32(UDP_ENCAP_ESPINUDP)
+	return os.NewSyscallError("setsockopt", setsockopt(fd, syscall.IPPROTO_UDP, UDP_ENCAP, unsafe.Pointer(&encap), 4))
+}
@@ -26,3 +26,38 @@ func (s *CertPayload) Decode(b []byte) error {
 	s.Data = append([]byte{}, b[1:]...)
 	return nil
 }
+
+func (s *CertRequestPayload) Type() PayloadType {
+	return PayloadTypeCERTREQ
+}
+
+func (s *CertRequestPayload) Encode() (b []byte) {
+	b = []byte{uint8(s.CertEncodingType)}
+	return append(b, s.CertificationAuthority...)
+}
+
+func (s *CertRequestPayload) Decode(b []byte) error {
+	if len(b) < 1 {
+		return errors.Wrap(ERR_INVALID_SYNTAX, "certreq too small")
+	}
+	// Header has already been decoded
+	ct, _ := packets.ReadB8(b, 0)
+	s.CertEncodingType = CertEncodingType(ct)
+	s.CertificationAuthority = append([]byte{}, b[1:]...)
+	if s.CertEncodingType == X_509_CERTIFICATE_SIGNATURE && len(s.CertificationAuthority)%CA_HASH_LENGTH != 0 {
+		return errors.Wrap(ERR_INVALID_SYNTAX, fmt.Sprintf("certreq length %d is not a multiple of %d",
+			len(s.CertificationAuthority), CA_HASH_LENGTH))
+	}
+	return nil
+}
+
+// CA_HASH_LENGTH is length of SHA-1 hash of a CA public key
+const CA_HASH_LENGTH = 20
+
+// Authorities splits the Certification Authority field into SHA-1 hashes of CA public keys
+func (s *CertRequestPayload) Authorities() (hashes [][]byte) {
+	for b := s.CertificationAuthority; len(b) >= CA_HASH_LENGTH; b = b[CA_HASH_LENGTH:] {
+		hashes = append(hashes, b[:CA_HASH_LENGTH])
+	}
+	return
+}
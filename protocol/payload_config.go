@@ -2,13 +2,25 @@ package protocol
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/msgboxio/packets"
 	"github.com/pkg/errors"
 )
 
-func (s *ConfigurationPayload) Type() PayloadType  { return PayloadTypeCP }
-func (s *ConfigurationPayload) Encode() (b []byte) { return }
+func (s *ConfigurationPayload) Type() PayloadType { return PayloadTypeCP }
+
+func (s *ConfigurationPayload) Encode() (b []byte) {
+	b = []byte{uint8(s.ConfigurationType), 0, 0, 0}
+	for _, attr := range s.ConfigurationAttributes {
+		ab := make([]byte, 4)
+		packets.WriteB16(ab, 0, uint16(attr.ConfigurationAttributeType)&0x7fff)
+		packets.WriteB16(ab, 2, uint16(len(attr.Value)))
+		b = append(b, append(ab, attr.Value...)...)
+	}
+	return
+}
+
 func (s *ConfigurationPayload) Decode(b []byte) error {
 	if len(b) < 4 {
 		return errors.Wrap(ERR_INVALID_SYNTAX, fmt.Sprintf("payload too small %d < %d", len(b), 4))
@@ -25,26 +37,198 @@ func (s *ConfigurationPayload) Decode(b []byte) error {
 		if len(b) < 4+int(aLen) {
 			return errors.Wrap(ERR_INVALID_SYNTAX, fmt.Sprintf("Attribute value too small %d < %d", len(b), 4+int(aLen)))
 		}
-		switch ConfigurationAttributeType(aType) {
-		case INTERNAL_IP4_ADDRESS:
-		case INTERNAL_IP4_NETMASK:
-		case INTERNAL_IP4_DNS:
-		case INTERNAL_IP4_NBNS:
-		case INTERNAL_IP4_DHCP:
-		case APPLICATION_VERSION:
-		case INTERNAL_IP6_ADDRESS:
-		case INTERNAL_IP6_DNS:
-		case INTERNAL_IP6_DHCP:
-		case INTERNAL_IP4_SUBNET:
-		case SUPPORTED_ATTRIBUTES:
-		case INTERNAL_IP6_SUBNET:
+		// reserved bit is ignored
+		attrType := ConfigurationAttributeType(aType & 0x7fff)
+		if !isAttributeLengthValid(attrType, int(aLen)) {
+			return errors.Wrap(ERR_INVALID_SYNTAX, fmt.Sprintf("Attribute %d has invalid length %d", attrType, aLen))
 		}
 		attr := &ConfigurationAttribute{
-			ConfigurationAttributeType: ConfigurationAttributeType(aType),
-			Value: append([]byte{}, b[4:aLen+4]...),
+			ConfigurationAttributeType: attrType,
+			Value:                      append([]byte{}, b[4:aLen+4]...),
 		}
 		s.ConfigurationAttributes = append(s.ConfigurationAttributes, attr)
 		b = b[aLen+4:]
 	}
 	return nil
 }
+
+// rfc7296 section 3.15.1; an empty value is always allowed
+func isAttributeLengthValid(t ConfigurationAttributeType, l int) bool {
+	if l == 0 {
+		return true
+	}
+	switch t {
+	case INTERNAL_IP4_ADDRESS, INTERNAL_IP4_NETMASK, INTERNAL_IP4_DNS, INTERNAL_IP4_NBNS, INTERNAL_IP4_DHCP:
+		return l == net.IPv4len
+	case INTERNAL_IP6_DNS, INTERNAL_IP6_DHCP:
+		return l == net.IPv6len
+	case INTERNAL_IP6_ADDRESS, INTERNAL_IP6_SUBNET:
+		return l == net.IPv6len+1
+	case INTERNAL_IP4_SUBNET:
+		return l == 2*net.IPv4len
+	case SUPPORTED_ATTRIBUTES:
+		return l%2 == 0
+	}
+	// APPLICATION_VERSION & unknown attributes
+	return true
+}
+
+// Get returns all attributes of given type
+func (s *ConfigurationPayload) Get(t ConfigurationAttributeType) (attrs []*ConfigurationAttribute) {
+	for _, attr := range s.ConfigurationAttributes {
+		if attr.ConfigurationAttributeType == t {
+			attrs = append(attrs, attr)
+		}
+	}
+	return
+}
+
+// Add appends an attribute
+func (s *ConfigurationPayload) Add(attr *ConfigurationAttribute) {
+	s.ConfigurationAttributes = append(s.ConfigurationAttributes, attr)
+}
+
+// IPs returns addresses from INTERNAL_IP4_ADDRESS, INTERNAL_IP4_DNS, INTERNAL_IP6_DNS etc
+// empty attributes are skipped
+func (s *ConfigurationPayload) IPs(t ConfigurationAttributeType) (ips []net.IP) {
+	for _, attr := range s.Get(t) {
+		if ip := attr.IP(); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return
+}
+
+// Networks returns networks from INTERNAL_IP4_SUBNET, INTERNAL_IP6_SUBNET & INTERNAL_IP6_ADDRESS
+// empty attributes are skipped
+func (s *ConfigurationPayload) Networks(t ConfigurationAttributeType) (nets []*net.IPNet) {
+	for _, attr := range s.Get(t) {
+		if n := attr.IPNet(); n != nil {
+			nets = append(nets, n)
+		}
+	}
+	return
+}
+
+// Netmask returns the INTERNAL_IP4_NETMASK, or nil
+func (s *ConfigurationPayload) Netmask() net.IPMask {
+	for _, attr := range s.Get(INTERNAL_IP4_NETMASK) {
+		if len(attr.Value) == net.IPv4len {
+			return net.IPMask(append([]byte{}, attr.Value...))
+		}
+	}
+	return nil
+}
+
+// SupportedAttributes returns the list from SUPPORTED_ATTRIBUTES
+func (s *ConfigurationPayload) SupportedAttributes() (types []ConfigurationAttributeType) {
+	for _, attr := range s.Get(SUPPORTED_ATTRIBUTES) {
+		for i := 0; i+2 <= len(attr.Value); i += 2 {
+			t, _ := packets.ReadB16(attr.Value, i)
+			types = append(types, ConfigurationAttributeType(t&0x7fff))
+		}
+	}
+	return
+}
+
+// ApplicationVersion returns the APPLICATION_VERSION string
+func (s *ConfigurationPayload) ApplicationVersion() string {
+	for _, attr := range s.Get(APPLICATION_VERSION) {
+		return string(attr.Value)
+	}
+	return ""
+}
+
+// IP decodes an address valued attribute
+func (attr *ConfigurationAttribute) IP() net.IP {
+	switch l := len(attr.Value); l {
+	case net.IPv4len, net.IPv6len:
+		return net.IP(append([]byte{}, attr.Value...))
+	case net.IPv6len + 1: // INTERNAL_IP6_ADDRESS has a prefix
+		return net.IP(append([]byte{}, attr.Value[:net.IPv6len]...))
+	}
+	return nil
+}
+
+// IPNet decodes a network valued attribute
+func (attr *ConfigurationAttribute) IPNet() *net.IPNet {
+	switch len(attr.Value) {
+	case 2 * net.IPv4len: // address & netmask
+		return &net.IPNet{
+			IP:   net.IP(append([]byte{}, attr.Value[:net.IPv4len]...)),
+			Mask: net.IPMask(append([]byte{}, attr.Value[net.IPv4len:]...)),
+		}
+	case net.IPv6len + 1: // address & prefix length
+		prefix := int(attr.Value[net.IPv6len])
+		if prefix > 8*net.IPv6len {
+			return nil
+		}
+		return &net.IPNet{
+			IP:   net.IP(append([]byte{}, attr.Value[:net.IPv6len]...)),
+			Mask: net.CIDRMask(prefix, 8*net.IPv6len),
+		}
+	}
+	return nil
+}
+
+// attribute constructors
+
+// EmptyAttribute is used in CFG_REQUEST to ask for a value
+func EmptyAttribute(t ConfigurationAttributeType) *ConfigurationAttribute {
+	return &ConfigurationAttribute{ConfigurationAttributeType: t}
+}
+
+// IPAttribute builds INTERNAL_IP4_ADDRESS, INTERNAL_IP4_NETMASK, INTERNAL_IP4_DNS & INTERNAL_IP6_DNS etc
+func IPAttribute(t ConfigurationAttributeType, ip net.IP) *ConfigurationAttribute {
+	switch t {
+	case INTERNAL_IP6_DNS, INTERNAL_IP6_DHCP:
+		ip = ip.To16()
+	default:
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+	}
+	return &ConfigurationAttribute{
+		ConfigurationAttributeType: t,
+		Value:                      append([]byte{}, ip...),
+	}
+}
+
+// IPNetAttribute builds INTERNAL_IP4_SUBNET, INTERNAL_IP6_SUBNET & INTERNAL_IP6_ADDRESS
+func IPNetAttribute(t ConfigurationAttributeType, n *net.IPNet) *ConfigurationAttribute {
+	var value []byte
+	if t == INTERNAL_IP4_SUBNET {
+		mask := n.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		value = append(append(value, n.IP.To4()...), mask...)
+	} else {
+		prefix, _ := n.Mask.Size()
+		value = append(append(value, n.IP.To16()...), uint8(prefix))
+	}
+	return &ConfigurationAttribute{
+		ConfigurationAttributeType: t,
+		Value:                      value,
+	}
+}
+
+// SupportedAttributesAttribute builds SUPPORTED_ATTRIBUTES
+func SupportedAttributesAttribute(types ...ConfigurationAttributeType) *ConfigurationAttribute {
+	value := make([]byte, 2*len(types))
+	for i, t := range types {
+		packets.WriteB16(value, 2*i, uint16(t)&0x7fff)
+	}
+	return &ConfigurationAttribute{
+		ConfigurationAttributeType: SUPPORTED_ATTRIBUTES,
+		Value:                      value,
+	}
+}
+
+// ApplicationVersionAttribute builds APPLICATION_VERSION
+func ApplicationVersionAttribute(version string) *ConfigurationAttribute {
+	return &ConfigurationAttribute{
+		ConfigurationAttributeType: APPLICATION_VERSION,
+		Value:                      []byte(version),
+	}
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestConfigurationRequest(t *testing.T) {
+	cp := &ConfigurationPayload{
+		PayloadHeader:     &PayloadHeader{},
+		ConfigurationType: CFG_REQUEST,
+	}
+	cp.Add(EmptyAttribute(INTERNAL_IP4_ADDRESS))
+	cp.Add(EmptyAttribute(INTERNAL_IP4_DNS))
+	cp.Add(EmptyAttribute(INTERNAL_IP6_ADDRESS))
+	cp.Add(ApplicationVersionAttribute("ike"))
+	b := cp.Encode()
+	dec := &ConfigurationPayload{PayloadHeader: &PayloadHeader{}}
+	if err := dec.Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if dec.ConfigurationType != CFG_REQUEST {
+		t.Errorf("type %d", dec.ConfigurationType)
+	}
+	if len(dec.Get(INTERNAL_IP4_ADDRESS)) != 1 || len(dec.IPs(INTERNAL_IP4_ADDRESS)) != 0 {
+		t.Error("INTERNAL_IP4_ADDRESS")
+	}
+	if dec.ApplicationVersion() != "ike" {
+		t.Error("APPLICATION_VERSION", dec.ApplicationVersion())
+	}
+	if !bytes.Equal(b, dec.Encode()) {
+		t.Error("encoding differs")
+	}
+}
+
+func TestConfigurationReply(t *testing.T) {
+	_, subnet4, _ := net.ParseCIDR("10.1.0.0/16")
+	addr6, subnet6, _ := net.ParseCIDR("2001:db8::5/64")
+	cp := &ConfigurationPayload{
+		PayloadHeader:     &PayloadHeader{},
+		ConfigurationType: CFG_REPLY,
+	}
+	cp.Add(IPAttribute(INTERNAL_IP4_ADDRESS, net.ParseIP("10.1.0.5")))
+	cp.Add(IPAttribute(INTERNAL_IP4_NETMASK, net.IP(net.CIDRMask(16, 32))))
+	cp.Add(IPAttribute(INTERNAL_IP4_DNS, net.ParseIP("10.1.0.1")))
+	cp.Add(IPAttribute(INTERNAL_IP6_DNS, net.ParseIP("2001:db8::1")))
+	cp.Add(IPNetAttribute(INTERNAL_IP4_SUBNET, subnet4))
+	cp.Add(IPNetAttribute(INTERNAL_IP6_ADDRESS, &net.IPNet{IP: addr6, Mask: subnet6.Mask}))
+	cp.Add(IPNetAttribute(INTERNAL_IP6_SUBNET, subnet6))
+	cp.Add(SupportedAttributesAttribute(INTERNAL_IP4_ADDRESS, INTERNAL_IP6_ADDRESS))
+	dec := &ConfigurationPayload{PayloadHeader: &PayloadHeader{}}
+	if err := dec.Decode(cp.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if ips := dec.IPs(INTERNAL_IP4_ADDRESS); len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.1.0.5")) {
+		t.Error("INTERNAL_IP4_ADDRESS", ips)
+	}
+	if mask := dec.Netmask(); mask.String() != net.CIDRMask(16, 32).String() {
+		t.Error("INTERNAL_IP4_NETMASK", mask)
+	}
+	if ips := dec.IPs(INTERNAL_IP6_DNS); len(ips) != 1 || !ips[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Error("INTERNAL_IP6_DNS", ips)
+	}
+	if nets := dec.Networks(INTERNAL_IP4_SUBNET); len(nets) != 1 || nets[0].String() != "10.1.0.0/16" {
+		t.Error("INTERNAL_IP4_SUBNET", nets)
+	}
+	if nets := dec.Networks(INTERNAL_IP6_ADDRESS); len(nets) != 1 || nets[0].String() != "2001:db8::5/64" {
+		t.Error("INTERNAL_IP6_ADDRESS", nets)
+	}
+	if nets := dec.Networks(INTERNAL_IP6_SUBNET); len(nets) != 1 || nets[0].String() != "2001:db8::/64" {
+		t.Error("INTERNAL_IP6_SUBNET", nets)
+	}
+	types := []ConfigurationAttributeType{INTERNAL_IP4_ADDRESS, INTERNAL_IP6_ADDRESS}
+	if sup := dec.SupportedAttributes(); !reflect.DeepEqual(sup, types) {
+		t.Error("SUPPORTED_ATTRIBUTES", sup)
+	}
+}
+
+func TestConfigurationBadLength(t *testing.T) {
+	// INTERNAL_IP4_ADDRESS with 3 octets
+	b := []byte{uint8(CFG_REPLY), 0, 0, 0, 0, 1, 0, 3, 10, 0, 0}
+	dec := &ConfigurationPayload{PayloadHeader: &PayloadHeader{}}
+	if err := dec.Decode(b); err == nil {
+		t.Error("expected error")
+	}
+}
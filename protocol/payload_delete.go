@@ -35,7 +35,7 @@ func (s *DeletePayload) Decode(b []byte) error {
 	for i := 0; i < int(nspi); i++ {
 		spi := append([]byte{}, b[:int(lspi)]...)
 		s.Spis = append(s.Spis, spi)
-		b = b[:int(lspi)]
+		b = b[int(lspi):]
 	}
 	return nil
 }
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/msgboxio/packets"
+	"github.com/pkg/errors"
+)
+
+func (s *EapPayload) Type() PayloadType {
+	return PayloadTypeEAP
+}
+
+func (s *EapPayload) Encode() (b []byte) {
+	b = []byte{uint8(s.Code), s.Identifier, 0, 0}
+	if s.Code == EAP_REQUEST || s.Code == EAP_RESPONSE {
+		b = append(b, uint8(s.EapType))
+		b = append(b, s.Data...)
+	}
+	packets.WriteB16(b, 2, uint16(len(b)))
+	return
+}
+
+func (s *EapPayload) Decode(b []byte) error {
+	if len(b) < 4 {
+		return errors.Wrap(ERR_INVALID_SYNTAX, fmt.Sprintf("eap too small %d < %d", len(b), 4))
+	}
+	// Header has already been decoded
+	code, _ := packets.ReadB8(b, 0)
+	s.Code = EapCode(code)
+	s.Identifier, _ = packets.ReadB8(b, 1)
+	length, _ := packets.ReadB16(b, 2)
+	if int(length) != len(b) {
+		return errors.Wrap(ERR_INVALID_SYNTAX, fmt.Sprintf("eap length %d != %d", length, len(b)))
+	}
+	switch s.Code {
+	case EAP_REQUEST, EAP_RESPONSE:
+		if len(b) < 5 {
+			return errors.Wrap(ERR_INVALID_SYNTAX, "eap type is missing")
+		}
+		s.EapType = EapType(b[4])
+		s.Data = append([]byte{}, b[5:]...)
+	case EAP_SUCCESS, EAP_FAILURE:
+	default:
+		return errors.Wrap(ERR_INVALID_SYNTAX, fmt.Sprintf("eap code %d", s.Code))
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/msgboxio/packets"
+	"github.com/pkg/errors"
+)
+
+func (s *EncryptedFragmentPayload) Type() PayloadType { return PayloadTypeSKF }
+
+// Encode returns the fragment header; encrypted contents are added by the caller
+func (s *EncryptedFragmentPayload) Encode() (b []byte) {
+	b = make([]byte, FRAGMENT_HEADER_LENGTH)
+	packets.WriteB16(b, 0, s.FragmentNumber)
+	packets.WriteB16(b, 2, s.TotalFragments)
+	return
+}
+
+func (s *EncryptedFragmentPayload) Decode(b []byte) error {
+	if len(b) < FRAGMENT_HEADER_LENGTH {
+		return errors.Wrap(ERR_INVALID_SYNTAX, fmt.Sprintf("fragment too small %d < %d", len(b), FRAGMENT_HEADER_LENGTH))
+	}
+	s.FragmentNumber, _ = packets.ReadB16(b, 0)
+	s.TotalFragments, _ = packets.ReadB16(b, 2)
+	// rfc7383 2.5
+	if s.FragmentNumber == 0 || s.TotalFragments == 0 || s.FragmentNumber > s.TotalFragments {
+		return errors.Wrap(ERR_INVALID_SYNTAX, fmt.Sprintf("invalid fragment %d of %d", s.FragmentNumber, s.TotalFragments))
+	}
+	return nil
+}
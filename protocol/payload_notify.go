@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"net"
 	"time"
 
 	"github.com/msgboxio/packets"
@@ -35,6 +36,27 @@ func (s *NotifyPayload) Encode() (b []byte) {
 		buf := []byte{0, 0}
 		packets.WriteB16(buf, 0, s.NotificationMessage.(uint16))
 		b = append(b, buf...)
+	case SET_WINDOW_SIZE:
+		buf := make([]byte, 4)
+		packets.WriteB32(buf, 0, s.NotificationMessage.(uint32))
+		b = append(b, buf...)
+	case TICKET_LT_OPAQUE:
+		tlt := s.NotificationMessage.(*TicketLifetime)
+		buf := make([]byte, 4)
+		// lifetime in seconds, followed by the ticket
+		packets.WriteB32(buf, 0, uint32(tlt.Lifetime.Seconds()))
+		b = append(append(b, buf...), tlt.Ticket...)
+	case REDIRECT, REDIRECTED_FROM:
+		rd := s.NotificationMessage.(*Redirect)
+		// gw ident type | length | gw identity | [nonce]
+		gwType, gw := GW_FQDN, []byte(rd.Gateway)
+		if ip := net.ParseIP(rd.Gateway); ip.To4() != nil {
+			gwType, gw = GW_IPV4, ip.To4()
+		} else if ip != nil {
+			gwType, gw = GW_IPV6, ip.To16()
+		}
+		b = append(b, uint8(gwType), uint8(len(gw)))
+		b = append(append(b, gw...), rd.Nonce...)
 	default:
 		if s.NotificationMessage != nil {
 			b = append(b, s.NotificationMessage.([]byte)...)
@@ -84,6 +106,12 @@ func (s *NotifyPayload) Decode(b []byte) (err error) {
 			return errors.Wrap(ERR_INVALID_SYNTAX, "Notify payload COOKIE")
 		}
 		s.NotificationMessage = append([]byte{}, data...)
+	case COOKIE2:
+		// rfc4555 4.5; 8 to 64 bytes
+		if len(data) < 8 || len(data) > 64 {
+			return errors.Wrap(ERR_INVALID_SYNTAX, "Notify payload COOKIE2")
+		}
+		s.NotificationMessage = append([]byte{}, data...)
 	case INVALID_KE_PAYLOAD:
 		// check if data is 2 bytes
 		if len(data) != 2 {
@@ -96,6 +124,44 @@ func (s *NotifyPayload) Decode(b []byte) (err error) {
 		}
 		wsize, _ := packets.ReadB32(data, 0)
 		s.NotificationMessage = wsize
+	case TICKET_LT_OPAQUE:
+		if len(data) <= 4 {
+			return errors.Wrap(ERR_INVALID_SYNTAX, "Notify payload TICKET_LT_OPAQUE")
+		}
+		lft, _ := packets.ReadB32(data, 0)
+		s.NotificationMessage = &TicketLifetime{
+			Lifetime: time.Second * time.Duration(lft),
+			Ticket:   append([]byte{}, data[4:]...),
+		}
+	case REDIRECT, REDIRECTED_FROM:
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return errors.Wrapf(ERR_INVALID_SYNTAX, "Notify payload %s", s.NotificationType)
+		}
+		gw := data[2 : 2+int(data[1])]
+		rd := &Redirect{}
+		switch GwIdentType(data[0]) {
+		case GW_IPV4:
+			if len(gw) != net.IPv4len {
+				return errors.Wrapf(ERR_INVALID_SYNTAX, "Notify payload %s address", s.NotificationType)
+			}
+			rd.Gateway = net.IP(gw).String()
+		case GW_IPV6:
+			if len(gw) != net.IPv6len {
+				return errors.Wrapf(ERR_INVALID_SYNTAX, "Notify payload %s address", s.NotificationType)
+			}
+			rd.Gateway = net.IP(gw).String()
+		case GW_FQDN:
+			if len(gw) == 0 {
+				return errors.Wrapf(ERR_INVALID_SYNTAX, "Notify payload %s FQDN", s.NotificationType)
+			}
+			rd.Gateway = string(gw)
+		default:
+			return errors.Wrapf(ERR_INVALID_SYNTAX, "Notify payload %s gateway type %d", s.NotificationType, data[0])
+		}
+		if nonce := data[2+len(gw):]; len(nonce) > 0 {
+			rd.Nonce = append([]byte{}, nonce...)
+		}
+		s.NotificationMessage = rd
 	default:
 		s.NotificationMessage = append([]byte{}, data...)
 	}
@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRedirectDecodeLength(t *testing.T) {
+	for _, nType := range []NotificationType{REDIRECT, REDIRECTED_FROM} {
+		// gateway lengths that wrap around in a byte
+		for _, gwLen := range []int{254, 255} {
+			gw := bytes.Repeat([]byte{'g'}, gwLen)
+			b := []byte{0, 0, byte(nType >> 8), byte(nType), byte(GW_FQDN), byte(gwLen)}
+			b = append(append(b, gw...), 1, 2, 3)
+			n := &NotifyPayload{PayloadHeader: &PayloadHeader{}}
+			if err := n.Decode(b); err != nil {
+				t.Fatal(err)
+			}
+			rd, ok := n.NotificationMessage.(*Redirect)
+			if !ok || rd.Gateway != string(gw) || !bytes.Equal(rd.Nonce, []byte{1, 2, 3}) {
+				t.Errorf("%s with gateway length %d: %v", nType, gwLen, n.NotificationMessage)
+			}
+		}
+	}
+}
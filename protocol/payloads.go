@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
 	"log"
 
@@ -40,14 +41,17 @@ func (p *Payloads) GetCertchain() (chain []*x509.Certificate, err error) {
 				err = errors.Errorf("unexpected payload; logic error")
 				break
 			}
+			if certP.CertEncodingType == CERTIFICATE_REVOCATION_LIST {
+				continue
+			}
 			if certP.CertEncodingType != X_509_CERTIFICATE_SIGNATURE {
 				err = errors.Errorf("cert encoding not supported: %v", certP.CertEncodingType)
 				break
 			}
 			// cert.data is DER-encoded X.509 certificate
-			x509Cert, err := x509.ParseCertificate(certP.Data)
-			if err != nil {
-				err = errors.Errorf("unable to parse cert: %s", err)
+			x509Cert, parseErr := x509.ParseCertificate(certP.Data)
+			if parseErr != nil {
+				err = errors.Errorf("unable to parse cert: %s", parseErr)
 				break
 			}
 			chain = append(chain, x509Cert)
@@ -56,6 +60,31 @@ func (p *Payloads) GetCertchain() (chain []*x509.Certificate, err error) {
 	return
 }
 
+// GetCertRevocationLists returns CRLs sent in CERT payloads
+func (p *Payloads) GetCertRevocationLists() (crls []*pkix.CertificateList, err error) {
+	for _, pl := range p.Array {
+		if certP, ok := pl.(*CertPayload); ok && certP.CertEncodingType == CERTIFICATE_REVOCATION_LIST {
+			crl, parseErr := x509.ParseDERCRL(certP.Data)
+			if parseErr != nil {
+				return nil, errors.Errorf("unable to parse crl: %s", parseErr)
+			}
+			crls = append(crls, crl)
+		}
+	}
+	return
+}
+
+// GetCertAuthorities returns CA key hashes from X.509 CERTREQ payloads
+func (p *Payloads) GetCertAuthorities() (hashes [][]byte) {
+	for _, pl := range p.Array {
+		if certReq, ok := pl.(*CertRequestPayload); ok &&
+			certReq.CertEncodingType == X_509_CERTIFICATE_SIGNATURE {
+			hashes = append(hashes, certReq.Authorities()...)
+		}
+	}
+	return
+}
+
 func (p *Payloads) GetNotifications() (ns []*NotifyPayload) {
 	for _, pl := range p.Array {
 		if pl.Type() == PayloadTypeN {
@@ -120,6 +149,8 @@ func DecodePayloads(b []byte, nextPayload PayloadType) (*Payloads, error) {
 			payload = &TrafficSelectorPayload{PayloadHeader: pHeader, TrafficSelectorPayloadType: PayloadTypeTSr}
 		case PayloadTypeSK:
 			payload = &EncryptedPayload{PayloadHeader: pHeader}
+		case PayloadTypeSKF:
+			payload = &EncryptedFragmentPayload{PayloadHeader: pHeader}
 		case PayloadTypeCP:
 			payload = &ConfigurationPayload{PayloadHeader: pHeader}
 		case PayloadTypeEAP:
@@ -135,7 +166,7 @@ func DecodePayloads(b []byte, nextPayload PayloadType) (*Payloads, error) {
 			log.Printf("Payload %s: %s from:\n%s", payload.Type(), spew.Sdump(payload), hex.Dump(pbuf))
 		}
 		payloads.Add(payload)
-		if nextPayload == PayloadTypeSK {
+		if nextPayload == PayloadTypeSK || nextPayload == PayloadTypeSKF {
 			// log.V(1).Infof("Received %s: encrypted payloads %s", s.IkeHeader.ExchangeType, *payloads)
 			return payloads, nil
 		}
@@ -160,7 +191,7 @@ func EncodePayloads(payloads *Payloads) (b []byte) {
 		hdr.NextPayload = next
 		body = append(hdr.Encode(), body...)
 		if PacketLog {
-			log.Println("Payload %s: %s to:\n%s", pl.Type(), spew.Sdump(pl), hex.Dump(body))
+			log.Printf("Payload %s: %s to:\n%s", pl.Type(), spew.Sdump(pl), hex.Dump(body))
 		}
 		b = append(b, body...)
 	}
@@ -3,6 +3,7 @@ package protocol
 import (
 	"math/big"
 	"net"
+	"time"
 )
 
 const (
@@ -494,14 +495,8 @@ type CertPayload struct {
 */
 type CertRequestPayload struct {
 	*PayloadHeader
-}
-
-func (s *CertRequestPayload) Type() PayloadType  { return PayloadTypeCERTREQ }
-func (s *CertRequestPayload) Encode() (b []byte) { return }
-func (s *CertRequestPayload) Decode(b []byte) (err error) {
-	// Header has already been decoded
-	// TODO
-	return
+	CertEncodingType
+	CertificationAuthority []byte
 }
 
 /*
@@ -666,6 +661,29 @@ type NotifyPayload struct {
 	NotificationMessage interface{}
 }
 
+// TicketLifetime is the message of TICKET_LT_OPAQUE, rfc5723
+type TicketLifetime struct {
+	Lifetime time.Duration
+	Ticket   []byte
+}
+
+// GwIdentType is the type of gateway identity in REDIRECT & REDIRECTED_FROM, rfc5685
+type GwIdentType uint8
+
+const (
+	GW_IPV4 GwIdentType = 1
+	GW_IPV6 GwIdentType = 2
+	GW_FQDN GwIdentType = 3
+)
+
+// Redirect is the message of REDIRECT & REDIRECTED_FROM, rfc5685
+// Gateway is an IP address or FQDN
+// Nonce is initiator's, only in REDIRECT replying to IKE_SA_INIT
+type Redirect struct {
+	Gateway string
+	Nonce   []byte
+}
+
 /*
     0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
@@ -796,6 +814,32 @@ func (s *EncryptedPayload) Decode(b []byte) (err error) {
 	return
 }
 
+/*
+                        1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   | Next Payload  |C|  RESERVED   |         Payload Length        |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |        Fragment Number        |        Total Fragments        |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |                     Initialization Vector                     |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   ~                      Encrypted content                        ~
+   +               +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |               |             Padding (0-255 octets)            |
+   +-+-+-+-+-+-+-+-+                               +-+-+-+-+-+-+-+-+
+   |                                               |  Pad Length   |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   ~                    Integrity Checksum Data                    ~
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+type EncryptedFragmentPayload struct {
+	*PayloadHeader
+	FragmentNumber, TotalFragments uint16
+}
+
+const FRAGMENT_HEADER_LENGTH = 4
+
 /*
     0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
@@ -868,11 +912,40 @@ type ConfigurationAttribute struct {
 */
 type EapPayload struct {
 	*PayloadHeader
+	Code       EapCode
+	Identifier uint8
+	EapType    EapType // only in Request & Response
+	Data       []byte  // Type-Data
 }
 
-func (s *EapPayload) Type() PayloadType  { return PayloadTypeEAP }
-func (s *EapPayload) Encode() (b []byte) { return }
-func (s *EapPayload) Decode(b []byte) (err error) {
-	// TODO
-	return
-}
+/*
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |     Code      |  Identifier   |            Length             |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |     Type      |  Type_Data...
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+
+// EapCode is the code of an EAP packet, rfc3748
+type EapCode uint8
+
+const (
+	EAP_REQUEST  EapCode = 1
+	EAP_RESPONSE EapCode = 2
+	EAP_SUCCESS  EapCode = 3
+	EAP_FAILURE  EapCode = 4
+)
+
+// EapType is the method of EAP Request & Response, rfc3748
+type EapType uint8
+
+const (
+	EAP_TYPE_IDENTITY      EapType = 1
+	EAP_TYPE_NOTIFICATION  EapType = 2
+	EAP_TYPE_NAK           EapType = 3
+	EAP_TYPE_MD5_CHALLENGE EapType = 4
+	EAP_TYPE_GTC           EapType = 6
+	EAP_TYPE_TLS           EapType = 13
+	EAP_TYPE_MSCHAPV2      EapType = 26
+)
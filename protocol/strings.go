@@ -64,6 +64,8 @@ func (p PayloadType) String() string {
 		return "TSr"
 	case PayloadTypeSK:
 		return "SK"
+	case PayloadTypeSKF:
+		return "SKF"
 	case PayloadTypeCP:
 		return "CP"
 	case PayloadTypeEAP:
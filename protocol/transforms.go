@@ -17,15 +17,32 @@ func ProposalFromTransform(prot ProtocolID, trs TransformMap, spi []byte) Propos
 	}
 }
 
-// AsList converts transforms to flat list
+// ProposalsFromTransforms builds one proposal for each suite, in order of preference
+func ProposalsFromTransforms(prot ProtocolID, suites []TransformMap, spi []byte) (props Proposals) {
+	for idx, trs := range suites {
+		props = append(props, &SaProposal{
+			IsLast:     idx == len(suites)-1,
+			Number:     uint8(idx + 1),
+			ProtocolID: prot,
+			Spi:        append([]byte{}, spi...),
+			Transforms: trs.AsList(),
+		})
+	}
+	return
+}
+
+// AsList converts transforms to flat list, ordered by type
 func (t TransformMap) AsList() (trs []*SaTransform) {
-	for _, trsVal := range t {
-		trs = append(trs, trsVal)
+	for ty := TRANSFORM_TYPE_ENCR; ty <= TRANSFORM_TYPE_ESN; ty++ {
+		if trsVal, ok := t[ty]; ok {
+			trs = append(trs, trsVal)
+		}
 	}
 	return
 }
 
 // Within checks if the configured set of transforms occurs within list of proposed transforms
+// every configured transform must be proposed, and every proposed type must be configured
 func (t TransformMap) Within(proposed []*SaTransform) bool {
 	listHas := func(proposed []*SaTransform, target *SaTransform) bool {
 		for _, tr := range proposed {
@@ -36,11 +53,16 @@ func (t TransformMap) Within(proposed []*SaTransform) bool {
 		return false
 	}
 	for _, transform := range t {
-		if listHas(proposed, transform) {
-			return true
+		if !listHas(proposed, transform) {
+			return false
+		}
+	}
+	for _, tr := range proposed {
+		if _, ok := t[tr.Transform.Type]; !ok {
+			return false
 		}
 	}
-	return false
+	return len(t) > 0
 }
 
 func (t TransformMap) GetType(ty TransformType) *Transform {
@@ -0,0 +1,544 @@
+package ike
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	stderror "errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// RADIUS client; rfc2865 authentication, rfc2866 accounting & rfc3579 EAP
+
+const (
+	radiusAccessRequest      = 1
+	radiusAccessAccept       = 2
+	radiusAccessReject       = 3
+	radiusAccountingRequest  = 4
+	radiusAccountingResponse = 5
+	radiusAccessChallenge    = 11
+)
+
+const (
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusFramedIPAddress      = 8
+	radiusState                = 24
+	radiusClass                = 25
+	radiusVendorSpecific       = 26
+	radiusCalledStationID      = 30
+	radiusCallingStationID     = 31
+	radiusNasIdentifier        = 32
+	radiusAcctStatusType       = 40
+	radiusAcctSessionID        = 44
+	radiusAcctSessionTime      = 46
+	radiusAcctTerminateCause   = 49
+	radiusEapMessage           = 79
+	radiusMessageAuthenticator = 80
+)
+
+// rfc2548 Microsoft attributes, carry the MSK
+const (
+	radiusVendorMicrosoft = 311
+	radiusMsMppeSendKey   = 16
+	radiusMsMppeRecvKey   = 17
+)
+
+const (
+	radiusAcctStart = 1
+	radiusAcctStop  = 2
+)
+
+// rfc2866 5.10 Acct-Terminate-Cause
+const (
+	radiusCauseUserRequest    = 1
+	radiusCauseLostCarrier    = 2
+	radiusCauseIdleTimeout    = 4
+	radiusCauseSessionTimeout = 5
+	radiusCauseAdminReset     = 6
+	radiusCauseNasError       = 9
+)
+
+const radiusHeaderLen = 20
+
+var errRadiusTimeout = stderror.New("RADIUS server did not reply")
+
+type radiusAttr struct {
+	typ   uint8
+	value []byte
+}
+
+// radiusPacket is Code | Identifier | Length | Authenticator | Attributes
+type radiusPacket struct {
+	code          uint8
+	id            uint8
+	authenticator [16]byte
+	attrs         []radiusAttr
+	password      []byte // User-Password, hidden for each server
+}
+
+func (p *radiusPacket) add(typ uint8, value []byte) {
+	p.attrs = append(p.attrs, radiusAttr{typ, value})
+}
+
+func (p *radiusPacket) addString(typ uint8, value string) {
+	if value != "" {
+		p.add(typ, []byte(value))
+	}
+}
+
+func (p *radiusPacket) addUint32(typ uint8, value uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	p.add(typ, b)
+}
+
+// get returns the first attribute of typ
+func (p *radiusPacket) get(typ uint8) []byte {
+	for _, a := range p.attrs {
+		if a.typ == typ {
+			return a.value
+		}
+	}
+	return nil
+}
+
+// addEap splits the EAP packet over EAP-Message attributes
+func (p *radiusPacket) addEap(eap []byte) {
+	for len(eap) > 253 {
+		p.add(radiusEapMessage, eap[:253])
+		eap = eap[253:]
+	}
+	p.add(radiusEapMessage, eap)
+}
+
+// eap joins EAP-Message attributes
+func (p *radiusPacket) eap() (eap []byte) {
+	for _, a := range p.attrs {
+		if a.typ == radiusEapMessage {
+			eap = append(eap, a.value...)
+		}
+	}
+	return
+}
+
+// vendorAttr returns the first Vendor-Specific attribute of vendor & typ
+func (p *radiusPacket) vendorAttr(vendor uint32, typ uint8) []byte {
+	for _, a := range p.attrs {
+		if a.typ != radiusVendorSpecific || len(a.value) < 6 || binary.BigEndian.Uint32(a.value) != vendor {
+			continue
+		}
+		if a.value[4] == typ && int(a.value[5]) == len(a.value)-4 && a.value[5] >= 2 {
+			return a.value[6:]
+		}
+	}
+	return nil
+}
+
+func (p *radiusPacket) encode() []byte {
+	b := []byte{p.code, p.id, 0, 0}
+	b = append(b, p.authenticator[:]...)
+	for _, a := range p.attrs {
+		b = append(b, a.typ, uint8(len(a.value)+2))
+		b = append(b, a.value...)
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
+}
+
+func decodeRadius(b []byte) (*radiusPacket, error) {
+	if len(b) < radiusHeaderLen {
+		return nil, errors.Errorf("RADIUS: packet too small %d", len(b))
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length < radiusHeaderLen || length > len(b) {
+		return nil, errors.Errorf("RADIUS: length %d of %d", length, len(b))
+	}
+	p := &radiusPacket{code: b[0], id: b[1]}
+	copy(p.authenticator[:], b[4:radiusHeaderLen])
+	for attrs := b[radiusHeaderLen:length]; len(attrs) > 0; {
+		if len(attrs) < 2 || attrs[1] < 2 || int(attrs[1]) > len(attrs) {
+			return nil, errors.New("RADIUS: invalid attribute")
+		}
+		p.add(attrs[0], append([]byte{}, attrs[2:attrs[1]]...))
+		attrs = attrs[attrs[1]:]
+	}
+	return p, nil
+}
+
+// attrOffset returns where the value of the first attribute of typ starts in b
+func attrOffset(b []byte, typ uint8) int {
+	for i := radiusHeaderLen; i+2 <= len(b); i += int(b[i+1]) {
+		if b[i] == typ {
+			return i + 2
+		}
+		if b[i+1] < 2 {
+			break
+		}
+	}
+	return -1
+}
+
+// signMessage fills in Message-Authenticator, hmac-md5 of the packet with it zeroed
+func signMessage(b, secret []byte) {
+	if i := attrOffset(b, radiusMessageAuthenticator); i > 0 {
+		copy(b[i:i+16], make([]byte, 16))
+		mac := hmac.New(md5.New, secret)
+		mac.Write(b)
+		copy(b[i:i+16], mac.Sum(nil))
+	}
+}
+
+// responseAuthenticator is md5(Code | Identifier | Length | RequestAuth | Attributes | Secret)
+// accounting requests use it too, with zero RequestAuth
+func responseAuthenticator(b, requestAuth, secret []byte) []byte {
+	h := md5.New()
+	h.Write(b[:4])
+	h.Write(requestAuth)
+	h.Write(b[radiusHeaderLen:])
+	h.Write(secret)
+	return h.Sum(nil)
+}
+
+// encodeRequest authenticates the request to server
+// Access-Request has a random authenticator & Message-Authenticator
+func (p *radiusPacket) encodeRequest(secret []byte) ([]byte, error) {
+	if p.code != radiusAccessRequest {
+		b := p.encode()
+		copy(b[4:radiusHeaderLen], responseAuthenticator(b, make([]byte, 16), secret))
+		copy(p.authenticator[:], b[4:radiusHeaderLen])
+		return b, nil
+	}
+	if _, err := rand.Read(p.authenticator[:]); err != nil {
+		return nil, err
+	}
+	signed := &radiusPacket{
+		code:          p.code,
+		id:            p.id,
+		authenticator: p.authenticator,
+		attrs:         append([]radiusAttr{}, p.attrs...),
+	}
+	if p.password != nil {
+		signed.add(radiusUserPassword, hidePassword(p.password, secret, p.authenticator[:]))
+	}
+	signed.add(radiusMessageAuthenticator, make([]byte, 16))
+	b := signed.encode()
+	signMessage(b, secret)
+	return b, nil
+}
+
+// verifyResponse checks reply to request is from server that knows secret
+func verifyResponse(b []byte, req *radiusPacket, secret []byte) error {
+	if !hmac.Equal(responseAuthenticator(b, req.authenticator[:], secret), b[4:radiusHeaderLen]) {
+		return errors.New("RADIUS: wrong Response Authenticator")
+	}
+	i := attrOffset(b, radiusMessageAuthenticator)
+	if i < 0 {
+		if req.code == radiusAccessRequest && attrOffset(b, radiusEapMessage) > 0 {
+			return errors.New("RADIUS: missing Message-Authenticator")
+		}
+		return nil
+	}
+	signed := append([]byte{}, b...)
+	copy(signed[4:radiusHeaderLen], req.authenticator[:])
+	signMessage(signed, secret)
+	if !hmac.Equal(signed[i:i+16], b[i:i+16]) {
+		return errors.New("RADIUS: wrong Message-Authenticator")
+	}
+	return nil
+}
+
+// hidePassword is rfc2865 5.2 User-Password
+func hidePassword(password, secret, requestAuth []byte) []byte {
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+	prev := requestAuth
+	for i := 0; i < len(padded); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		for j, x := range h.Sum(nil) {
+			padded[i+j] ^= x
+		}
+		prev = padded[i : i+16]
+	}
+	return padded
+}
+
+// mppeKey reveals rfc2548 2.4.2 MS-MPPE keys: Salt | String
+func mppeKey(value, secret, requestAuth []byte) ([]byte, error) {
+	if len(value) < 2+16 || (len(value)-2)%16 != 0 {
+		return nil, errors.New("RADIUS: invalid MS-MPPE key")
+	}
+	salt, c := value[:2], value[2:]
+	p := make([]byte, len(c))
+	prev := append(append([]byte{}, requestAuth...), salt...)
+	for i := 0; i < len(c); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		for j, x := range h.Sum(nil) {
+			p[i+j] = c[i+j] ^ x
+		}
+		prev = c[i : i+16]
+	}
+	if int(p[0]) > len(p)-1 {
+		return nil, errors.New("RADIUS: invalid MS-MPPE key length")
+	}
+	return p[1 : 1+p[0]], nil
+}
+
+// RadiusServer is a RADIUS server & the secret shared with it
+type RadiusServer struct {
+	Address string // host:port
+	Secret  []byte
+}
+
+// RadiusClient sends requests to the server that last answered
+// others are tried in turn when it does not
+type RadiusClient struct {
+	Servers []RadiusServer
+	// requests are retransmitted after Timeout, for each of Retries
+	Timeout time.Duration
+	Retries int
+	// identifies us to servers
+	NasIdentifier string
+
+	mu      sync.Mutex
+	current int
+	id      uint8
+}
+
+// NewRadiusClient creates a client for servers, in order of preference
+func NewRadiusClient(servers []RadiusServer, nasIdentifier string) *RadiusClient {
+	return &RadiusClient{
+		Servers:       servers,
+		Timeout:       3 * time.Second,
+		Retries:       2,
+		NasIdentifier: nasIdentifier,
+	}
+}
+
+// exchange returns the reply, the authenticated request & the secret of the server that sent it
+func (c *RadiusClient) exchange(req *radiusPacket) (*radiusPacket, []byte, error) {
+	c.mu.Lock()
+	first := c.current
+	c.id++
+	req.id = c.id
+	c.mu.Unlock()
+	req.addString(radiusNasIdentifier, c.NasIdentifier)
+	err := errors.New("RADIUS: no servers")
+	for i := range c.Servers {
+		n := (first + i) % len(c.Servers)
+		server := &c.Servers[n]
+		var reply *radiusPacket
+		if reply, err = c.exchangeWith(server, req); err == nil {
+			// MUTATION
+			c.mu.Lock()
+			c.current = n
+			c.mu.Unlock()
+			return reply, server.Secret, nil
+		}
+	}
+	return nil, nil, err
+}
+
+func (c *RadiusClient) exchangeWith(server *RadiusServer, req *radiusPacket) (*radiusPacket, error) {
+	b, err := req.encodeRequest(server.Secret)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", server.Address)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 4096)
+	for try := 0; try <= c.Retries; try++ {
+		if _, err = conn.Write(b); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(c.Timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				// retransmit after timeout, or give up on server
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, errors.WithStack(err)
+			}
+			// replies to other requests, or not from server, are dropped
+			reply, err := decodeRadius(buf[:n])
+			if err != nil || reply.id != req.id || verifyResponse(buf[:n], req, server.Secret) != nil {
+				continue
+			}
+			return reply, nil
+		}
+	}
+	return nil, errors.Wrapf(errRadiusTimeout, "RADIUS: %s", server.Address)
+}
+
+// Password is not revealed by RADIUS servers, see CheckPassword
+func (c *RadiusClient) Password(user string) ([]byte, bool) {
+	return nil, false
+}
+
+// CheckPassword asks servers if user's password is right, rfc2865 PAP
+func (c *RadiusClient) CheckPassword(user string, password []byte) error {
+	req := &radiusPacket{code: radiusAccessRequest, password: password}
+	req.addString(radiusUserName, user)
+	reply, _, err := c.exchange(req)
+	if err != nil {
+		return err
+	}
+	if reply.code != radiusAccessAccept {
+		return errors.Errorf("RADIUS: %s was rejected", user)
+	}
+	return nil
+}
+
+// radiusEapReply is server's answer to an EAP response
+type radiusEapReply struct {
+	code  uint8
+	eap   []byte
+	state []byte
+	class []byte
+	msk   []byte // from Access-Accept
+}
+
+// relayEap passes peer's EAP packet to servers, with State of their previous reply, rfc3579
+func (c *RadiusClient) relayEap(user string, eap, state []byte) (*radiusEapReply, error) {
+	req := &radiusPacket{code: radiusAccessRequest}
+	req.addString(radiusUserName, user)
+	req.addEap(eap)
+	if state != nil {
+		req.add(radiusState, state)
+	}
+	reply, secret, err := c.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	r := &radiusEapReply{
+		code:  reply.code,
+		eap:   reply.eap(),
+		state: reply.get(radiusState),
+		class: reply.get(radiusClass),
+	}
+	if reply.code != radiusAccessAccept {
+		return r, nil
+	}
+	// MSK is MS-MPPE-Recv-Key | MS-MPPE-Send-Key, rfc5216 2.3
+	recv, send := reply.vendorAttr(radiusVendorMicrosoft, radiusMsMppeRecvKey), reply.vendorAttr(radiusVendorMicrosoft, radiusMsMppeSendKey)
+	if recv != nil && send != nil {
+		recvKey, err := mppeKey(recv, secret, req.authenticator[:])
+		if err != nil {
+			return nil, err
+		}
+		sendKey, err := mppeKey(send, secret, req.authenticator[:])
+		if err != nil {
+			return nil, err
+		}
+		r.msk = append(recvKey, sendKey...)
+	}
+	return r, nil
+}
+
+// account sends Accounting-Request, rfc2866
+func (c *RadiusClient) account(req *radiusPacket) error {
+	req.code = radiusAccountingRequest
+	reply, _, err := c.exchange(req)
+	if err != nil {
+		return err
+	}
+	if reply.code != radiusAccountingResponse {
+		return errors.Errorf("RADIUS: unexpected accounting reply %d", reply.code)
+	}
+	return nil
+}
+
+// accountingRequest describes the session
+func (sess *Session) accountingRequest(status uint32) *radiusPacket {
+	req := &radiusPacket{}
+	req.addUint32(radiusAcctStatusType, status)
+	req.addString(radiusAcctSessionID, sess.acctSessionID)
+	req.addString(radiusUserName, sess.peerUser())
+	req.addString(radiusCallingStationID, AddrToIp(sess.Remote).String())
+	req.addString(radiusCalledStationID, AddrToIp(sess.Local).String())
+	if !sess.isInitiator && sess.configuration != nil {
+		if ips := sess.configuration.IPs(protocol.INTERNAL_IP4_ADDRESS); len(ips) > 0 {
+			req.add(radiusFramedIPAddress, ips[0].To4())
+		}
+	}
+	if eap := eapAuthenticator(sess.peerAuth()); eap != nil && eap.server != nil && eap.server.class != nil {
+		req.add(radiusClass, eap.server.class)
+	}
+	return req
+}
+
+// peerUser names peer, by its EAP identity if it had one
+func (sess *Session) peerUser() string {
+	if eap := eapAuthenticator(sess.peerAuth()); eap != nil && eap.server != nil && eap.server.user != "" {
+		return eap.server.user
+	}
+	if sess.peerIDp != nil {
+		return string(sess.peerIDp.Data)
+	}
+	return ""
+}
+
+// startAccounting reports the established session
+func (sess *Session) startAccounting() {
+	if sess.cfg.Accounting == nil {
+		return
+	}
+	// MUTATION
+	sess.acctStart = time.Now()
+	sess.acctSessionID = fmt.Sprintf("%s-%d", sess.IkeSpiI, sess.SessionID)
+	if err := sess.cfg.Accounting.account(sess.accountingRequest(radiusAcctStart)); err != nil {
+		sess.Logger.Log("ACCOUNTING", "start", "ERROR", err)
+	}
+}
+
+// stopAccounting reports the session is gone, and why
+func (sess *Session) stopAccounting(cause error) {
+	if sess.cfg.Accounting == nil || sess.acctStart.IsZero() {
+		return
+	}
+	req := sess.accountingRequest(radiusAcctStop)
+	req.addUint32(radiusAcctSessionTime, uint32(time.Since(sess.acctStart)/time.Second))
+	req.addUint32(radiusAcctTerminateCause, acctTerminateCause(cause))
+	if err := sess.cfg.Accounting.account(req); err != nil {
+		sess.Logger.Log("ACCOUNTING", "stop", "ERROR", err)
+	}
+	// MUTATION
+	sess.acctStart = time.Time{}
+}
+
+func acctTerminateCause(err error) uint32 {
+	switch errors.Cause(err) {
+	case errPeerRemovedIkeSa:
+		return radiusCauseUserRequest
+	case errPeerDead:
+		return radiusCauseLostCarrier
+	case errorRekeyDeadlineExceeded:
+		return radiusCauseSessionTimeout
+	case context.Canceled:
+		return radiusCauseAdminReset
+	}
+	if IsTimeout(err) {
+		return radiusCauseIdleTimeout
+	}
+	return radiusCauseNasError
+}
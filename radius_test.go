@@ -0,0 +1,256 @@
+package ike
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/msgboxio/ike/protocol"
+)
+
+// radiusStandIn is a local RADIUS server
+type radiusStandIn struct {
+	conn   *net.UDPConn
+	secret []byte
+	handle func(req *radiusPacket) *radiusPacket
+}
+
+func newRadiusStandIn(t *testing.T, secret string, handle func(*radiusPacket) *radiusPacket) *radiusStandIn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &radiusStandIn{conn: conn, secret: []byte(secret), handle: handle}
+	go s.serve()
+	return s
+}
+
+func (s *radiusStandIn) server() RadiusServer {
+	return RadiusServer{Address: s.conn.LocalAddr().String(), Secret: s.secret}
+}
+
+func (s *radiusStandIn) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		b := buf[:n]
+		req, err := decodeRadius(b)
+		if err != nil {
+			continue
+		}
+		if req.code == radiusAccessRequest {
+			signed := append([]byte{}, b...)
+			signMessage(signed, s.secret)
+			if !bytes.Equal(signed, b) {
+				continue
+			}
+			if hidden := req.get(radiusUserPassword); hidden != nil {
+				req.password = revealPassword(hidden, s.secret, req.authenticator[:])
+			}
+		} else if !hmac.Equal(responseAuthenticator(b, make([]byte, 16), s.secret), b[4:radiusHeaderLen]) {
+			continue
+		}
+		if reply := s.handle(req); reply != nil {
+			s.conn.WriteToUDP(s.encodeReply(reply, req), from)
+		}
+	}
+}
+
+// encodeReply signs reply to req
+func (s *radiusStandIn) encodeReply(reply, req *radiusPacket) []byte {
+	reply.id, reply.authenticator = req.id, req.authenticator
+	if req.code == radiusAccessRequest {
+		reply.add(radiusMessageAuthenticator, make([]byte, 16))
+	}
+	b := reply.encode()
+	signMessage(b, s.secret)
+	copy(b[4:radiusHeaderLen], responseAuthenticator(b, req.authenticator[:], s.secret))
+	return b
+}
+
+func revealPassword(hidden, secret, requestAuth []byte) []byte {
+	p := make([]byte, len(hidden))
+	prev := requestAuth
+	for i := 0; i+16 <= len(hidden); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		for j, x := range h.Sum(nil) {
+			p[i+j] = hidden[i+j] ^ x
+		}
+		prev = hidden[i : i+16]
+	}
+	return bytes.TrimRight(p, "\x00")
+}
+
+// mppeAttr hides key in a MS-MPPE attribute
+func mppeAttr(typ uint8, key, secret, requestAuth []byte) []byte {
+	p := append([]byte{uint8(len(key))}, key...)
+	p = append(p, make([]byte, (16-len(p)%16)%16)...)
+	salt := []byte{0x80, 0x01}
+	c := make([]byte, len(p))
+	prev := append(append([]byte{}, requestAuth...), salt...)
+	for i := 0; i < len(p); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		for j, x := range h.Sum(nil) {
+			c[i+j] = p[i+j] ^ x
+		}
+		prev = c[i : i+16]
+	}
+	value := make([]byte, 6)
+	binary.BigEndian.PutUint32(value, radiusVendorMicrosoft)
+	value[4], value[5] = typ, uint8(2+len(salt)+len(c))
+	return append(append(value, salt...), c...)
+}
+
+// radiusBackend has a user directory, runs EAP conversations & records accounting
+func radiusBackend(t *testing.T, secret string, identity *EapIdentity, acct chan<- *radiusPacket) func(*radiusPacket) *radiusPacket {
+	conversations := map[string]*eapServer{}
+	return func(req *radiusPacket) *radiusPacket {
+		switch {
+		case req.code == radiusAccountingRequest:
+			acct <- req
+			return &radiusPacket{code: radiusAccountingResponse}
+		case req.password != nil:
+			password, ok := identity.Users.Password(string(req.get(radiusUserName)))
+			if ok && bytes.Equal(password, req.password) {
+				return &radiusPacket{code: radiusAccessAccept}
+			}
+			return &radiusPacket{code: radiusAccessReject}
+		}
+		eap := &protocol.EapPayload{}
+		if err := eap.Decode(req.eap()); err != nil {
+			t.Error(err)
+			return &radiusPacket{code: radiusAccessReject}
+		}
+		state := string(req.get(radiusState))
+		s := conversations[state]
+		if s == nil {
+			s = newEapServer(identity)
+			s.id = eap.Identifier
+			state = fmt.Sprintf("%d", len(conversations)+1)
+			conversations[state] = s
+		}
+		out, err := s.handle(eap)
+		if err != nil {
+			reply := &radiusPacket{code: radiusAccessReject}
+			reply.addEap(s.failure().Encode())
+			return reply
+		}
+		reply := &radiusPacket{code: radiusAccessChallenge}
+		reply.addEap(out.Encode())
+		if out.Code == protocol.EAP_SUCCESS {
+			reply.code = radiusAccessAccept
+			half := len(s.msk) / 2
+			reply.add(radiusVendorSpecific, mppeAttr(radiusMsMppeRecvKey, s.msk[:half], []byte(secret), req.authenticator[:]))
+			reply.add(radiusVendorSpecific, mppeAttr(radiusMsMppeSendKey, s.msk[half:], []byte(secret), req.authenticator[:]))
+			reply.add(radiusClass, []byte("staff"))
+		} else {
+			reply.add(radiusState, []byte(state))
+		}
+		return reply
+	}
+}
+
+var radiusUsers = &EapIdentity{
+	Methods: []NewEapMethod{NewEapMschapv2},
+	Users:   LocalUsers{"alice": "secret"},
+}
+
+func TestRadiusFailover(t *testing.T) {
+	// nothing listens on the first, second does not know our secret
+	closed, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	closed.Close()
+	stranger := newRadiusStandIn(t, "other", radiusBackend(t, "other", radiusUsers, nil))
+	defer stranger.conn.Close()
+	standIn := newRadiusStandIn(t, "radsec", radiusBackend(t, "radsec", radiusUsers, nil))
+	defer standIn.conn.Close()
+	other := stranger.server()
+	other.Secret = standIn.secret
+	client := NewRadiusClient([]RadiusServer{
+		{Address: closed.LocalAddr().String(), Secret: standIn.secret},
+		other,
+		standIn.server(),
+	}, "gw")
+	client.Timeout, client.Retries = 100*time.Millisecond, 1
+	if err := client.CheckPassword("alice", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if client.current != 2 {
+		t.Errorf("server %d answered", client.current)
+	}
+	if err := client.CheckPassword("alice", []byte("guess")); err == nil {
+		t.Error("wrong password was accepted")
+	}
+}
+
+// waitForAccounting returns the next Accounting-Request of status
+func waitForAccounting(t *testing.T, acct <-chan *radiusPacket, status uint32) *radiusPacket {
+	select {
+	case req := <-acct:
+		if got := binary.BigEndian.Uint32(req.get(radiusAcctStatusType)); got != status {
+			t.Fatalf("accounting %d, not %d", got, status)
+		}
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no accounting %d", status)
+	}
+	return nil
+}
+
+func TestRadiusSessions(t *testing.T) {
+	acct := make(chan *radiusPacket, 10)
+	standIn := newRadiusStandIn(t, "radsec", radiusBackend(t, "radsec", radiusUsers, acct))
+	defer standIn.conn.Close()
+	client := NewRadiusClient([]RadiusServer{standIn.server()}, "gw")
+	for _, peerID := range []*EapIdentity{
+		// EAP is relayed
+		{Radius: client},
+		// RADIUS checks the password
+		{Methods: []NewEapMethod{NewEapGtc}, Users: client},
+	} {
+		cfgR := sessionTestConfig()
+		cfgR.PeerID = peerID
+		cfgR.Accounting = client
+		cfg := sessionTestConfig()
+		cfg.LocalID = &EapClientIdentity{User: "alice", Password: "secret"}
+		cfg.Accounting = client
+		ini, err := runSessionPair(t, cfg, cfgR, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// gateway's session is of the user
+		var users []string
+		for i := 0; i < 2; i++ {
+			start := waitForAccounting(t, acct, radiusAcctStart)
+			if user := string(start.get(radiusUserName)); user == "alice" {
+				if peerID.Radius != nil && string(start.get(radiusClass)) != "staff" {
+					t.Error("Class was not sent back")
+				}
+				users = append(users, user)
+			}
+		}
+		if len(users) != 1 {
+			t.Fatalf("sessions of %v", users)
+		}
+		ini.Shutdown(context.Canceled)
+		stop := waitForAccounting(t, acct, radiusAcctStop)
+		if string(stop.get(radiusAcctSessionID)) != ini.acctSessionID {
+			t.Error("stopped another session")
+		}
+		if cause := binary.BigEndian.Uint32(stop.get(radiusAcctTerminateCause)); cause != radiusCauseAdminReset {
+			t.Errorf("terminated by %d", cause)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package ike
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// rfc5685 redirect
+
+// redirectError is returned when client is sent to another gateway
+type redirectError struct {
+	Gateway string
+}
+
+func (e redirectError) Error() string {
+	return "REDIRECT to " + e.Gateway
+}
+
+// Redirector picks the gateway a client is sent to
+type Redirector interface {
+	// Redirect returns address or FQDN of the gateway for client at remote, "" keeps the client
+	Redirect(remote net.Addr) string
+}
+
+// RedirectFunc adapts a function to Redirector
+type RedirectFunc func(remote net.Addr) string
+
+func (f RedirectFunc) Redirect(remote net.Addr) string {
+	return f(remote)
+}
+
+// PrefixRedirect sends clients from Prefix to Gateway
+type PrefixRedirect struct {
+	Prefix  *net.IPNet
+	Gateway string
+}
+
+// PrefixRedirector uses the first prefix client's address is within
+type PrefixRedirector []PrefixRedirect
+
+func (pr PrefixRedirector) Redirect(remote net.Addr) string {
+	ip := AddrToIp(remote)
+	for _, r := range pr {
+		if r.Prefix.Contains(ip) {
+			return r.Gateway
+		}
+	}
+	return ""
+}
+
+// LoadRedirector sends clients to Gateways in turn while Overloaded reports true
+type LoadRedirector struct {
+	Overloaded func() bool
+	Gateways   []string
+
+	next uint32
+}
+
+func (lr *LoadRedirector) Redirect(net.Addr) string {
+	if len(lr.Gateways) == 0 || !lr.Overloaded() {
+		return ""
+	}
+	n := atomic.AddUint32(&lr.next, 1)
+	return lr.Gateways[int(n-1)%len(lr.Gateways)]
+}
+
+// Redirect asks the client to move to the gateway policy picks for it
+// only gateway sessions whose client supports it are redirected; others ignore it
+func (sess *Session) Redirect(policy Redirector) {
+	if sess.redirects == nil {
+		return
+	}
+	select {
+	case sess.redirects <- policy:
+	default:
+	}
+}
+
+// RedirectFromSession builds INFORMATIONAL Request sending client to gateway
+// HDR, SK { N(REDIRECT) } -->
+func RedirectFromSession(sess *Session, gateway string) *Message {
+	info := makeInformational(infoParams{
+		isInitiator: sess.isInitiator,
+		spiI:        sess.IkeSpiI,
+		spiR:        sess.IkeSpiR,
+	})
+	info.Payloads.Add(&protocol.NotifyPayload{
+		PayloadHeader:       &protocol.PayloadHeader{},
+		NotificationType:    protocol.REDIRECT,
+		NotificationMessage: &protocol.Redirect{Gateway: gateway},
+	})
+	return info
+}
+
+// checkRedirect makes sure REDIRECT answers our IKE_SA_INIT
+// it has to return our nonce
+func checkRedirect(sess *Session, notif *protocol.NotifyPayload) error {
+	rd, ok := notif.NotificationMessage.(*protocol.Redirect)
+	if !ok || !sess.redirectSupported {
+		return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_SA_INIT: unexpected REDIRECT")
+	}
+	if !bytes.Equal(rd.Nonce, sess.tkm.Ni.Bytes()) {
+		return errors.Wrap(protocol.ERR_INVALID_SYNTAX, "IKE_SA_INIT: REDIRECT with wrong nonce")
+	}
+	return redirectError{rd.Gateway}
+}
+
+// runRedirect sends client to the gateway policy picks for it
+// client deletes the IKE SA once it replied
+func runRedirect(sess *Session, policy Redirector) (err error) {
+	if !sess.redirectSupported {
+		sess.Logger.Log("REDIRECT", "not supported by peer")
+		return
+	}
+	gw := policy.Redirect(sess.Remote)
+	if gw == "" {
+		return
+	}
+	sess.Logger.Log("REDIRECT", gw)
+	redirectFn := func() (*OutgoingMessage, error) {
+		return sess.InformationalMsg(RedirectFromSession(sess, gw))
+	}
+	msg, err := sess.sendMsgGetReply(redirectFn, func(msg *Message) error {
+		return onRequest(sess, msg)
+	}, nil)
+	if err != nil {
+		return
+	}
+	for _, n := range msg.Payloads.GetNotifications() {
+		if nErr, ok := protocol.GetIkeErrorCode(n.NotificationType); ok {
+			return errors.Wrap(nErr, "REDIRECT: peer notified")
+		}
+	}
+	return
+}
+
+// onRedirect acknowledges gateway's REDIRECT, then ends the session so it can be followed
+func onRedirect(sess *Session, n *protocol.NotifyPayload) error {
+	rd, ok := n.NotificationMessage.(*protocol.Redirect)
+	if !ok || !sess.redirectSupported || sess.redirects != nil {
+		level.Warn(sess.Logger).Log("REDIRECT", "unexpected")
+		return sess.SendEmptyInformational(true)
+	}
+	if err := sess.SendEmptyInformational(true); err != nil {
+		return err
+	}
+	return redirectError{rd.Gateway}
+}
+
+const (
+	// gateways client follows within redirectWindow
+	maxRedirects   = 5
+	redirectWindow = time.Minute
+)
+
+// redirectChain keeps the gateways client was sent to, so it does not follow them in a loop
+type redirectChain struct {
+	started time.Time
+	visited map[string]bool
+}
+
+// follow returns the address of gateway that redirected client from current
+// the new gateway is at the same port
+func (rc *redirectChain) follow(gateway string, current net.Addr) (net.Addr, error) {
+	now := time.Now()
+	if rc.visited == nil || now.Sub(rc.started) > redirectWindow {
+		rc.started = now
+		rc.visited = map[string]bool{}
+	}
+	rc.visited[AddrToIp(current).String()] = true
+	if len(rc.visited) > maxRedirects {
+		return nil, errors.Errorf("REDIRECT: more than %d redirects", maxRedirects)
+	}
+	_, port := AddrToIpPort(current)
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(gateway, strconv.Itoa(port)))
+	if err != nil {
+		return nil, errors.Wrap(err, "REDIRECT")
+	}
+	if rc.visited[addr.IP.String()] {
+		return nil, errors.Errorf("REDIRECT: loop to %s", gateway)
+	}
+	return addr, nil
+}
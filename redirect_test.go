@@ -0,0 +1,96 @@
+package ike
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// redirectInit sends initiator's IKE_SA_INIT to a gateway that redirects it
+func redirectInit(t *testing.T, ini *Session, gwCfg *Config) (*Message, error) {
+	iAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 500}
+	rAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 500}
+	out, err := ini.InitMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := DecodeMessage(out.Data, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.LocalAddr, msg.RemoteAddr = rAddr, iAddr
+	replies := make(chan []byte, 1)
+	if err = checkInitRequest(msg, &testcb{writeTo: replies}, gwCfg, logger); err == nil {
+		return nil, nil
+	}
+	reply, rerr := DecodeMessage(<-replies, logger)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return reply, err
+}
+
+func TestRedirectInit(t *testing.T) {
+	gwCfg := testConfig()
+	gwCfg.Redirect = PrefixRedirector{{Prefix: &net.IPNet{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)}, Gateway: "192.0.2.3"}}
+	cfg := testConfig()
+	// client that does not support it stays
+	ini, err := NewInitiator(cfg, zeroAddr, zeroAddr, &testcb{}, &SessionCallback{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, _ := redirectInit(t, ini, gwCfg); reply != nil {
+		t.Fatal("client was redirected")
+	}
+	cfg.AcceptRedirect = true
+	ini, err = NewInitiator(cfg, zeroAddr, zeroAddr, &testcb{}, &SessionCallback{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := redirectInit(t, ini, gwCfg)
+	if re, ok := errors.Cause(err).(redirectError); !ok || re.Gateway != "192.0.2.3" {
+		t.Fatalf("gateway did not redirect: %v", err)
+	}
+	if err := checkInitResponseForSession(ini, reply); err != (redirectError{"192.0.2.3"}) {
+		t.Errorf("REDIRECT was not followed: %v", err)
+	}
+	// REDIRECT has to return our nonce
+	other, _ := NewInitiator(cfg, zeroAddr, zeroAddr, &testcb{}, &SessionCallback{}, logger)
+	if _, ok := errors.Cause(checkInitResponseForSession(other, reply)).(redirectError); ok {
+		t.Error("REDIRECT for another initiator was followed")
+	}
+}
+
+func TestRedirectInformational(t *testing.T) {
+	ini, res := establishedTestSessions(t, nil)
+	ini.redirectSupported, res.redirectSupported = true, true
+	res.redirects = make(chan Redirector, 1)
+	cerr := make(chan error, 2)
+	go func() { cerr <- monitorSa(ini) }()
+	go func() { cerr <- monitorSa(res) }()
+	res.Redirect(RedirectFunc(func(remote net.Addr) string {
+		return "gw.example.com"
+	}))
+	select {
+	case err := <-cerr:
+		if err != (redirectError{"gw.example.com"}) {
+			t.Fatalf("client was not redirected: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client was not redirected")
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	var rc redirectChain
+	gw1 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 500}
+	gw2, err := rc.follow("192.0.2.2", gw1)
+	if err != nil || gw2.String() != "192.0.2.2:500" {
+		t.Fatalf("redirect: %v %v", gw2, err)
+	}
+	if _, err := rc.follow("192.0.2.1", gw2); err == nil {
+		t.Error("redirect loop was followed")
+	}
+}
@@ -0,0 +1,225 @@
+package ike
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+)
+
+// RevocationPolicy decides what happens when revocation status cannot be determined
+// revoked certificates are always rejected
+type RevocationPolicy int
+
+const (
+	// RevocationSoftFail accepts certificates whose status is unknown
+	RevocationSoftFail RevocationPolicy = iota
+	// RevocationHardFail rejects certificates whose status is unknown
+	RevocationHardFail
+)
+
+func (p RevocationPolicy) String() string {
+	if p == RevocationHardFail {
+		return "HARD_FAIL"
+	}
+	return "SOFT_FAIL"
+}
+
+const (
+	DefaultCRLReloadInterval = time.Hour
+	DefaultOCSPTimeout       = 5 * time.Second
+)
+
+var errRevocationUnknown = errors.New("revocation status is unknown")
+
+// RevocationChecker checks peer certificates against CRLs & an OCSP responder
+type RevocationChecker struct {
+	CRLFiles       []string
+	ReloadInterval time.Duration
+	// queried when no CRL covers the certificate
+	// if empty, the responder named in the certificate is used
+	OCSPServer  string
+	OCSPTimeout time.Duration
+	Policy      RevocationPolicy
+
+	mu   sync.RWMutex
+	crls []*pkix.CertificateList
+}
+
+// NewRevocationChecker loads the CRL files
+func NewRevocationChecker(crlFiles []string, ocspServer string, policy RevocationPolicy) (*RevocationChecker, error) {
+	c := &RevocationChecker{
+		CRLFiles:       crlFiles,
+		ReloadInterval: DefaultCRLReloadInterval,
+		OCSPServer:     ocspServer,
+		OCSPTimeout:    DefaultOCSPTimeout,
+		Policy:         policy,
+	}
+	if err := c.LoadCRLs(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadCRLs (re)reads CRL files, PEM or DER encoded
+// previously loaded CRLs are kept if any file fails to load
+func (c *RevocationChecker) LoadCRLs() error {
+	var crls []*pkix.CertificateList
+	for _, file := range c.CRLFiles {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		crl, err := x509.ParseCRL(b)
+		if err != nil {
+			return errors.Wrapf(err, "parsing %s", file)
+		}
+		crls = append(crls, crl)
+	}
+	c.mu.Lock()
+	c.crls = crls
+	c.mu.Unlock()
+	return nil
+}
+
+// Run reloads CRL files periodically, until ctx is done
+func (c *RevocationChecker) Run(ctx context.Context, logger log.Logger) {
+	interval := c.ReloadInterval
+	if interval == 0 {
+		interval = DefaultCRLReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.LoadCRLs(); err != nil {
+				logger.Log("CRL", "reload", "ERROR", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CheckChain checks all certificates in a verified chain, except the root
+// inband CRLs were sent by peer
+func (c *RevocationChecker) CheckChain(chain []*x509.Certificate, inband []*pkix.CertificateList, logger log.Logger) error {
+	for i := 0; i+1 < len(chain); i++ {
+		if err := c.Check(chain[i], chain[i+1], inband, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check finds the status of cert from CRLs, then from OCSP
+func (c *RevocationChecker) Check(cert, issuer *x509.Certificate, inband []*pkix.CertificateList, logger log.Logger) error {
+	c.mu.RLock()
+	crls := append(append([]*pkix.CertificateList{}, c.crls...), inband...)
+	c.mu.RUnlock()
+	err := checkCRLs(cert, issuer, crls)
+	if err == errRevocationUnknown {
+		err = c.checkOCSP(cert, issuer)
+	}
+	if err == nil {
+		return nil
+	}
+	if !isRevoked(err) {
+		logger.Log("REVOCATION", c.Policy, "SERIAL", cert.SerialNumber, "ERROR", err)
+		if c.Policy == RevocationSoftFail {
+			return nil
+		}
+	}
+	return err
+}
+
+type revokedError struct {
+	serial string
+	source string
+}
+
+func (e revokedError) Error() string {
+	return fmt.Sprintf("certificate %s was revoked (%s)", e.serial, e.source)
+}
+
+func isRevoked(err error) bool {
+	_, ok := errors.Cause(err).(revokedError)
+	return ok
+}
+
+// checkCRLs looks for cert in current CRLs signed by issuer
+func checkCRLs(cert, issuer *x509.Certificate, crls []*pkix.CertificateList) error {
+	covered := false
+	for _, crl := range crls {
+		// CRLs from other issuers fail the signature check
+		if crl.HasExpired(time.Now()) || issuer.CheckCRLSignature(crl) != nil {
+			continue
+		}
+		covered = true
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return revokedError{cert.SerialNumber.String(), "CRL"}
+			}
+		}
+	}
+	if !covered {
+		return errRevocationUnknown
+	}
+	return nil
+}
+
+func (c *RevocationChecker) checkOCSP(cert, issuer *x509.Certificate) error {
+	server := c.OCSPServer
+	if server == "" && len(cert.OCSPServer) > 0 {
+		server = cert.OCSPServer[0]
+	}
+	if server == "" {
+		return errRevocationUnknown
+	}
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return err
+	}
+	timeout := c.OCSPTimeout
+	if timeout == 0 {
+		timeout = DefaultOCSPTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return errors.Wrap(errRevocationUnknown, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Wrapf(errRevocationUnknown, "OCSP responder: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(errRevocationUnknown, err.Error())
+	}
+	status, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return errors.Wrap(errRevocationUnknown, err.Error())
+	}
+	if !status.NextUpdate.IsZero() && status.NextUpdate.Before(time.Now()) {
+		return errors.Wrap(errRevocationUnknown, "stale OCSP response")
+	}
+	switch status.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return revokedError{cert.SerialNumber.String(), "OCSP"}
+	default:
+		return errors.Wrap(errRevocationUnknown, "OCSP")
+	}
+}
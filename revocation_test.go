@@ -0,0 +1,163 @@
+package ike
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+type revocationTestPKI struct {
+	ca            *x509.Certificate
+	caKey         crypto.Signer
+	good, revoked *x509.Certificate
+}
+
+func newRevocationTestPKI(t *testing.T) *revocationTestPKI {
+	ca, caKey, err := NewECCA("TEST CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := &revocationTestPKI{ca: ca, caKey: caKey.(crypto.Signer)}
+	for _, c := range []**x509.Certificate{&pki.good, &pki.revoked} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if *c, err = NewSignedCert(CertID{CommonName: "172.17.0.1"}, key.Public(), ca, caKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pki
+}
+
+func (pki *revocationTestPKI) crl(t *testing.T) []byte {
+	now := time.Now()
+	der, err := pki.ca.CreateCRL(rand.Reader, pki.caKey, []pkix.RevokedCertificate{
+		{SerialNumber: pki.revoked.SerialNumber, RevocationTime: now},
+	}, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// ocspResponder is a stand in for an OCSP server
+func (pki *revocationTestPKI) ocspResponder(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status := ocsp.Good
+		if req.SerialNumber.Cmp(pki.revoked.SerialNumber) == 0 {
+			status = ocsp.Revoked
+		}
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(pki.ca, pki.ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now,
+			NextUpdate:   now.Add(time.Hour),
+			RevokedAt:    now,
+		}, pki.caKey)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write(resp)
+	}))
+}
+
+func TestRevocationCRLFile(t *testing.T) {
+	pki := newRevocationTestPKI(t)
+	dir, err := ioutil.TempDir("", "crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ca.crl")
+	if err = ioutil.WriteFile(file, pki.crl(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checker, err := NewRevocationChecker([]string{file}, "", RevocationHardFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nop := log.NewNopLogger()
+	if err = checker.Check(pki.good, pki.ca, nil, nop); err != nil {
+		t.Error(err)
+	}
+	if err = checker.Check(pki.revoked, pki.ca, nil, nop); !isRevoked(err) {
+		t.Error("revoked certificate accepted", err)
+	}
+	// reload with an empty CRL
+	empty, _ := pki.ca.CreateCRL(rand.Reader, pki.caKey, nil, time.Now(), time.Now().Add(time.Hour))
+	ioutil.WriteFile(file, empty, 0644)
+	if err = checker.LoadCRLs(); err != nil {
+		t.Fatal(err)
+	}
+	if err = checker.Check(pki.revoked, pki.ca, nil, nop); err != nil {
+		t.Error("reloaded CRL not used", err)
+	}
+}
+
+func TestRevocationInbandCRL(t *testing.T) {
+	pki := newRevocationTestPKI(t)
+	crl, err := x509.ParseDERCRL(pki.crl(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nop := log.NewNopLogger()
+	hard := &RevocationChecker{Policy: RevocationHardFail}
+	if err = hard.Check(pki.good, pki.ca, nil, nop); err == nil {
+		t.Error("unknown status accepted with hard fail")
+	}
+	inband := []*pkix.CertificateList{crl}
+	if err = hard.Check(pki.good, pki.ca, inband, nop); err != nil {
+		t.Error(err)
+	}
+	if err = hard.Check(pki.revoked, pki.ca, inband, nop); !isRevoked(err) {
+		t.Error("revoked certificate accepted", err)
+	}
+	// CRL from another CA does not count
+	other := newRevocationTestPKI(t)
+	if err = hard.Check(other.good, other.ca, inband, nop); err == nil {
+		t.Error("CRL of other CA was used")
+	}
+}
+
+func TestRevocationOCSP(t *testing.T) {
+	pki := newRevocationTestPKI(t)
+	server := pki.ocspResponder(t)
+	nop := log.NewNopLogger()
+	checker, err := NewRevocationChecker(nil, server.URL, RevocationHardFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checker.CheckChain([]*x509.Certificate{pki.good, pki.ca}, nil, nop); err != nil {
+		t.Error(err)
+	}
+	if err = checker.CheckChain([]*x509.Certificate{pki.revoked, pki.ca}, nil, nop); !isRevoked(err) {
+		t.Error("revoked certificate accepted", err)
+	}
+	// responder is down
+	server.Close()
+	if err = checker.Check(pki.good, pki.ca, nil, nop); err == nil {
+		t.Error("unknown status accepted with hard fail")
+	}
+	checker.Policy = RevocationSoftFail
+	if err = checker.Check(pki.good, pki.ca, nil, nop); err != nil {
+		t.Error("soft fail", err)
+	}
+}
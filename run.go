@@ -1,6 +1,7 @@
 package ike
 
 import (
+	"bytes"
 	"time"
 
 	"github.com/go-kit/kit/log/level"
@@ -11,12 +12,20 @@ import (
 var (
 	initJitter   = 2 * time.Second
 	jitterFactor = -0.5
+	// IKE SA rekey refused by peer is retried after
+	ikeSaRekeyRetry = time.Minute
 )
 
 func runInitiator(sess *Session) (err error) {
 	// send initiator INIT after jittered wait and wait for reply
 	time.Sleep(Jitter(initJitter, jitterFactor))
 	var msg *Message
+	triedGroups := map[protocol.DhTransformId]bool{}
+	// session resumed from a ticket uses IKE_SESSION_RESUME instead
+	checkInitResponse := checkInitResponseForSession
+	if sess.resume != nil {
+		checkInitResponse = checkResumeResponseForSession
+	}
 	for {
 		msg, err = sess.SendMsgGetReply(sess.InitMsg)
 		if err != nil {
@@ -24,7 +33,7 @@ func runInitiator(sess *Session) (err error) {
 		}
 		// TODO - check if we already have a connection to this host
 		// check if incoming message is an acceptable Init Response
-		if err = checkInitResponseForSession(sess, msg); err != nil {
+		if err = checkInitResponse(sess, msg); err != nil {
 			if ce, ok := err.(peerRequestsCookieError); ok {
 				sess.SetCookie(ce.Cookie)
 				sess.msgIDReq.reset(0)
@@ -32,6 +41,18 @@ func runInitiator(sess *Session) (err error) {
 				// TODO -fix
 				continue
 			}
+			if de, ok := err.(peerRequestsDhGroupError); ok {
+				// try each group once, same SPI & cookie
+				if triedGroups[de.DhGroup] {
+					return errors.Wrapf(protocol.ERR_INVALID_KE_PAYLOAD, "peer asked for group %s again", de.DhGroup)
+				}
+				triedGroups[sess.tkm.suite.DhGroup.TransformId()] = true
+				if err = sess.SetDhGroup(de.DhGroup); err != nil {
+					return
+				}
+				sess.msgIDReq.reset(0)
+				continue
+			}
 			// return error
 			return
 		}
@@ -44,16 +65,18 @@ func runInitiator(sess *Session) (err error) {
 	if err = sess.CreateIkeSa(init); err != nil {
 		return
 	}
+	// If there is NAT, then all the further communication is performed over port 4500
 	if init.hasNat {
-		sess.Logger.Log("NAT detected")
+		sess.setNat(init)
 	}
-	// TODO
-	// If there is NAT , then all the further communication is performed over port 4500 instead of the default port 500
-	// also, periodically send keepalive packets in order for NAT to keep it’s bindings alive.
 	// save message
 	sess.initRb = msg.Data
-	// start auth
-	sess.EspSpiI = MakeSpi()[:4]
+	// start auth; first Child SA is created with IKE SA, unless it is childless
+	var child *childSa
+	if !sess.childless {
+		child = &childSa{espSpiI: MakeSpi()[:4]}
+		sess.children = []*childSa{child}
+	}
 	// send AUTH and wait for reply
 	if msg, err = sess.SendMsgGetReply(sess.AuthMsg); err != nil {
 		return
@@ -62,6 +85,19 @@ func runInitiator(sess *Session) (err error) {
 	if err = checkAuthResponseForSession(sess, msg); err != nil {
 		return
 	}
+	peerID := peerIdPayload(sess, msg)
+	// gateway may require EAP
+	if msg, err = runEapClientRound(sess, msg); err != nil {
+		sess.CheckError(err, false)
+		return
+	}
+	// authenticate again, if responder asked for it
+	if len(sess.localRounds) > 0 {
+		if msg, err = runInitiatorAuthRounds(sess, msg); err != nil {
+			sess.CheckError(err, false)
+			return
+		}
+	}
 	// can we authenticate ?
 	espSpiR, lifetime, err := handleAuthForSession(sess, msg)
 	if err != nil {
@@ -69,11 +105,18 @@ func runInitiator(sess *Session) (err error) {
 		sess.CheckError(err, false)
 		return
 	}
-	// replace espSpiI & lifetime : MUTATION
-	sess.EspSpiR = espSpiR
-	if lifetime != 0 {
-		sess.cfg.Lifetime = lifetime
+	// selectors may have been narrowed by responder
+	// replace espSpiR, selectors & lifetime : MUTATION
+	if child != nil {
+		child.espSpiR = espSpiR
+		child.tsI, child.tsR = sess.cfg.TsI, sess.cfg.TsR
+		child.lifetime = sess.cfg.Lifetime
+		if lifetime != 0 {
+			child.lifetime = lifetime
+		}
 	}
+	// ticket to resume the session with
+	sess.keepTicket(msg, peerID)
 	return
 }
 
@@ -86,6 +129,7 @@ func runResponder(sess *Session) (err error) {
 	if !ok {
 		return errorSessionClosed
 	}
+	sess.msgIDResp.replyTo(msg.IkeHeader.MsgID)
 	// fetch params already attached from prior parsing
 	init, ok := msg.Params.(*initParams)
 	if !ok {
@@ -95,31 +139,58 @@ func runResponder(sess *Session) (err error) {
 		return
 	}
 	if init.hasNat {
-		sess.Logger.Log("NAT detected")
+		sess.setNat(init)
 	}
-	// TODO - NAT
 	// save message
 	sess.initIb = msg.Data
 	// send INIT_reply & wait for AUTH
-	msg, err = sess.SendMsgGetReply(sess.InitMsg)
-	if err != nil {
+	// retransmitted INIT is answered with the same reply
+	if err = sess.sendMsg(sess.InitMsg()); err != nil {
+		return
+	}
+	if msg, err = sess.waitForRequest(); err != nil {
 		return
 	}
 	// is it an AUTH request
 	if err = checkAuthRequestForSession(sess, msg); err != nil {
 		return
 	}
+	// initiator may have moved to NAT-T port
+	if sess.natLocal || sess.natRemote {
+		sess.followNatT(msg)
+	}
 	// can we authenticate ?
-	espSpiI, lifetime, err := handleAuthForSession(sess, msg)
+	var espSpiI protocol.Spi
+	var lifetime time.Duration
+	if len(sess.peerRounds) > 0 {
+		// initiator authenticates again, SA is negotiated in its first request
+		if err = runResponderAuthRounds(sess, msg); err == nil {
+			espSpiI, lifetime, err = handleSaForSession(sess, msg)
+		}
+	} else {
+		espSpiI, lifetime, err = handleAuthForSession(sess, msg)
+	}
 	if err != nil {
 		sess.AuthReply(err)
 		return
 	}
-	// replace espSpiI & espSpiR : MUTATION
-	sess.EspSpiI = espSpiI
-	sess.EspSpiR = MakeSpi()[:4]
-	if lifetime != 0 {
-		sess.cfg.Lifetime = lifetime
+	// first Child SA, unless initiator created none : MUTATION
+	if !sess.childless {
+		child := &childSa{
+			espSpiI:  espSpiI,
+			espSpiR:  MakeSpi()[:4],
+			tsI:      sess.cfg.TsI,
+			tsR:      sess.cfg.TsR,
+			lifetime: sess.cfg.Lifetime,
+		}
+		if lifetime != 0 {
+			child.lifetime = lifetime
+		}
+		sess.children = []*childSa{child}
+	}
+	// ticket peer can resume the session with
+	if err = sess.issueTicket(msg); err != nil {
+		return
 	}
 	// send AUTH_reply
 	if err = sess.sendMsg(sess.AuthMsg()); err != nil {
@@ -128,7 +199,8 @@ func runResponder(sess *Session) (err error) {
 	return
 }
 
-func runIpsecRekey(sess *Session) (err error) {
+// runIpsecRekey rekeys child, or creates it if it has no spis
+func runIpsecRekey(sess *Session, child *childSa) (err error) {
 	// if REKEY timeout
 	//  create new tkm, send REKEY, wait for REKEY_reply,
 	//  retry on timeout
@@ -136,28 +208,50 @@ func runIpsecRekey(sess *Session) (err error) {
 	if err != nil {
 		return
 	}
-	espSpiI := MakeSpi()[:4]
+	espSpi := MakeSpi()[:4]
 	// closure with parameters for new SA
 	rekeyFn := func() (*OutgoingMessage, error) {
-		return sess.RekeyMsg(ChildSaFromSession(sess, newTkm, true, espSpiI))
+		return sess.RekeyMsg(ChildSaFromSession(sess, child, newTkm, true, espSpi, 0))
 	}
-	msg, err := sess.SendMsgGetReply(rekeyFn)
-	if err != nil {
+	// peer may be rekeying the same SA
+	var peerRekey *childSaRekey
+	handleRequest := func(msg *Message) (err error) {
+		if msg.IkeHeader.ExchangeType != protocol.CREATE_CHILD_SA || rekeysIkeSa(msg) {
+			return onRequest(sess, msg)
+		}
+		rekey, err := onRekeyRequest(sess, msg)
+		if err != nil || rekey == nil {
+			return
+		}
+		if rekey.old == child {
+			peerRekey = rekey
+			return
+		}
+		sess.replaceSa(rekey)
 		return
 	}
-	params, err := parseChildSa(msg, true)
+	msg, err := sess.sendMsgGetReply(rekeyFn, handleRequest, nil)
 	if err != nil {
 		return
 	}
 	for _, n := range msg.Payloads.GetNotifications() {
 		if nErr, ok := protocol.GetIkeErrorCode(n.NotificationType); ok {
+			if child.espSpiI == nil {
+				// IKE SA is kept without the additional Child SA
+				sess.Logger.Log("CHILD_SA", "rejected", "ERROR", nErr)
+				return
+			}
 			// for example, due to FAILED_CP_REQUIRED, NO_PROPOSAL_CHOSEN, TS_UNACCEPTABLE etc
 			// TODO - for now, we should simply end the IKE_SA
 			err = errors.Wrap(nErr, "peer notified")
 			return
 		}
 	}
-	espSpiR, err := checkIpsecRekeyResponse(sess, params)
+	params, err := parseChildSa(msg, true)
+	if err != nil {
+		return
+	}
+	peerSpi, err := checkIpsecRekeyResponse(sess, child, params)
 	if err != nil {
 		// send notification in INFORMATIONAL request to peer & end IKE SA
 		sess.CheckError(err, false)
@@ -169,35 +263,72 @@ func runIpsecRekey(sess *Session) (err error) {
 		}
 	}
 	newTkm.Nr = params.nonce
+	rekey := &childSaRekey{
+		childSa: &childSa{
+			espSpiI:  espSpi,
+			espSpiR:  peerSpi,
+			tsI:      child.tsI,
+			tsR:      child.tsR,
+			lifetime: child.lifetime,
+		},
+		ni:          newTkm.Ni,
+		nr:          newTkm.Nr,
+		isInitiator: true,
+	}
+	if !sess.isInitiator {
+		rekey.espSpiI, rekey.espSpiR = peerSpi, espSpi
+	}
+	if params.lifetime != 0 {
+		rekey.lifetime = params.lifetime
+	}
+	if child.espSpiI != nil {
+		rekey.old = child
+	}
 	// install new SA - [espSpiI, espSpiR, nI, nR & dhShared]
-	err = sess.AddSa(addSaParams(sess.tkm,
-		newTkm.Ni, newTkm.Nr, newTkm.DhShared,
-		espSpiI, espSpiR,
-		&sess.cfg))
+	err = sess.AddSa(rekeyedSaParams(sess.tkm, newTkm.DhShared, rekey, &sess.cfg, sess.isInitiator))
 	if err != nil {
 		return
 	}
-	// remove old sa
-	sess.RemoveSa()
-	// replace espSpiI & espSpiR : MUTATION
-	sess.EspSpiI = espSpiI
-	sess.EspSpiR = espSpiR
-	if params.lifetime != 0 {
-		sess.cfg.Lifetime = params.lifetime
+	if peerRekey == nil {
+		// remove old sa
+		sess.replaceSa(rekey)
+		return
+	}
+	// simultaneous rekey; both sides keep the same SA
+	redundant, keep := peerRekey, rekey
+	if hasLowestNonce(rekey, peerRekey) {
+		redundant, keep = rekey, peerRekey
+	}
+	sess.Logger.Log("REKEY", "collision", "REDUNDANT", redundant.localSpi(sess))
+	sess.removeSa(redundant.childSa)
+	sess.replaceSa(keep)
+	if redundant == rekey {
+		// SA we created is deleted by us
+		deleteFn := func() (*OutgoingMessage, error) {
+			return sess.InformationalMsg(DeleteEspFromSession(sess, false, rekey.localSpi(sess)))
+		}
+		_, err = sess.sendMsgGetReply(deleteFn, handleRequest, nil)
 	}
 	return
 }
 
-func onRekeyRequest(sess *Session, msg *Message) (err error) {
+// onRekeyRequest installs Child SA requested by peer
+// old SA is replaced by caller
+// rejected requests return no Child SA; IKE SA is kept
+func onRekeyRequest(sess *Session, msg *Message) (rekey *childSaRekey, err error) {
 	// if REKEY rx :
 	params, err := parseChildSa(msg, false)
 	if err != nil {
 		return
 	}
-	espSpiI, err := checkIpsecRekeyRequest(sess, params)
+	child, peerSpi, selected, err := checkIpsecRekeyRequest(sess, params)
 	if err != nil {
-		// send notification to peer & end IKE SA
-		sess.CheckError(err, true)
+		// send notification to peer
+		sess.childSaErrorReply(err)
+		if _, ok := errors.Cause(err).(protocol.IkeErrorCode); ok {
+			sess.Logger.Log("CHILD_SA", "rejected", "ERROR", err)
+			err = nil
+		}
 		return
 	}
 	// create tkm with new Nonce
@@ -210,49 +341,218 @@ func onRekeyRequest(sess *Session, msg *Message) (err error) {
 			return
 		}
 	}
-	espSpiR := MakeSpi()[:4]
+	espSpi := MakeSpi()[:4]
 	//  send REKEY_reply
 	// closure with parameters for new SA
-	err = sess.sendMsg(sess.RekeyMsg(ChildSaFromSession(sess, newTkm, false, espSpiR)))
+	err = sess.sendMsg(sess.RekeyMsg(ChildSaFromSession(sess, child, newTkm, false, espSpi, selected)))
 	if err != nil {
 		return
 	}
+	rekey = &childSaRekey{
+		childSa: &childSa{
+			espSpiI:  peerSpi,
+			espSpiR:  espSpi,
+			tsI:      child.tsI,
+			tsR:      child.tsR,
+			lifetime: child.lifetime,
+		},
+		ni: newTkm.Ni,
+		nr: newTkm.Nr,
+	}
+	if sess.isInitiator {
+		rekey.espSpiI, rekey.espSpiR = espSpi, peerSpi
+	}
+	if params.targetEspSpi != nil {
+		rekey.old = child
+	}
 	// install new SA - [espSpiI, espSpiR, nI, nR & dhShared]
-	err = sess.AddSa(addSaParams(sess.tkm,
-		newTkm.Ni, newTkm.Nr, newTkm.DhShared,
-		espSpiI, espSpiR,
-		&sess.cfg))
+	err = sess.AddSa(rekeyedSaParams(sess.tkm, newTkm.DhShared, rekey, &sess.cfg, sess.isInitiator))
+	return
+}
+
+// deleteChildSa removes Child SA & asks peer to delete it too
+func deleteChildSa(sess *Session, child *childSa) (err error) {
+	spi := child.localSpi(sess)
+	sess.removeChildSa(child)
+	deleteFn := func() (*OutgoingMessage, error) {
+		return sess.InformationalMsg(DeleteEspFromSession(sess, false, spi))
+	}
+	_, err = sess.sendMsgGetReply(deleteFn, func(msg *Message) error {
+		return onRequest(sess, msg)
+	}, nil)
+	return
+}
+
+// runIkeSaRekey replaces IKE SA with a new one
+// errIkeSaRekeyRefused is returned when peer refused it; IKE SA is kept
+func runIkeSaRekey(sess *Session) (err error) {
+	// create tkm with the negotiated suite & new spi, send REKEY, wait for REKEY_reply
+	newTkm, err := NewTkm(&sess.cfg, nil)
 	if err != nil {
 		return
 	}
-	// remove old sa
-	sess.RemoveSa()
-	// replace espSpiI & espSpiR : MUTATION
-	sess.EspSpiI = espSpiI
-	sess.EspSpiR = espSpiR
-	if params.lifetime != 0 {
-		sess.cfg.Lifetime = params.lifetime
+	rekey := &ikeSaRekey{tkm: newTkm, spiI: MakeSpi(), isInitiator: true}
+	rekeyFn := func() (*OutgoingMessage, error) {
+		return sess.RekeyMsg(ikeSaRekeyFromSession(sess, rekey))
+	}
+	// peer may be rekeying IKE SA too
+	var peerRekey *ikeSaRekey
+	handleRequest := func(msg *Message) error {
+		if msg.IkeHeader.ExchangeType != protocol.CREATE_CHILD_SA || !rekeysIkeSa(msg) {
+			return onRequest(sess, msg)
+		}
+		if err := onIkeSaRekeyRequest(sess, msg); err != nil {
+			return err
+		}
+		peerRekey = sess.ikeSaRekey
+		return nil
 	}
-	//  send INFORMATIONAL, wait for INFORMATIONAL_reply
-	//  if timeout, send REKEY_reply again
+	var msg *Message
+	triedGroups := make(map[protocol.DhTransformId]bool)
+	for {
+		if msg, err = sess.sendMsgGetReply(rekeyFn, handleRequest, nil); err != nil {
+			return
+		}
+		n := errorNotification(msg)
+		if n == nil {
+			break
+		}
+		if dh, ok := n.NotificationMessage.(uint16); ok && n.NotificationType == protocol.INVALID_KE_PAYLOAD {
+			// try each group once
+			triedGroups[newTkm.suite.DhGroup.TransformId()] = true
+			if suite := sess.cfg.ikeSuiteWithDhGroup(protocol.DhTransformId(dh)); suite != nil && !triedGroups[protocol.DhTransformId(dh)] {
+				sess.Logger.Log("INVALID_KE_PAYLOAD", "retry", "DH", protocol.DhTransformId(dh))
+				if err = newTkm.switchDhGroup(suite); err != nil {
+					return
+				}
+				continue
+			}
+		}
+		// for example, due to TEMPORARY_FAILURE or NO_PROPOSAL_CHOSEN
+		return errors.Wrapf(errIkeSaRekeyRefused, "peer notified %s", n.NotificationType)
+	}
+	params, err := parseChildSa(msg, true)
+	if err != nil {
+		return
+	}
+	if rekey.spiR, err = checkIkeSaRekeyResponse(sess, params); err != nil {
+		sess.CheckError(err, false)
+		return
+	}
+	newTkm.Nr = params.nonce
+	if err = newTkm.DhGenerateKey(params.dhPublic); err != nil {
+		return
+	}
+	newTkm.IkeSaKeys(rekey.spiI, rekey.spiR, sess.tkm.skD)
+	if peerRekey != nil {
+		// simultaneous rekey, rfc7296 2.8.1; both sides keep the same IKE SA
+		// redundant one was never used, side that created it deletes it, rfc7296 2.8.2
+		if rekey.hasLowestNonce(peerRekey) {
+			sess.Logger.Log("IKE_SA", "collision", "REDUNDANT", rekey.spiI)
+			// peer deletes the old IKE SA, then its one is used
+			return sess.sendRedundantIkeSaDelete(rekey)
+		}
+		sess.Logger.Log("IKE_SA", "collision", "REDUNDANT", peerRekey.spiI)
+	}
+	// delete old IKE SA; must be the last request on it
+	if msg, err = sess.sendMsgGetReply(sess.DeleteMsg, handleRequest, nil); err != nil {
+		return
+	}
+	if msg.IkeHeader.ExchangeType != protocol.INFORMATIONAL || !msg.IkeHeader.Flags.IsResponse() {
+		return errors.Errorf("IKE SA Delete: unexpected %s", msg.IkeHeader.ExchangeType)
+	}
+	sess.switchIkeSa(rekey)
 	return
 }
 
-func monitorSa(sess *Session) (err error) {
-	// install policy
-	err = sess.installPolicy()
+// errorNotification returns the first error notification of msg
+func errorNotification(msg *Message) *protocol.NotifyPayload {
+	for _, n := range msg.Payloads.GetNotifications() {
+		if _, ok := protocol.GetIkeErrorCode(n.NotificationType); ok {
+			return n
+		}
+	}
+	return nil
+}
+
+// onIkeSaRekeyRequest creates IKE SA requested by peer
+// rejected requests keep the current IKE SA
+func onIkeSaRekeyRequest(sess *Session, msg *Message) (err error) {
+	params, err := parseChildSa(msg, false)
 	if err != nil {
 		return
 	}
-	// add INITIAL sa
-	err = sess.AddSa(addSaParams(sess.tkm,
-		sess.tkm.Ni, sess.tkm.Nr, nil, // NOTE : use the original SA
-		sess.EspSpiI, sess.EspSpiR,
-		&sess.cfg))
+	rekey, err := checkIkeSaRekeyRequest(sess, params)
 	if err != nil {
+		// send notification to peer
+		sess.childSaErrorReply(err)
+		if _, ok := errors.Cause(err).(protocol.IkeErrorCode); ok {
+			sess.Logger.Log("IKE_SA", "rekey rejected", "ERROR", err)
+			err = nil
+		}
+		return
+	}
+	// create tkm with new Nonce & spi
+	if rekey.tkm, err = NewTkm(&sess.cfg, params.nonce); err != nil {
+		return
+	}
+	if err = rekey.tkm.DhGenerateKey(params.dhPublic); err != nil {
+		return
+	}
+	rekey.spiR = MakeSpi()
+	//  send REKEY_reply
+	if err = sess.sendMsg(sess.RekeyMsg(ikeSaRekeyFromSession(sess, rekey))); err != nil {
+		return
+	}
+	rekey.tkm.IkeSaKeys(rekey.spiI, rekey.spiR, sess.tkm.skD)
+	// new IKE SA is used once peer deletes the old one : MUTATION
+	sess.ikeSaRekey = rekey
+	return
+}
+
+func monitorSa(sess *Session) (err error) {
+	// replace policies held after the previous session found peer dead
+	if sess.held != nil {
+		sess.held.releasePolicies()
+		// MUTATION
+		sess.held = nil
+	}
+	// childless IKE SA has no Child SA from IKE_AUTH
+	var child *childSa
+	if !sess.childless {
+		child = sess.children[0]
+		// install policy
+		if err = sess.installPolicy(child); err != nil {
+			return
+		}
+	}
+	// add address & routes given to us by remote access gateway
+	if err = sess.installClientConfig(); err != nil {
 		return
 	}
+	if child != nil {
+		// add INITIAL sa
+		err = sess.AddSa(addSaParams(sess.tkm,
+			sess.tkm.Ni, sess.tkm.Nr, nil, // NOTE : use the original SA
+			child,
+			&sess.cfg))
+		if err != nil {
+			return
+		}
+		child.startTimers()
+	}
 	if sess.isInitiator {
+		children := sess.cfg.Children
+		// childless IKE SA creates the Child SA for TsI & TsR now
+		if sess.childless && sess.cfg.TsI != nil && sess.cfg.TsR != nil {
+			children = append([]ChildSaConfig{{TsI: sess.cfg.TsI, TsR: sess.cfg.TsR}}, children...)
+		}
+		// create additional Child SAs
+		for _, cfg := range children {
+			if err = runIpsecRekey(sess, childSaFromConfig(&sess.cfg, cfg)); err != nil {
+				return
+			}
+		}
 		// send INFORMATIONAL, wait for INFORMATIONAL_reply
 		// if timeout, send AUTH_reply again
 		// monitor SA
@@ -260,76 +560,235 @@ func monitorSa(sess *Session) (err error) {
 			return
 		}
 	}
-	// check for duplicate SA, if found remove one with smaller nonce
 	// setup SA REKEY timeout (jittered) & monitoring
-	rekeyDelay := sess.cfg.Lifetime
-	saRekeyDeadline := time.NewTimer(rekeyDelay)
-	rekeyTimeout := Jitter(rekeyDelay, jitterFactor)
-	saRekeyTimer := time.NewTimer(rekeyTimeout)
-	sess.Logger.Log("RekeyDeadline", rekeyDelay, "RekeyTimeout", rekeyTimeout)
+	// each Child SA has its own; timer is set for the earliest one
+	childTimeout := sess.nextChildSaTimeout()
+	childTimer := time.NewTimer(childTimeout)
+	if child != nil {
+		sess.Logger.Log("Lifetime", child.lifetime, "RekeyTimeout", childTimeout)
+	}
+	// either side can rekey IKE SA
+	var ikeRekeyTimer *time.Timer
+	var ikeRekey <-chan time.Time
+	ikeRekeyTimeout := Jitter(sess.cfg.IkeLifetime, jitterFactor)
+	if ikeRekeyTimeout != 0 {
+		ikeRekeyTimer = time.NewTimer(ikeRekeyTimeout)
+		ikeRekey = ikeRekeyTimer.C
+		sess.Logger.Log("IkeRekeyTimeout", ikeRekeyTimeout)
+	}
+	// returns when to rekey next; refused rekey is retried sooner
+	rekeyIkeSa := func() (time.Duration, error) {
+		err := runIkeSaRekey(sess)
+		if errors.Cause(err) != errIkeSaRekeyRefused {
+			return ikeRekeyTimeout, err
+		}
+		sess.Logger.Log("IkeRekey", err)
+		if ikeRekeyTimeout > ikeSaRekeyRetry {
+			return Jitter(ikeSaRekeyRetry, jitterFactor), nil
+		}
+		return ikeRekeyTimeout, nil
+	}
+	// check peer when nothing was received for a while
+	var dpdTimer *time.Timer
+	var dpd <-chan time.Time
+	if sess.cfg.DpdDelay != 0 {
+		dpdTimer = time.NewTimer(sess.cfg.DpdDelay)
+		dpd = dpdTimer.C
+	}
+	// keep NAT mapping alive; with MOBIKE, NAT can appear on a new path
+	var keepalive <-chan time.Time
+	if (sess.natLocal && sess.udpEncap || sess.mobike) && sess.cfg.NatKeepalive != 0 {
+		ticker := time.NewTicker(sess.cfg.NatKeepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
 	for {
 		select {
-		// TODO - use a timeout here
 		case msg, ok := <-sess.incoming:
 			if !ok {
 				return errorSessionClosed
 			}
-			switch msg.IkeHeader.ExchangeType {
-			// if INFORMATIONAL, send INFORMATIONAL_reply
-			case protocol.INFORMATIONAL:
-				evt := HandleInformationalForSession(sess, msg)
-				if evt == nil {
-					continue
-				}
-				switch evt.SessionNotificationType {
-				case MSG_EMPTY_RESPONSE:
-					break
-				case MSG_EMPTY_REQUEST:
-					if iErr := sess.SendEmptyInformational(true); iErr != nil {
-						return iErr
-					}
-				case MSG_ERROR:
-					iErr := evt.Message.(error)
-					sess.Logger.Log("INFORMATIONAL", iErr)
-					return iErr
-				default:
-					level.Warn(sess.Logger).Log("INFORMATIONAL", "unhandled", "NOTIFICATION", evt.Message)
+			if !msg.IkeHeader.Flags.IsResponse() {
+				sess.msgIDResp.replyTo(msg.IkeHeader.MsgID)
+			}
+			ikeSpi := sess.IkeSpiI
+			if err = onRequest(sess, msg); err != nil {
+				return
+			}
+			// peer was heard from
+			if dpdTimer != nil {
+				resetTimer(dpdTimer, sess.cfg.DpdDelay)
+			}
+			// peer rekeyed IKE SA
+			if !bytes.Equal(ikeSpi, sess.IkeSpiI) && ikeRekeyTimer != nil {
+				ikeRekeyTimer.Reset(ikeRekeyTimeout)
+			}
+		case <-childTimer.C:
+			if err = checkChildSas(sess); err != nil {
+				return
+			}
+		case <-ikeRekey:
+			sess.Logger.Log("IkeRekey", "Timeout")
+			var next time.Duration
+			if next, err = rekeyIkeSa(); err != nil {
+				sess.Logger.Log("IkeRekeyError", err)
+				return
+			}
+			ikeRekeyTimer.Reset(next)
+		case <-dpd:
+			if err = runDpd(sess); err != nil {
+				return
+			}
+			dpdTimer.Reset(sess.cfg.DpdDelay)
+		case upd := <-sess.addressUpdates:
+			if err = runUpdateSaAddresses(sess, upd); err != nil {
+				return
+			}
+		case policy := <-sess.redirects:
+			if err = runRedirect(sess, policy); err != nil {
+				return
+			}
+		case <-keepalive:
+			sess.sendNatKeepalive()
+		} // select
+		// peer moved; Child SAs follow once its new address is checked
+		if sess.addressesMoved {
+			if err = runReturnRoutabilityCheck(sess); err != nil {
+				return
+			}
+		}
+		// rekey IKE SA before our message ids wrap around; peer does the same for its ids
+		if sess.msgIDReq.exhausted() {
+			sess.Logger.Log("IkeRekey", "message ids exhausted")
+			var next time.Duration
+			if next, err = rekeyIkeSa(); err != nil {
+				return
+			}
+			if ikeRekeyTimer != nil {
+				resetTimer(ikeRekeyTimer, next)
+			}
+		}
+		// Child SAs may have changed
+		resetTimer(childTimer, sess.nextChildSaTimeout())
+	} // for
+}
+
+// checkChildSas rekeys Child SAs which are due & removes the expired ones
+// returns error when no Child SA is left, unless IKE SA is childless
+func checkChildSas(sess *Session) (err error) {
+	now := time.Now()
+	for _, child := range append([]*childSa{}, sess.children...) {
+		if sess.childSaByPeerSpi(child.peerSpi(sess)) != child {
+			// replaced by peer meanwhile
+			continue
+		}
+		if !now.Before(child.expireAt) {
+			sess.Logger.Log("CHILD_SA", "expired", "SPI", child.localSpi(sess))
+			if err = deleteChildSa(sess, child); err != nil {
+				return
+			}
+		} else if !now.Before(child.rekeyAt) {
+			sess.Logger.Log("Rekey", "Timeout", "SPI", child.localSpi(sess))
+			if err = runIpsecRekey(sess, child); err != nil {
+				sess.Logger.Log("RekeyError", err)
+				return
+			}
+		}
+	}
+	if len(sess.children) == 0 && !sess.childless {
+		return errorRekeyDeadlineExceeded
+	}
+	return
+}
+
+// onRequest handles requests from peer, and INFORMATIONAL responses
+// returns error when IKE SA has to end
+func onRequest(sess *Session, msg *Message) (err error) {
+	switch msg.IkeHeader.ExchangeType {
+	// if INFORMATIONAL, send INFORMATIONAL_reply
+	case protocol.INFORMATIONAL:
+		return onInformational(sess, msg)
+	case protocol.CREATE_CHILD_SA:
+		if rekeysIkeSa(msg) {
+			return onIkeSaRekeyRequest(sess, msg)
+		}
+		rekey, err := onRekeyRequest(sess, msg)
+		if err != nil || rekey == nil {
+			return err
+		}
+		sess.replaceSa(rekey)
+	}
+	return
+}
+
+// onInformational handles INFORMATIONAL from peer
+// returns error when IKE SA has to end
+func onInformational(sess *Session, msg *Message) (err error) {
+	// rfc4555 MOBIKE
+	if !msg.IkeHeader.Flags.IsResponse() {
+		if msg.Payloads.GetNotification(protocol.UPDATE_SA_ADDRESSES) != nil {
+			return onUpdateSaAddresses(sess, msg)
+		}
+		if isReturnRoutabilityCheck(msg) {
+			return onReturnRoutabilityCheck(sess, msg)
+		}
+		// rfc5685 redirect
+		if n := msg.Payloads.GetNotification(protocol.REDIRECT); n != nil {
+			return onRedirect(sess, n)
+		}
+	}
+	evt := HandleInformationalForSession(sess, msg)
+	if evt == nil {
+		return
+	}
+	switch evt.SessionNotificationType {
+	case MSG_EMPTY_RESPONSE:
+		break
+	case MSG_EMPTY_REQUEST:
+		return sess.SendEmptyInformational(true)
+	case MSG_NOTIFICATION:
+		if cp, ok := evt.Message.(*protocol.ConfigurationPayload); ok && !msg.IkeHeader.Flags.IsResponse() {
+			return onConfiguration(sess, cp)
+		}
+	case MSG_ERROR:
+		iErr := evt.Message.(error)
+		switch errors.Cause(iErr) {
+		case errPeerRemovedIkeSa:
+			if sess.ikeSaRekey != nil {
+				// peer deleted the IKE SA it rekeyed
+				if err = sess.SendEmptyInformational(true); err != nil {
+					return
 				}
-			case protocol.CREATE_CHILD_SA:
-				// ONLY :
-				// Accept SA rekey if responder
-				if sess.isInitiator {
-					level.Warn(sess.Logger).Log("CREATE_CHILD_SA", "Currently only supported for responder")
-					// send notification
-					sess.Notify(protocol.ERR_NO_ADDITIONAL_SAS, true)
+				sess.switchIkeSa(sess.ikeSaRekey)
+				return
+			}
+		case errPeerRemovedEspSa:
+			del := msg.Payloads.Get(protocol.PayloadTypeD).(*protocol.DeletePayload)
+			var spis []protocol.Spi
+			for _, spi := range del.Spis {
+				child := sess.childSaByPeerSpi(spi)
+				if child == nil {
+					// redundant SA from a rekey collision, already removed
+					sess.Logger.Log("INFORMATIONAL", "removed", "SA", spi)
 					continue
 				}
-				if err = onRekeyRequest(sess, msg); err != nil {
-					return err
-				}
-				// reset timers
-				saRekeyTimer.Reset(rekeyTimeout)
-				saRekeyDeadline.Reset(rekeyDelay)
+				spis = append(spis, child.localSpi(sess))
+				sess.removeChildSa(child)
 			}
-		case <-saRekeyDeadline.C:
-			return errorRekeyDeadlineExceeded
-		case <-saRekeyTimer.C:
-			// ONLY :
-			// Initiate SA rekey if initiator
-			if !sess.isInitiator {
-				level.Warn(sess.Logger).Log("RekeyTimeout", "Currently only supported for initiator")
-				continue
+			if err = sess.sendEspDeleteReply(spis); err != nil {
+				return
 			}
-			sess.Logger.Log("Rekey", "Timeout")
-			if err = runIpsecRekey(sess); err != nil {
-				sess.Logger.Log("RekeyError", err)
+			if len(sess.children) > 0 || sess.childless {
+				// other Child SAs, or the childless IKE SA, are kept
 				return
 			}
-			// reset timers
-			saRekeyTimer.Reset(rekeyTimeout)
-			saRekeyDeadline.Reset(rekeyDelay)
-		} // select
-	} // for
+		}
+		sess.Logger.Log("INFORMATIONAL", iErr)
+		return iErr
+	default:
+		level.Warn(sess.Logger).Log("INFORMATIONAL", "unhandled", "NOTIFICATION", evt.Message)
+	}
+	return
 }
 
 // RunSession starts and monitors the session returning when the session ends
@@ -341,6 +800,7 @@ func RunSession(sess *Session) error {
 		err = runResponder(sess)
 	}
 	if err == nil {
+		sess.startAccounting()
 		err = monitorSa(sess)
 	}
 	sess.cancel()
@@ -10,32 +10,36 @@ import (
 // or from the rekeyed Tkm when Perfect Forward Secrecy is used
 func addSaParams(tkm *Tkm,
 	ni, nr, dhShared *big.Int,
-	espSpiI, espSpiR []byte,
+	child *childSa,
 	cfg *Config) *platform.SaParams {
 	// sa processing
 	espEi, espAi, espEr, espAr := tkm.IpsecSaKeys(ni, nr, dhShared)
-	SpiI := SpiToInt32(espSpiI)
-	SpiR := SpiToInt32(espSpiR)
-	return &platform.SaParams{
-		PolicyParams:  cfg.Policy(),
-		EspEi:         espEi,
-		EspAi:         espAi,
-		EspEr:         espEr,
-		EspAr:         espAr,
-		SpiI:          int(SpiI),
-		SpiR:          int(SpiR),
-		EspTransforms: cfg.ProposalEsp,
+	sa := removeSaParams(child, cfg)
+	sa.EspEi, sa.EspAi, sa.EspEr, sa.EspAr = espEi, espAi, espEr, espAr
+	// kept to move the SA to new addresses : MUTATION
+	child.sa = sa
+	return sa
+}
+
+// rekeyedSaParams generates keys for Child SA created by CREATE_CHILD_SA
+// keys are for the exchange initiator, SA params from the IKE initiator's point of view
+func rekeyedSaParams(tkm *Tkm, dhShared *big.Int, rekey *childSaRekey, cfg *Config, isIkeInitiator bool) *platform.SaParams {
+	sa := addSaParams(tkm, rekey.ni, rekey.nr, dhShared, rekey.childSa, cfg)
+	if rekey.isInitiator != isIkeInitiator {
+		// IKE responder started the exchange
+		sa.EspEi, sa.EspAi, sa.EspEr, sa.EspAr = sa.EspEr, sa.EspAr, sa.EspEi, sa.EspAi
 	}
+	return sa
 }
 
-func removeSaParams(espSpiI, espSpiR []byte, cfg *Config) *platform.SaParams {
+func removeSaParams(child *childSa, cfg *Config) *platform.SaParams {
 	// sa processing
-	SpiI := SpiToInt32(espSpiI)
-	SpiR := SpiToInt32(espSpiR)
+	SpiI := SpiToInt32(child.espSpiI)
+	SpiR := SpiToInt32(child.espSpiR)
 	return &platform.SaParams{
-		PolicyParams:  cfg.Policy(),
+		PolicyParams:  cfg.childPolicy(child.tsI, child.tsR),
 		SpiI:          int(SpiI),
 		SpiR:          int(SpiR),
-		EspTransforms: cfg.ProposalEsp,
+		EspTransforms: cfg.ProposalEsp[0],
 	}
 }
@@ -6,7 +6,9 @@ import (
 	stderror "errors"
 	"fmt"
 	"net"
+	"reflect"
 	"sync/atomic"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -21,6 +23,8 @@ var (
 	errorRekeyDeadlineExceeded = stderror.New("Rekey Deadline Exceeded")
 	errPeerRemovedIkeSa        = stderror.New("Delete IKE SA")
 	errPeerRemovedEspSa        = stderror.New("Delete ESP SA")
+	errPeerDead                = stderror.New("Dead Peer")
+	errIkeSaRekeyRefused       = stderror.New("IKE SA Rekey Refused")
 )
 
 var sessionCount int32
@@ -32,6 +36,10 @@ type SessionCallback struct {
 
 	InstallChildSa func(*Session, *platform.SaParams) error
 	RemoveChildSa  func(*Session, *platform.SaParams) error
+
+	// remote access client; address, dns & subnets assigned by the gateway
+	InstallClientConfig func(*Session, *platform.ClientConfig) error
+	RemoveClientConfig  func(*Session, *platform.ClientConfig) error
 }
 
 // Session stores IKE session's local state
@@ -44,22 +52,74 @@ type Session struct {
 
 	tkm                 *Tkm
 	authPeer, authLocal Authenticator
+	// rfc4739; initiator authenticates in more IKE_AUTH rounds
+	localRounds, peerRounds []Authenticator
+	authRound               int // after the first one
+	// EAP; initiator's AUTH was keyed with its MSK, so is our reply
+	eapMsk Authenticator
+	// peer's ID from the first round, its AUTH after EAP is for it
+	peerIDp *protocol.IdPayload
+	// rfc5998; gateway was authenticated by EAP alone
+	eapOnly bool
+	// RADIUS accounting; zero acctStart if it was not started
+	acctStart     time.Time
+	acctSessionID string
 
 	isInitiator       bool
 	rfc7427Signatures bool
+	fragmentation     bool     // rfc7383
+	peerAuthorities   [][]byte // CERTREQ from peer
+	ikeProposal       uint8    // proposal numbers selected by us as responder
+	espProposal       uint8
 	SessionID         int32
 
 	IkeSpiI, IkeSpiR protocol.Spi
-	EspSpiI, EspSpiR protocol.Spi
 
-	msgIDReq, msgIDResp msgID
+	children  []*childSa // first one is created by IKE_AUTH
+	childless bool       // rfc6023; both support it, IKE_AUTH creates no Child SA
+
+	// DpdHold: policies of a dead session are kept till the restarted one replaces them
+	policiesHeld bool
+	held         *Session
+
+	msgIDReq, msgIDResp *msgID // ours & peer's requests
+
+	ikeSaRekey     *ikeSaRekey // waiting for peer to delete the old IKE SA
+	onIkeSaRekeyed func(sess *Session, oldSpiI protocol.Spi)
 
-	incoming chan *Message
+	incoming  chan *Message
+	fragments map[fragmentKey]*fragmentBuffer
 
 	// cached data
 	initIb, initRb  []byte
 	responderCookie []byte
 
+	// remote access
+	configuration *protocol.ConfigurationPayload // CP sent in IKE_AUTH
+	peerIdentity  string
+	leases        []*AddressPool
+	clientConfig  *platform.ClientConfig
+	configured    bool // clientConfig was installed
+
+	// rfc3948 NAT traversal
+	natConn             Conn // listens on NatTPort
+	natLocal, natRemote bool // NAT detected by IKE_SA_INIT
+	udpEncap            bool // moved to natConn, ESP is sent in UDP
+
+	// rfc4555 MOBIKE
+	mobike         bool               // both peers support it
+	addressUpdates chan addressUpdate // only the original initiator updates addresses
+	addressesMoved bool               // by peer; Child SAs follow once return routability is checked
+
+	// rfc5723 session resumption
+	resume *Ticket // session is resumed with it
+	ticket *Ticket // issued by responder in IKE_AUTH
+
+	// rfc5685 redirect
+	redirectSupported bool            // client: we accept REDIRECT; gateway: client does
+	redirectedFrom    string          // client: gateway that redirected us here
+	redirects         chan Redirector // gateway asks client to move
+
 	// data from client
 	Conn          Conn
 	Local, Remote net.Addr
@@ -76,6 +136,30 @@ func NewInitiator(cfg *Config, localAddr, remoteAddr net.Addr, conn Conn, cb *Se
 	if err != nil {
 		return nil, err
 	}
+	return newInitiator(cfg, tkm, localAddr, remoteAddr, conn, cb, logger)
+}
+
+// NewResumingInitiator creates an initiator session that resumes the one ticket was issued for
+func NewResumingInitiator(cfg *Config, ticket *Ticket, localAddr, remoteAddr net.Addr, conn Conn, cb *SessionCallback, logger log.Logger) (*Session, error) {
+	if ticket.Expired() {
+		return nil, errors.WithStack(errTicketExpired)
+	}
+	// IKE SA keeps its suite
+	sessCfg := *cfg
+	sessCfg.ProposalIke = []protocol.TransformMap{ticket.state.Suite}
+	tkm, err := NewTkmResume(&sessCfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := newInitiator(&sessCfg, tkm, localAddr, remoteAddr, conn, cb, logger)
+	if err != nil {
+		return nil, err
+	}
+	sess.resume = ticket
+	return sess, nil
+}
+
+func newInitiator(cfg *Config, tkm *Tkm, localAddr, remoteAddr net.Addr, conn Conn, cb *SessionCallback, logger log.Logger) (*Session, error) {
 	cxt, cancel := context.WithCancel(context.Background())
 	sess := &Session{
 		cxt:               cxt,
@@ -83,6 +167,7 @@ func NewInitiator(cfg *Config, localAddr, remoteAddr net.Addr, conn Conn, cb *Se
 		SessionID:         atomic.AddInt32(&sessionCount, 1),
 		isInitiator:       true,
 		rfc7427Signatures: true,
+		fragmentation:     cfg.FragmentSize > 0,
 		tkm:               tkm,
 		cfg:               *cfg,
 		IkeSpiI:           MakeSpi(),
@@ -90,10 +175,15 @@ func NewInitiator(cfg *Config, localAddr, remoteAddr net.Addr, conn Conn, cb *Se
 		incoming:          make(chan *Message, 10),
 		Conn:              conn,
 		Cb:                *cb,
-		msgIDReq:          msgID{id: 0},
-		msgIDResp:         msgID{id: -1},
+		msgIDReq:          newMsgID(1),
+		msgIDResp:         newMsgID(cfg.WindowSize),
+		addressUpdates:    make(chan addressUpdate, 1),
+		redirectSupported: cfg.AcceptRedirect,
+	}
+	if cfg.RequestAddress {
+		sess.configuration = configurationRequest()
 	}
-	err = sess.setAddresses(localAddr, remoteAddr)
+	err := sess.setAddresses(localAddr, remoteAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -103,16 +193,54 @@ func NewInitiator(cfg *Config, localAddr, remoteAddr net.Addr, conn Conn, cb *Se
 
 // NewResponder creates a Responder session
 func NewResponder(cfg *Config, conn Conn, cb *SessionCallback, initI *Message, logger log.Logger) (*Session, error) {
-	// get spi
-	ikeSpiI := initI.IkeHeader.SpiI
 	// cast is safe since we already checked for presence of payloads
 	// assert ?
 	noI := initI.Payloads.Get(protocol.PayloadTypeNonce).(*protocol.NoncePayload)
+	saI := initI.Payloads.Get(protocol.PayloadTypeSA).(*protocol.SaPayload)
+	keI := initI.Payloads.Get(protocol.PayloadTypeKE).(*protocol.KePayload)
+	// session uses the suite we select
+	sessCfg := *cfg
+	ikeProposal, suite, err := cfg.SelectIkeProposal(saI.Proposals, keI.DhTransformId)
+	if err != nil {
+		return nil, err
+	}
+	sessCfg.ProposalIke = []protocol.TransformMap{suite}
 	// creating tkm is expensive, should come after checks are positive
-	tkm, err := NewTkm(cfg, noI.Nonce)
+	tkm, err := NewTkm(&sessCfg, noI.Nonce)
 	if err != nil {
 		return nil, err
 	}
+	sess, err := newResponder(&sessCfg, tkm, conn, cb, initI, logger)
+	if err != nil {
+		return nil, err
+	}
+	sess.ikeProposal = ikeProposal
+	return sess, nil
+}
+
+// NewResumingResponder creates a Responder session from IKE_SESSION_RESUME
+// its ticket was checked by checkResumeRequest
+func NewResumingResponder(cfg *Config, conn Conn, cb *SessionCallback, initI *Message, logger log.Logger) (*Session, error) {
+	init, ok := initI.Params.(*initParams)
+	if !ok || init.resume == nil {
+		return nil, errors.New("missing resume parameters")
+	}
+	// IKE SA keeps its suite
+	sessCfg := *cfg
+	sessCfg.ProposalIke = []protocol.TransformMap{init.resume.state.Suite}
+	tkm, err := NewTkmResume(&sessCfg, init.nonce)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := newResponder(&sessCfg, tkm, conn, cb, initI, logger)
+	if err != nil {
+		return nil, err
+	}
+	sess.resume = init.resume
+	return sess, nil
+}
+
+func newResponder(cfg *Config, tkm *Tkm, conn Conn, cb *SessionCallback, initI *Message, logger log.Logger) (*Session, error) {
 	cxt, cancel := context.WithCancel(context.Background())
 	// create and run session
 	sess := &Session{
@@ -121,15 +249,16 @@ func NewResponder(cfg *Config, conn Conn, cb *SessionCallback, initI *Message, l
 		SessionID: atomic.AddInt32(&sessionCount, 1),
 		tkm:       tkm,
 		cfg:       *cfg,
-		IkeSpiI:   ikeSpiI,
+		IkeSpiI:   initI.IkeHeader.SpiI,
 		IkeSpiR:   MakeSpi(),
 		incoming:  make(chan *Message, 10),
 		Conn:      conn,
 		Cb:        *cb,
-		msgIDReq:  msgID{id: 0},
-		msgIDResp: msgID{id: -1},
+		msgIDReq:  newMsgID(1),
+		msgIDResp: newMsgID(cfg.WindowSize),
+		redirects: make(chan Redirector, 1),
 	}
-	err = sess.setAddresses(initI.LocalAddr, initI.RemoteAddr)
+	err := sess.setAddresses(initI.LocalAddr, initI.RemoteAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -151,15 +280,29 @@ func (sess *Session) Shutdown(err error) {
 	// dont send Delete for
 	switch errors.Cause(err) {
 	case errPeerRemovedIkeSa,
+		errPeerDead,
 		protocol.ERR_UNSUPPORTED_CRITICAL_PAYLOAD,
 		protocol.ERR_INVALID_SYNTAX,
 		protocol.ERR_AUTHENTICATION_FAILED:
 		break
 	default:
-		sess.sendIkeSaDelete()
+		// nor for peer that does not reply
+		if !IsTimeout(err) {
+			sess.sendIkeSaDelete()
+		}
+	}
+	if sess.holdPolicies(err) {
+		// MUTATION
+		sess.policiesHeld = true
+		for _, child := range sess.children {
+			sess.removeSa(child)
+		}
+	} else {
+		sess.RemoveSa()
 	}
-	sess.RemoveSa()
-	sess.removePolicy()
+	sess.removeClientConfig()
+	sess.stopAccounting(err)
+	sess.releaseAddresses()
 	// NOTE : it is possible that RunSession has exited already
 	close(sess.incoming) // closing channel will cause RunSession to continue
 	<-sess.cxt.Done()    // wait till it returns
@@ -171,8 +314,16 @@ func (sess *Session) IsInitiator() bool {
 	return sess.isInitiator
 }
 
+// Ticket returns the resumption ticket responder issued, if any
+func (sess *Session) Ticket() *Ticket {
+	return sess.ticket
+}
+
 type OutgoingMessage struct {
-	Data []byte
+	Data      []byte
+	Fragments [][]byte // rfc7383; sent instead of Data
+
+	header *protocol.IkeHeader
 }
 
 func (sess *Session) tag() string {
@@ -187,8 +338,23 @@ func (sess *Session) String() string {
 	return fmt.Sprintf("%s<=>%s %s", sess.IkeSpiI, sess.IkeSpiR, sess.tkm)
 }
 
+// CreateIkeSa creates keys & authenticators
+// resumed sessions derive them from the ticket
 func (sess *Session) CreateIkeSa(init *initParams) error {
+	if sess.resume != nil {
+		return sess.resumeIkeSa(init)
+	}
 	if sess.isInitiator {
+		// switch to the suite responder selected
+		_, suite, err := sess.cfg.SelectProposal(protocol.IKE, init.proposals)
+		if err != nil {
+			return err
+		}
+		if err = sess.tkm.setIkeSuite(suite); err != nil {
+			return err
+		}
+		// MUTATION
+		sess.cfg.ProposalIke = []protocol.TransformMap{suite}
 		// peer responders nonce
 		sess.tkm.Nr = init.nonce
 		// peer responders spi
@@ -198,6 +364,8 @@ func (sess *Session) CreateIkeSa(init *initParams) error {
 		sess.tkm.Ni = init.nonce
 		// peer initiators spi
 		sess.IkeSpiI = append([]byte{}, init.spiI...)
+		// client can be redirected later
+		sess.redirectSupported = init.redirectSupported
 	}
 	//
 	// we know what IKE ciphersuite peer selected
@@ -209,21 +377,123 @@ func (sess *Session) CreateIkeSa(init *initParams) error {
 	}
 	// peer will/not use secure signatures
 	sess.rfc7427Signatures = init.rfc7427Signatures
+	// both need to support fragmentation
+	sess.fragmentation = init.fragmentation && sess.cfg.FragmentSize > 0
+	// initiator decides in IKE_AUTH
+	sess.childless = init.childless && sess.cfg.Childless
+	// responder's CERTREQ
+	sess.peerAuthorities = init.certAuthorities
 	// create rest of ike sa
 	sess.tkm.IkeSaKeys(sess.IkeSpiI, sess.IkeSpiR, nil)
 	// create authenticators
 	sess.authLocal = NewAuthenticator(sess.cfg.LocalID, sess.tkm, sess.isInitiator, sess.rfc7427Signatures)
 	sess.authPeer = NewAuthenticator(sess.cfg.PeerID, sess.tkm, sess.isInitiator, sess.rfc7427Signatures)
+	// initiator authenticates again only if responder asked for it
+	if sess.isInitiator && init.multipleAuth {
+		for _, id := range sess.cfg.LocalAuthRounds {
+			sess.localRounds = append(sess.localRounds, NewAuthenticator(id, sess.tkm, sess.isInitiator, sess.rfc7427Signatures))
+		}
+	} else if sess.isInitiator && len(sess.cfg.LocalAuthRounds) > 0 {
+		sess.Logger.Log("MULTIPLE_AUTH", "not supported by peer")
+	}
+	if !sess.isInitiator {
+		for _, id := range sess.cfg.PeerAuthRounds {
+			sess.peerRounds = append(sess.peerRounds, NewAuthenticator(id, sess.tkm, sess.isInitiator, sess.rfc7427Signatures))
+		}
+	}
 	sess.Logger.Log("IKE_SA", "initialised", "session", sess, "securesig", init.rfc7427Signatures)
 	return nil
 }
 
+// resumeIkeSa creates IKE SA from ticket & IKE_SESSION_RESUME
+// peers authenticate using keys derived from the resumed IKE SA
+func (sess *Session) resumeIkeSa(init *initParams) error {
+	if sess.isInitiator {
+		sess.tkm.Nr = init.nonce
+		sess.IkeSpiR = append([]byte{}, init.spiR...)
+	} else {
+		sess.IkeSpiI = append([]byte{}, init.spiI...)
+	}
+	sess.fragmentation = init.fragmentation && sess.cfg.FragmentSize > 0
+	sess.tkm.ResumeIkeSaKeys(sess.IkeSpiI, sess.IkeSpiR, sess.resume.state.SkD)
+	localID, peerID := sess.resume.state.identities(sess.isInitiator)
+	sess.authLocal = &ResumeAuthenticator{tkm: sess.tkm, forInitiator: sess.isInitiator, identity: localID}
+	sess.authPeer = &ResumeAuthenticator{tkm: sess.tkm, forInitiator: sess.isInitiator, identity: peerID}
+	sess.Logger.Log("IKE_SA", "resumed", "session", sess, "old", sess.resume.state.SpiI)
+	return nil
+}
+
+// switchIkeSa replaces the IKE SA with the rekeyed one
+// child SAs are carried over
+func (sess *Session) switchIkeSa(rekey *ikeSaRekey) {
+	oldSpiI := sess.IkeSpiI
+	// side that started the rekey is the initiator of the new IKE SA
+	if rekey.isInitiator != sess.isInitiator {
+		sess.swapRoles()
+	}
+	// MUTATION
+	sess.tkm = rekey.tkm
+	sess.IkeSpiI = rekey.spiI
+	sess.IkeSpiR = rekey.spiR
+	// window sizes are kept
+	sess.msgIDReq = newMsgID(sess.msgIDReq.window)
+	sess.msgIDResp = newMsgID(sess.msgIDResp.window)
+	sess.fragments = nil
+	sess.ikeSaRekey = nil
+	sess.Logger.Log("IKE_SA", "rekeyed", "session", sess, "old", oldSpiI)
+	if sess.onIkeSaRekeyed != nil {
+		sess.onIkeSaRekeyed(sess, oldSpiI)
+	}
+}
+
+// swapRoles makes initiator the responder & vice versa
+// child SA state is kept from the initiator's point of view
+func (sess *Session) swapRoles() {
+	// MUTATION
+	sess.isInitiator = !sess.isInitiator
+	for _, child := range sess.children {
+		child.espSpiI, child.espSpiR = child.espSpiR, child.espSpiI
+		child.tsI, child.tsR = child.tsR, child.tsI
+	}
+	sess.cfg.TsI, sess.cfg.TsR = sess.cfg.TsR, sess.cfg.TsI
+	// config is shared with other sessions
+	children := make([]ChildSaConfig, 0, len(sess.cfg.Children))
+	for _, child := range sess.cfg.Children {
+		children = append(children, ChildSaConfig{TsI: child.TsR, TsR: child.TsI, Lifetime: child.Lifetime})
+	}
+	sess.cfg.Children = children
+}
+
 func (sess *Session) SetCookie(cn *protocol.NotifyPayload) {
 	sess.responderCookie = cn.NotificationMessage.([]byte)
 }
 
+// SetDhGroup regenerates KE for the group responder asked for
+// group must be in one of our suites
+func (sess *Session) SetDhGroup(dh protocol.DhTransformId) error {
+	if sess.tkm.suite.DhGroup.TransformId() == dh {
+		return errors.Wrapf(protocol.ERR_INVALID_KE_PAYLOAD, "peer requested group %s already in use", dh)
+	}
+	if suite := sess.cfg.ikeSuiteWithDhGroup(dh); suite != nil {
+		sess.Logger.Log("INVALID_KE_PAYLOAD", "retry", "DH", dh)
+		return sess.tkm.switchDhGroup(suite)
+	}
+	return errors.Wrapf(protocol.ERR_INVALID_KE_PAYLOAD, "peer requested group %s, not allowed", dh)
+}
+
 func (sess *Session) PostMessage(msg *Message) {
+	if sess.isRetransmittedRequest(msg) {
+		sess.Logger.Log("RETRANSMIT", msg.IkeHeader.MsgID)
+		sess.writeMsg(sess.msgIDResp.response(msg.IkeHeader.MsgID))
+		return
+	}
 	check := func() (err error) {
+		if msg.IkeHeader.NextPayload == protocol.PayloadTypeSKF {
+			// continue with the reassembled message
+			if msg, err = sess.defragment(msg); err != nil {
+				return
+			}
+		}
 		if err = sess.isMessageValid(msg); err != nil {
 			return
 		}
@@ -236,30 +506,57 @@ func (sess *Session) PostMessage(msg *Message) {
 		return
 	}
 	if err := check(); err != nil {
-		level.Warn(sess.Logger).Log("DROP", err)
+		if err != errIncompleteMessage {
+			level.Warn(sess.Logger).Log("DROP", err)
+		}
 		return
 	}
 	sess.incoming <- msg
 }
 
 func (sess *Session) encode(msg *Message) (*OutgoingMessage, error) {
+	if sess.fragmentation && msg.IkeHeader.NextPayload == protocol.PayloadTypeSK {
+		frags, err := msg.EncodeFragments(sess.tkm, sess.isInitiator, sess.cfg.FragmentSize, sess.Logger)
+		if err != nil {
+			return nil, err
+		}
+		if len(frags) == 1 {
+			return &OutgoingMessage{Data: frags[0], header: msg.IkeHeader}, nil
+		}
+		return &OutgoingMessage{Fragments: frags, header: msg.IkeHeader}, nil
+	}
 	buf, err := msg.Encode(sess.tkm, sess.isInitiator, sess.Logger)
-	return &OutgoingMessage{buf}, err
+	return &OutgoingMessage{Data: buf, header: msg.IkeHeader}, err
 }
 
 func (sess *Session) sendMsg(msg *OutgoingMessage, err error) error {
 	if err != nil {
 		return err
 	}
+	if msg.header != nil && msg.header.Flags.IsResponse() {
+		sess.msgIDResp.addResponse(msg)
+	}
+	return sess.writeMsg(msg)
+}
+
+func (sess *Session) writeMsg(msg *OutgoingMessage) (err error) {
+	for _, frag := range msg.Fragments {
+		if err = WriteData(sess.Conn, frag, sess.Remote, sess.Logger); err != nil {
+			return err
+		}
+	}
+	if msg.Fragments != nil {
+		return nil
+	}
 	return WriteData(sess.Conn, msg.Data, sess.Remote, sess.Logger)
 }
 
-// this can be used in genreal case, but not for INFO requests from responders -- TODO
+// nextID is for IKE_SA_INIT & IKE_AUTH, where only initiator sends requests
 func (sess *Session) nextID() (id uint32) {
 	if sess.isInitiator {
 		id = sess.msgIDReq.next()
 	} else {
-		id = sess.msgIDResp.next()
+		id = sess.msgIDResp.reply()
 	}
 	return
 }
@@ -283,10 +580,13 @@ func (sess *Session) InitMsg() (*OutgoingMessage, error) {
 
 // AuthMsg generates IKE_AUTH
 func (sess *Session) AuthMsg() (*OutgoingMessage, error) {
-	sess.Logger.Log("TX_SELECTORS", fmt.Sprintf("[INI]%s<=>%s[RES]", sess.cfg.TsI, sess.cfg.TsR))
 	// make sure selectors are present
-	if sess.cfg.TsI == nil || sess.cfg.TsR == nil {
+	if sess.childless {
+		sess.Logger.Log("TX_SELECTORS", "none")
+	} else if sess.cfg.TsI == nil || sess.cfg.TsR == nil {
 		return nil, errors.WithStack(protocol.ERR_NO_PROPOSAL_CHOSEN)
+	} else {
+		sess.Logger.Log("TX_SELECTORS", fmt.Sprintf("[INI]%s<=>%s[RES]", sess.cfg.TsI, sess.cfg.TsR))
 	}
 	auth, err := authFromSession(sess)
 	if err != nil {
@@ -297,32 +597,116 @@ func (sess *Session) AuthMsg() (*OutgoingMessage, error) {
 	return sess.encode(auth)
 }
 
+// RekeyMsg generates CREATE_CHILD_SA
+// either side can start one
 func (sess *Session) RekeyMsg(child *Message) (*OutgoingMessage, error) {
-	child.IkeHeader.MsgID = sess.nextID()
+	if child.IkeHeader.Flags.IsResponse() {
+		child.IkeHeader.MsgID = sess.msgIDResp.reply()
+	} else {
+		child.IkeHeader.MsgID = sess.msgIDReq.next()
+	}
 	// encode & send
 	return sess.encode(child)
 }
 
 // SendMsgGetReply sends a request and waits for valid reply
 func (sess *Session) SendMsgGetReply(genMsg func() (*OutgoingMessage, error)) (*Message, error) {
-	for {
-		// send initiator INIT after jittered wait
-		if err := sess.sendMsg(genMsg()); err != nil {
+	return sess.sendMsgGetReply(genMsg, nil, nil)
+}
+
+// waitForRequest waits as long as peer would retransmit its request
+func (sess *Session) waitForRequest() (*Message, error) {
+	b := sess.retransmission()
+	msg, err := packetOrTimeOut(sess.incoming, b.total())
+	if err == errorReplyTimedout {
+		return nil, errors.Wrap(err, "waiting for request")
+	}
+	if err == nil {
+		sess.msgIDResp.replyTo(msg.IkeHeader.MsgID)
+	}
+	return msg, err
+}
+
+// sendMsgGetReply passes requests from peer to onRequest while waiting for the reply
+// so are responses to our other outstanding requests
+// request is retransmitted with the configured backoff, unless b is given
+func (sess *Session) sendMsgGetReply(genMsg func() (*OutgoingMessage, error), onRequest func(*Message) error, b *backoff) (*Message, error) {
+	if b == nil {
+		b = sess.retransmission()
+	}
+	// peer may not accept more requests till it answers the earlier ones
+	for !sess.msgIDReq.hasRoom() {
+		msg, err := packetOrTimeOut(sess.incoming, b.total())
+		if err == errorReplyTimedout {
+			return nil, errors.WithStack(&TimeoutError{Retransmits: b.retries})
+		} else if err != nil {
+			return nil, err
+		}
+		if !msg.IkeHeader.Flags.IsResponse() && onRequest == nil {
+			return msg, nil
+		}
+		if err = sess.handleOther(msg, onRequest); err != nil {
 			return nil, err
 		}
+	}
+	// same message is retransmitted
+	out, err := genMsg()
+	if err != nil {
+		return nil, err
+	}
+	send := true
+	timeout, retries := b.timeout, 0
+	for {
+		if send {
+			if err := sess.sendMsg(out, nil); err != nil {
+				return nil, err
+			}
+		}
 		// wait for reply, or timeout
-		msg, err := packetOrTimeOut(sess.incoming)
+		msg, err := packetOrTimeOut(sess.incoming, timeout)
 		if err != nil {
-			// on timeout, send INIT again, and loop
+			// on timeout, send again, and loop
 			if err == errorReplyTimedout {
+				if retries == b.retries {
+					err := &TimeoutError{Retransmits: retries}
+					if out.header != nil {
+						err.ExchangeType, err.MsgID = out.header.ExchangeType, out.header.MsgID
+					}
+					return nil, errors.WithStack(err)
+				}
+				retries++
+				timeout *= 2
+				send = true
 				continue
 			}
 			return nil, err
 		}
-		return msg, err
+		if msg.IkeHeader.Flags.IsResponse() && (out.header == nil || msg.IkeHeader.MsgID == out.header.MsgID) {
+			return msg, nil
+		}
+		if !msg.IkeHeader.Flags.IsResponse() && onRequest == nil {
+			sess.msgIDResp.replyTo(msg.IkeHeader.MsgID)
+			return msg, nil
+		}
+		if err = sess.handleOther(msg, onRequest); err != nil {
+			return nil, err
+		}
+		send = false
 	}
 }
 
+// handleOther passes peer's request, or response to another of our requests, to onRequest
+func (sess *Session) handleOther(msg *Message, onRequest func(*Message) error) error {
+	if onRequest == nil {
+		sess.Logger.Log("DROP", "response", "ID", msg.IkeHeader.MsgID)
+		return nil
+	}
+	if !msg.IkeHeader.Flags.IsResponse() {
+		sess.msgIDResp.replyTo(msg.IkeHeader.MsgID)
+	}
+	return onRequest(msg)
+}
+
 // utilities
 
 // CheckError checks error for error & sends notification within INFORMATIONAL
@@ -346,23 +730,82 @@ func (sess *Session) AuthReply(ie error) {
 
 func (sess *Session) Notify(ie protocol.IkeErrorCode, isResponse bool) {
 	info := NotifyFromSession(sess, ie, isResponse)
-	info.IkeHeader.MsgID = sess.nextID()
+	if isResponse {
+		info.IkeHeader.MsgID = sess.msgIDResp.reply()
+	} else {
+		info.IkeHeader.MsgID = sess.msgIDReq.next()
+	}
 	// encode & send
 	sess.sendMsg(sess.encode(info))
 }
 
-func (sess *Session) sendIkeSaDelete() {
-	info := DeleteFromSession(sess)
-	info.IkeHeader.MsgID = sess.msgIDReq.next()
+// childSaErrorReply rejects a CREATE_CHILD_SA request
+func (sess *Session) childSaErrorReply(ie error) {
+	iErr, ok := errors.Cause(ie).(protocol.IkeErrorCode)
+	if !ok {
+		return
+	}
+	reply := NotifyFromSession(sess, iErr, true)
+	reply.IkeHeader.ExchangeType = protocol.CREATE_CHILD_SA
+	if iErr == protocol.ERR_INVALID_KE_PAYLOAD {
+		// group we accept
+		np := reply.Payloads.Get(protocol.PayloadTypeN).(*protocol.NotifyPayload)
+		np.NotificationMessage = uint16(suiteDhGroup(sess.cfg.ProposalIke[0]))
+	}
+	reply.IkeHeader.MsgID = sess.msgIDResp.reply()
 	// encode & send
-	sess.sendMsg(sess.encode(info))
+	sess.sendMsg(sess.encode(reply))
+}
+
+// InformationalMsg generates INFORMATIONAL request
+func (sess *Session) InformationalMsg(info *Message) (*OutgoingMessage, error) {
+	info.IkeHeader.MsgID = sess.msgIDReq.next()
+	return sess.encode(info)
+}
+
+// DeleteMsg generates an IKE SA Delete request
+func (sess *Session) DeleteMsg() (*OutgoingMessage, error) {
+	return sess.InformationalMsg(DeleteFromSession(sess))
+}
+
+func (sess *Session) sendIkeSaDelete() {
+	sess.sendMsg(sess.DeleteMsg())
+}
+
+// sendRedundantIkeSaDelete deletes the IKE SA we created in a rekey collision
+// request is the first one on that SA & protected by its keys; reply is not waited for
+func (sess *Session) sendRedundantIkeSaDelete(rekey *ikeSaRekey) error {
+	info := deleteIkeSa(rekey.isInitiator, rekey.spiI, rekey.spiR)
+	info.IkeHeader.MsgID = 0
+	b, err := info.Encode(rekey.tkm, rekey.isInitiator, sess.Logger)
+	if err != nil {
+		return err
+	}
+	return WriteData(sess.Conn, b, sess.Remote, sess.Logger)
+}
+
+// sendEspDeleteReply replies to ESP Delete with our spis of the removed SAs
+func (sess *Session) sendEspDeleteReply(spis []protocol.Spi) error {
+	if len(spis) == 0 {
+		return sess.SendEmptyInformational(true)
+	}
+	info := DeleteEspFromSession(sess, true, spis...)
+	info.IkeHeader.MsgID = sess.msgIDResp.reply()
+	return sess.sendMsg(sess.encode(info))
+}
+
+// sendConfigurationReply answers CP in INFORMATIONAL request
+func (sess *Session) sendConfigurationReply(cp *protocol.ConfigurationPayload) error {
+	info := ConfigurationFromSession(sess, cp, true)
+	info.IkeHeader.MsgID = sess.msgIDResp.reply()
+	return sess.sendMsg(sess.encode(info))
 }
 
 // SendEmptyInformational can be used for periodic keepalive
 func (sess *Session) SendEmptyInformational(isResponse bool) error {
 	info := EmptyFromSession(sess, isResponse)
 	if isResponse {
-		info.IkeHeader.MsgID = sess.msgIDResp.next()
+		info.IkeHeader.MsgID = sess.msgIDResp.reply()
 	} else {
 		info.IkeHeader.MsgID = sess.msgIDReq.next()
 	}
@@ -382,21 +825,35 @@ func (sess *Session) isMessageValid(msg *Message) error {
 	// check sequence numbers
 	seq := msg.IkeHeader.MsgID
 	if msg.IkeHeader.Flags.IsResponse() {
-		// response id ought to be same as our request id
-		if seq != uint32(sess.msgIDReq.get()) {
-			return errors.Wrap(protocol.ERR_INVALID_MESSAGE_ID,
-				fmt.Sprintf("unexpected response id %d, expected %+v", seq, sess.msgIDReq))
-		}
-		sess.msgIDReq.confirm()
-	} else {
-		// request id ought to be one larger than the prev response
-		if seq != uint32(sess.msgIDResp.get()+1) {
-			return errors.Wrap(protocol.ERR_INVALID_MESSAGE_ID,
-				fmt.Sprintf("unexpected request id %d, expected %+v", seq, sess.msgIDResp))
+		// response to one of our outstanding requests
+		return sess.msgIDReq.confirm(seq)
+	}
+	// new request within our window
+	return sess.msgIDResp.accept(seq)
+}
+
+// isRetransmittedRequest checks if peer resent a request we replied to
+// fragmented requests are answered once, for their first fragment
+func (sess *Session) isRetransmittedRequest(msg *Message) bool {
+	if msg.IkeHeader.Flags.IsResponse() || !bytes.Equal(msg.IkeHeader.SpiI, sess.IkeSpiI) {
+		return false
+	}
+	if sess.msgIDResp.response(msg.IkeHeader.MsgID) == nil {
+		return false
+	}
+	switch msg.IkeHeader.NextPayload {
+	case protocol.PayloadTypeSKF:
+		skf, ok := msg.Payloads.Get(protocol.PayloadTypeSKF).(*protocol.EncryptedFragmentPayload)
+		if !ok || skf.FragmentNumber != 1 {
+			return false
 		}
-		sess.msgIDResp.confirm()
+		fallthrough
+	case protocol.PayloadTypeSK:
+		// must be from peer
+		_, err := sess.tkm.VerifyDecrypt(msg.Data, sess.isInitiator)
+		return err == nil
 	}
-	return nil
+	return bytes.Equal(msg.Data, sess.initIb)
 }
 
 // setAddresses sets tunnel endpoint addresses
@@ -407,6 +864,12 @@ func (sess *Session) setAddresses(local, remote net.Addr) error {
 		// selectors already configured
 		return nil
 	}
+	if sess.isInitiator && sess.cfg.RequestAddress {
+		// peer will narrow them to the address it assigns
+		slen := len(AddrToIp(remote)) * 8
+		all := &net.IPNet{IP: make(net.IP, slen/8), Mask: net.CIDRMask(0, slen)}
+		return sess.cfg.AddNetworkSelectors(all, all, true)
+	}
 	return sess.cfg.AddHostSelectors(AddrToIp(local), AddrToIp(remote), sess.isInitiator)
 }
 
@@ -422,6 +885,7 @@ func (sess *Session) saAddr() (net.IP, net.IP) {
 // AddSa adds Child SA
 func (sess *Session) AddSa(sa *platform.SaParams) (err error) {
 	sa.Ini, sa.Res = sess.saAddr()
+	sa.IniPort, sa.ResPort = sess.saPorts()
 	sess.Logger.Log("INSTALL_SA",
 		fmt.Sprintf("%#x<=>%#x; [%s]%s<=>%s[%s]", sa.SpiI, sa.SpiR, sa.Ini, sa.IniNet, sa.ResNet, sa.Res))
 	if sess.Cb.InstallChildSa != nil {
@@ -430,14 +894,21 @@ func (sess *Session) AddSa(sa *platform.SaParams) (err error) {
 	return
 }
 
-// RemoveSa removes Child SA
-func (sess *Session) RemoveSa() (err error) {
-	if sess.EspSpiI == nil || sess.EspSpiR == nil {
+// RemoveSa removes all Child SAs & their policies
+func (sess *Session) RemoveSa() {
+	for len(sess.children) > 0 {
+		sess.removeChildSa(sess.children[0])
+	}
+}
+
+func (sess *Session) removeSa(child *childSa) (err error) {
+	if child.espSpiI == nil || child.espSpiR == nil {
 		sess.Logger.Log("REMOVE_SA", "sa was not started")
 		return
 	}
-	sa := removeSaParams(sess.EspSpiI, sess.EspSpiR, &sess.cfg)
+	sa := removeSaParams(child, &sess.cfg)
 	sa.Ini, sa.Res = sess.saAddr()
+	sa.IniPort, sa.ResPort = sess.saPorts()
 	sess.Logger.Log("REMOVE_SA",
 		fmt.Sprintf("%#x<=>%#x; [%s]%s<=>%s[%s]", sa.SpiI, sa.SpiR, sa.Ini, sa.IniNet, sa.ResNet, sa.Res))
 	if sess.Cb.RemoveChildSa != nil {
@@ -446,8 +917,71 @@ func (sess *Session) RemoveSa() (err error) {
 	return
 }
 
-func (sess *Session) installPolicy() (err error) {
-	pol := sess.cfg.Policy()
+// removeChildSa removes SA & its policy, unless another Child SA uses it
+func (sess *Session) removeChildSa(child *childSa) {
+	sess.removeSa(child)
+	sess.dropChildSa(child)
+}
+
+// dropChildSa removes child from session & its policy, unless another Child SA uses it
+func (sess *Session) dropChildSa(child *childSa) {
+	// MUTATION
+	for i, c := range sess.children {
+		if c == child {
+			sess.children = append(sess.children[:i:i], sess.children[i+1:]...)
+			break
+		}
+	}
+	for _, c := range sess.children {
+		if reflect.DeepEqual(c.tsI, child.tsI) && reflect.DeepEqual(c.tsR, child.tsR) {
+			return
+		}
+	}
+	sess.removePolicy(child)
+}
+
+// replaceSa switches to the rekeyed Child SA & removes the old one
+// additional Child SA is added to the session
+func (sess *Session) replaceSa(rekey *childSaRekey) {
+	child := rekey.childSa
+	child.startTimers()
+	for i, old := range sess.children {
+		if old == rekey.old {
+			sess.removeSa(old)
+			// MUTATION
+			sess.children[i] = child
+			return
+		}
+	}
+	// MUTATION
+	sess.children = append(sess.children, child)
+	sess.Logger.Log("CHILD_SA", "added", "SPI", child.localSpi(sess), "COUNT", len(sess.children))
+	sess.installPolicy(child)
+}
+
+// childSaByPeerSpi finds Child SA by peer's inbound spi
+func (sess *Session) childSaByPeerSpi(spi protocol.Spi) *childSa {
+	for _, child := range sess.children {
+		if bytes.Equal(spi, child.peerSpi(sess)) {
+			return child
+		}
+	}
+	return nil
+}
+
+// nextChildSaTimeout is the time till a Child SA needs to be rekeyed, or removed
+func (sess *Session) nextChildSaTimeout() time.Duration {
+	next := sess.cfg.Lifetime
+	for _, child := range sess.children {
+		if timeout := child.nextTimeout(); timeout < next {
+			next = timeout
+		}
+	}
+	return next
+}
+
+func (sess *Session) installPolicy(child *childSa) (err error) {
+	pol := sess.cfg.childPolicy(child.tsI, child.tsR)
 	pol.Ini, pol.Res = sess.saAddr()
 	sess.Logger.Log("INSTALL_POLICY",
 		fmt.Sprintf("[%s]%s<=>%s[%s]", pol.Ini, pol.IniNet, pol.ResNet, pol.Res))
@@ -457,12 +991,42 @@ func (sess *Session) installPolicy() (err error) {
 	return
 }
 
-func (sess *Session) removePolicy() (err error) {
-	if sess.EspSpiI == nil || sess.EspSpiR == nil {
+func (sess *Session) installClientConfig() (err error) {
+	if sess.clientConfig == nil {
+		return
+	}
+	sess.Logger.Log("INSTALL_CLIENT_CONFIG",
+		fmt.Sprintf("%s DNS %s; %s", sess.clientConfig.Addresses, sess.clientConfig.DNS, sess.clientConfig.Subnets))
+	if sess.Cb.InstallClientConfig != nil {
+		if err = sess.Cb.InstallClientConfig(sess, sess.clientConfig); err != nil {
+			return
+		}
+	}
+	// MUTATION
+	sess.configured = true
+	return
+}
+
+// removeClientConfig undoes installClientConfig, if it succeeded
+func (sess *Session) removeClientConfig() (err error) {
+	if !sess.configured {
+		return
+	}
+	// MUTATION
+	sess.configured = false
+	sess.Logger.Log("REMOVE_CLIENT_CONFIG", fmt.Sprintf("%s", sess.clientConfig.Addresses))
+	if sess.Cb.RemoveClientConfig != nil {
+		err = sess.Cb.RemoveClientConfig(sess, sess.clientConfig)
+	}
+	return
+}
+
+func (sess *Session) removePolicy(child *childSa) (err error) {
+	if child.espSpiI == nil || child.espSpiR == nil {
 		sess.Logger.Log("REMOVE_POLICY", "sa was not started")
 		return
 	}
-	pol := sess.cfg.Policy()
+	pol := sess.cfg.childPolicy(child.tsI, child.tsR)
 	pol.Ini, pol.Res = sess.saAddr()
 	sess.Logger.Log("REMOVE_POLICY",
 		fmt.Sprintf("[%s]%s<=>%s[%s]", pol.Ini, pol.IniNet, pol.ResNet, pol.Res))
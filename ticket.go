@@ -0,0 +1,233 @@
+package ike
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	stderror "errors"
+	"sync"
+	"time"
+
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+// rfc5723 session resumption
+
+var (
+	errTicketRejected = stderror.New("Ticket Rejected")
+	errTicketExpired  = stderror.New("Ticket Expired")
+	errTicketReplayed = stderror.New("Ticket Replayed")
+	errTicketInvalid  = stderror.New("Ticket Invalid")
+)
+
+// ticketState is the IKE SA state a ticket resumes, rfc5723 4.3.1
+type ticketState struct {
+	SpiI, SpiR       protocol.Spi // of the IKE SA ticket was issued for
+	Suite            protocol.TransformMap
+	SkD              []byte
+	IdTypeI, IdTypeR protocol.IdType
+	IdI, IdR         []byte
+	Expires          time.Time
+}
+
+// Ticket is used by initiator to resume its session
+type Ticket struct {
+	Opaque  []byte // from TICKET_LT_OPAQUE, sent back in TICKET_OPAQUE
+	Expires time.Time
+
+	state *ticketState // our copy
+}
+
+// Expired checks if ticket can still be used
+func (t *Ticket) Expired() bool {
+	return !time.Now().Before(t.Expires)
+}
+
+// identities of the IKE SA, as they were sent in IKE_AUTH
+func (st *ticketState) identities(forInitiator bool) (local, peer Identity) {
+	local = &ticketIdentity{st.IdTypeI, st.IdI}
+	peer = &ticketIdentity{st.IdTypeR, st.IdR}
+	if !forInitiator {
+		local, peer = peer, local
+	}
+	return
+}
+
+// ticketIdentity is the identity peer had in the resumed session
+type ticketIdentity struct {
+	idType protocol.IdType
+	id     []byte
+}
+
+func (t *ticketIdentity) IdType() protocol.IdType { return t.idType }
+func (t *ticketIdentity) Id() []byte              { return t.id }
+func (t *ticketIdentity) AuthData([]byte) []byte  { return nil }
+
+func (t *ticketIdentity) AuthMethod() protocol.AuthMethod {
+	return protocol.AUTH_SHARED_KEY_MESSAGE_INTEGRITY_CODE
+}
+
+// newTicketState records the IKE SA, peer identity is from its IKE_AUTH message
+func newTicketState(sess *Session, peerID *protocol.IdPayload, lifetime time.Duration) *ticketState {
+	local := sess.localIdentity()
+	st := &ticketState{
+		SpiI:    sess.IkeSpiI,
+		SpiR:    sess.IkeSpiR,
+		Suite:   sess.cfg.ProposalIke[0],
+		SkD:     append([]byte{}, sess.tkm.skD...),
+		IdTypeI: local.IdType(),
+		IdI:     local.Id(),
+		IdTypeR: peerID.IdType,
+		IdR:     peerID.Data,
+		Expires: time.Now().Add(lifetime),
+	}
+	if !sess.isInitiator {
+		st.IdTypeI, st.IdTypeR = st.IdTypeR, st.IdTypeI
+		st.IdI, st.IdR = st.IdR, st.IdI
+	}
+	return st
+}
+
+// TicketKeys encrypt the tickets a responder issues
+// key is replaced every Rotate; tickets encrypted with older keys are accepted till they expire
+// a ticket can be used once
+type TicketKeys struct {
+	Lifetime time.Duration // of the issued tickets
+	Rotate   time.Duration
+
+	mu   sync.Mutex
+	keys []*ticketKey         // newest first
+	used map[string]time.Time // nonces of used tickets, till they expire
+}
+
+type ticketKey struct {
+	id      uint32
+	aead    cipher.AEAD
+	created time.Time
+}
+
+// NewTicketKeys creates keys for tickets valid for lifetime
+func NewTicketKeys(lifetime, rotate time.Duration) *TicketKeys {
+	return &TicketKeys{
+		Lifetime: lifetime,
+		Rotate:   rotate,
+		used:     map[string]time.Time{},
+	}
+}
+
+func newTicketKey() (*ticketKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &ticketKey{id: binary.BigEndian.Uint32(id), aead: aead, created: time.Now()}, nil
+}
+
+// current returns the key to encrypt with, rotating it if due
+// keys no ticket can be valid for are dropped
+func (tk *TicketKeys) current(now time.Time) (*ticketKey, error) {
+	if len(tk.keys) == 0 || now.Sub(tk.keys[0].created) >= tk.Rotate {
+		key, err := newTicketKey()
+		if err != nil {
+			return nil, err
+		}
+		tk.keys = append([]*ticketKey{key}, tk.keys...)
+	}
+	for i := 1; i < len(tk.keys); i++ {
+		// tickets were issued with keys[i] before keys[i-1] replaced it
+		if now.Sub(tk.keys[i-1].created) >= tk.Lifetime {
+			tk.keys = tk.keys[:i]
+			break
+		}
+	}
+	return tk.keys[0], nil
+}
+
+// seal encrypts state into a ticket
+// key id | nonce | encrypted state
+func (tk *TicketKeys) seal(st *ticketState) ([]byte, error) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	key, err := tk.current(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(st); err != nil {
+		return nil, err
+	}
+	ticket := make([]byte, 4, 4+key.aead.NonceSize()+buf.Len()+key.aead.Overhead())
+	binary.BigEndian.PutUint32(ticket, key.id)
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ticket = append(ticket, nonce...)
+	return key.aead.Seal(ticket, nonce, buf.Bytes(), ticket[:4]), nil
+}
+
+// open decrypts the ticket & marks it as used
+func (tk *TicketKeys) open(ticket []byte) (*ticketState, error) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	now := time.Now()
+	if _, err := tk.current(now); err != nil {
+		return nil, err
+	}
+	if len(ticket) < 4 {
+		return nil, errors.WithStack(errTicketInvalid)
+	}
+	id := binary.BigEndian.Uint32(ticket)
+	var key *ticketKey
+	for _, k := range tk.keys {
+		if k.id == id {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return nil, errors.Wrap(errTicketInvalid, "unknown key")
+	}
+	ns := key.aead.NonceSize()
+	if len(ticket) < 4+ns {
+		return nil, errors.WithStack(errTicketInvalid)
+	}
+	nonce := ticket[4 : 4+ns]
+	b, err := key.aead.Open(nil, nonce, ticket[4+ns:], ticket[:4])
+	if err != nil {
+		return nil, errors.Wrap(errTicketInvalid, err.Error())
+	}
+	st := &ticketState{}
+	if err = gob.NewDecoder(bytes.NewReader(b)).Decode(st); err != nil {
+		return nil, errors.Wrap(errTicketInvalid, err.Error())
+	}
+	if !now.Before(st.Expires) {
+		return nil, errors.WithStack(errTicketExpired)
+	}
+	for n, expires := range tk.used {
+		if !now.Before(expires) {
+			delete(tk.used, n)
+		}
+	}
+	if _, ok := tk.used[string(nonce)]; ok {
+		return nil, errors.WithStack(errTicketReplayed)
+	}
+	tk.used[string(nonce)] = st.Expires
+	return st, nil
+}
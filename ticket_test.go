@@ -0,0 +1,151 @@
+package ike
+
+import (
+	"testing"
+	"time"
+
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
+
+func TestTicketKeys(t *testing.T) {
+	tk := NewTicketKeys(time.Hour, time.Hour)
+	st := &ticketState{SkD: []byte{1, 2, 3}, IdI: []byte("ak@msgbox.io"), Expires: time.Now().Add(time.Hour)}
+	ticket, err := tk.seal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := tk.open(ticket); err != nil || string(opened.IdI) != "ak@msgbox.io" {
+		t.Fatalf("open: %v", err)
+	}
+	// used once
+	if _, err := tk.open(ticket); errors.Cause(err) != errTicketReplayed {
+		t.Errorf("replayed ticket: %v", err)
+	}
+	// tampered
+	ticket, _ = tk.seal(st)
+	ticket[len(ticket)-1] ^= 1
+	if _, err := tk.open(ticket); errors.Cause(err) != errTicketInvalid {
+		t.Errorf("tampered ticket: %v", err)
+	}
+	// expired
+	ticket, _ = tk.seal(&ticketState{Expires: time.Now().Add(-time.Second)})
+	if _, err := tk.open(ticket); errors.Cause(err) != errTicketExpired {
+		t.Errorf("expired ticket: %v", err)
+	}
+	// ticket from the replaced key is accepted till no ticket can be valid
+	ticket, _ = tk.seal(st)
+	tk.keys[0].created = tk.keys[0].created.Add(-2 * time.Hour)
+	if _, err := tk.seal(st); err != nil || len(tk.keys) != 2 {
+		t.Fatalf("key was not rotated: %v", err)
+	}
+	tk.keys[0].created = tk.keys[0].created.Add(-time.Hour)
+	if _, err := tk.open(ticket); errors.Cause(err) != errTicketInvalid {
+		t.Errorf("ticket from old key: %v", err)
+	}
+}
+
+func ticketTestConfig() *Config {
+	cfg := sessionTestConfig()
+	cfg.RequestTicket = true
+	cfg.Tickets = NewTicketKeys(time.Hour, time.Hour)
+	return cfg
+}
+
+// runTicketSessions runs a session pair sharing cfg
+func runTicketSessions(t *testing.T, cfg *Config, ticket *Ticket) (*Session, error) {
+	return runSessionPair(t, cfg, cfg, ticket)
+}
+
+func TestSessionResume(t *testing.T) {
+	cfg := ticketTestConfig()
+	ini, err := runTicketSessions(t, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := ini.Ticket()
+	if ticket == nil || ticket.Expired() {
+		t.Fatal("no ticket was issued")
+	}
+	// without dh & certificates
+	resumed, err := runTicketSessions(t, cfg, ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.resume != ticket || resumed.tkm.DhShared != nil {
+		t.Error("session was not resumed")
+	}
+	// resumed session gets a ticket of its own
+	if next := resumed.Ticket(); next == nil || next == ticket {
+		t.Error("no ticket for the resumed session")
+	}
+}
+
+func TestSessionResumeReplay(t *testing.T) {
+	cfg := ticketTestConfig()
+	st := &ticketState{
+		Suite:   cfg.ProposalIke[0],
+		SkD:     []byte{1, 2, 3},
+		IdTypeI: pskTestID.IdType(),
+		IdI:     pskTestID.Id(),
+		Expires: time.Now().Add(time.Hour),
+	}
+	opaque, err := cfg.Tickets.seal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := &Ticket{Opaque: opaque, Expires: st.Expires, state: st}
+	replies := make(chan []byte, 2)
+	conn := &testcb{writeTo: replies}
+	initMsg := func(ini *Session) *Message {
+		out, err := ini.InitMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := DecodeMessage(out.Data, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.LocalAddr, msg.RemoteAddr = zeroAddr, zeroAddr
+		return msg
+	}
+	// request returns our COOKIE first
+	resumeRequest := func() (*Session, *Message) {
+		ini, err := NewResumingInitiator(cfg, ticket, zeroAddr, zeroAddr, conn, &SessionCallback{}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkResumeRequest(initMsg(ini), conn, cfg, logger); errors.Cause(err) != errMissingCookie {
+			t.Fatalf("request without COOKIE: %v", err)
+		}
+		reply, err := DecodeMessage(<-replies, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ce, ok := checkResumeResponseForSession(ini, reply).(peerRequestsCookieError)
+		if !ok {
+			t.Fatal("COOKIE was not requested")
+		}
+		ini.SetCookie(ce.Cookie)
+		ini.msgIDReq.reset(0)
+		return ini, initMsg(ini)
+	}
+	if _, msg := resumeRequest(); checkResumeRequest(msg, conn, cfg, logger) != nil {
+		t.Fatal("ticket was not accepted")
+	}
+	// same ticket again is rejected, initiator falls back to IKE_SA_INIT
+	ini, msg := resumeRequest()
+	if err := checkResumeRequest(msg, conn, cfg, logger); errors.Cause(err) != errTicketReplayed {
+		t.Fatalf("replayed ticket: %v", err)
+	}
+	reply, err := DecodeMessage(<-replies, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.IkeHeader.ExchangeType != protocol.IKE_SESSION_RESUME {
+		t.Errorf("reply is %s", reply.IkeHeader.ExchangeType)
+	}
+	if err := checkResumeResponseForSession(ini, reply); errors.Cause(err) != errTicketRejected {
+		t.Errorf("TICKET_NACK: %v", err)
+	}
+}
@@ -1,17 +1,76 @@
 package ike
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	"github.com/msgboxio/ike/protocol"
+	"github.com/pkg/errors"
+)
 
 const REPLY_WAIT_TIMEOUT = 5 * time.Second
 
-func packetOrTimeOut(incoming <-chan *Message) (*Message, error) {
+// DefaultRetransmitRetries gives up on peer after about 2.5 minutes
+const DefaultRetransmitRetries = 4
+
+// TimeoutError is returned when peer did not reply to any retransmission of a request
+type TimeoutError struct {
+	ExchangeType protocol.IkeExchangeType
+	MsgID        uint32
+	Retransmits  int
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s %d: no reply after %d retransmits", e.ExchangeType, e.MsgID, e.Retransmits)
+}
+
+// Timeout is true, like for net.Error
+func (e *TimeoutError) Timeout() bool { return true }
+
+// IsTimeout checks if peer did not reply in time
+func IsTimeout(err error) bool {
+	_, ok := errors.Cause(err).(*TimeoutError)
+	return ok
+}
+
+func packetOrTimeOut(incoming <-chan *Message, timeout time.Duration) (*Message, error) {
 	select {
 	case msg, ok := <-incoming:
 		if ok {
 			return msg, nil
 		}
 		return nil, errorSessionClosed
-	case <-time.After(Jitter(REPLY_WAIT_TIMEOUT, 0.2)):
+	case <-time.After(Jitter(timeout, 0.2)):
 		return nil, errorReplyTimedout
 	}
 }
+
+// backoff doubles the wait for reply after each retransmission
+type backoff struct {
+	timeout time.Duration
+	retries int
+}
+
+// total is the time till the last retransmission times out
+func (b *backoff) total() time.Duration {
+	return b.timeout * (1<<uint(b.retries+1) - 1)
+}
+
+// retransmission is the configured backoff for requests
+func (sess *Session) retransmission() *backoff {
+	if sess.cfg.RetransmitTimeout == 0 {
+		return &backoff{timeout: REPLY_WAIT_TIMEOUT, retries: DefaultRetransmitRetries}
+	}
+	return &backoff{timeout: sess.cfg.RetransmitTimeout, retries: sess.cfg.RetransmitRetries}
+}
+
+// resetTimer stops timer & sets it to fire after d
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
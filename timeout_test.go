@@ -0,0 +1,62 @@
+package ike
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// responder replays its reply to a retransmitted request
+func TestRetransmittedRequest(t *testing.T) {
+	ini, res := establishedTestSessions(t, nil)
+	toI := make(chan []byte, 10)
+	res.Conn = &testcb{writeTo: toI}
+	go monitorSa(res)
+	req, err := ini.InformationalMsg(EmptyFromSession(ini, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies [][]byte
+	for i := 0; i < 2; i++ {
+		ini.writeMsg(req)
+		select {
+		case reply := <-toI:
+			replies = append(replies, reply)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reply")
+		}
+	}
+	if !bytes.Equal(replies[0], replies[1]) {
+		t.Error("reply differs")
+	}
+	// next request is handled as usual
+	ini.msgIDReq.confirm(req.header.MsgID)
+	req, _ = ini.InformationalMsg(EmptyFromSession(ini, false))
+	ini.writeMsg(req)
+	select {
+	case reply := <-toI:
+		if bytes.Equal(reply, replies[0]) {
+			t.Error("old reply")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+	}
+}
+
+func TestRetransmitBackoff(t *testing.T) {
+	ini, _ := establishedTestSessions(t, nil)
+	ini.cfg.RetransmitTimeout = 10 * time.Millisecond
+	ini.cfg.RetransmitRetries = 2
+	toR := make(chan []byte, 10)
+	ini.Conn = &testcb{writeTo: toR}
+	_, err := ini.sendMsgGetReply(func() (*OutgoingMessage, error) {
+		return ini.InformationalMsg(EmptyFromSession(ini, false))
+	}, nil, nil)
+	if !IsTimeout(err) || len(toR) != 3 {
+		t.Fatalf("%d requests; %v", len(toR), err)
+	}
+	// request is resent as is
+	if first := <-toR; !bytes.Equal(first, <-toR) {
+		t.Error("retransmitted request differs")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"math/big"
 
 	"github.com/msgboxio/ike/crypto"
+	"github.com/msgboxio/ike/protocol"
 	"github.com/pkg/errors"
 )
 
@@ -39,12 +40,17 @@ type Tkm struct {
 
 var errMissingCryptoKeys = errors.New("Missing crypto keys")
 
+// NewTkm uses the most preferred suites
+// these have been narrowed to the negotiated ones for responders & rekeying
 func NewTkm(cfg *Config, ni *big.Int) (*Tkm, error) {
-	suite, err := crypto.NewCipherSuite(cfg.ProposalIke)
+	if len(cfg.ProposalIke) == 0 || len(cfg.ProposalEsp) == 0 {
+		return nil, errors.New("missing crypto suites")
+	}
+	suite, err := crypto.NewCipherSuite(cfg.ProposalIke[0])
 	if err != nil {
 		return nil, err
 	}
-	espSuite, err := crypto.NewCipherSuite(cfg.ProposalEsp)
+	espSuite, err := crypto.NewCipherSuite(cfg.ProposalEsp[0])
 	if err != nil {
 		return nil, err
 	}
@@ -54,6 +60,43 @@ func NewTkm(cfg *Config, ni *big.Int) (*Tkm, error) {
 	return newTkmInitiator(suite, espSuite)
 }
 
+// NewTkmResume is used to resume the session a ticket was issued for
+// there is no dh exchange, only nonces
+func NewTkmResume(cfg *Config, ni *big.Int) (*Tkm, error) {
+	if len(cfg.ProposalIke) == 0 || len(cfg.ProposalEsp) == 0 {
+		return nil, errors.New("missing crypto suites")
+	}
+	suite, err := crypto.NewCipherSuite(cfg.ProposalIke[0])
+	if err != nil {
+		return nil, err
+	}
+	espSuite, err := crypto.NewCipherSuite(cfg.ProposalEsp[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = suite.CheckIkeTransforms(); err != nil {
+		return nil, err
+	}
+	if err = espSuite.CheckEspTransforms(); err != nil {
+		return nil, err
+	}
+	tkm := &Tkm{
+		suite:    suite,
+		espSuite: espSuite,
+		Ni:       ni,
+	}
+	if ni == nil {
+		tkm.Ni, err = createNonce(suite.Prf.Length * 8)
+		return tkm, err
+	}
+	bitLen := ni.BitLen()
+	if bitLen < 128 || bitLen < (suite.Prf.Length*8)/2 {
+		return nil, errors.New("Proposed nonce is too small")
+	}
+	tkm.Nr, err = createNonce(bitLen)
+	return tkm, err
+}
+
 func newTkmInitiator(suite, espSuite *crypto.CipherSuite) (tkm *Tkm, err error) {
 	if err = suite.CheckIkeTransforms(); err != nil {
 		return
@@ -103,6 +146,51 @@ func newTkmResponder(suite, espSuite *crypto.CipherSuite, ni *big.Int) (tkm *Tkm
 	return
 }
 
+// setIkeSuite switches to the suite chosen by responder
+// dh group must be the one already used
+func (t *Tkm) setIkeSuite(trs protocol.TransformMap) error {
+	suite, err := crypto.NewCipherSuite(trs)
+	if err != nil {
+		return err
+	}
+	if err = suite.CheckIkeTransforms(); err != nil {
+		return err
+	}
+	if suite.DhGroup.TransformId() != t.suite.DhGroup.TransformId() {
+		return errors.Wrapf(protocol.ERR_INVALID_KE_PAYLOAD, "selected dh group %s, used %s",
+			suite.DhGroup.TransformId(), t.suite.DhGroup.TransformId())
+	}
+	t.suite = suite
+	return nil
+}
+
+// switchDhGroup uses suite with the dh group requested by responder
+// new dh keys are created, nonce is kept as cookie depends on it
+func (t *Tkm) switchDhGroup(trs protocol.TransformMap) error {
+	suite, err := crypto.NewCipherSuite(trs)
+	if err != nil {
+		return err
+	}
+	if err = suite.CheckIkeTransforms(); err != nil {
+		return err
+	}
+	t.suite = suite
+	return t.dhCreate()
+}
+
+// setEspSuite switches to the negotiated esp suite
+func (t *Tkm) setEspSuite(trs protocol.TransformMap) error {
+	espSuite, err := crypto.NewCipherSuite(trs)
+	if err != nil {
+		return err
+	}
+	if err = espSuite.CheckEspTransforms(); err != nil {
+		return err
+	}
+	t.espSuite = espSuite
+	return nil
+}
+
 // 4.1.2 creation of ike sa
 
 func createNonce(bits int) (no *big.Int, err error) {
@@ -142,6 +230,14 @@ func (t *Tkm) skeySeedRekey(old_SK_D []byte) []byte {
 	return t.suite.Prf.Apply(old_SK_D, append(t.DhShared.Bytes(), append(t.Ni.Bytes(), t.Nr.Bytes()...)...))
 }
 
+// rfc5723 5.1
+var resumptionLabel = []byte("Resumption")
+
+func (t *Tkm) skeySeedResume(old_SK_D []byte) []byte {
+	// SKEYSEED = prf(SK_d (old), "Resumption" | Ni | Nr)
+	return t.suite.Prf.Apply(old_SK_D, append(append(append([]byte{}, resumptionLabel...), t.Ni.Bytes()...), t.Nr.Bytes()...))
+}
+
 // IkeSaKeys creates ike sa keys
 func (t *Tkm) IkeSaKeys(spiI, spiR []byte, old_skD []byte) {
 	// fmt.Printf("key inputs: \nni:\n%snr:\n%sshared:\n%sspii:\n%sspir:\n%s",
@@ -153,6 +249,15 @@ func (t *Tkm) IkeSaKeys(spiI, spiR []byte, old_skD []byte) {
 	} else {
 		SKEYSEED = t.skeySeedRekey(old_skD)
 	}
+	t.ikeSaKeys(SKEYSEED, spiI, spiR)
+}
+
+// ResumeIkeSaKeys creates keys of IKE SA resumed from a ticket; there is no dh
+func (t *Tkm) ResumeIkeSaKeys(spiI, spiR []byte, old_skD []byte) {
+	t.ikeSaKeys(t.skeySeedResume(old_skD), spiI, spiR)
+}
+
+func (t *Tkm) ikeSaKeys(SKEYSEED, spiI, spiR []byte) {
 	kmLen := 3*t.suite.Prf.Length + 2*t.suite.KeyLen + 2*t.suite.MacTruncLen
 	// KEYMAT =  = prf+ (SKEYSEED, Ni | Nr | SPIi | SPIr)
 	KEYMAT := t.prfplus(SKEYSEED,
@@ -14,6 +14,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/msgboxio/ike/platform"
+	"github.com/msgboxio/ike/protocol"
 	"github.com/pkg/errors"
 )
 
@@ -76,17 +77,49 @@ func eccertTestIds(t testing.TB) (localID, remoteID Identity) {
 
 	localID = &CertIdentity{
 		Certificate: cert,
+		Chain:       []*x509.Certificate{cacert},
 		PrivateKey:  key,
 	}
 	roots := x509.NewCertPool()
 	roots.AddCert(cacert)
 	remoteID = &CertIdentity{
-		Roots: roots,
-		Name:  "172.17.0.1",
+		Roots:     roots,
+		RootCerts: []*x509.Certificate{cacert},
+		Name:      "172.17.0.1",
 	}
 	return
 }
 
+// testSessionPair creates initiator & responder sessions sharing IKE SA keys
+// they fragment large messages
+func testSessionPair(t *testing.T) (ini, res *Session) {
+	cfg := testConfig()
+	cfg.FragmentSize = DefaultFragmentSize
+	tkmI, err := NewTkm(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkmR, err := NewTkm(cfg, tkmI.Ni)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkmI.Nr = tkmR.Nr
+	if err = tkmI.DhGenerateKey(tkmR.DhPublic); err != nil {
+		t.Fatal(err)
+	}
+	if err = tkmR.DhGenerateKey(tkmI.DhPublic); err != nil {
+		t.Fatal(err)
+	}
+	spiI, spiR := MakeSpi(), MakeSpi()
+	tkmI.IkeSaKeys(spiI, spiR, nil)
+	tkmR.IkeSaKeys(spiI, spiR, nil)
+	ini = &Session{cfg: *cfg, tkm: tkmI, isInitiator: true, fragmentation: true,
+		IkeSpiI: spiI, IkeSpiR: spiR, msgIDReq: newMsgID(1), msgIDResp: newMsgID(1), Logger: logger}
+	res = &Session{cfg: *cfg, tkm: tkmR, fragmentation: true,
+		IkeSpiI: spiI, IkeSpiR: spiR, msgIDReq: newMsgID(1), msgIDResp: newMsgID(1), Logger: logger}
+	return
+}
+
 type testcb struct {
 	writeTo chan []byte
 	saTo    chan *platform.SaParams
@@ -146,7 +179,9 @@ func runTestResponder(cfg *Config, cbk *testcb, readFrom chan []byte, log log.Lo
 			if err != nil {
 				cbk.errTo <- err
 			}
-			if err = checkInitRequest(initI, cbk, cfg, log); errors.Cause(err) == errMissingCookie {
+			// initiator retries after COOKIE or INVALID_KE_PAYLOAD
+			if err = checkInitRequest(initI, cbk, cfg, log); errors.Cause(err) == errMissingCookie ||
+				errors.Cause(err) == protocol.ERR_INVALID_KE_PAYLOAD {
 				continue
 			} else if err != nil {
 				cbk.errTo <- err
@@ -184,6 +219,84 @@ func runTestResponder(cfg *Config, cbk *testcb, readFrom chan []byte, log log.Lo
 	}
 }
 
+// sessionTestConfig authenticates with PSK & has a Child SA for 192.0.2.0/24
+func sessionTestConfig() *Config {
+	cfg := testConfig()
+	cfg.LocalID = pskTestID
+	cfg.PeerID = pskTestID
+	_, net, _ := net.ParseCIDR("192.0.2.0/24")
+	cfg.AddNetworkSelectors(net, net, true)
+	return cfg
+}
+
+// runSessionPair connects an initiator, resuming with ticket if given, to a responder
+func runSessionPair(t *testing.T, cfg, cfgR *Config, ticket *Ticket) (*Session, error) {
+	return runTappedSessionPair(t, cfg, cfgR, ticket, nil)
+}
+
+// runTappedSessionPair is runSessionPair that gives tap every packet sent to the responder
+func runTappedSessionPair(t *testing.T, cfg, cfgR *Config, ticket *Ticket, tap func([]byte)) (*Session, error) {
+	initJitter = 0
+	iAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 500}
+	rAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 500}
+	toI, toR := make(chan []byte, 10), make(chan []byte, 10)
+	sa := make(chan *platform.SaParams, 2)
+	cerr := make(chan error, 2)
+	cbI, cbR := &testcb{toR, sa, cerr}, &testcb{toI, sa, cerr}
+	var ini *Session
+	var err error
+	if ticket != nil {
+		ini, err = NewResumingInitiator(cfg, ticket, iAddr, rAddr, cbI, scb(cbI), logger)
+	} else {
+		ini, err = NewInitiator(cfg, iAddr, rAddr, cbI, scb(cbI), logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+	go func() { cerr <- RunSession(ini) }()
+	go func() {
+		for b := range toI {
+			if msg, err := DecodeMessage(b, logger); err == nil {
+				msg.LocalAddr, msg.RemoteAddr = iAddr, rAddr
+				ini.PostMessage(msg)
+			}
+		}
+	}()
+	go func() {
+		var res *Session
+		for b := range toR {
+			if tap != nil {
+				tap(b)
+			}
+			msg, err := DecodeMessage(b, logger)
+			if err != nil {
+				continue
+			}
+			msg.LocalAddr, msg.RemoteAddr = rAddr, iAddr
+			if res == nil {
+				if msg.IkeHeader.ExchangeType == protocol.IKE_SESSION_RESUME {
+					if err = checkResumeRequest(msg, cbR, cfgR, logger); err == nil {
+						res, err = NewResumingResponder(cfgR, cbR, scb(cbR), msg, logger)
+					}
+				} else if err = checkInitRequest(msg, cbR, cfgR, logger); err == nil {
+					res, err = NewResponder(cfgR, cbR, scb(cbR), msg, logger)
+				}
+				if errors.Cause(err) == errMissingCookie {
+					// initiator retries with our COOKIE
+					continue
+				}
+				if err != nil {
+					cerr <- err
+					return
+				}
+				go func() { cerr <- RunSession(res) }()
+			}
+			res.PostMessage(msg)
+		}
+	}()
+	return ini, waitFor2Sa(t, sa, cerr)
+}
+
 func waitFor2Sa(t testing.TB, sa chan *platform.SaParams, cerr chan error) (err error) {
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
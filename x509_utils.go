@@ -45,6 +45,28 @@ func LoadPEMCert(certFile string) (*x509.Certificate, error) {
 	return x509.ParseCertificate(block.Bytes)
 }
 
+// LoadPEMCerts loads all certificates in a PEM file
+func LoadPEMCerts(certFile string) (certs []*x509.Certificate, err error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.Errorf("no certificates in %s", certFile)
+	}
+	return
+}
+
 func LoadCerts(certFile string) ([]*x509.Certificate, error) {
 	certDER, err := ioutil.ReadFile(certFile)
 	if err != nil {
@@ -198,6 +220,12 @@ func NewSignedCert(cfg CertID, publicKey interface{}, caCert *x509.Certificate,
 		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 	}
+	if cfg.IsCA {
+		// issuing CA
+		certTmpl.IsCA = true
+		certTmpl.BasicConstraintsValid = true
+		certTmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
 	certDERBytes, err := x509.CreateCertificate(rand.Reader, &certTmpl, caCert, publicKey, caKey)
 	if err != nil {
 		return nil, err